@@ -1,10 +1,112 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
 	"github.com/kobu/c8y-devmgmt-repo-intgr/pkg/app"
+	s "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/static"
 )
 
+const usage = `Usage: %[1]s [command] [flags]
+
+Commands:
+  serve     run the microservice (default if no command is given)
+  validate  lint the index files of a local directory or the storage
+  plan      show the changes a synchronization would apply to a tenant
+  sync      synchronize a tenant (once with --once, otherwise on its schedule)
+  generate  propose index entries for objects of the storage that are not indexed yet
+
+Run '%[1]s <command> -h' for the flags of a command.
+`
+
 func main() {
-	runtimeApp := app.NewApp()
-	runtimeApp.Run()
+	command := "serve"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+	if command == "serve" {
+		runtimeApp := app.NewApp()
+		runtimeApp.Run()
+		return
+	}
+
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	o := app.CLIOptions{Out: os.Stdout}
+	verbose := flags.Bool("v", false, "verbose logging")
+	flags.StringVar(&o.Host, "host", os.Getenv("C8Y_HOST"), "Cumulocity URL (env C8Y_HOST)")
+	flags.StringVar(&o.Tenant, "tenant", os.Getenv("C8Y_TENANT"), "tenant id (env C8Y_TENANT)")
+	flags.StringVar(&o.Username, "user", os.Getenv("C8Y_USER"), "username (env C8Y_USER)")
+	passwordStdin := flags.Bool("password-stdin", false, "read the password from stdin instead of the environment variable C8Y_PASSWORD")
+	flags.StringVar(&o.StorageProvider, "storage-provider", os.Getenv("FW_STORAGE_PROVIDER"), "storage provider, e.g. awsS3 or azblob (env FW_STORAGE_PROVIDER). If not set, the tenant options of the tenant are used")
+	flags.StringVar(&o.StorageConfig, "storage-config", os.Getenv("FW_STORAGE_CONFIG"), "JSON connection details of the storage provider, same format as the tenant option (env FW_STORAGE_CONFIG)")
+	flags.StringVar(&o.Index.Prefix, "index-prefix", os.Getenv("FW_INDEX_PREFIX"), "prefix of the index files and objects within the storage, e.g. prod/ (env FW_INDEX_PREFIX)")
+	flags.StringVar(&o.Index.VersionsFile, "versions-file", s.INDEX_FILE_VERSIONS, "name of the firmware versions index file")
+	flags.StringVar(&o.Index.InfoFile, "info-file", s.INDEX_FILE_INFO, "name of the firmware info index file")
+	flags.StringVar(&o.Index.TenantGroupsFile, "tenant-groups-file", s.INDEX_FILE_TENANT_GROUPS, "name of the (optional) tenant groups file")
+	flags.StringVar(&o.ContextPath, "context-path", s.TOPT_CATEGORY, "context path of the service, used for the download URLs of created firmware versions")
+	var checkObjects, once, write bool
+	var prefix string
+	switch command {
+	case "validate":
+		flags.StringVar(&o.IndexDir, "index-dir", "", "local directory containing the index files (instead of the storage)")
+		flags.BoolVar(&checkObjects, "check-objects", false, "check that the objects referenced by the index files exist")
+	case "plan":
+		flags.StringVar(&o.IndexDir, "index-dir", "", "local directory containing the index files (instead of the storage)")
+	case "sync":
+		flags.BoolVar(&once, "once", false, "run a single synchronization and exit")
+	case "generate":
+		flags.StringVar(&prefix, "prefix", "", "only objects whose key starts with this prefix are considered")
+		flags.BoolVar(&write, "write", false, "write the merged index files back to the storage")
+	case "-h", "-help", "--help", "help":
+		fmt.Fprintf(os.Stdout, usage, os.Args[0])
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command '%s'\n\n", command)
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		os.Exit(2)
+	}
+	flags.Parse(os.Args[2:])
+	// the password is not accepted as flag, as it would be visible in the process list and the shell history
+	o.Password = os.Getenv("C8Y_PASSWORD")
+	if *passwordStdin {
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			fmt.Fprintln(os.Stderr, "Error: could not read password from stdin:", err)
+			os.Exit(1)
+		}
+		o.Password = strings.TrimRight(password, "\r\n")
+	}
+
+	level := slog.LevelWarn
+	if *verbose {
+		level = slog.LevelInfo
+	}
+	slog.SetLogLoggerLevel(level)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var err error
+	switch command {
+	case "validate":
+		err = app.Validate(ctx, o, checkObjects)
+	case "plan":
+		err = app.Plan(ctx, o)
+	case "sync":
+		err = app.SyncTenant(ctx, o, once)
+	case "generate":
+		err = app.Generate(ctx, o, prefix, write)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
 }
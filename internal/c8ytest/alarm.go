@@ -0,0 +1,110 @@
+package c8ytest
+
+import (
+	"net/http"
+	"time"
+)
+
+func alarmMatches(alarm map[string]any, r *http.Request) bool {
+	params := r.URL.Query()
+	if source := params.Get("source"); len(source) > 0 && alarm["source"].(map[string]any)["id"] != source {
+		return false
+	}
+	if status := params.Get("status"); len(status) > 0 && alarm["status"] != status {
+		return false
+	}
+	if alarmType := params.Get("type"); len(alarmType) > 0 && alarm["type"] != alarmType {
+		return false
+	}
+	return true
+}
+
+func (s *Server) serveAlarms(w http.ResponseWriter, r *http.Request, t *tenant, path []string) {
+	// update of a single alarm, only text, status and severity can be changed
+	if len(path) == 3 && path[1] == "alarms" && r.Method == http.MethodPut {
+		body, ok := decodeBody(w, r)
+		if !ok {
+			return
+		}
+		for _, alarm := range t.alarms {
+			if alarm["id"] == path[2] {
+				for _, key := range []string{"text", "status", "severity"} {
+					if value, ok := body[key]; ok {
+						alarm[key] = value
+					}
+				}
+				writeJSON(w, http.StatusOK, alarm)
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, "alarm/Not Found", "Alarm '"+path[2]+"' not found")
+		return
+	}
+	if len(path) != 2 || path[1] != "alarms" {
+		writeError(w, http.StatusNotFound, "general/Not Found", "Unsupported request: "+r.Method+" "+r.URL.Path)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		alarms := []map[string]any{}
+		for _, alarm := range t.alarms {
+			if alarmMatches(alarm, r) {
+				alarms = append(alarms, alarm)
+			}
+		}
+		alarms, statistics := paginate(alarms, r)
+		writeJSON(w, http.StatusOK, map[string]any{"alarms": alarms, "statistics": statistics})
+	case http.MethodPost:
+		body, ok := decodeBody(w, r)
+		if !ok {
+			return
+		}
+		source, _ := body["source"].(map[string]any)
+		if source == nil || t.managedObjects[source["id"].(string)] == nil {
+			writeError(w, http.StatusUnprocessableEntity, "alarm/Unprocessable Entity", "Unknown source of alarm")
+			return
+		}
+		if _, ok := body["status"]; !ok {
+			body["status"] = "ACTIVE"
+		}
+		// active alarms of the same type and source are de-duplicated
+		for _, alarm := range t.alarms {
+			if alarm["status"] == "ACTIVE" && body["status"] == "ACTIVE" && alarm["type"] == body["type"] && alarm["source"].(map[string]any)["id"] == source["id"] {
+				alarm["count"] = alarm["count"].(int) + 1
+				alarm["text"] = body["text"]
+				writeJSON(w, http.StatusCreated, alarm)
+				return
+			}
+		}
+		body["id"] = s.nextId()
+		body["count"] = 1
+		body["creationTime"] = time.Now().Format(time.RFC3339)
+		t.alarms = append(t.alarms, body)
+		writeJSON(w, http.StatusCreated, body)
+	case http.MethodPut:
+		// bulk update of all alarms matching the filter
+		body, ok := decodeBody(w, r)
+		if !ok {
+			return
+		}
+		for _, alarm := range t.alarms {
+			if alarmMatches(alarm, r) {
+				alarm["status"] = body["status"]
+			}
+		}
+		writeJSON(w, http.StatusOK, nil)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "general/Method Not Allowed", "Unsupported request: "+r.Method+" "+r.URL.Path)
+	}
+}
+
+// Alarms returns copies of the alarms of the tenant
+func (s *Server) Alarms(tenantId string) []map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []map[string]any
+	for _, alarm := range s.tenants[tenantId].alarms {
+		res = append(res, copyJSON(alarm))
+	}
+	return res
+}
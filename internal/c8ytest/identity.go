@@ -0,0 +1,90 @@
+package c8ytest
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+func (s *Server) externalId(t *tenant, key string) map[string]any {
+	idType, externalId, _ := strings.Cut(key, "/")
+	moId := t.externalIds[key]
+	return map[string]any{
+		"type":       idType,
+		"externalId": externalId,
+		"self":       s.URL + "/identity/externalIds/" + url.PathEscape(idType) + "/" + url.PathEscape(externalId),
+		"managedObject": map[string]any{
+			"id":   moId,
+			"self": s.managedObjectUrl(moId),
+		},
+	}
+}
+
+func (s *Server) serveIdentity(w http.ResponseWriter, r *http.Request, t *tenant, path []string) {
+	switch {
+	// /identity/globalIds/{id}/externalIds
+	case len(path) == 4 && path[1] == "globalIds" && path[3] == "externalIds":
+		moId := path[2]
+		if t.managedObjects[moId] == nil {
+			writeError(w, http.StatusNotFound, "identity/Not Found", "Managed object '"+moId+"' not found")
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			var keys []string
+			for key, id := range t.externalIds {
+				if id == moId {
+					keys = append(keys, key)
+				}
+			}
+			slices.Sort(keys)
+			externalIds := []map[string]any{}
+			for _, key := range keys {
+				externalIds = append(externalIds, s.externalId(t, key))
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"externalIds": externalIds})
+		case http.MethodPost:
+			body, ok := decodeBody(w, r)
+			if !ok {
+				return
+			}
+			idType, _ := body["type"].(string)
+			externalId, _ := body["externalId"].(string)
+			key := idType + "/" + externalId
+			if _, exists := t.externalIds[key]; exists {
+				writeError(w, http.StatusConflict, "identity/Conflict", "External id '"+key+"' already exists")
+				return
+			}
+			t.externalIds[key] = moId
+			writeJSON(w, http.StatusCreated, s.externalId(t, key))
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "general/Method Not Allowed", "Unsupported request: "+r.Method+" "+r.URL.Path)
+		}
+	// /identity/externalIds/{type}/{externalId}
+	case len(path) == 4 && path[1] == "externalIds":
+		key := path[2] + "/" + path[3]
+		if _, ok := t.externalIds[key]; !ok {
+			writeError(w, http.StatusNotFound, "identity/Not Found", "External id not found; external id = ID [type="+path[2]+", value="+path[3]+"]")
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, s.externalId(t, key))
+		case http.MethodDelete:
+			delete(t.externalIds, key)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "general/Method Not Allowed", "Unsupported request: "+r.Method+" "+r.URL.Path)
+		}
+	default:
+		writeError(w, http.StatusNotFound, "general/Not Found", "Unsupported request: "+r.Method+" "+r.URL.Path)
+	}
+}
+
+// AddExternalId registers an external id for a managed object of the tenant
+func (s *Server) AddExternalId(tenantId string, moId string, idType string, externalId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tenants[tenantId].externalIds[idType+"/"+externalId] = moId
+}
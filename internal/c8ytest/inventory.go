@@ -0,0 +1,307 @@
+package c8ytest
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const defaultPageSize = 5
+
+// returns the requested page of items, incl. the paging statistics
+func paginate[T any](items []T, r *http.Request) ([]T, map[string]any) {
+	pageSize, err := strconv.Atoi(r.URL.Query().Get("pageSize"))
+	if err != nil || pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	currentPage, err := strconv.Atoi(r.URL.Query().Get("currentPage"))
+	if err != nil || currentPage <= 0 {
+		currentPage = 1
+	}
+	statistics := map[string]any{
+		"currentPage": currentPage,
+		"pageSize":    pageSize,
+		"totalPages":  (len(items) + pageSize - 1) / pageSize,
+	}
+	start := min((currentPage-1)*pageSize, len(items))
+	end := min(start+pageSize, len(items))
+	return items[start:end], statistics
+}
+
+func (s *Server) managedObjectUrl(id string) string {
+	return s.URL + "/inventory/managedObjects/" + id
+}
+
+// renders a managed object as returned by Cumulocity, incl. its child additions (and its parents if an index of them is given)
+func (s *Server) render(t *tenant, mo map[string]any, parents map[string][]string) map[string]any {
+	res := maps.Clone(mo)
+	id := mo["id"].(string)
+	res["self"] = s.managedObjectUrl(id)
+	references := []map[string]any{}
+	for _, childId := range t.childAdditions[id] {
+		references = append(references, s.reference(t, childId))
+	}
+	res["childAdditions"] = map[string]any{"self": s.managedObjectUrl(id) + "/childAdditions", "references": references}
+	if parents != nil {
+		parentReferences := []map[string]any{}
+		for _, parentId := range parents[id] {
+			parentReferences = append(parentReferences, s.reference(t, parentId))
+		}
+		res["additionParents"] = map[string]any{"self": s.managedObjectUrl(id) + "/additionParents", "references": parentReferences}
+	}
+	return res
+}
+
+// returns the ids of the parents (in creation order) by the id of their child additions
+func additionParents(t *tenant) map[string][]string {
+	res := make(map[string][]string)
+	for _, parentId := range t.moIds {
+		for _, childId := range t.childAdditions[parentId] {
+			res[childId] = append(res[childId], parentId)
+		}
+	}
+	return res
+}
+
+func (s *Server) reference(t *tenant, id string) map[string]any {
+	return map[string]any{
+		"managedObject": map[string]any{
+			"id":   id,
+			"name": t.managedObjects[id]["name"],
+			"self": s.managedObjectUrl(id),
+		},
+	}
+}
+
+func (s *Server) nextId() string {
+	s.lastId++
+	return strconv.Itoa(s.lastId)
+}
+
+func decodeBody(w http.ResponseWriter, r *http.Request) (map[string]any, bool) {
+	body := make(map[string]any)
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "general/Unprocessable Entity", "Invalid JSON body: "+err.Error())
+		return nil, false
+	}
+	return body, true
+}
+
+func (s *Server) serveInventory(w http.ResponseWriter, r *http.Request, t *tenant, user User, path []string) {
+	if len(path) < 2 || path[1] != "managedObjects" {
+		writeError(w, http.StatusNotFound, "general/Not Found", "Unsupported request: "+r.Method+" "+r.URL.Path)
+		return
+	}
+	switch {
+	case len(path) == 2 && r.Method == http.MethodGet:
+		s.listManagedObjects(w, r, t)
+	case len(path) == 2 && r.Method == http.MethodPost:
+		body, ok := decodeBody(w, r)
+		if !ok {
+			return
+		}
+		writeJSON(w, http.StatusCreated, s.render(t, s.createManagedObject(t, body, user.Username), nil))
+	case len(path) >= 3 && t.managedObjects[path[2]] == nil:
+		writeError(w, http.StatusNotFound, "inventory/Not Found", "Finding device data from database failed : No managedObject for id '"+path[2]+"'!")
+	case len(path) == 3 && r.Method == http.MethodGet:
+		var parents map[string][]string
+		if r.URL.Query().Get("withParents") == "true" {
+			parents = additionParents(t)
+		}
+		writeJSON(w, http.StatusOK, s.render(t, t.managedObjects[path[2]], parents))
+	case len(path) == 3 && r.Method == http.MethodPut:
+		body, ok := decodeBody(w, r)
+		if !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, s.render(t, updateManagedObject(t.managedObjects[path[2]], body), nil))
+	case len(path) == 3 && r.Method == http.MethodDelete:
+		s.deleteManagedObject(t, path[2])
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) == 4 && path[3] == "childAdditions" && r.Method == http.MethodGet:
+		references := []map[string]any{}
+		for _, childId := range t.childAdditions[path[2]] {
+			references = append(references, s.reference(t, childId))
+		}
+		references, statistics := paginate(references, r)
+		writeJSON(w, http.StatusOK, map[string]any{"references": references, "statistics": statistics})
+	case len(path) == 4 && path[3] == "childAdditions" && r.Method == http.MethodPost:
+		body, ok := decodeBody(w, r)
+		if !ok {
+			return
+		}
+		childId, _ := body["managedObject"].(map[string]any)["id"].(string)
+		if t.managedObjects[childId] == nil {
+			writeError(w, http.StatusUnprocessableEntity, "inventory/Unprocessable Entity", "Unknown child addition '"+childId+"'")
+			return
+		}
+		if !slices.Contains(t.childAdditions[path[2]], childId) {
+			t.childAdditions[path[2]] = append(t.childAdditions[path[2]], childId)
+		}
+		writeJSON(w, http.StatusCreated, s.reference(t, childId))
+	case len(path) == 5 && path[3] == "childAdditions" && r.Method == http.MethodDelete:
+		if !slices.Contains(t.childAdditions[path[2]], path[4]) {
+			writeError(w, http.StatusNotFound, "inventory/Not Found", "Child addition '"+path[4]+"' not found")
+			return
+		}
+		t.childAdditions[path[2]] = slices.DeleteFunc(t.childAdditions[path[2]], func(id string) bool { return id == path[4] })
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "general/Method Not Allowed", "Unsupported request: "+r.Method+" "+r.URL.Path)
+	}
+}
+
+func (s *Server) listManagedObjects(w http.ResponseWriter, r *http.Request, t *tenant) {
+	params := r.URL.Query()
+	matches, err := parseQuery(params.Get("query"))
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "inventory/Invalid Query", err.Error())
+		return
+	}
+	var ids []string
+	if len(params.Get("ids")) > 0 {
+		ids = splitList(params.Get("ids"))
+	}
+	managedObjects := []map[string]any{}
+	for _, id := range t.moIds {
+		mo := t.managedObjects[id]
+		if len(ids) > 0 && !slices.Contains(ids, id) {
+			continue
+		}
+		if moType := params.Get("type"); len(moType) > 0 && mo["type"] != moType {
+			continue
+		}
+		if fragmentType := params.Get("fragmentType"); len(fragmentType) > 0 && mo[fragmentType] == nil {
+			continue
+		}
+		if !matches(mo) {
+			continue
+		}
+		managedObjects = append(managedObjects, mo)
+	}
+	managedObjects, statistics := paginate(managedObjects, r)
+	var parents map[string][]string
+	if params.Get("withParents") == "true" {
+		parents = additionParents(t)
+	}
+	for i, mo := range managedObjects {
+		managedObjects[i] = s.render(t, mo, parents)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"managedObjects": managedObjects, "statistics": statistics})
+}
+
+func (s *Server) createManagedObject(t *tenant, body map[string]any, owner string) map[string]any {
+	delete(body, "self")
+	delete(body, "childAdditions")
+	delete(body, "additionParents")
+	now := time.Now().Format(time.RFC3339)
+	body["id"] = s.nextId()
+	body["owner"] = owner
+	body["creationTime"] = now
+	body["lastUpdated"] = now
+	t.managedObjects[body["id"].(string)] = body
+	t.moIds = append(t.moIds, body["id"].(string))
+	return body
+}
+
+// merges the fragments of body into the managed object, fragments set to null are removed
+func updateManagedObject(mo map[string]any, body map[string]any) map[string]any {
+	for key, value := range body {
+		switch key {
+		case "id", "self", "owner", "creationTime", "lastUpdated", "childAdditions", "additionParents":
+			continue
+		}
+		if value == nil {
+			delete(mo, key)
+			continue
+		}
+		mo[key] = value
+	}
+	mo["lastUpdated"] = time.Now().Format(time.RFC3339)
+	return mo
+}
+
+// deletes the managed object incl. all references towards it and its external ids
+func (s *Server) deleteManagedObject(t *tenant, id string) {
+	delete(t.managedObjects, id)
+	delete(t.childAdditions, id)
+	t.moIds = slices.DeleteFunc(t.moIds, func(moId string) bool { return moId == id })
+	for parentId, children := range t.childAdditions {
+		t.childAdditions[parentId] = slices.DeleteFunc(children, func(childId string) bool { return childId == id })
+	}
+	maps.DeleteFunc(t.externalIds, func(_ string, moId string) bool { return moId == id })
+}
+
+// CreateManagedObject creates a managed object in the tenant (e.g. a device) and returns its id
+func (s *Server) CreateManagedObject(tenantId string, mo map[string]any) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.createManagedObject(s.tenants[tenantId], maps.Clone(mo), "admin")["id"].(string)
+}
+
+// CreateDevice creates a device managed object in the tenant owned by the (device) user and returns its id
+func (s *Server) CreateDevice(tenantId string, owner string, mo map[string]any) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	device := maps.Clone(mo)
+	device["c8y_IsDevice"] = map[string]any{}
+	return s.createManagedObject(s.tenants[tenantId], device, owner)["id"].(string)
+}
+
+// AddChildAddition assigns the managed object as child addition to the parent (e.g. a firmware version to its firmware)
+func (s *Server) AddChildAddition(tenantId string, parentId string, childId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.tenants[tenantId]
+	t.childAdditions[parentId] = append(t.childAdditions[parentId], childId)
+}
+
+// ManagedObject returns a copy of a managed object of the tenant
+func (s *Server) ManagedObject(tenantId string, id string) (map[string]any, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.tenants[tenantId]
+	mo, ok := t.managedObjects[id]
+	if !ok {
+		return nil, false
+	}
+	return copyJSON(s.render(t, mo, additionParents(t))), true
+}
+
+// ManagedObjects returns copies of the managed objects of the tenant matching the (inventory query language) query
+func (s *Server) ManagedObjects(tenantId string, query string) []map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	matches, err := parseQuery(query)
+	if err != nil {
+		panic(fmt.Sprintf("invalid query %q: %s", query, err))
+	}
+	t := s.tenants[tenantId]
+	parents := additionParents(t)
+	var res []map[string]any
+	for _, id := range t.moIds {
+		if mo := t.managedObjects[id]; matches(mo) {
+			res = append(res, copyJSON(s.render(t, mo, parents)))
+		}
+	}
+	return res
+}
+
+// ChildAdditions returns the ids of the child additions of a managed object
+func (s *Server) ChildAdditions(tenantId string, id string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.tenants[tenantId].childAdditions[id])
+}
+
+// returns a deep copy, so that callers can't modify the state of the server
+func copyJSON(value map[string]any) map[string]any {
+	b, _ := json.Marshal(value)
+	res := make(map[string]any)
+	json.Unmarshal(b, &res)
+	return res
+}
@@ -0,0 +1,199 @@
+package c8ytest
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// matcher is a compiled inventory query
+type matcher func(mo map[string]any) bool
+
+// parseQuery compiles the subset of the inventory query language used by the service:
+// "<fragment path> eq|ne <value>" (values may contain * wildcards), has(<fragment>), not(<expr>), and, or and parentheses.
+// Ordering ($orderby) is ignored, managed objects are always returned in creation order.
+func parseQuery(query string) (matcher, error) {
+	query = strings.TrimSpace(query)
+	query = strings.TrimPrefix(query, "$filter=")
+	if i := strings.Index(query, "$orderby="); i >= 0 {
+		query = strings.TrimSpace(query[:i])
+	}
+	if len(query) == 0 {
+		return func(map[string]any) bool { return true }, nil
+	}
+	p := &queryParser{tokens: tokenize(query)}
+	m, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected token %q", p.tokens[p.pos])
+	}
+	return m, nil
+}
+
+func tokenize(query string) []string {
+	var tokens []string
+	var current strings.Builder
+	flush := func() {
+		if current.Len() > 0 {
+			tokens = append(tokens, current.String())
+			current.Reset()
+		}
+	}
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; c {
+		case ' ', '\t', '\n':
+			flush()
+		case '(', ')':
+			flush()
+			tokens = append(tokens, string(c))
+		case '\'':
+			// quoted values are kept incl. their quotes, so they are never mistaken for keywords
+			// quotes within values are escaped by doubling them
+			flush()
+			end := i + 1
+			for ; end < len(query); end++ {
+				if query[end] == '\'' {
+					if end+1 < len(query) && query[end+1] == '\'' {
+						end++
+						continue
+					}
+					break
+				}
+			}
+			tokens = append(tokens, query[i:min(end+1, len(query))])
+			i = end
+		default:
+			current.WriteByte(c)
+		}
+	}
+	flush()
+	return tokens
+}
+
+type queryParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *queryParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *queryParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *queryParser) expect(token string) error {
+	if got := p.next(); got != token {
+		return fmt.Errorf("expected %q, got %q", token, got)
+	}
+	return nil
+}
+
+func (p *queryParser) parseOr() (matcher, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(mo map[string]any) bool { return l(mo) || right(mo) }
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseAnd() (matcher, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "and") {
+		p.next()
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(mo map[string]any) bool { return l(mo) && right(mo) }
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseTerm() (matcher, error) {
+	token := p.next()
+	switch {
+	case token == "(":
+		m, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return m, p.expect(")")
+	case strings.EqualFold(token, "not"):
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		m, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return func(mo map[string]any) bool { return !m(mo) }, p.expect(")")
+	case strings.EqualFold(token, "has"):
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		fragment := p.next()
+		return func(mo map[string]any) bool {
+			_, ok := lookup(mo, fragment)
+			return ok
+		}, p.expect(")")
+	case len(token) == 0 || token == ")":
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	op := strings.ToLower(p.next())
+	if op != "eq" && op != "ne" {
+		return nil, fmt.Errorf("unsupported operator %q", op)
+	}
+	literal := strings.TrimSuffix(strings.TrimPrefix(p.next(), "'"), "'")
+	pattern := regexp.MustCompile("^" + strings.ReplaceAll(regexp.QuoteMeta(strings.ReplaceAll(literal, "''", "'")), `\*`, ".*") + "$")
+	return func(mo map[string]any) bool {
+		value, ok := lookup(mo, token)
+		return (ok && pattern.MatchString(fmt.Sprint(value))) == (op == "eq")
+	}, nil
+}
+
+// returns the value of a (dot separated) fragment path
+func lookup(mo map[string]any, fragmentPath string) (any, bool) {
+	var value any = mo
+	for _, name := range strings.Split(fragmentPath, ".") {
+		fragment, ok := value.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if value, ok = fragment[name]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func splitList(value string) []string {
+	var res []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			res = append(res, item)
+		}
+	}
+	return res
+}
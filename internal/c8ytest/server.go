@@ -0,0 +1,287 @@
+// Package c8ytest provides an in-memory fake of the Cumulocity REST API for tests.
+//
+// It covers the parts of the API used by the service: inventory (incl. child additions), identity, alarms,
+// tenant options, current user/tenant and the application subscriptions of a microservice. All requests are
+// authenticated via basic auth (<tenant>/<user>:<password>) against the users known to the fake.
+package c8ytest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+)
+
+// User is a user of a tenant, incl. its (effective) roles
+type User struct {
+	Username string
+	Password string
+	Roles    []string
+}
+
+type tenant struct {
+	id         string
+	domainName string
+	users      map[string]User
+	// key = <category>/<key>
+	options map[string]string
+	// managed objects by id, ids are kept in creation order for stable paging
+	managedObjects map[string]map[string]any
+	moIds          []string
+	childAdditions map[string][]string
+	// key = <type>/<externalId>, value = managed object id
+	externalIds map[string]string
+	alarms      []map[string]any
+}
+
+// Server is a fake Cumulocity instance hosting the tenants subscribed to a single microservice
+type Server struct {
+	*httptest.Server
+	mu            sync.Mutex
+	lastId        int
+	serviceTenant string
+	application   string
+	bootstrapUser User
+	tenants       map[string]*tenant
+	// service users of the tenants subscribed to the application
+	subscriptions map[string]User
+	requests      int
+	hook          func(w http.ResponseWriter, r *http.Request, serve http.HandlerFunc)
+}
+
+// NewServer starts a fake Cumulocity. The application is owned by (and subscribed to) the service tenant.
+// The server is closed once the test finished.
+func NewServer(t testing.TB, serviceTenant string, application string) *Server {
+	s := &Server{
+		serviceTenant: serviceTenant,
+		application:   application,
+		bootstrapUser: User{Username: "servicebootstrap_" + application, Password: "bootstrap-secret"},
+		tenants:       make(map[string]*tenant),
+		subscriptions: make(map[string]User),
+	}
+	s.AddTenant(serviceTenant, serviceTenant+".c8y.example.com")
+	s.tenants[serviceTenant].users[s.bootstrapUser.Username] = s.bootstrapUser
+	s.Subscribe(serviceTenant)
+	s.Server = httptest.NewServer(s)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// AddTenant creates a tenant (if not existing yet)
+func (s *Server) AddTenant(tenantId string, domainName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tenants[tenantId]; ok {
+		return
+	}
+	s.tenants[tenantId] = &tenant{
+		id:             tenantId,
+		domainName:     domainName,
+		users:          make(map[string]User),
+		options:        make(map[string]string),
+		managedObjects: make(map[string]map[string]any),
+		childAdditions: make(map[string][]string),
+		externalIds:    make(map[string]string),
+	}
+}
+
+// Subscribe subscribes the tenant to the application, creating the tenant and its service user if needed
+func (s *Server) Subscribe(tenantId string) {
+	s.AddTenant(tenantId, tenantId+".c8y.example.com")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	serviceUser := User{
+		Username: "service_" + s.application,
+		Password: "service-secret-" + tenantId,
+		Roles:    []string{"ROLE_INVENTORY_READ", "ROLE_INVENTORY_ADMIN", "ROLE_IDENTITY_READ", "ROLE_IDENTITY_ADMIN", "ROLE_ALARM_ADMIN", "ROLE_OPTION_MANAGEMENT_READ"},
+	}
+	s.tenants[tenantId].users[serviceUser.Username] = serviceUser
+	s.subscriptions[tenantId] = serviceUser
+}
+
+// Unsubscribe removes the subscription of the tenant, its service user can't log in anymore
+func (s *Server) Unsubscribe(tenantId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if serviceUser, ok := s.subscriptions[tenantId]; ok {
+		delete(s.tenants[tenantId].users, serviceUser.Username)
+		delete(s.subscriptions, tenantId)
+	}
+}
+
+// UnsubscribeKeepingServiceUser removes the subscription of the tenant, but its service user can still log in, as if the
+// unsubscription is noticed before the credentials are revoked
+func (s *Server) UnsubscribeKeepingServiceUser(tenantId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subscriptions, tenantId)
+}
+
+// AddUser adds a user (e.g. a device user) to an existing tenant
+func (s *Server) AddUser(tenantId string, user User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tenants[tenantId].users[user.Username] = user
+}
+
+// SetOption sets a tenant option, an empty value removes it
+func (s *Server) SetOption(tenantId string, category string, key string, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(value) == 0 {
+		delete(s.tenants[tenantId].options, category+"/"+key)
+		return
+	}
+	s.tenants[tenantId].options[category+"/"+key] = value
+}
+
+// SetBootstrapEnv exposes the bootstrap credentials of the application via the environment variables read by go-c8y
+func (s *Server) SetBootstrapEnv(t testing.TB) {
+	t.Setenv(c8y.EnvironmentBootstrapTenant, s.serviceTenant)
+	t.Setenv(c8y.EnvironmentBootstrapUsername, s.bootstrapUser.Username)
+	t.Setenv(c8y.EnvironmentBootstrapPassword, s.bootstrapUser.Password)
+}
+
+// NewClient returns a client authenticated as the bootstrap user of the application, as used by the microservice
+func (s *Server) NewClient() *c8y.Client {
+	return c8y.NewClient(nil, s.URL, s.serviceTenant, s.bootstrapUser.Username, s.bootstrapUser.Password, true)
+}
+
+// Requests returns the number of requests received so far
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// SetRequestHook sets a function each request is passed to (outside of the lock of the fake) instead of serving it directly.
+// It may observe or delay the request before serving it via serve, or answer it on its own, e.g. to simulate errors.
+func (s *Server) SetRequestHook(hook func(w http.ResponseWriter, r *http.Request, serve http.HandlerFunc)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hook = hook
+}
+
+type errorResponse struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if body != nil {
+		json.NewEncoder(w).Encode(body)
+	}
+}
+
+func writeError(w http.ResponseWriter, statusCode int, err string, message string) {
+	writeJSON(w, statusCode, errorResponse{Error: err, Message: message})
+}
+
+// authenticates the request, returns the tenant and user it was sent by
+func (s *Server) authenticate(r *http.Request) (*tenant, User, bool) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, User{}, false
+	}
+	tenantId, username, found := strings.Cut(username, "/")
+	if !found {
+		return nil, User{}, false
+	}
+	t, ok := s.tenants[tenantId]
+	if !ok {
+		return nil, User{}, false
+	}
+	user, ok := t.users[username]
+	if !ok || user.Password != password {
+		return nil, User{}, false
+	}
+	return t, user, true
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	hook := s.hook
+	s.mu.Unlock()
+	if hook != nil {
+		hook(w, r, s.serve)
+		return
+	}
+	s.serve(w, r)
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	t, user, ok := s.authenticate(r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "security/Unauthorized", "Invalid credentials!")
+		return
+	}
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/user/currentUser":
+		s.getCurrentUser(w, user)
+	case r.Method == http.MethodGet && r.URL.Path == "/tenant/currentTenant":
+		writeJSON(w, http.StatusOK, map[string]any{"name": t.id, "domainName": t.domainName, "self": s.URL + r.URL.Path})
+	case r.Method == http.MethodGet && len(path) == 4 && path[0] == "tenant" && path[1] == "options":
+		s.getOption(w, t, path[2], path[3])
+	case r.Method == http.MethodGet && r.URL.Path == "/application/currentApplication/subscriptions":
+		s.getSubscriptions(w, t, user)
+	case path[0] == "inventory":
+		s.serveInventory(w, r, t, user, path)
+	case path[0] == "identity":
+		s.serveIdentity(w, r, t, path)
+	case path[0] == "alarm":
+		s.serveAlarms(w, r, t, path)
+	default:
+		writeError(w, http.StatusNotFound, "general/Not Found", "Unsupported request: "+r.Method+" "+r.URL.Path)
+	}
+}
+
+func (s *Server) getCurrentUser(w http.ResponseWriter, user User) {
+	roles := make([]map[string]any, 0, len(user.Roles))
+	for _, role := range user.Roles {
+		roles = append(roles, map[string]any{"id": role, "name": role})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"id":             user.Username,
+		"userName":       user.Username,
+		"effectiveRoles": roles,
+	})
+}
+
+func (s *Server) getOption(w http.ResponseWriter, t *tenant, category string, key string) {
+	value, ok := t.options[category+"/"+key]
+	if !ok {
+		writeError(w, http.StatusNotFound, "options/Not Found", "Unable to find option by given key: "+category+"/"+key)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"category": category, "key": key, "value": value})
+}
+
+// only the bootstrap user of the application may list its subscriptions
+func (s *Server) getSubscriptions(w http.ResponseWriter, t *tenant, user User) {
+	if t.id != s.serviceTenant || user.Username != s.bootstrapUser.Username {
+		writeError(w, http.StatusForbidden, "security/Forbidden", "Access is denied")
+		return
+	}
+	tenantIds := make([]string, 0, len(s.subscriptions))
+	for tenantId := range s.subscriptions {
+		tenantIds = append(tenantIds, tenantId)
+	}
+	slices.Sort(tenantIds)
+	users := make([]map[string]any, 0, len(tenantIds))
+	for _, tenantId := range tenantIds {
+		serviceUser := s.subscriptions[tenantId]
+		users = append(users, map[string]any{"tenant": tenantId, "name": serviceUser.Username, "password": serviceUser.Password})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"users": users})
+}
@@ -0,0 +1,22 @@
+package model
+
+import "errors"
+
+// ErrVersionExists is returned (wrapped) if a published firmware version (or its object) already exists
+var ErrVersionExists = errors.New("firmware version already exists")
+
+// ErrInvalidPublishRequest is returned (wrapped) if mandatory fields of a published firmware version are missing
+var ErrInvalidPublishRequest = errors.New("invalid publish request")
+
+// PublishRequest describes a firmware version published via the API. Name and version are mandatory, deviceType and
+// description are only used if the firmware is not part of the index files yet.
+type PublishRequest struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	DeviceType  string `json:"deviceType,omitempty"`
+	Description string `json:"description,omitempty"`
+	// original file name of the binary, used as last segment of the object key
+	FileName string `json:"fileName,omitempty"`
+	// size of the binary in bytes, mandatory for presigned uploads
+	Size int64 `json:"size,omitempty"`
+}
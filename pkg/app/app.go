@@ -2,15 +2,18 @@ package app
 
 import (
 	"context"
-	"errors"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/hashicorp/go-retryablehttp"
@@ -23,8 +26,14 @@ import (
 	"github.com/reubenmiller/go-c8y/pkg/c8y"
 	"github.com/reubenmiller/go-c8y/pkg/microservice"
 	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+	"gopkg.in/robfig/cron.v2"
 )
 
+// max. time to wait for background work (e.g. in-flight synchronizations) on shutdown.
+// Kubernetes kills the container 30 seconds after sending SIGTERM by default.
+const shutdownTimeout = 25 * time.Second
+
 // App represents the http server and c8y microservice application
 type App struct {
 	echoServer      *echo.Echo
@@ -49,6 +58,9 @@ func NewApp() *App {
 	c8ymicroservice := microservice.NewDefaultMicroservice(opts)
 
 	customHTTPClient.RetryMax = 2
+	// a 429 pauses all requests (of all tenant synchronizations running in parallel)
+	sharedBackoff := &SharedBackoff{}
+	customHTTPClient.HTTPClient.Transport = sharedBackoff.Transport(customHTTPClient.HTTPClient.Transport)
 	customHTTPClient.PrepareRetry = func(req *http.Request) error {
 		// Update latest service user credentials
 		if username, _, ok := req.BasicAuth(); ok {
@@ -67,6 +79,7 @@ func NewApp() *App {
 
 	customHTTPClient.CheckRetry = func(ctx context.Context, resp *http.Response, err error) (bool, error) {
 		if resp.StatusCode == http.StatusTooManyRequests {
+			sharedBackoff.TriggerFromResponse(resp)
 			return true, nil
 		}
 
@@ -94,103 +107,355 @@ func NewApp() *App {
 	return app
 }
 
-func syncSubscriptionsWithTenantControllers(c *c8y.Client, estClient *est.ExternalStorageClient, fwControllers *FirmwareTenantControllers, ctxPath string) {
-	subscriptions, _, _ := c.Application.GetCurrentApplicationSubscriptions(c.Context.BootstrapUserFromEnvironment())
+// registers a controller for each newly subscribed tenant (resuming from its persisted sync state) and unregisters the ones of unsubscribed tenants.
+// Returns the ids of the newly registered tenants.
+func syncSubscriptionsWithTenantControllers(c *c8y.Client, sources est.Sources, fwControllers *FirmwareTenantControllers, ctxPath string) []string {
+	subscriptions, _, err := c.Application.GetCurrentApplicationSubscriptions(c.Context.BootstrapUserFromEnvironment())
+	if err != nil {
+		slog.Error("Error while requesting application subscriptions. Skipping this iteration.", "err", err)
+		return nil
+	}
+	// an empty list is rather a glitch of the platform than all tenants unsubscribing at once, as unregistering drops the
+	// controllers (incl. their state) the tenants are only unregistered once the list is empty a second time in a row
+	if len(subscriptions.Users) == 0 && fwControllers.emptySubscriptionLists.Add(1) < 2 {
+		slog.Warn("Received empty list of application subscriptions. Keeping the registered tenants until it is confirmed.")
+		return nil
+	}
+	if len(subscriptions.Users) > 0 {
+		fwControllers.emptySubscriptionLists.Store(0)
+	}
+	var registeredTenants []string
+	subscribedTenants := make(map[string]bool)
 	for _, user := range subscriptions.Users {
 		tenant := user.Tenant
 		if len(tenant) == 0 {
 			slog.Warn("No tenant for for subscription user")
 			continue
 		}
+		subscribedTenants[tenant] = true
 		_, exists := fwControllers.Get(tenant)
 		if exists {
 			slog.Info("Controller already existing for tenant", "tenant", tenant)
 			continue
 		}
-		currentTenant, _, err := c.Tenant.GetCurrentTenant(c.Context.ServiceUserContext(tenant, false))
+		// firmware controller for tenant does not exist, create and register it
+		fc, err := newTenantController(c.Context.ServiceUserContext(tenant, false), c, sources, fwControllers, tenant, ctxPath)
 		if err != nil {
-			slog.Warn("Error while invoking /tenant/currentTenant. Skipping this tenant subscription", "err", err, "tenant", tenant)
+			slog.Warn("Could not create controller for tenant. Skipping this tenant subscription", "err", err, "tenant", tenant)
 			continue
 		}
-		domainName := currentTenant.DomainName
-		if len(domainName) == 0 {
-			slog.Warn("Domain name is empty for tenant. Skipping this tenant subscription", "tenant", tenant)
+		fwControllers.Register(fc)
+		registeredTenants = append(registeredTenants, tenant)
+	}
+
+	// unregister controllers of tenants that unsubscribed from the service
+	for _, tenant := range fwControllers.TenantIds() {
+		if subscribedTenants[tenant] {
 			continue
 		}
-		// firmware controller for tenant does not exist, create and register it
-		fc := FirmwareTenantController{
-			tenantStore: &FirmwareTenantStore{
-				FirmwareByName:         make(map[string]FirmwareStoreFwEntry),
-				FirmwareVersionsByName: make(map[string][]FirmwareStoreVersionEntry),
-			},
-			ctx:            c.Context.ServiceUserContext(tenant, false),
-			c8yClient:      c,
-			estClient:      estClient,
-			tenantId:       tenant,
-			serviceBaseUrl: "https://" + domainName + "/service/" + ctxPath,
+		slog.Info("Tenant is not subscribed anymore. Unregistering its controller.", "tenant", tenant)
+		fc, _ := fwControllers.Unregister(tenant)
+		// best effort, the credentials of the service user of the tenant may already be invalid (see the cleanup API otherwise)
+		if fwControllers.syncSettings.CleanupOnUnsubscribe {
+			if _, err := fc.RemoveCreatedFirmwareObjects(); err == nil {
+				fc.removeSyncState()
+			}
 		}
-		fwControllers.Register(fc)
-		fwControllers.SyncTenantsWithIndexFiles([]string{tenant})
 	}
+	return registeredTenants
+}
+
+// creates the controller of a tenant, resuming from its persisted sync state. ctx carries the credentials used towards the tenant.
+func newTenantController(ctx context.Context, c *c8y.Client, sources est.Sources, fwControllers *FirmwareTenantControllers, tenant string, ctxPath string) (*FirmwareTenantController, error) {
+	currentTenant, _, err := c.Tenant.GetCurrentTenant(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error while invoking /tenant/currentTenant: %w", err)
+	}
+	if len(currentTenant.DomainName) == 0 {
+		return nil, fmt.Errorf("domain name is empty for tenant %s", tenant)
+	}
+	fc := &FirmwareTenantController{
+		tenantStore:    NewFirmwareTenantStore(),
+		ctx:            ctx,
+		c8yClient:      c,
+		sources:        sources,
+		tenantId:       tenant,
+		serviceBaseUrl: "https://" + currentTenant.DomainName + "/service/" + ctxPath,
+		syncSettings:   fwControllers.syncSettings,
+	}
+	// tenants may override the default schedule within their own tenant options
+	fc.schedule = readTenantSchedule(ctx, c, fwControllers.defaultSchedule)
+	// an invalid overlay source fails the controller, as the versions of the overlay would be removed from the tenant otherwise
+	if fc.overlay, err = readOverlaySourceFromTenantOptions(ctx, c, tenant, fwControllers.storageSettings, fwControllers.overlaySettings); err != nil {
+		return nil, err
+	}
+	if fc.overlay != nil {
+		fc.sources = append(slices.Clip(sources), *fc.overlay)
+		fc.overlayOverride = tenantListed(fwControllers.overlaySettings.overrideTenants, tenant)
+	}
+	// without the persisted sync state a second one would be created, so the tenant is retried with the next subscription check
+	if err := fc.loadSyncState(); err != nil {
+		return nil, fmt.Errorf("error while reading the persisted sync state of tenant %s: %w", tenant, err)
+	}
+	return fc, nil
 }
 
-func syncSubscriptionsWithTenantControllersPeriodically(c *c8y.Client, estClient *est.ExternalStorageClient, fwControllers *FirmwareTenantControllers, ctxPath string) {
+func syncSubscriptionsWithTenantControllersPeriodically(ctx context.Context, c *c8y.Client, sources est.Sources, fwControllers *FirmwareTenantControllers, ctxPath string) {
 	for {
-		syncSubscriptionsWithTenantControllers(c, estClient, fwControllers, ctxPath)
-		time.Sleep(60 * time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(60 * time.Second):
+		}
+		if registeredTenants := syncSubscriptionsWithTenantControllers(c, sources, fwControllers, ctxPath); len(registeredTenants) > 0 {
+			fwControllers.SyncTenantsWithIndexFiles(ctx, registeredTenants)
+		}
+	}
+}
+
+func readStartupStaggerFromTenantOptions(c *c8y.Client) int {
+	staggerSecs := s.TOPT_FW_STARTUP_STAGGER_SECS_DEFAULTVALUE
+	opt, _, err := c.TenantOptions.GetOption(c.Context.ServiceUserContext(c.TenantName, false),
+		s.TOPT_CATEGORY, s.TOPT_FW_STARTUP_STAGGER_SECS)
+	if err == nil {
+		if o, e := strconv.Atoi(opt.Value); e == nil && o >= 0 {
+			staggerSecs = o
+		}
 	}
+	return staggerSecs
 }
 
-func CreateStorageClientFromTenantOptions(application *microservice.Microservice) (est.ExternalStorageClient, error) {
-	ctx := application.WithServiceUser(application.Client.TenantName)
-	c8yClient := application.Client
+func CreateStorageSourcesFromTenantOptions(application *microservice.Microservice) (est.Sources, error) {
+	return createStorageSourcesFromTenantOptions(application.WithServiceUser(application.Client.TenantName), application.Client)
+}
+
+// creates the storage sources configured within the tenant options, ctx carries the credentials used to read them.
+// Without a list of sources, the storage provider is used as single (default) source.
+func createStorageSourcesFromTenantOptions(ctx context.Context, c8yClient *c8y.Client) (est.Sources, error) {
+	settings := readClientSettingsFromTenantOptions(ctx, c8yClient)
+
+	if sourcesOpt, _, err := c8yClient.TenantOptions.GetOption(ctx, s.TOPT_CATEGORY, s.TOPT_FW_STORAGE_SOURCES); err == nil {
+		sources, err := est.NewSources(ctx, sourcesOpt.Value, settings)
+		if err != nil {
+			slog.Error("Fatal problem while initializing storage sources. Make sure the tenant options align with documentation", "tenantOptionKey", s.TOPT_FW_STORAGE_SOURCES, "err", err)
+			return nil, err
+		}
+		slog.Info("Storage sources initialized", "sources", sources.Ids())
+		return sources, nil
+	}
+
 	storageProvider, _, err := c8yClient.TenantOptions.GetOption(ctx, s.TOPT_CATEGORY, s.TOPT_FW_STORAGE_PROVIDER_KEY)
 	if err != nil {
 		slog.Error(fmt.Sprintf("Could not read required storageProvider tenant option (category=%s, key=%s)", s.TOPT_CATEGORY, s.TOPT_FW_STORAGE_PROVIDER_KEY), "err", err)
 		return nil, err
 	}
+	estClient, err := est.NewClientFromTenantOptions(ctx, c8yClient, s.TOPT_CATEGORY, storageProvider.Value, settings)
+	if err != nil {
+		slog.Error("Fatal problem while initializing storage client. Make sure the tenant options align with documentation", "provider", storageProvider.Value, "err", err)
+		return nil, err
+	}
+	return est.SingleSource(estClient, readIndexLayoutFromTenantOptions(ctx, c8yClient)), nil
+}
 
+func readClientSettingsFromTenantOptions(ctx context.Context, c *c8y.Client) est.ClientSettings {
 	urlExpirationMins := s.TOPT_FW_URL_EXPIRATION_MINS_DEFAULTVALUE
-	opt, _, err := c8yClient.TenantOptions.GetOption(ctx, s.TOPT_CATEGORY, s.TOPT_FW_URL_EXPIRATION_MINS)
+	opt, _, err := c.TenantOptions.GetOption(ctx, s.TOPT_CATEGORY, s.TOPT_FW_URL_EXPIRATION_MINS)
 	if err == nil {
 		if o, e := strconv.Atoi(opt.Value); e == nil {
 			urlExpirationMins = o
 		}
 	}
+	return est.ClientSettings{UrlExpirationMins: urlExpirationMins}
+}
 
-	switch storageProvider.Value {
-	case "awsS3":
-		slog.Info("Detected desired storage account to be awsS3. Initializing client...")
-		awsClient := &est.AWSClient{}
-		if err := awsClient.Init(ctx, c8yClient, s.TOPT_CATEGORY, s.TOPT_FW_AWS_CONNECTION_KEY, urlExpirationMins); err != nil {
-			slog.Error("Fatal problem while initializing AWS client", "err", err)
-			return nil, err
+// location of the index files of the (single) storage provider, the files are located in the bucket root by default
+func readIndexLayoutFromTenantOptions(ctx context.Context, c *c8y.Client) est.IndexLayout {
+	layout := est.IndexLayout{}
+	for key, field := range map[string]*string{
+		s.TOPT_FW_INDEX_PREFIX:             &layout.Prefix,
+		s.TOPT_FW_INDEX_VERSIONS_FILE:      &layout.VersionsFile,
+		s.TOPT_FW_INDEX_INFO_FILE:          &layout.InfoFile,
+		s.TOPT_FW_INDEX_TENANT_GROUPS_FILE: &layout.TenantGroupsFile,
+	} {
+		if opt, _, err := c.TenantOptions.GetOption(ctx, s.TOPT_CATEGORY, key); err == nil {
+			*field = strings.TrimSpace(opt.Value)
 		}
-		return awsClient, nil
-	case "azblob":
-		slog.Info("Detected desired storage account to be azblob. Initializing client...")
-		azClient := &est.AzClient{}
-		if err := azClient.Init(ctx, c8yClient, s.TOPT_CATEGORY, s.TOPT_FW_AZ_CONNECTION_KEY, urlExpirationMins); err != nil {
-			slog.Error("Fatal problem while initializing Azure client", "err", err)
-			return nil, err
+	}
+	return layout
+}
+
+// creates the (empty) registry of tenant controllers, configured via the tenant options of the service's own tenant
+// ctx carries the credentials used to read the tenant options.
+func newFirmwareTenantControllers(ctx context.Context, c *c8y.Client, sources est.Sources) *FirmwareTenantControllers {
+	return &FirmwareTenantControllers{
+		sources:            sources,
+		storageSettings:    readClientSettingsFromTenantOptions(ctx, c),
+		overlaySettings:    readOverlaySettingsFromTenantOptions(ctx, c),
+		tenantControllers:  make(map[string]*FirmwareTenantController),
+		syncSettings:       readSyncSettingsFromTenantOptions(ctx, c),
+		syncConcurrency:    readSyncConcurrencyFromTenantOptions(ctx, c),
+		syncTrigger:        make(chan struct{}, 1),
+		defaultSchedule:    readDefaultScheduleFromTenantOptions(ctx, c),
+		eventWatchPrefixes: readEventWatchPrefixesFromTenantOptions(ctx, c),
+	}
+}
+
+func readSyncSettingsFromTenantOptions(ctx context.Context, c *c8y.Client) SyncSettings {
+	settings := SyncSettings{
+		DeletionMode:            s.TOPT_FW_DELETION_MODE_DEFAULTVALUE,
+		RetentionVersions:       s.TOPT_FW_RETENTION_VERSIONS_DEFAULTVALUE,
+		RetentionOrder:          s.TOPT_FW_RETENTION_ORDER_DEFAULTVALUE,
+		CleanupOnUnsubscribe:    s.TOPT_FW_CLEANUP_ON_UNSUBSCRIBE_DEFAULTVALUE,
+		TenantStoreMaxAgeMins:   s.TOPT_FW_TENANT_STORE_MAX_AGE_MINS_DEFAULTVALUE,
+		ForceResyncIntervalMins: s.TOPT_FW_FORCE_RESYNC_INTERVAL_MINS_DEFAULTVALUE,
+	}
+	opt, _, err := c.TenantOptions.GetOption(ctx, s.TOPT_CATEGORY, s.TOPT_FW_DELETION_MODE)
+	if err == nil {
+		switch opt.Value {
+		case s.DELETION_MODE_DELETE, s.DELETION_MODE_ARCHIVE:
+			settings.DeletionMode = opt.Value
+		default:
+			slog.Warn("Unsupported deletion mode in tenant options. Using default.", "deletionMode", opt.Value, "default", settings.DeletionMode)
+		}
+	}
+	opt, _, err = c.TenantOptions.GetOption(ctx, s.TOPT_CATEGORY, s.TOPT_FW_RETENTION_VERSIONS)
+	if err == nil {
+		if o, e := strconv.Atoi(opt.Value); e == nil && o >= 0 {
+			settings.RetentionVersions = o
+		}
+	}
+	opt, _, err = c.TenantOptions.GetOption(ctx, s.TOPT_CATEGORY, s.TOPT_FW_RETENTION_ORDER)
+	if err == nil {
+		switch opt.Value {
+		case s.RETENTION_ORDER_SEMVER, s.RETENTION_ORDER_INDEX:
+			settings.RetentionOrder = opt.Value
+		default:
+			slog.Warn("Unsupported retention order in tenant options. Using default.", "retentionOrder", opt.Value, "default", settings.RetentionOrder)
+		}
+	}
+	opt, _, err = c.TenantOptions.GetOption(ctx, s.TOPT_CATEGORY, s.TOPT_FW_CLEANUP_ON_UNSUBSCRIBE)
+	if err == nil {
+		if o, e := strconv.ParseBool(opt.Value); e == nil {
+			settings.CleanupOnUnsubscribe = o
 		}
-		return azClient, nil
-	default:
-		slog.Error("Storage provider not supported", "err", err)
-		return nil, errors.New("provided none or an unsupported storage provider. Make sure the tenant options align with documentation")
 	}
+	opt, _, err = c.TenantOptions.GetOption(ctx, s.TOPT_CATEGORY, s.TOPT_FW_TENANT_STORE_MAX_AGE_MINS)
+	if err == nil {
+		if o, e := strconv.Atoi(opt.Value); e == nil && o >= 0 {
+			settings.TenantStoreMaxAgeMins = o
+		}
+	}
+	opt, _, err = c.TenantOptions.GetOption(ctx, s.TOPT_CATEGORY, s.TOPT_FW_FORCE_RESYNC_INTERVAL_MINS)
+	if err == nil {
+		if o, e := strconv.Atoi(opt.Value); e == nil && o >= 0 {
+			settings.ForceResyncIntervalMins = o
+		}
+	}
+	slog.Info("Using synchronization settings", "deletionMode", settings.DeletionMode, "retentionVersions", settings.RetentionVersions, "retentionOrder", settings.RetentionOrder, "cleanupOnUnsubscribe", settings.CleanupOnUnsubscribe, "tenantStoreMaxAgeMins", settings.TenantStoreMaxAgeMins, "forceResyncIntervalMins", settings.ForceResyncIntervalMins)
+	return settings
 }
 
-func scheduleAutoObserver(c *c8y.Client, fwControllers *FirmwareTenantControllers) {
+func readSyncConcurrencyFromTenantOptions(ctx context.Context, c *c8y.Client) int {
+	concurrency := s.TOPT_FW_SYNC_CONCURRENCY_DEFAULTVALUE
+	opt, _, err := c.TenantOptions.GetOption(ctx, s.TOPT_CATEGORY, s.TOPT_FW_SYNC_CONCURRENCY)
+	if err == nil {
+		if o, e := strconv.Atoi(opt.Value); e == nil && o > 0 {
+			concurrency = o
+		}
+	}
+	return concurrency
+}
+
+// reads the default schedule of all tenants: the fixed observe interval, unless a cron expression is configured
+func readDefaultScheduleFromTenantOptions(ctx context.Context, c *c8y.Client) TenantSchedule {
 	observeTimeMins := s.TOPT_FW_STORAGE_OBSERVE_INTERVAL_MINS_DEFAULTVALUE
-	opt, _, err := c.TenantOptions.GetOption(c.Context.ServiceUserContext(c.TenantName, false),
-		s.TOPT_CATEGORY, s.TOPT_FW_STORAGE_OBSERVE_INTERVAL_MINS)
+	opt, _, err := c.TenantOptions.GetOption(ctx, s.TOPT_CATEGORY, s.TOPT_FW_STORAGE_OBSERVE_INTERVAL_MINS)
 	if err == nil {
-		if o, e := strconv.Atoi(opt.Value); e == nil {
+		if o, e := strconv.Atoi(opt.Value); e == nil && o > 0 {
 			observeTimeMins = o
 		}
 	}
-	go fwControllers.AutoObserve(observeTimeMins)
+	spec := fmt.Sprintf("@every %dm", observeTimeMins)
+	interval, _ := cron.Parse(spec)
+	schedule := readTenantSchedule(ctx, c, TenantSchedule{Spec: spec, Schedule: interval})
+	slog.Info("Using default sync schedule", "schedule", schedule.Spec, "jitter", schedule.Jitter.String(), "maintenanceWindow", schedule.MaintenanceWindow != nil)
+	return schedule
+}
+
+func readEventWatchPrefixesFromTenantOptions(ctx context.Context, c *c8y.Client) []string {
+	var watchPrefixes []string
+	opt, _, err := c.TenantOptions.GetOption(ctx, s.TOPT_CATEGORY, s.TOPT_FW_EVENT_WATCH_PREFIXES)
+	if err == nil {
+		for _, prefix := range strings.Split(opt.Value, ",") {
+			if prefix = strings.TrimSpace(prefix); len(prefix) > 0 {
+				watchPrefixes = append(watchPrefixes, prefix)
+			}
+		}
+	}
+	return watchPrefixes
+}
+
+// consumes the change notifications of the sources (if supported and configured) until ctx is done. Polling stays active as fallback.
+func observeStorageEvents(ctx context.Context, sources est.Sources, fwControllers *FirmwareTenantControllers) {
+	var wg sync.WaitGroup
+	for _, source := range sources {
+		notifier, ok := source.Client.(est.ChangeNotifier)
+		if !ok || !notifier.EventsEnabled() {
+			slog.Info("Storage change notifications not configured, relying on polling (and webhooks) only", "source", source.Id)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fwControllers.ObserveStorageEvents(ctx, notifier)
+		}()
+	}
+	wg.Wait()
+}
+
+// prefix of the objects uploaded via the publish API, always ends with a slash unless empty
+func readUploadPrefixFromTenantOptions(c *c8y.Client) string {
+	opt, _, err := c.TenantOptions.GetOption(c.Context.ServiceUserContext(c.TenantName, false),
+		s.TOPT_CATEGORY, s.TOPT_FW_UPLOAD_PREFIX)
+	if err != nil {
+		return s.TOPT_FW_UPLOAD_PREFIX_DEFAULTVALUE
+	}
+	prefix := strings.TrimLeft(strings.TrimSpace(opt.Value), "/")
+	if len(prefix) > 0 && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix
+}
+
+func readDeviceTypeCheckFromTenantOptions(c *c8y.Client) handlers.DeviceTypeCheck {
+	check := handlers.DeviceTypeCheck{
+		Enabled:  s.TOPT_FW_DOWNLOAD_DEVICE_TYPE_CHECK_DEFAULTVALUE,
+		CacheTTL: time.Duration(s.TOPT_FW_DOWNLOAD_CACHE_TTL_SECS_DEFAULTVALUE) * time.Second,
+	}
+	ctx := c.Context.ServiceUserContext(c.TenantName, false)
+	opt, _, err := c.TenantOptions.GetOption(ctx, s.TOPT_CATEGORY, s.TOPT_FW_DOWNLOAD_DEVICE_TYPE_CHECK)
+	if err == nil {
+		if o, e := strconv.ParseBool(opt.Value); e == nil {
+			check.Enabled = o
+		}
+	}
+	opt, _, err = c.TenantOptions.GetOption(ctx, s.TOPT_CATEGORY, s.TOPT_FW_DOWNLOAD_CACHE_TTL_SECS)
+	if err == nil {
+		if o, e := strconv.Atoi(opt.Value); e == nil && o >= 0 {
+			check.CacheTTL = time.Duration(o) * time.Second
+		}
+	}
+	slog.Info("Using device type check of downloads", "enabled", check.Enabled, "cacheTtl", check.CacheTTL.String())
+	return check
+}
+
+func readWebhookSecretFromTenantOptions(c *c8y.Client) string {
+	opt, _, err := c.TenantOptions.GetOption(c.Context.ServiceUserContext(c.TenantName, false),
+		s.TOPT_CATEGORY, s.TOPT_FW_WEBHOOK_SECRET)
+	if err != nil {
+		return ""
+	}
+	return opt.Value
 }
 
 // Run starts the microservice
@@ -202,7 +467,7 @@ func (a *App) Run() {
 	bUrl := application.Client.BaseURL
 	slog.Info("Service BaseURL", "url", bUrl.Scheme+"://"+bUrl.Hostname()+"/service/"+application.Application.ContextPath)
 
-	estClient, err := CreateStorageClientFromTenantOptions(application)
+	sources, err := CreateStorageSourcesFromTenantOptions(application)
 	if err != nil {
 		slog.Error("Error while initiating the connection to the external storage. This is a fatal error, exiting in 10 seconds...", "error", err)
 		time.Sleep(time.Second * 10)
@@ -210,49 +475,91 @@ func (a *App) Run() {
 	}
 
 	// init Firmware Controllers
-	tenantFwControllers := FirmwareTenantControllers{
-		estClient:         estClient,
-		tenantControllers: make(map[string]FirmwareTenantController),
-	}
-	// check registered tenants, create a Firmware Controller for each of them
-	syncSubscriptionsWithTenantControllers(application.Client, &estClient, &tenantFwControllers, application.Application.ContextPath)
+	tenantFwControllers := newFirmwareTenantControllers(application.Client.Context.ServiceUserContext(application.Client.TenantName, false), application.Client, sources)
+	// root context of all background work, cancelled on SIGINT/SIGTERM (sent by Kubernetes)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	group, ctx := errgroup.WithContext(ctx)
+
+	// check registered tenants, create a Firmware Controller for each of them (resuming from their persisted sync state)
+	registeredTenants := syncSubscriptionsWithTenantControllers(application.Client, sources, tenantFwControllers, application.Application.ContextPath)
+	staggerSecs := readStartupStaggerFromTenantOptions(application.Client)
+	group.Go(func() error {
+		tenantFwControllers.SyncTenantsStaggered(ctx, registeredTenants, time.Duration(staggerSecs)*time.Second)
+		return nil
+	})
 	// Start routine to periodically check for tenant subscriptions and add Firmware Controller for Each
-	go syncSubscriptionsWithTenantControllersPeriodically(application.Client, &estClient, &tenantFwControllers, application.Application.ContextPath)
+	group.Go(func() error {
+		syncSubscriptionsWithTenantControllersPeriodically(ctx, application.Client, sources, tenantFwControllers, application.Application.ContextPath)
+		return nil
+	})
 	// let firmware controller observe external storage
-	scheduleAutoObserver(application.Client, &tenantFwControllers)
+	group.Go(func() error {
+		tenantFwControllers.RunScheduler(ctx)
+		return nil
+	})
+	// sync immediately on storage change notifications (and webhook calls)
+	group.Go(func() error {
+		tenantFwControllers.RunTriggeredSyncs(ctx)
+		return nil
+	})
+	group.Go(func() error {
+		observeStorageEvents(ctx, sources, tenantFwControllers)
+		return nil
+	})
 
 	// now start webserver
 	if a.echoServer == nil {
 		addr := ":" + application.Config.GetString("server.port")
 		zap.S().Infof("starting http server on %s", addr)
 
-		a.echoServer = echo.New()
-		setDefaultContextHandler(a.echoServer, a.c8ymicroservice)
-		provider := c8yauth.NewAuthProvider(application.Client)
-		a.echoServer.Use(c8yauth.AuthenticationBasic(provider))
-		a.echoServer.Use(c8yauth.AuthenticationBearer(provider))
+		a.setupEchoServer(sources, tenantFwControllers)
 
-		a.setRouters(&estClient)
-
-		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
-		defer stop()
 		// Start server
-		go func() {
+		group.Go(func() error {
 			if err := a.echoServer.Start(addr); err != nil && err != http.ErrServerClosed {
-				a.echoServer.Logger.Fatal("shutting down the server")
+				return fmt.Errorf("http server failed: %w", err)
 			}
-		}()
-
+			return nil
+		})
 		// Wait for interrupt signal to gracefully shutdown the server with a timeout of 10 seconds.
-		<-ctx.Done()
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		if err := a.echoServer.Shutdown(ctx); err != nil {
-			a.echoServer.Logger.Fatal(err)
+		group.Go(func() error {
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			return a.echoServer.Shutdown(shutdownCtx)
+		})
+	}
+
+	// in-flight synchronizations stop after their current step, give them a bounded amount of time to do so
+	done := make(chan error, 1)
+	go func() {
+		done <- group.Wait()
+	}()
+	<-ctx.Done()
+	slog.Info("Shutting down, waiting for background work to finish", "timeout", shutdownTimeout.String())
+	select {
+	case err := <-done:
+		if err != nil {
+			slog.Error("Service stopped with error", "err", err)
+			return
 		}
+		slog.Info("Service stopped")
+	case <-time.After(shutdownTimeout):
+		slog.Warn("Background work did not finish in time, stopping anyway")
 	}
 }
 
+// creates the http server incl. authentication and all routes
+func (a *App) setupEchoServer(sources est.Sources, fwControllers *FirmwareTenantControllers) {
+	a.echoServer = echo.New()
+	setDefaultContextHandler(a.echoServer, a.c8ymicroservice)
+	provider := c8yauth.NewAuthProvider(a.c8ymicroservice.Client)
+	a.echoServer.Use(c8yauth.AuthenticationBasic(provider))
+	a.echoServer.Use(c8yauth.AuthenticationBearer(provider))
+	a.setRouters(sources, fwControllers)
+}
+
 func setDefaultContextHandler(e *echo.Echo, c8yms *microservice.Microservice) {
 	// Add Custom Context
 	e.Use(func(h echo.HandlerFunc) echo.HandlerFunc {
@@ -266,8 +573,47 @@ func setDefaultContextHandler(e *echo.Echo, c8yms *microservice.Microservice) {
 	})
 }
 
-func (a *App) setRouters(estClient *est.ExternalStorageClient) {
+func (a *App) setRouters(sources est.Sources, fwControllers *FirmwareTenantControllers) {
 	server := a.echoServer
-	handlers.RegisterFirmwareHandler(server, estClient)
+	handlers.RegisterFirmwareHandler(server, fwControllers.Source, readDeviceTypeCheckFromTenantOptions(a.c8ymicroservice.Client))
+	// index files are generated and firmware is published in the primary source
+	source := sources.Primary()
+	handlers.RegisterStatusHandler(server, func(tenantIds ...string) any {
+		return fwControllers.SyncStatus(tenantIds...)
+	}, fwControllers.SetPaused, fwControllers.Cleanup)
+	handlers.RegisterIndexHandler(server, func(ctx context.Context, prefix string, write bool) (any, error) {
+		proposal, err := GenerateIndex(ctx, source, prefix)
+		if err != nil || !write || len(proposal.Versions) == 0 {
+			return proposal, err
+		}
+		if err := proposal.Write(ctx, source.Client); err != nil {
+			return nil, err
+		}
+		fwControllers.TriggerSync("index files generated")
+		return proposal, nil
+	})
+	uploadPrefix := readUploadPrefixFromTenantOptions(a.c8ymicroservice.Client)
+	handlers.RegisterPublishHandler(server, func(ctx context.Context, req model.PublishRequest, body io.Reader, size int64) (any, error) {
+		entry, err := PublishFirmwareVersion(ctx, source, uploadPrefix, req, body, size)
+		if err != nil {
+			return nil, err
+		}
+		fwControllers.TriggerSync("firmware version published")
+		return entry, nil
+	}, func(ctx context.Context, req model.PublishRequest) (any, error) {
+		return PrepareFirmwareUpload(ctx, source, uploadPrefix, req)
+	}, func(ctx context.Context, req model.PublishRequest) (any, error) {
+		entry, err := CompleteFirmwareUpload(ctx, source, uploadPrefix, req)
+		if err != nil {
+			return nil, err
+		}
+		fwControllers.TriggerSync("firmware upload completed")
+		return entry, nil
+	})
+	if secret := readWebhookSecretFromTenantOptions(a.c8ymicroservice.Client); len(secret) > 0 {
+		handlers.RegisterEventHandlers(server, secret, sources, fwControllers.HandleStorageEvents, fwControllers.TriggerSync)
+	} else {
+		slog.Info("No webhook secret configured, webhook endpoints are disabled")
+	}
 	a.c8ymicroservice.AddHealthEndpointHandlers(server)
 }
@@ -0,0 +1,1101 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kobu/c8y-devmgmt-repo-intgr/internal/c8ytest"
+	"github.com/kobu/c8y-devmgmt-repo-intgr/internal/model"
+	est "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/externalstorage"
+	s "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/static"
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+	"github.com/reubenmiller/go-c8y/pkg/microservice"
+)
+
+// End-to-end scenarios running the service against a fake Cumulocity (see internal/c8ytest) and the memory storage provider
+
+const (
+	testServiceTenant = "t100"
+	testContextPath   = "c8y-devmgmt-repo-intgr"
+	testVersionsIndex = `{"key": "fw-1_1.0.0.zip", "name": "fw 1", "version": "1.0.0"}
+{"key": "fw-1_1.0.1.zip", "name": "fw 1", "version": "1.0.1"}`
+	testInfoIndex = `{"name": "fw 1", "description": "fw 1 description", "deviceType": "c8y_Linux"}
+{"name": "fw 2", "description": "fw 2 description"}`
+)
+
+func init() {
+	est.RegisterMemoryProvider()
+}
+
+type testEnv struct {
+	t       *testing.T
+	c8y     *c8ytest.Server
+	app     *App
+	sources est.Sources
+	// client of the primary source
+	storage     *est.MemoryClient
+	controllers *FirmwareTenantControllers
+}
+
+// starts a fake Cumulocity whose service tenant is configured with the given tenant options (next to the memory storage provider)
+func newTestEnv(t *testing.T, options map[string]string) *testEnv {
+	fake := c8ytest.NewServer(t, testServiceTenant, testContextPath)
+	fake.SetBootstrapEnv(t)
+	connectionDetails, _ := json.Marshal(est.MemoryConnectionDetails{
+		BucketName: "firmware",
+		BaseUrl:    "https://storage.example.com",
+		Objects: map[string]string{
+			s.INDEX_FILE_VERSIONS: testVersionsIndex,
+			s.INDEX_FILE_INFO:     testInfoIndex,
+		},
+	})
+	fake.SetOption(testServiceTenant, s.TOPT_CATEGORY, s.TOPT_FW_STORAGE_PROVIDER_KEY, "memory")
+	fake.SetOption(testServiceTenant, s.TOPT_CATEGORY, "fwMemoryConnectionDetails", string(connectionDetails))
+	for key, value := range options {
+		fake.SetOption(testServiceTenant, s.TOPT_CATEGORY, key, value)
+	}
+
+	ms := &microservice.Microservice{Client: fake.NewClient()}
+	sources, err := CreateStorageSourcesFromTenantOptions(ms)
+	if err != nil {
+		t.Fatalf("could not create storage sources: %s", err)
+	}
+	env := &testEnv{
+		t:           t,
+		c8y:         fake,
+		app:         &App{c8ymicroservice: ms},
+		sources:     sources,
+		storage:     est.Unwrap(sources.Primary().Client).(*est.MemoryClient),
+		controllers: newFirmwareTenantControllers(ms.Client.Context.ServiceUserContext(testServiceTenant, false), ms.Client, sources),
+	}
+	env.app.setupEchoServer(env.sources, env.controllers)
+	return env
+}
+
+// subscribes the tenants and registers their controllers, as done by the periodic subscription check
+func (env *testEnv) subscribe(tenantIds ...string) []string {
+	for _, tenantId := range tenantIds {
+		env.c8y.Subscribe(tenantId)
+	}
+	return syncSubscriptionsWithTenantControllers(env.app.c8ymicroservice.Client, env.sources, env.controllers, testContextPath)
+}
+
+func (env *testEnv) sync() *SyncRunReport {
+	report := env.controllers.SyncTenantsWithIndexFiles(context.Background(), env.controllers.TenantIds())
+	if report == nil {
+		env.t.Fatal("synchronization did not run")
+	}
+	return report
+}
+
+func (env *testEnv) setVersionsIndex(content string) {
+	env.storage.Put(s.INDEX_FILE_VERSIONS, []byte(content))
+}
+
+// returns the firmware versions created by the service, key = <name>@<version>
+func (env *testEnv) versions(tenantId string) map[string]map[string]any {
+	res := make(map[string]map[string]any)
+	for _, mo := range env.c8y.ManagedObjects(tenantId, "type eq c8y_FirmwareBinary and has(externalResourceOrigin)") {
+		res[mo["name"].(string)+"@"+mo["c8y_Firmware"].(map[string]any)["version"].(string)] = mo
+	}
+	return res
+}
+
+// returns the firmware objects, key = name
+func (env *testEnv) firmwares(tenantId string) map[string]map[string]any {
+	res := make(map[string]map[string]any)
+	for _, mo := range env.c8y.ManagedObjects(tenantId, "type eq c8y_Firmware") {
+		res[mo["name"].(string)] = mo
+	}
+	return res
+}
+
+// adds a device user and the device managed object it owns
+func (env *testEnv) addDevice(tenantId string, username string, device map[string]any) c8ytest.User {
+	user := c8ytest.User{Username: username, Password: "device-secret", Roles: []string{"ROLE_DEVICE"}}
+	env.c8y.AddUser(tenantId, user)
+	env.c8y.CreateDevice(tenantId, username, device)
+	return user
+}
+
+func (env *testEnv) request(method string, target string, tenantId string, user c8ytest.User) *httptest.ResponseRecorder {
+	return env.requestWithBody(method, target, tenantId, user, "", nil)
+}
+
+func (env *testEnv) requestWithBody(method string, target string, tenantId string, user c8ytest.User, contentType string, body io.Reader) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, body)
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.SetBasicAuth(tenantId+"/"+user.Username, user.Password)
+	rec := httptest.NewRecorder()
+	env.app.echoServer.ServeHTTP(rec, req)
+	return rec
+}
+
+func assertKeys[V any](t *testing.T, what string, m map[string]V, keys ...string) {
+	t.Helper()
+	if len(m) != len(keys) {
+		t.Errorf("expected %s %v, got %d entries: %v", what, keys, len(m), m)
+		return
+	}
+	for _, key := range keys {
+		if _, ok := m[key]; !ok {
+			t.Errorf("expected %s %v, missing %s", what, keys, key)
+		}
+	}
+}
+
+func TestEndToEndSubscribeAndSync(t *testing.T) {
+	env := newTestEnv(t, nil)
+	registered := env.subscribe("t1", "t2")
+	if slices.Sort(registered); strings.Join(registered, ",") != "t1,t100,t2" {
+		t.Fatalf("expected all subscribed tenants to be registered, got %v", registered)
+	}
+
+	report := env.sync()
+	if report.Succeeded != 3 || report.Failed != 0 {
+		t.Fatalf("expected all tenants to be synchronized, got %+v", report)
+	}
+	for _, tenantId := range registered {
+		firmwares := env.firmwares(tenantId)
+		assertKeys(t, "firmwares", firmwares, "fw 1")
+		if deviceType := firmwares["fw 1"]["c8y_Filter"].(map[string]any)["type"]; deviceType != "c8y_Linux" {
+			t.Errorf("expected device type filter c8y_Linux, got %v", deviceType)
+		}
+		versions := env.versions(tenantId)
+		assertKeys(t, "versions", versions, "fw 1@1.0.0", "fw 1@1.0.1")
+		for _, version := range versions {
+			id := version["id"].(string)
+			expectedUrl := "https://" + tenantId + ".c8y.example.com/service/" + testContextPath + "/firmware/download?id=" + id
+			if url := version["c8y_Firmware"].(map[string]any)["url"]; url != expectedUrl {
+				t.Errorf("expected version url %s, got %v", expectedUrl, url)
+			}
+			if parents := version["additionParents"].(map[string]any)["references"].([]any); len(parents) != 1 {
+				t.Errorf("expected version %s to be assigned to its firmware, got parents %v", id, parents)
+			}
+		}
+		if states := env.c8y.ManagedObjects(tenantId, "type eq "+s.SYNC_STATE_TYPE); len(states) != 1 {
+			t.Errorf("expected the sync state to be persisted in tenant %s, got %v", tenantId, states)
+		}
+	}
+
+	// nothing changed, so no tenant needs to be synchronized again
+	if report := env.sync(); report.Unchanged != 3 {
+		t.Errorf("expected all tenants to be unchanged, got %+v", report)
+	}
+	// already registered tenants are not registered twice
+	if registered := env.subscribe(); len(registered) != 0 {
+		t.Errorf("expected no new tenants, got %v", registered)
+	}
+}
+
+func TestEndToEndSyncConcurrency(t *testing.T) {
+	env := newTestEnv(t, map[string]string{s.TOPT_FW_SYNC_CONCURRENCY: "2"})
+	env.subscribe("t1", "t2", "t3", "t4", "t5")
+	var mu sync.Mutex
+	inFlight := make(map[string]int)
+	maxTenants := 0
+	env.c8y.SetRequestHook(func(w http.ResponseWriter, r *http.Request, serve http.HandlerFunc) {
+		username, _, _ := r.BasicAuth()
+		tenantId, _, _ := strings.Cut(username, "/")
+		mu.Lock()
+		inFlight[tenantId]++
+		maxTenants = max(maxTenants, len(inFlight))
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		serve(w, r)
+		mu.Lock()
+		defer mu.Unlock()
+		if inFlight[tenantId]--; inFlight[tenantId] == 0 {
+			delete(inFlight, tenantId)
+		}
+	})
+
+	report := env.sync()
+	if len(report.Tenants) != 6 || report.Failed != 0 {
+		t.Fatalf("expected all tenants to be synchronized, got %+v", report)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if maxTenants != 2 {
+		t.Errorf("expected 2 tenants to be synchronized at the same time, got %d", maxTenants)
+	}
+}
+
+func TestEndToEndIndexChanges(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.subscribe()
+	env.sync()
+	removedId := env.versions(testServiceTenant)["fw 1@1.0.0"]["id"].(string)
+
+	// version removed, version and firmware added
+	env.setVersionsIndex(`{"key": "fw-1_1.0.1.zip", "name": "fw 1", "version": "1.0.1"}
+{"key": "fw-1_1.0.2.zip", "name": "fw 1", "version": "1.0.2"}
+{"key": "fw-2_2.0.0.zip", "name": "fw 2", "version": "2.0.0"}`)
+	report := env.sync()
+	if result := report.Tenants[0]; result.Created != 2 || result.Deleted != 1 || !result.Success() {
+		t.Errorf("expected 2 created and 1 deleted version, got %+v", result)
+	}
+	assertKeys(t, "versions", env.versions(testServiceTenant), "fw 1@1.0.1", "fw 1@1.0.2", "fw 2@2.0.0")
+	assertKeys(t, "firmwares", env.firmwares(testServiceTenant), "fw 1", "fw 2")
+	if _, ok := env.c8y.ManagedObject(testServiceTenant, removedId); ok {
+		t.Errorf("expected removed version %s to be deleted", removedId)
+	}
+
+	// firmware without any versions left is deleted as well
+	env.setVersionsIndex(`{"key": "fw-1_1.0.1.zip", "name": "fw 1", "version": "1.0.1"}`)
+	env.sync()
+	assertKeys(t, "versions", env.versions(testServiceTenant), "fw 1@1.0.1")
+	assertKeys(t, "firmwares", env.firmwares(testServiceTenant), "fw 1")
+
+	// versions installed on devices are kept, an alarm informs about the deferred removal
+	env.c8y.CreateManagedObject(testServiceTenant, map[string]any{
+		"name":         "device 1",
+		"c8y_IsDevice": map[string]any{},
+		"c8y_Firmware": map[string]any{"name": "fw 1", "version": "1.0.1"},
+	})
+	env.setVersionsIndex(`{"key": "fw-1_1.0.2.zip", "name": "fw 1", "version": "1.0.2"}`)
+	report = env.sync()
+	if result := report.Tenants[0]; result.Deferred != 1 {
+		t.Errorf("expected the removal to be deferred, got %+v", result)
+	}
+	assertKeys(t, "versions", env.versions(testServiceTenant), "fw 1@1.0.1", "fw 1@1.0.2")
+	alarms := env.c8y.Alarms(testServiceTenant)
+	if len(alarms) != 1 || alarms[0]["type"] != s.ALARM_TYPE_REMOVAL_BLOCKED || alarms[0]["status"] != "ACTIVE" {
+		t.Errorf("expected an active %s alarm, got %v", s.ALARM_TYPE_REMOVAL_BLOCKED, alarms)
+	}
+}
+
+func TestEndToEndManualVersionNotDuplicated(t *testing.T) {
+	env := newTestEnv(t, map[string]string{s.TOPT_FW_FORCE_RESYNC_INTERVAL_MINS: "0"})
+	env.subscribe("t1")
+	// firmware version created manually in the tenant, with the same name and version as an index entry
+	fwId := env.c8y.CreateManagedObject("t1", map[string]any{"name": "fw 1", "type": "c8y_Firmware"})
+	versionId := env.c8y.CreateManagedObject("t1", map[string]any{
+		"name":         "fw 1",
+		"type":         "c8y_FirmwareBinary",
+		"c8y_Firmware": map[string]any{"version": "1.0.0", "url": "https://example.com/manual.zip"},
+	})
+	env.c8y.AddChildAddition("t1", fwId, versionId)
+
+	for range 2 {
+		if report := env.sync(); report.Failed != 0 {
+			t.Fatalf("unexpected failed synchronization %+v", report)
+		}
+		versions := env.c8y.ManagedObjects("t1", "type eq c8y_FirmwareBinary")
+		if len(versions) != 2 {
+			t.Fatalf("expected the manual version not to be duplicated, got %v", versions)
+		}
+		if _, ok := env.c8y.ManagedObject("t1", versionId); !ok {
+			t.Fatal("expected the manual version to be kept")
+		}
+	}
+	assertKeys(t, "firmware versions created by the service", env.versions("t1"), "fw 1@1.0.1")
+}
+
+func TestEndToEndClearRemovalBlockedAlarm(t *testing.T) {
+	env := newTestEnv(t, map[string]string{s.TOPT_FW_DELETION_MODE: s.DELETION_MODE_ARCHIVE})
+	env.subscribe()
+	env.sync()
+	deviceId := env.c8y.CreateManagedObject(testServiceTenant, map[string]any{
+		"name":         "device 1",
+		"c8y_IsDevice": map[string]any{},
+		"c8y_Firmware": map[string]any{"name": "fw 1", "version": "1.0.0"},
+	})
+	versionId := env.versions(testServiceTenant)["fw 1@1.0.0"]["id"].(string)
+	env.setVersionsIndex(`{"key": "fw-1_1.0.1.zip", "name": "fw 1", "version": "1.0.1"}`)
+	env.sync()
+	// alarm of another application on the same version
+	client := env.app.c8ymicroservice.Client
+	ctx := client.Context.ServiceUserContext(testServiceTenant, false)
+	if _, _, err := client.Alarm.Create(ctx, c8y.Alarm{Source: &c8y.Source{ID: versionId}, Type: "c8y_OtherAlarm", Severity: c8y.AlarmSeverityMajor, Text: "other", Time: c8y.NewTimestamp()}); err != nil {
+		t.Fatalf("could not create alarm: %s", err)
+	}
+
+	// once the version is not installed anymore, it is archived and only the alarm of the service is cleared
+	if _, _, err := client.Inventory.Update(ctx, deviceId, map[string]any{"c8y_Firmware": map[string]any{"name": "fw 1", "version": "1.0.1"}}); err != nil {
+		t.Fatalf("could not update device: %s", err)
+	}
+	if result := env.sync().Tenants[0]; result.Archived != 1 {
+		t.Fatalf("expected the version to be archived, got %+v", result)
+	}
+	statuses := make(map[string]any)
+	for _, alarm := range env.c8y.Alarms(testServiceTenant) {
+		statuses[alarm["type"].(string)] = alarm["status"]
+	}
+	if statuses[s.ALARM_TYPE_REMOVAL_BLOCKED] != "CLEARED" || statuses["c8y_OtherAlarm"] != "ACTIVE" {
+		t.Errorf("expected only the removal blocked alarm to be cleared, got %v", statuses)
+	}
+}
+
+func TestEndToEndUnsubscribe(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.subscribe("t1")
+	env.sync()
+
+	env.c8y.Unsubscribe("t1")
+	env.subscribe()
+	if _, ok := env.controllers.Get("t1"); ok {
+		t.Error("expected controller of unsubscribed tenant to be unregistered")
+	}
+	if report := env.sync(); len(report.Tenants) != 1 || report.Tenants[0].TenantId != testServiceTenant {
+		t.Errorf("expected only the service tenant to be synchronized, got %+v", report.Tenants)
+	}
+}
+
+func TestEndToEndSyncStateNotReadable(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.subscribe("t1")
+	env.sync()
+	env.controllers.Unregister("t1")
+
+	// the persisted sync state of the tenant can't be read temporarily
+	env.c8y.SetRequestHook(func(w http.ResponseWriter, r *http.Request, serve http.HandlerFunc) {
+		if r.URL.Query().Get("type") == s.SYNC_STATE_TYPE {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		serve(w, r)
+	})
+	if registered := env.subscribe(); len(registered) != 0 {
+		t.Fatalf("expected tenant not to be registered without its sync state, got %v", registered)
+	}
+	env.c8y.SetRequestHook(nil)
+	if registered := env.subscribe(); !slices.Equal(registered, []string{"t1"}) {
+		t.Fatalf("expected tenant to be registered once its sync state is readable, got %v", registered)
+	}
+	env.sync()
+	if states := env.c8y.ManagedObjects("t1", "type eq "+s.SYNC_STATE_TYPE); len(states) != 1 {
+		t.Errorf("expected a single sync state, got %v", states)
+	}
+}
+
+// counts how often the versions index file is checked for changes
+type indexStatCounter struct {
+	est.ExternalStorageClient
+	stats atomic.Int32
+}
+
+func (c *indexStatCounter) Stat(ctx context.Context, objectKey string) (est.ObjectInfo, error) {
+	if objectKey == s.INDEX_FILE_VERSIONS {
+		c.stats.Add(1)
+	}
+	return c.ExternalStorageClient.Stat(ctx, objectKey)
+}
+
+func TestEndToEndStaggeredSync(t *testing.T) {
+	env := newTestEnv(t, nil)
+	registered := env.subscribe("t1", "t2")
+	counter := &indexStatCounter{ExternalStorageClient: env.controllers.sources[0].Client}
+	env.controllers.sources[0].Client = counter
+
+	report := env.controllers.SyncTenantsStaggered(context.Background(), registered, time.Millisecond)
+	if report == nil || len(report.Tenants) != 3 || report.Failed != 0 {
+		t.Fatalf("expected all tenants to be reported by a single run, got %+v", report)
+	}
+	if stats := counter.stats.Load(); stats != 1 {
+		t.Errorf("expected the index files to be read once, got %d checks", stats)
+	}
+	if last := env.controllers.LastRunReport(); last != report {
+		t.Errorf("expected the staggered run to be the latest report, got %+v", last)
+	}
+	assertKeys(t, "firmware versions", env.versions("t2"), "fw 1@1.0.0", "fw 1@1.0.1")
+}
+
+func TestEndToEndEmptySubscriptionList(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.subscribe("t1")
+
+	env.c8y.Unsubscribe("t1")
+	env.c8y.Unsubscribe(testServiceTenant)
+	env.subscribe()
+	if ids := env.controllers.TenantIds(); len(ids) != 2 {
+		t.Errorf("expected tenants to be kept on a single empty subscription list, got %v", ids)
+	}
+	env.c8y.Subscribe(testServiceTenant)
+	env.subscribe()
+	env.c8y.Unsubscribe(testServiceTenant)
+	env.subscribe()
+	if _, ok := env.controllers.Get(testServiceTenant); !ok {
+		t.Error("expected the count of empty subscription lists to be reset by a non-empty one")
+	}
+	env.subscribe()
+	if ids := env.controllers.TenantIds(); len(ids) != 0 {
+		t.Errorf("expected tenants to be unregistered on the second empty subscription list in a row, got %v", ids)
+	}
+}
+
+func TestEndToEndCleanupBeforeUnsubscribe(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.subscribe("t1", "t2")
+	env.sync()
+	admin := c8ytest.User{Username: "admin", Password: "admin-secret", Roles: []string{"ROLE_INVENTORY_ADMIN"}}
+	env.c8y.AddUser("t1", admin)
+	// version created manually below the firmware created by the service
+	fwId := env.firmwares("t1")["fw 1"]["id"].(string)
+	manualId := env.c8y.CreateManagedObject("t1", map[string]any{"name": "fw 1", "type": "c8y_FirmwareBinary", "c8y_Firmware": map[string]any{"version": "0.9.0"}})
+	env.c8y.AddChildAddition("t1", fwId, manualId)
+
+	if rec := env.request(http.MethodPost, "/sync/tenants/t2/cleanup", "t1", admin); rec.Code != http.StatusForbidden {
+		t.Errorf("expected cleanup of another tenant to be rejected, got %d", rec.Code)
+	}
+	rec := env.request(http.MethodPost, "/sync/tenants/t1/cleanup", "t1", admin)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"removed":2`) {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+	assertKeys(t, "firmware versions", env.versions("t1"))
+	// the firmware still holds the manual version
+	if _, ok := env.c8y.ManagedObject("t1", fwId); !ok {
+		t.Error("expected firmware with manual version to be kept")
+	}
+	if _, ok := env.c8y.ManagedObject("t1", manualId); !ok {
+		t.Error("expected manual version to be kept")
+	}
+	assertKeys(t, "firmware versions of other tenant", env.versions("t2"), "fw 1@1.0.0", "fw 1@1.0.1")
+
+	// the pause is persisted, so the objects are not recreated after a restart either
+	env.controllers.Unregister("t1")
+	env.subscribe()
+	env.setVersionsIndex(testVersionsIndex + "\n" + `{"key": "fw-1_1.0.2.zip", "name": "fw 1", "version": "1.0.2"}`)
+	env.sync()
+	assertKeys(t, "firmware versions", env.versions("t1"))
+	if fc, ok := env.controllers.Get("t1"); !ok || !fc.SyncState().Paused {
+		t.Errorf("expected tenant to stay paused after the restart")
+	}
+
+	// resuming synchronizes the tenant again
+	env.controllers.SetPaused("t1", false)
+	env.sync()
+	assertKeys(t, "firmware versions", env.versions("t1"), "fw 1@1.0.0", "fw 1@1.0.1", "fw 1@1.0.2")
+}
+
+func TestEndToEndCleanupOnUnsubscribe(t *testing.T) {
+	env := newTestEnv(t, map[string]string{s.TOPT_FW_CLEANUP_ON_UNSUBSCRIBE: "true"})
+	env.subscribe("t1", "t2")
+	env.sync()
+
+	env.c8y.UnsubscribeKeepingServiceUser("t1")
+	env.subscribe()
+	if _, ok := env.controllers.Get("t1"); ok {
+		t.Error("expected controller of unsubscribed tenant to be unregistered")
+	}
+	assertKeys(t, "firmwares", env.firmwares("t1"))
+	assertKeys(t, "firmware versions", env.versions("t1"))
+	if objects := env.c8y.ManagedObjects("t1", "type eq "+s.SYNC_STATE_TYPE); len(objects) != 0 {
+		t.Errorf("expected sync state to be removed, got %v", objects)
+	}
+
+	// objects are left behind once the credentials of the service user are invalid
+	env.c8y.Unsubscribe("t2")
+	env.subscribe()
+	if _, ok := env.controllers.Get("t2"); ok {
+		t.Error("expected controller of unsubscribed tenant to be unregistered")
+	}
+	assertKeys(t, "firmware versions", env.versions("t2"), "fw 1@1.0.0", "fw 1@1.0.1")
+}
+
+func TestEndToEndDownloadRedirect(t *testing.T) {
+	env := newTestEnv(t, map[string]string{s.TOPT_FW_DELETION_MODE: s.DELETION_MODE_ARCHIVE})
+	env.subscribe("t1")
+	env.sync()
+	device := env.addDevice("t1", "device_1", map[string]any{"type": "c8y_Linux"})
+	versions := env.versions("t1")
+	id := versions["fw 1@1.0.0"]["id"].(string)
+
+	rec := env.request(http.MethodGet, "/firmware/download?id="+id, "t1", device)
+	if rec.Code != http.StatusTemporaryRedirect || !strings.HasPrefix(rec.Header().Get("Location"), "https://storage.example.com/fw-1_1.0.0.zip?expires=") {
+		t.Errorf("expected redirect to the storage, got %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+	// versions of other tenants are not visible
+	if rec := env.request(http.MethodGet, "/firmware/download?id="+env.versions(testServiceTenant)["fw 1@1.0.0"]["id"].(string), "t1", device); rec.Code != http.StatusNotFound {
+		t.Errorf("expected version of other tenant not to be found, got %d", rec.Code)
+	}
+	if rec := env.request(http.MethodGet, "/firmware/download?id="+id, "t1", c8ytest.User{Username: "device_1", Password: "wrong"}); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected invalid credentials to be rejected, got %d", rec.Code)
+	}
+	user := c8ytest.User{Username: "user", Password: "user-secret", Roles: []string{"ROLE_INVENTORY_READ"}}
+	env.c8y.AddUser("t1", user)
+	if rec := env.request(http.MethodGet, "/firmware/download?id="+id, "t1", user); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected users without device role to be rejected, got %d", rec.Code)
+	}
+
+	// archived versions can't be downloaded anymore
+	env.setVersionsIndex(`{"key": "fw-1_1.0.1.zip", "name": "fw 1", "version": "1.0.1"}`)
+	env.sync()
+	if rec := env.request(http.MethodGet, "/firmware/download?id="+id, "t1", device); rec.Code != http.StatusGone {
+		t.Errorf("expected archived version to be gone, got %d", rec.Code)
+	}
+	if children := env.c8y.ChildAdditions("t1", versions["fw 1@1.0.0"]["additionParents"].(map[string]any)["references"].([]any)[0].(map[string]any)["managedObject"].(map[string]any)["id"].(string)); len(children) != 1 {
+		t.Errorf("expected archived version to be detached from its firmware, got children %v", children)
+	}
+}
+
+func TestEndToEndArchiveAndRestore(t *testing.T) {
+	env := newTestEnv(t, map[string]string{s.TOPT_FW_DELETION_MODE: s.DELETION_MODE_ARCHIVE})
+	env.subscribe("t1")
+	env.sync()
+	fwId := env.firmwares("t1")["fw 1"]["id"].(string)
+	versionIds := []string{env.versions("t1")["fw 1@1.0.0"]["id"].(string), env.versions("t1")["fw 1@1.0.1"]["id"].(string)}
+
+	// archiving all versions marks the emptied firmware as archived as well
+	env.setVersionsIndex(`{"key": "fw-2_2.0.0.zip", "name": "fw 2", "version": "2.0.0"}`)
+	if result := env.sync().Tenants[0]; result.Archived != 2 {
+		t.Fatalf("expected both versions to be archived, got %+v", result)
+	}
+	if fw := env.firmwares("t1")["fw 1"]; fw[s.FRAGMENT_ARCHIVED] == nil {
+		t.Fatalf("expected emptied firmware to be archived, got %v", fw)
+	}
+
+	// the restored version and its firmware lose the marker, the version is assigned to the firmware again
+	env.setVersionsIndex(testVersionsIndex)
+	if result := env.sync().Tenants[0]; result.Restored != 2 {
+		t.Fatalf("expected both versions to be restored, got %+v", result)
+	}
+	if fw := env.firmwares("t1")["fw 1"]; fw["id"] != fwId || fw[s.FRAGMENT_ARCHIVED] != nil {
+		t.Errorf("expected firmware to be restored, got %v", fw)
+	}
+	for _, versionId := range versionIds {
+		if version, _ := env.c8y.ManagedObject("t1", versionId); version[s.FRAGMENT_ARCHIVED] != nil {
+			t.Errorf("expected version to be restored, got %v", version)
+		}
+	}
+	if children := env.c8y.ChildAdditions("t1", fwId); len(children) != 2 {
+		t.Errorf("expected restored versions to be assigned to the firmware, got %v", children)
+	}
+}
+
+func TestEndToEndGenerateIndex(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.subscribe("t1")
+	env.storage.Put("fw-2/fw-2_2.0.0.zip", []byte("binary"))
+	admin := c8ytest.User{Username: "admin", Password: "admin-secret", Roles: []string{"ROLE_INVENTORY_ADMIN"}}
+	env.c8y.AddUser(testServiceTenant, admin)
+	env.c8y.AddUser("t1", admin)
+
+	// the storage is shared, so subscribed tenants must not change the index files
+	if rec := env.request(http.MethodPost, "/index/generate?write=true", "t1", admin); rec.Code != http.StatusForbidden {
+		t.Errorf("expected users of subscribed tenants to be rejected, got %d", rec.Code)
+	}
+	rec := env.request(http.MethodPost, "/index/generate?prefix=fw-2/", testServiceTenant, admin)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"versions":[{"key":"fw-2/fw-2_2.0.0.zip","name":"fw 2","version":"2.0.0"}]`) || !strings.Contains(rec.Body.String(), `"written":false`) {
+		t.Errorf("unexpected proposal %d: %s", rec.Code, rec.Body.String())
+	}
+	if content, _ := est.ReadObjectAsString(context.Background(), env.storage, s.INDEX_FILE_VERSIONS); content != testVersionsIndex {
+		t.Errorf("expected index file not to be written without write=true, got %s", content)
+	}
+
+	if rec := env.request(http.MethodPost, "/index/generate?prefix=fw-2/&write=true", testServiceTenant, admin); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"written":true`) {
+		t.Errorf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+	env.sync()
+	assertKeys(t, "firmware versions", env.versions("t1"), "fw 1@1.0.0", "fw 1@1.0.1", "fw 2@2.0.0")
+}
+
+// multipart form of the publish API, the binary is added as last part
+func publishForm(fields map[string]string, fileName string, content string) (string, io.Reader) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for _, key := range slices.Sorted(maps.Keys(fields)) {
+		form.WriteField(key, fields[key])
+	}
+	if len(fileName) > 0 {
+		file, _ := form.CreateFormFile("file", fileName)
+		io.WriteString(file, content)
+	}
+	form.Close()
+	return form.FormDataContentType(), &body
+}
+
+func TestEndToEndPublish(t *testing.T) {
+	env := newTestEnv(t, map[string]string{s.TOPT_FW_UPLOAD_PREFIX: "ci"})
+	env.subscribe("t1")
+	admin := c8ytest.User{Username: "ci", Password: "ci-secret", Roles: []string{"ROLE_INVENTORY_ADMIN"}}
+	env.c8y.AddUser(testServiceTenant, admin)
+	env.c8y.AddUser("t1", admin)
+	publish := func(tenantId string, fields map[string]string, fileName string) *httptest.ResponseRecorder {
+		contentType, body := publishForm(fields, fileName, "binary of "+fields["version"])
+		return env.requestWithBody(http.MethodPost, "/firmware/publish", tenantId, admin, contentType, body)
+	}
+	fields := map[string]string{"name": "fw 3", "version": "3.0.0", "deviceType": "c8y_Linux", "description": "published by CI"}
+
+	if rec := publish("t1", fields, "fw3.bin"); rec.Code != http.StatusForbidden {
+		t.Errorf("expected users of subscribed tenants to be rejected, got %d", rec.Code)
+	}
+	rec := publish(testServiceTenant, fields, "C:\\build\\fw3.bin")
+	if rec.Code != http.StatusCreated || !strings.Contains(rec.Body.String(), `"key":"ci/fw-3-3b9e2d1a/3.0.0/fw3.bin"`) {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+	if content, err := est.ReadObjectAsString(context.Background(), env.storage, "ci/fw-3-3b9e2d1a/3.0.0/fw3.bin"); err != nil || content != "binary of 3.0.0" {
+		t.Errorf("unexpected object %q: %v", content, err)
+	}
+	info, _ := est.ReadObjectAsString(context.Background(), env.storage, s.INDEX_FILE_INFO)
+	if entry := ParseExtFwInfoContents(info)["fw 3"]; entry.DeviceType != "c8y_Linux" || entry.Description != "published by CI" {
+		t.Errorf("expected firmware to be added to the info file, got %s", info)
+	}
+
+	if rec := publish(testServiceTenant, fields, "fw3.bin"); rec.Code != http.StatusConflict {
+		t.Errorf("expected publishing the same version again to fail, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := publish(testServiceTenant, map[string]string{"name": "fw 3"}, "fw3.bin"); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "missing mandatory fields [version]") {
+		t.Errorf("expected missing version to be rejected, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := publish(testServiceTenant, map[string]string{"name": "fw 3", "version": "3.0.1"}, ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected missing file to be rejected, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	env.sync()
+	assertKeys(t, "firmware versions", env.versions("t1"), "fw 1@1.0.0", "fw 1@1.0.1", "fw 3@3.0.0")
+}
+
+func TestRegisterIndexEntryRetriesOnConcurrentChange(t *testing.T) {
+	storage := est.NewMemoryClient(est.MemoryConnectionDetails{BucketName: "firmware", Objects: map[string]string{
+		s.INDEX_FILE_VERSIONS: testVersionsIndex,
+		s.INDEX_FILE_INFO:     testInfoIndex,
+	}}, 1)
+	// changes the versions file between reading and writing it (once)
+	concurrent := &concurrentWriter{MemoryClient: storage}
+	entry := ExtFirmwareVersionEntry{Key: "fw-1_1.0.2.zip", Name: "fw 1", Version: "1.0.2"}
+	if err := registerIndexEntry(context.Background(), est.Source{Client: concurrent}, entry, ExtFirmwareInfoEntry{Name: "fw 1"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	versions, _ := est.ReadObjectAsString(context.Background(), storage, s.INDEX_FILE_VERSIONS)
+	if entries := ParseExtFwVersionContents(versions); len(entries) != 4 || entries[2].Version != "2.0.0" || entries[3].Version != "1.0.2" {
+		t.Errorf("expected concurrent change to be kept, got %s", versions)
+	}
+}
+
+func TestObjectKeyForPublishedVersion(t *testing.T) {
+	tests := []struct {
+		req  model.PublishRequest
+		want string
+	}{
+		{req: model.PublishRequest{Name: "fw-1", Version: "1.0.0", FileName: "fw.bin"}, want: "ci/fw-1/1.0.0/fw.bin"},
+		{req: model.PublishRequest{Name: "fw 1", Version: "1.0.0", FileName: "fw.bin"}, want: "ci/fw-1-242f393f/1.0.0/fw.bin"},
+		{req: model.PublishRequest{Name: "fw/1", Version: "1.0.0", FileName: "fw.bin"}, want: "ci/fw-1-5e185fd9/1.0.0/fw.bin"},
+		{req: model.PublishRequest{Name: "fw-1", Version: "1.0.0"}, want: "ci/fw-1/1.0.0/fw-1_1.0.0"},
+	}
+	for _, tt := range tests {
+		if got := objectKeyForPublishedVersion("ci/", tt.req); got != tt.want {
+			t.Errorf("objectKeyForPublishedVersion(%+v) = %s, want %s", tt.req, got, tt.want)
+		}
+	}
+}
+
+// fails writing the index files
+type failingIndexWriter struct {
+	*est.MemoryClient
+}
+
+func (w *failingIndexWriter) Write(ctx context.Context, objectKey string, body io.Reader, size int64, opts est.WriteOptions) (est.ObjectInfo, error) {
+	if objectKey == s.INDEX_FILE_VERSIONS || objectKey == s.INDEX_FILE_INFO {
+		return est.ObjectInfo{}, errors.New("storage unavailable")
+	}
+	return w.MemoryClient.Write(ctx, objectKey, body, size, opts)
+}
+
+func TestPublishFirmwareVersionRemovesObjectOnRegistrationFailure(t *testing.T) {
+	storage := est.NewMemoryClient(est.MemoryConnectionDetails{BucketName: "firmware", Objects: map[string]string{
+		s.INDEX_FILE_VERSIONS: testVersionsIndex,
+		s.INDEX_FILE_INFO:     testInfoIndex,
+	}}, 1)
+	source := est.Source{Client: &failingIndexWriter{MemoryClient: storage}}
+	req := model.PublishRequest{Name: "fw-3", Version: "3.0.0", FileName: "fw.bin"}
+	if _, err := PublishFirmwareVersion(context.Background(), source, "ci/", req, strings.NewReader("binary"), -1); err == nil {
+		t.Fatal("expected publishing to fail")
+	}
+	if _, err := storage.Stat(context.Background(), "ci/fw-3/3.0.0/fw.bin"); !errors.Is(err, est.ErrNotFound) {
+		t.Errorf("expected uploaded object to be removed, got %v", err)
+	}
+
+	// publishing can be retried
+	source.Client = storage
+	if _, err := PublishFirmwareVersion(context.Background(), source, "ci/", req, strings.NewReader("binary"), -1); err != nil {
+		t.Errorf("expected publishing to succeed once the index files can be written, got %v", err)
+	}
+}
+
+type concurrentWriter struct {
+	*est.MemoryClient
+	changed bool
+}
+
+func (w *concurrentWriter) Write(ctx context.Context, objectKey string, body io.Reader, size int64, opts est.WriteOptions) (est.ObjectInfo, error) {
+	if !w.changed && objectKey == s.INDEX_FILE_VERSIONS {
+		w.changed = true
+		w.Put(objectKey, []byte(testVersionsIndex+"\n"+`{"key": "fw-2_2.0.0.zip", "name": "fw 2", "version": "2.0.0"}`))
+	}
+	return w.MemoryClient.Write(ctx, objectKey, body, size, opts)
+}
+
+func TestEndToEndPresignedUpload(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.subscribe("t1")
+	ci := c8ytest.User{Username: "ci", Password: "ci-secret", Roles: []string{"ROLE_FIRMWARE_REPO_PUBLISH"}}
+	admin := c8ytest.User{Username: "admin", Password: "admin-secret", Roles: []string{"ROLE_INVENTORY_ADMIN"}}
+	env.c8y.AddUser(testServiceTenant, ci)
+	env.c8y.AddUser(testServiceTenant, admin)
+	request := func(target string, user c8ytest.User, body string) *httptest.ResponseRecorder {
+		return env.requestWithBody(http.MethodPost, target, testServiceTenant, user, "application/json", strings.NewReader(body))
+	}
+	body := `{"name": "fw 3", "version": "3.0.0", "fileName": "fw3.img", "deviceType": "c8y_Linux", "size": 5}`
+
+	if rec := request("/firmware/uploads", admin, body); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected users without the publish role to be rejected, got %d", rec.Code)
+	}
+	rec := request("/firmware/uploads", ci, body)
+	upload := FirmwareUpload{}
+	json.Unmarshal(rec.Body.Bytes(), &upload)
+	if rec.Code != http.StatusOK || upload.Key != "uploads/fw-3-3b9e2d1a/3.0.0/fw3.img" || upload.Upload.Method != http.MethodPut ||
+		!strings.HasPrefix(upload.Upload.URL, "https://storage.example.com/uploads/fw-3-3b9e2d1a/3.0.0/fw3.img?upload=true") {
+		t.Fatalf("unexpected upload %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := request("/firmware/uploads/complete", ci, body); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "was not uploaded") {
+		t.Errorf("expected completion without upload to fail, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := request("/firmware/uploads", ci, `{"name": "fw 3", "version": "3.0.0", "fileName": "fw3.img"}`); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "size") {
+		t.Errorf("expected upload without size to be rejected, got %d: %s", rec.Code, rec.Body.String())
+	}
+	env.storage.Put(upload.Key, []byte("truncated image"))
+	if rec := request("/firmware/uploads/complete", ci, body); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "has 15 bytes instead of 5") {
+		t.Errorf("expected upload of a different size to be rejected, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if _, err := env.storage.Stat(context.Background(), upload.Key); !errors.Is(err, est.ErrNotFound) {
+		t.Errorf("expected upload of a different size to be removed, got %v", err)
+	}
+	env.storage.Put(upload.Key, []byte("image"))
+	if rec := request("/firmware/uploads/complete", ci, body); rec.Code != http.StatusCreated {
+		t.Fatalf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := request("/firmware/uploads", ci, body); rec.Code != http.StatusConflict {
+		t.Errorf("expected upload of indexed version to be rejected, got %d: %s", rec.Code, rec.Body.String())
+	}
+	// completing a published version again (with a wrong size) must not remove its object
+	if rec := request("/firmware/uploads/complete", ci, strings.Replace(body, `"size": 5`, `"size": 6`, 1)); rec.Code != http.StatusConflict {
+		t.Errorf("expected completion of indexed version to be rejected, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if content, err := est.ReadObjectAsString(context.Background(), env.storage, upload.Key); err != nil || content != "image" {
+		t.Errorf("expected object of the published version to be kept, got %q (%v)", content, err)
+	}
+
+	env.sync()
+	assertKeys(t, "firmware versions", env.versions("t1"), "fw 1@1.0.0", "fw 1@1.0.1", "fw 3@3.0.0")
+}
+
+func TestEndToEndMultipleSources(t *testing.T) {
+	env := newTestEnv(t, map[string]string{s.TOPT_FW_STORAGE_SOURCES: `[
+		{"id": "shared", "provider": "memory", "config": {"bucketName": "shared", "baseUrl": "https://shared.example.com", "objects": {
+			"c8y-firmware-versions.json": "{\"key\": \"fw-1_1.0.0.zip\", \"name\": \"fw 1\", \"version\": \"1.0.0\"}",
+			"c8y-firmware-info.json": "{\"name\": \"fw 1\", \"description\": \"fw 1 description\", \"deviceType\": \"c8y_Linux\"}"}}},
+		{"id": "vendor", "provider": "memory", "config": {"bucketName": "vendor", "baseUrl": "https://vendor.example.com", "objects": {
+			"c8y-firmware-versions.json": "{\"key\": \"vendor/fw-1_1.0.0.zip\", \"name\": \"fw 1\", \"version\": \"1.0.0\"}\n{\"key\": \"vendor/fw-1_1.0.2.zip\", \"name\": \"fw 1\", \"version\": \"1.0.2\"}\n{\"key\": \"vendor/fw-3_3.0.0.zip\", \"name\": \"fw 3\", \"version\": \"3.0.0\"}",
+			"c8y-firmware-info.json": "{\"name\": \"fw 1\", \"description\": \"vendor description\"}\n{\"name\": \"fw 3\", \"description\": \"fw 3 description\"}"}}}
+	]`})
+	if ids := strings.Join(env.sources.Ids(), ","); ids != "shared,vendor" || env.storage.GetBucketName() != "shared" {
+		t.Fatalf("expected sources shared and vendor, got %s", ids)
+	}
+	env.subscribe("t1")
+	report := env.sync()
+	if report.Failed != 0 {
+		t.Fatalf("expected all tenants to be synchronized, got %+v", report)
+	}
+	// the version and firmware of the shared source take precedence
+	expectedConflicts := []string{
+		"firmware 'fw 1' of source 'vendor' is shadowed by source 'shared'",
+		"version '1.0.0' of firmware 'fw 1' of source 'vendor' is shadowed by source 'shared'",
+	}
+	if !slices.Equal(report.Conflicts, expectedConflicts) {
+		t.Errorf("expected conflicts %v, got %v", expectedConflicts, report.Conflicts)
+	}
+	if description := env.firmwares("t1")["fw 1"]["description"]; description != "fw 1 description" {
+		t.Errorf("expected description of the shared source, got %v", description)
+	}
+	versions := env.versions("t1")
+	assertKeys(t, "versions", versions, "fw 1@1.0.0", "fw 1@1.0.2", "fw 3@3.0.0")
+	for key, expected := range map[string][2]string{
+		"fw 1@1.0.0": {"shared", "https://shared.example.com/fw-1_1.0.0.zip?expires="},
+		"fw 1@1.0.2": {"vendor", "https://vendor.example.com/vendor/fw-1_1.0.2.zip?expires="},
+	} {
+		origin := versions[key]["externalResourceOrigin"].(map[string]any)
+		if origin["source"] != expected[0] || origin["container"] != expected[0] {
+			t.Errorf("%s: expected origin of source %s, got %v", key, expected[0], origin)
+		}
+	}
+
+	// downloads are signed by the source of the version
+	device := env.addDevice("t1", "device_1", map[string]any{"type": "c8y_Linux"})
+	for key, expected := range map[string]string{
+		"fw 1@1.0.0": "https://shared.example.com/fw-1_1.0.0.zip?expires=",
+		"fw 1@1.0.2": "https://vendor.example.com/vendor/fw-1_1.0.2.zip?expires=",
+	} {
+		rec := env.request(http.MethodGet, "/firmware/download?id="+versions[key]["id"].(string), "t1", device)
+		if rec.Code != http.StatusTemporaryRedirect || !strings.HasPrefix(rec.Header().Get("Location"), expected) {
+			t.Errorf("%s: expected redirect to %s, got %d %s", key, expected, rec.Code, rec.Header().Get("Location"))
+		}
+	}
+
+	// versions of unknown sources (e.g. removed from the configuration) can't be downloaded
+	id := versions["fw 3@3.0.0"]["id"].(string)
+	client := env.app.c8ymicroservice.Client
+	origin := map[string]any{"externalResourceOrigin": ExternalResourceOrigin{ObjectKey: "vendor/fw-3_3.0.0.zip", Source: "removed"}}
+	if _, _, err := client.Inventory.Update(client.Context.ServiceUserContext("t1", false), id, origin); err != nil {
+		t.Fatalf("could not update origin: %s", err)
+	}
+	if rec := env.request(http.MethodGet, "/firmware/download?id="+id, "t1", device); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected version of unknown source to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestEndToEndIndexPrefix(t *testing.T) {
+	connectionDetails, _ := json.Marshal(est.MemoryConnectionDetails{
+		BucketName: "firmware",
+		BaseUrl:    "https://storage.example.com",
+		Objects: map[string]string{
+			// index files of another environment sharing the bucket
+			s.INDEX_FILE_VERSIONS:       testVersionsIndex,
+			s.INDEX_FILE_INFO:           testInfoIndex,
+			"prod/versions.jsonl":       `{"key": "fw-3/fw-3_3.0.0.zip", "name": "fw 3", "version": "3.0.0"}`,
+			"prod/" + s.INDEX_FILE_INFO: `{"name": "fw 3", "description": "fw 3 description"}`,
+		},
+	})
+	env := newTestEnv(t, map[string]string{
+		"fwMemoryConnectionDetails":   string(connectionDetails),
+		s.TOPT_FW_INDEX_PREFIX:        "prod",
+		s.TOPT_FW_INDEX_VERSIONS_FILE: "versions.jsonl",
+	})
+	env.subscribe("t1")
+	env.sync()
+	versions := env.versions("t1")
+	assertKeys(t, "versions", versions, "fw 3@3.0.0")
+	origin := versions["fw 3@3.0.0"]["externalResourceOrigin"].(map[string]any)
+	if origin["prefix"] != "prod/" || origin["objectKey"] != "fw-3/fw-3_3.0.0.zip" {
+		t.Errorf("expected object key relative to the prefix, got %v", origin)
+	}
+	device := c8ytest.User{Username: "device_1", Password: "device-secret", Roles: []string{"ROLE_DEVICE"}}
+	env.c8y.AddUser("t1", device)
+	rec := env.request(http.MethodGet, "/firmware/download?id="+versions["fw 3@3.0.0"]["id"].(string), "t1", device)
+	if rec.Code != http.StatusTemporaryRedirect || !strings.HasPrefix(rec.Header().Get("Location"), "https://storage.example.com/prod/fw-3/fw-3_3.0.0.zip?expires=") {
+		t.Errorf("expected redirect to the object below the prefix, got %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+
+	// only changes of the index files below the prefix trigger a synchronization
+	if env.controllers.HandleStorageEvents([]est.StorageEvent{{EventName: "ObjectCreated:Put", ObjectKey: s.INDEX_FILE_VERSIONS}}) {
+		t.Error("expected index file of other environment to be ignored")
+	}
+	if !env.controllers.HandleStorageEvents([]est.StorageEvent{{EventName: "ObjectCreated:Put", ObjectKey: "prod/versions.jsonl"}}) {
+		t.Error("expected change of the index file below the prefix to trigger a synchronization")
+	}
+
+	// published versions are stored and indexed below the prefix
+	ci := c8ytest.User{Username: "ci", Password: "ci-secret", Roles: []string{"ROLE_FIRMWARE_REPO_PUBLISH"}}
+	env.c8y.AddUser(testServiceTenant, ci)
+	contentType, body := publishForm(map[string]string{"name": "fw 3", "version": "3.0.1"}, "fw.bin", "binary")
+	if rec := env.requestWithBody(http.MethodPost, "/firmware/publish", testServiceTenant, ci, contentType, body); rec.Code != http.StatusCreated {
+		t.Fatalf("expected version to be published, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if _, err := env.storage.Stat(context.Background(), "prod/uploads/fw-3-3b9e2d1a/3.0.1/fw.bin"); err != nil {
+		t.Errorf("expected binary below the prefix, got %v", err)
+	}
+	indexed, _ := est.ReadObjectAsString(context.Background(), env.storage, "prod/versions.jsonl")
+	if !strings.Contains(indexed, `"key":"uploads/fw-3-3b9e2d1a/3.0.1/fw.bin"`) {
+		t.Errorf("expected version to be indexed with relative key, got %s", indexed)
+	}
+}
+
+func TestEndToEndWatchedPrefixForcesResync(t *testing.T) {
+	env := newTestEnv(t, map[string]string{s.TOPT_FW_EVENT_WATCH_PREFIXES: "nightly/"})
+	env.subscribe("t1")
+	env.sync()
+	event := func(objectKey string) bool {
+		return env.controllers.HandleStorageEvents([]est.StorageEvent{{EventName: "ObjectCreated:Put", ObjectKey: objectKey}})
+	}
+
+	if event("other/fw.zip") {
+		t.Error("expected change of an unwatched object to be ignored")
+	}
+	if !event(s.INDEX_FILE_VERSIONS) {
+		t.Error("expected change of an index file to trigger a synchronization")
+	}
+	if report := env.sync(); report.Unchanged != 2 {
+		t.Errorf("expected unchanged index files to skip the tenants, got %+v", report)
+	}
+	if !event("nightly/fw-1_1.0.2.zip") {
+		t.Error("expected change below a watched prefix to trigger a synchronization")
+	}
+	if report := env.sync(); report.Unchanged != 0 || report.Failed != 0 {
+		t.Errorf("expected change below a watched prefix to force a resync of all tenants, got %+v", report)
+	}
+	if report := env.sync(); report.Unchanged != 2 {
+		t.Errorf("expected the forced resync to be applied once, got %+v", report)
+	}
+}
+
+func TestEndToEndTenantScope(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.storage.Put(s.INDEX_FILE_TENANT_GROUPS, []byte(`{"beta": ["t1"]}`))
+	env.setVersionsIndex(testVersionsIndex + `
+{"key": "fw-1_1.1.0-beta.zip", "name": "fw 1", "version": "1.1.0-beta", "tenantGroups": ["beta"]}
+{"key": "fw-1_1.0.2.zip", "name": "fw 1", "version": "1.0.2", "tenants": ["t2"]}
+{"key": "fw-1_1.0.3.zip", "name": "fw 1", "version": "1.0.3", "excludedTenants": ["t2"]}`)
+	env.subscribe("t1", "t2")
+	if report := env.sync(); report.Failed != 0 {
+		t.Fatalf("expected all tenants to be synchronized, got %+v", report)
+	}
+	assertKeys(t, "versions", env.versions("t1"), "fw 1@1.0.0", "fw 1@1.0.1", "fw 1@1.1.0-beta", "fw 1@1.0.3")
+	assertKeys(t, "versions", env.versions("t2"), "fw 1@1.0.0", "fw 1@1.0.1", "fw 1@1.0.2")
+
+	// versions are removed from tenants not entitled to them anymore
+	env.storage.Put(s.INDEX_FILE_TENANT_GROUPS, []byte(`{"beta": ["t2"]}`))
+	if !env.controllers.HandleStorageEvents([]est.StorageEvent{{EventName: "ObjectCreated:Put", ObjectKey: s.INDEX_FILE_TENANT_GROUPS}}) {
+		t.Error("expected change of the tenant groups file to trigger a synchronization")
+	}
+	env.sync()
+	assertKeys(t, "versions", env.versions("t1"), "fw 1@1.0.0", "fw 1@1.0.1", "fw 1@1.0.3")
+	assertKeys(t, "versions", env.versions("t2"), "fw 1@1.0.0", "fw 1@1.0.1", "fw 1@1.0.2", "fw 1@1.1.0-beta")
+}
+
+// allows overlay sources of the memory provider for the duration of the test
+func allowMemoryOverlays(t *testing.T) {
+	providers := overlayProviders
+	overlayProviders = append(slices.Clip(providers), "memory")
+	t.Cleanup(func() { overlayProviders = providers })
+}
+
+func TestEndToEndTenantOverlay(t *testing.T) {
+	allowMemoryOverlays(t)
+	env := newTestEnv(t, map[string]string{s.TOPT_FW_OVERLAY_TENANTS: "t1,t2", s.TOPT_FW_OVERLAY_OVERRIDE_TENANTS: "t2"})
+	overlay := `{"provider": "memory", "prefix": "custom", "config": {"bucketName": "customer", "baseUrl": "https://customer.example.com", "objects": {
+		"custom/c8y-firmware-versions.json": "{\"key\": \"fw-1_1.0.9.zip\", \"name\": \"fw 1\", \"version\": \"1.0.9\"}\n{\"key\": \"fw-9_9.0.0.zip\", \"name\": \"fw 9\", \"version\": \"9.0.0\"}",
+		"custom/c8y-firmware-info.json": "{\"name\": \"fw 1\", \"description\": \"customer description\"}\n{\"name\": \"fw 9\", \"description\": \"customer firmware\"}"}}}`
+	for _, tenantId := range []string{"t1", "t2"} {
+		env.c8y.AddTenant(tenantId, tenantId+".c8y.example.com")
+		env.c8y.SetOption(tenantId, s.TOPT_CATEGORY, s.TOPT_FW_OVERLAY_SOURCE, overlay)
+	}
+	env.subscribe("t1", "t2", "t3")
+	report := env.sync()
+	if report.Failed != 0 {
+		t.Fatalf("expected all tenants to be synchronized, got %+v", report)
+	}
+	// overlay entries are only merged for their tenant and can't override shared firmwares unless allowed
+	assertKeys(t, "versions", env.versions("t1"), "fw 1@1.0.0", "fw 1@1.0.1", "fw 9@9.0.0")
+	assertKeys(t, "versions", env.versions("t2"), "fw 1@1.0.0", "fw 1@1.0.1", "fw 1@1.0.9", "fw 9@9.0.0")
+	assertKeys(t, "versions", env.versions("t3"), "fw 1@1.0.0", "fw 1@1.0.1")
+	if description := env.firmwares("t1")["fw 1"]["description"]; description != "fw 1 description" {
+		t.Errorf("expected shared description, got %v", description)
+	}
+	if description := env.firmwares("t2")["fw 1"]["description"]; description != "customer description" {
+		t.Errorf("expected overridden description, got %v", description)
+	}
+	for _, result := range report.Tenants {
+		if result.TenantId == "t1" && len(result.Conflicts) != 2 || result.TenantId != "t1" && len(result.Conflicts) != 0 {
+			t.Errorf("%s: unexpected conflicts %v", result.TenantId, result.Conflicts)
+		}
+	}
+
+	// overlay versions are downloaded from the overlay source by their own tenant only
+	device := c8ytest.User{Username: "device_1", Password: "device-secret", Roles: []string{"ROLE_DEVICE"}}
+	env.c8y.AddUser("t1", device)
+	id := env.versions("t1")["fw 9@9.0.0"]["id"].(string)
+	rec := env.request(http.MethodGet, "/firmware/download?id="+id, "t1", device)
+	if rec.Code != http.StatusTemporaryRedirect || !strings.HasPrefix(rec.Header().Get("Location"), "https://customer.example.com/custom/fw-9_9.0.0.zip?expires=") {
+		t.Errorf("expected redirect to the overlay source, got %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+	if source, ok := env.controllers.Source("t3", overlaySourceId("t1")); ok {
+		t.Errorf("expected overlay source to be unknown to other tenants, got %+v", source)
+	}
+}
+
+func TestEndToEndTenantOverlayRestrictions(t *testing.T) {
+	allowMemoryOverlays(t)
+	env := newTestEnv(t, map[string]string{s.TOPT_FW_OVERLAY_TENANTS: "t2,t3,t4"})
+	overlays := map[string]string{
+		// not allowed to use an overlay, the option is ignored
+		"t1": `{"provider": "memory", "config": {"bucketName": "customer", "objects": {"c8y-firmware-versions.json": "{\"key\": \"fw-9_9.0.0.zip\", \"name\": \"fw 9\", \"version\": \"9.0.0\"}", "c8y-firmware-info.json": "{\"name\": \"fw 9\"}"}}}`,
+		// endpoints outside of the allowed hosts fail the tenant
+		"t2": `{"provider": "azblob", "config": {"connectionString": "BlobEndpoint=https://169.254.169.254/;SharedAccessSignature=sv=1", "containerName": "c"}}`,
+		"t3": `{"provider": "awsS3", "config": {"region": "eu-central-1", "accessKeyID": "id", "secretAccessKey": "secret", "bucketName": "b", "sqsQueueUrl": "http://localhost:9324/queue"}}`,
+		// index files exceeding the max. size fail the synchronization of the tenant
+		"t4": fmt.Sprintf(`{"provider": "memory", "config": {"bucketName": "customer", "objects": {"c8y-firmware-versions.json": "%s", "c8y-firmware-info.json": "{\"name\": \"fw 9\"}"}}}`, strings.Repeat(" ", maxOverlayIndexFileSize+1)),
+	}
+	for tenantId, overlay := range overlays {
+		env.c8y.AddTenant(tenantId, tenantId+".c8y.example.com")
+		env.c8y.SetOption(tenantId, s.TOPT_CATEGORY, s.TOPT_FW_OVERLAY_SOURCE, overlay)
+	}
+	if registered := env.subscribe("t1", "t2", "t3", "t4"); slices.Contains(registered, "t2") || slices.Contains(registered, "t3") || !slices.Contains(registered, "t4") {
+		t.Errorf("expected tenants with disallowed overlay endpoints not to be registered, got %v", registered)
+	}
+	report := env.sync()
+	assertKeys(t, "versions", env.versions("t1"), "fw 1@1.0.0", "fw 1@1.0.1")
+	for _, result := range report.Tenants {
+		if failed := len(result.Errors) > 0; failed != (result.TenantId == "t4") {
+			t.Errorf("%s: unexpected result %+v", result.TenantId, result)
+		}
+	}
+}
+
+func TestEndToEndDownloadDeviceTypeCheck(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.subscribe("t1")
+	env.sync()
+	linux := env.addDevice("t1", "device_linux", map[string]any{"type": "c8y_Linux"})
+	hardware := env.addDevice("t1", "device_hardware", map[string]any{"type": "thin-edge.io", "c8y_Hardware": map[string]any{"model": "c8y_Linux"}})
+	other := env.addDevice("t1", "device_other", map[string]any{"type": "thin-edge.io"})
+	// device users are told by their roles, not by their username
+	renamed := env.addDevice("t1", "sensor-1", map[string]any{"type": "thin-edge.io"})
+	quoted := env.addDevice("t1", "o'sensor", map[string]any{"type": "c8y_Linux"})
+	unregistered := c8ytest.User{Username: "device_unregistered", Password: "device-secret", Roles: []string{"ROLE_DEVICE"}}
+	env.c8y.AddUser("t1", unregistered)
+	// users managing the inventory (e.g. service users with the device role) are not checked
+	operator := c8ytest.User{Username: "device_operator", Password: "operator-secret", Roles: []string{"ROLE_DEVICE", "ROLE_INVENTORY_ADMIN"}}
+	env.c8y.AddUser("t1", operator)
+	id := env.versions("t1")["fw 1@1.0.0"]["id"].(string)
+	for _, test := range []struct {
+		user     c8ytest.User
+		expected int
+	}{
+		{linux, http.StatusTemporaryRedirect},
+		{hardware, http.StatusTemporaryRedirect},
+		{other, http.StatusForbidden},
+		{renamed, http.StatusForbidden},
+		{quoted, http.StatusTemporaryRedirect},
+		{unregistered, http.StatusForbidden},
+		{operator, http.StatusTemporaryRedirect},
+	} {
+		if rec := env.request(http.MethodGet, "/firmware/download?id="+id, "t1", test.user); rec.Code != test.expected {
+			t.Errorf("%s: expected %d, got %d: %s", test.user.Username, test.expected, rec.Code, rec.Body.String())
+		}
+	}
+
+	// the device and the device type of the firmware are cached, so repeated downloads only authenticate the user
+	requests := env.c8y.Requests()
+	if rec := env.request(http.MethodGet, "/firmware/download?id="+id, "t1", linux); rec.Code != http.StatusTemporaryRedirect {
+		t.Errorf("expected repeated download to be allowed, got %d", rec.Code)
+	}
+	if lookups := env.c8y.Requests() - requests; lookups != 3 {
+		t.Errorf("expected only authentication and version lookup, got %d requests", lookups)
+	}
+
+	// the check can be disabled
+	env = newTestEnv(t, map[string]string{s.TOPT_FW_DOWNLOAD_DEVICE_TYPE_CHECK: "false"})
+	env.subscribe("t1")
+	env.sync()
+	other = env.addDevice("t1", "device_other", map[string]any{"type": "thin-edge.io"})
+	if rec := env.request(http.MethodGet, "/firmware/download?id="+env.versions("t1")["fw 1@1.0.0"]["id"].(string), "t1", other); rec.Code != http.StatusTemporaryRedirect {
+		t.Errorf("expected download to be allowed without check, got %d", rec.Code)
+	}
+}
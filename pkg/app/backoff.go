@@ -0,0 +1,63 @@
+package app
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SharedBackoff lets all requests towards Cumulocity pause once any of them got rate limited (HTTP 429),
+// instead of each (parallel) tenant synchronization hammering the platform on its own.
+type SharedBackoff struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+// Trigger pauses all requests for the given duration (unless they are already paused for longer)
+func (b *SharedBackoff) Trigger(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if until := time.Now().Add(d); until.After(b.until) {
+		slog.Warn("Rate limited by Cumulocity. Pausing all requests.", "duration", d.String())
+		b.until = until
+	}
+}
+
+// Remaining returns the time left until requests are allowed again
+func (b *SharedBackoff) Remaining() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Until(b.until)
+}
+
+// TriggerFromResponse pauses all requests according to the Retry-After header of a 429 response (or a default of 5 seconds)
+func (b *SharedBackoff) TriggerFromResponse(resp *http.Response) {
+	d := 5 * time.Second
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		d = time.Duration(secs) * time.Second
+	}
+	b.Trigger(d)
+}
+
+// Transport returns a RoundTripper waiting for the shared backoff before sending a request
+func (b *SharedBackoff) Transport(next http.RoundTripper) http.RoundTripper {
+	return &backoffTransport{next: next, backoff: b}
+}
+
+type backoffTransport struct {
+	next    http.RoundTripper
+	backoff *SharedBackoff
+}
+
+func (t *backoffTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if wait := t.backoff.Remaining(); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	return t.next.RoundTrip(req)
+}
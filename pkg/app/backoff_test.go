@@ -0,0 +1,92 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestSharedBackoffTrigger(t *testing.T) {
+	b := &SharedBackoff{}
+	if remaining := b.Remaining(); remaining > 0 {
+		t.Fatalf("expected no backoff initially, got %v", remaining)
+	}
+
+	b.Trigger(time.Second)
+	if remaining := b.Remaining(); remaining <= 500*time.Millisecond || remaining > time.Second {
+		t.Errorf("expected backoff of about 1s, got %v", remaining)
+	}
+	b.Trigger(10 * time.Millisecond)
+	if remaining := b.Remaining(); remaining <= 500*time.Millisecond {
+		t.Errorf("expected a shorter backoff not to shorten the pause, got %v", remaining)
+	}
+	b.Trigger(time.Minute)
+	if remaining := b.Remaining(); remaining <= 30*time.Second {
+		t.Errorf("expected a longer backoff to extend the pause, got %v", remaining)
+	}
+
+	b = &SharedBackoff{}
+	b.Trigger(20 * time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+	if remaining := b.Remaining(); remaining > 0 {
+		t.Errorf("expected backoff to be over once elapsed, got %v", remaining)
+	}
+}
+
+func TestSharedBackoffTriggerFromResponse(t *testing.T) {
+	tests := []struct {
+		retryAfter string
+		min, max   time.Duration
+	}{
+		{retryAfter: "", min: 4 * time.Second, max: 5 * time.Second},
+		{retryAfter: "30", min: 29 * time.Second, max: 30 * time.Second},
+		{retryAfter: "0", min: 4 * time.Second, max: 5 * time.Second},
+		{retryAfter: "Wed, 21 Oct 2015 07:28:00 GMT", min: 4 * time.Second, max: 5 * time.Second},
+	}
+	for _, tt := range tests {
+		b := &SharedBackoff{}
+		resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}}
+		if len(tt.retryAfter) > 0 {
+			resp.Header.Set("Retry-After", tt.retryAfter)
+		}
+		b.TriggerFromResponse(resp)
+		if remaining := b.Remaining(); remaining < tt.min || remaining > tt.max {
+			t.Errorf("Retry-After %q: expected backoff between %v and %v, got %v", tt.retryAfter, tt.min, tt.max, remaining)
+		}
+	}
+}
+
+func TestSharedBackoffTransport(t *testing.T) {
+	b := &SharedBackoff{}
+	sent := 0
+	transport := b.Transport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		sent++
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}))
+
+	b.Trigger(50 * time.Millisecond)
+	start := time.Now()
+	req, _ := http.NewRequest(http.MethodGet, "http://c8y.example.com", nil)
+	if _, err := transport.RoundTrip(req); err != nil || sent != 1 {
+		t.Fatalf("expected request to be sent, got %v (sent %d)", err, sent)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("expected request to wait for the backoff, waited %v", elapsed)
+	}
+
+	b.Trigger(time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, _ = http.NewRequestWithContext(ctx, http.MethodGet, "http://c8y.example.com", nil)
+	if _, err := transport.RoundTrip(req); !errors.Is(err, context.DeadlineExceeded) || sent != 1 {
+		t.Errorf("expected waiting request to stop with its context, got %v (sent %d)", err, sent)
+	}
+}
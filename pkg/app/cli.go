@@ -0,0 +1,353 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	est "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/externalstorage"
+	s "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/static"
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+)
+
+// CLIOptions configure the command line mode (validate, plan, sync). Unlike the microservice, it works on a single tenant
+// and authenticates with the given user instead of the bootstrap user.
+type CLIOptions struct {
+	Host     string
+	Tenant   string
+	Username string
+	Password string
+	// storage provider (e.g. awsS3) and its JSON connection details. If not set, the tenant options of the tenant are used.
+	StorageProvider string
+	StorageConfig   string
+	// prefix and names of the index files within the storage (or the index directory) given via StorageProvider
+	Index est.IndexLayout
+	// local directory containing the index files, used instead of the storage (validate and plan only)
+	IndexDir string
+	// context path of the service, used for the download URLs of created firmware versions
+	ContextPath string
+	Out         io.Writer
+}
+
+// newC8yClient returns the client and ctx carrying the credentials of the user, so it is still cancelled with ctx (e.g. on SIGTERM)
+func (o *CLIOptions) newC8yClient(ctx context.Context) (*c8y.Client, context.Context, error) {
+	var missing []string
+	for _, field := range [][2]string{{"host", o.Host}, {"tenant", o.Tenant}, {"user", o.Username}, {"password", o.Password}} {
+		if len(field[1]) == 0 {
+			missing = append(missing, field[0])
+		}
+	}
+	if len(missing) > 0 {
+		return nil, nil, fmt.Errorf("missing Cumulocity credentials %v, set them via flags or environment variables (the password via C8Y_PASSWORD or --password-stdin)", missing)
+	}
+	client := c8y.NewClient(nil, o.Host, o.Tenant, o.Username, o.Password, true)
+	return client, context.WithValue(ctx, c8y.GetContextAuthTokenKey(), c8y.NewBasicAuthString(o.Tenant, o.Username, o.Password)), nil
+}
+
+// creates the storage sources from the options (a single source), falls back to the tenant options of the tenant if no provider is given
+func (o *CLIOptions) newStorageSources(ctx context.Context, client *c8y.Client) (est.Sources, error) {
+	if len(o.StorageProvider) == 0 {
+		if client == nil {
+			return nil, errors.New("no storage configured, set a storage provider (and its connection details) or an index directory")
+		}
+		return createStorageSourcesFromTenantOptions(ctx, client)
+	}
+	provider, ok := est.GetProvider(o.StorageProvider)
+	if !ok {
+		return nil, fmt.Errorf("unsupported storage provider '%s', supported providers are %v", o.StorageProvider, est.ProviderNames())
+	}
+	config, err := provider.ParseConfig(o.StorageConfig)
+	if err != nil {
+		return nil, err
+	}
+	estClient, err := provider.New(ctx, config, est.ClientSettings{UrlExpirationMins: s.TOPT_FW_URL_EXPIRATION_MINS_DEFAULTVALUE})
+	if err != nil {
+		return nil, err
+	}
+	return est.SingleSource(estClient, o.Index), nil
+}
+
+// the index directory has no prefix, only the names of the index files apply
+func (o *CLIOptions) indexDirSource() est.Source {
+	return est.Source{IndexLayout: est.IndexLayout{VersionsFile: o.Index.VersionsFile, InfoFile: o.Index.InfoFile, TenantGroupsFile: o.Index.TenantGroupsFile}}
+}
+
+// reads the index files from the index directory (if set) or the storage of the source
+func (o *CLIOptions) readIndexFiles(ctx context.Context, source est.Source) (string, string, error) {
+	var contents [2]string
+	for i, objectKey := range []string{source.VersionsFileName(), source.InfoFileName()} {
+		if len(o.IndexDir) > 0 {
+			content, err := os.ReadFile(filepath.Join(o.IndexDir, objectKey))
+			if err != nil {
+				return "", "", err
+			}
+			contents[i] = string(content)
+			continue
+		}
+		content, err := est.ReadObjectAsString(ctx, source.Client, objectKey)
+		if err != nil {
+			return "", "", fmt.Errorf("could not read %s from storage: %w", objectKey, err)
+		}
+		contents[i] = content
+	}
+	return contents[0], contents[1], nil
+}
+
+// reads the optional tenant groups file from the index directory (if set) or the storage of the source, empty if it doesn't exist
+func (o *CLIOptions) readTenantGroupsFile(ctx context.Context, source est.Source) (string, error) {
+	if len(o.IndexDir) > 0 {
+		content, err := os.ReadFile(filepath.Join(o.IndexDir, source.TenantGroupsFileName()))
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil
+		}
+		return string(content), err
+	}
+	content, _, err := readIndexFileForUpdate(ctx, source.Client, source.TenantGroupsFileName())
+	return content, err
+}
+
+// Validate lints the index files of the index directory (or of each storage source). With checkObjects, the referenced objects
+// need to exist as well. Returns an error if any errors were found, warnings are only printed.
+func Validate(ctx context.Context, o CLIOptions, checkObjects bool) error {
+	var issues []IndexIssue
+	if len(o.IndexDir) > 0 {
+		dirIssues, err := o.validate(ctx, o.indexDirSource(), checkObjects)
+		if err != nil {
+			return err
+		}
+		for _, issue := range dirIssues {
+			fmt.Fprintln(o.Out, issue)
+		}
+		issues = dirIssues
+	} else {
+		var client *c8y.Client
+		if len(o.StorageProvider) == 0 {
+			var err error
+			if client, ctx, err = o.newC8yClient(ctx); err != nil {
+				return err
+			}
+		}
+		sources, err := o.newStorageSources(ctx, client)
+		if err != nil {
+			return err
+		}
+		for _, source := range sources {
+			sourceIssues, err := o.validate(ctx, source, checkObjects)
+			if err != nil {
+				return fmt.Errorf("source %s: %w", source.Id, err)
+			}
+			if len(sources) > 1 {
+				fmt.Fprintf(o.Out, "source %s:\n", source.Id)
+			}
+			for _, issue := range sourceIssues {
+				fmt.Fprintln(o.Out, issue)
+			}
+			issues = append(issues, sourceIssues...)
+		}
+	}
+	errorCount := 0
+	for _, issue := range issues {
+		if issue.Severity == IssueError {
+			errorCount++
+		}
+	}
+	fmt.Fprintf(o.Out, "%d error(s), %d warning(s)\n", errorCount, len(issues)-errorCount)
+	if HasErrors(issues) {
+		return errors.New("index files are invalid")
+	}
+	return nil
+}
+
+// validates the index files of the storage of the source, or of the index directory if set
+func (o *CLIOptions) validate(ctx context.Context, source est.Source, checkObjects bool) ([]IndexIssue, error) {
+	stat := func(objectKey string) error {
+		_, err := os.Stat(filepath.Join(o.IndexDir, objectKey))
+		if errors.Is(err, fs.ErrNotExist) {
+			return est.ErrNotFound
+		}
+		return err
+	}
+	if len(o.IndexDir) == 0 {
+		stat = func(objectKey string) error {
+			_, err := source.Client.Stat(ctx, objectKey)
+			return err
+		}
+	}
+	contentFwVersionFile, contentFwInfoFile, err := o.readIndexFiles(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	contentTenantGroupsFile, err := o.readTenantGroupsFile(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	issues := ValidateIndexFiles(contentFwVersionFile, contentFwInfoFile)
+	issues = append(issues, ValidateTenantGroups(contentFwVersionFile, contentFwInfoFile, contentTenantGroupsFile)...)
+	if checkObjects {
+		issues = append(issues, ValidateIndexObjects(contentFwVersionFile, stat)...)
+	}
+	// the issues refer to the default names of the index files
+	for i, issue := range issues {
+		switch issue.File {
+		case s.INDEX_FILE_VERSIONS:
+			issues[i].File = source.VersionsFileName()
+		case s.INDEX_FILE_INFO:
+			issues[i].File = source.InfoFileName()
+		case s.INDEX_FILE_TENANT_GROUPS:
+			issues[i].File = source.TenantGroupsFileName()
+		}
+	}
+	return issues, nil
+}
+
+// creates the controllers (configured by the tenant options of the tenant) and the controller of the tenant itself
+func (o *CLIOptions) newControllers(ctx context.Context, client *c8y.Client, sources est.Sources) (*FirmwareTenantControllers, *FirmwareTenantController, error) {
+	fwControllers := newFirmwareTenantControllers(ctx, client, sources)
+	fc, err := newTenantController(ctx, client, sources, fwControllers, o.Tenant, o.ContextPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	fwControllers.Register(fc)
+	return fwControllers, fc, nil
+}
+
+// Plan prints the changes a synchronization would apply to the tenant, without applying them
+func Plan(ctx context.Context, o CLIOptions) error {
+	client, ctx, err := o.newC8yClient(ctx)
+	if err != nil {
+		return err
+	}
+	var sources est.Sources
+	if len(o.IndexDir) == 0 {
+		if sources, err = o.newStorageSources(ctx, client); err != nil {
+			return err
+		}
+	}
+	fwControllers, fc, err := o.newControllers(ctx, client, sources)
+	if err != nil {
+		return err
+	}
+	var index *indexFiles
+	if len(o.IndexDir) > 0 {
+		contentFwVersionFile, contentFwInfoFile, err := o.readIndexFiles(ctx, o.indexDirSource())
+		if err != nil {
+			return err
+		}
+		contentTenantGroupsFile, err := o.readTenantGroupsFile(ctx, o.indexDirSource())
+		if err != nil {
+			return err
+		}
+		index = parseIndexFiles(contentFwVersionFile, contentFwInfoFile)
+		groups, err := ParseTenantGroups(contentTenantGroupsFile)
+		if err != nil {
+			return fmt.Errorf("invalid tenant groups file: %w", err)
+		}
+		index.setTenantGroups(groups)
+	} else {
+		var ok bool
+		if index, ok = fwControllers.readIndexFiles(ctx); !ok {
+			return errors.New("index files could not be read from storage")
+		}
+		for _, conflict := range index.conflicts {
+			fmt.Fprintln(o.Out, "conflict: "+conflict)
+		}
+	}
+	fwVersionEntries, fwInfoEntries, inputHash, conflicts, err := fwControllers.tenantEntries(ctx, fc, index)
+	if err != nil {
+		return err
+	}
+	for _, conflict := range conflicts {
+		fmt.Fprintln(o.Out, "conflict: "+conflict)
+	}
+	plan, err := fc.Plan(fwVersionEntries, fwInfoEntries, inputHash)
+	if err != nil {
+		return err
+	}
+	plan.Print(o.Out)
+	return nil
+}
+
+// SyncTenant synchronizes the tenant with the index files of the storage. With once, a single synchronization is run,
+// otherwise the tenant is synchronized according to its schedule until ctx is done.
+func SyncTenant(ctx context.Context, o CLIOptions, once bool) error {
+	if len(o.IndexDir) > 0 {
+		return errors.New("synchronization requires a storage, an index directory is only supported by validate and plan")
+	}
+	client, clientCtx, err := o.newC8yClient(ctx)
+	if err != nil {
+		return err
+	}
+	sources, err := o.newStorageSources(clientCtx, client)
+	if err != nil {
+		return err
+	}
+	fwControllers, _, err := o.newControllers(clientCtx, client, sources)
+	if err != nil {
+		return err
+	}
+	if !once {
+		fwControllers.SyncTenantsWithIndexFiles(ctx, []string{o.Tenant})
+		fwControllers.RunScheduler(ctx)
+		return nil
+	}
+	report := fwControllers.SyncTenantsWithIndexFiles(ctx, []string{o.Tenant})
+	if report == nil || len(report.Tenants) == 0 {
+		return errors.New("synchronization did not run, index files could not be read")
+	}
+	result := report.Tenants[0]
+	switch {
+	case result.Paused:
+		fmt.Fprintf(o.Out, "Synchronization of tenant %s is paused, nothing applied\n", result.TenantId)
+	case result.Unchanged:
+		fmt.Fprintf(o.Out, "Tenant %s is already synchronized with the index files\n", result.TenantId)
+	default:
+		fmt.Fprintf(o.Out, "Synchronized tenant %s: %d created, %d restored, %d deleted, %d archived, %d deferred, %d postponed\n",
+			result.TenantId, result.Created, result.Restored, result.Deleted, result.Archived, result.Deferred, result.Postponed)
+	}
+	for _, e := range result.Errors {
+		fmt.Fprintln(o.Out, "error: "+e)
+	}
+	if !result.Success() {
+		slog.Error("Synchronization failed", "tenant", result.TenantId, "errors", len(result.Errors))
+		return fmt.Errorf("synchronization of tenant %s failed with %d error(s)", result.TenantId, len(result.Errors))
+	}
+	return nil
+}
+
+// Generate prints the index entries proposed for the not yet indexed objects below prefix of the primary storage source. With
+// write, the merged index files are written back to the storage (failing if they were changed concurrently).
+func Generate(ctx context.Context, o CLIOptions, prefix string, write bool) error {
+	var client *c8y.Client
+	if len(o.StorageProvider) == 0 {
+		var err error
+		if client, ctx, err = o.newC8yClient(ctx); err != nil {
+			return err
+		}
+	}
+	sources, err := o.newStorageSources(ctx, client)
+	if err != nil {
+		return err
+	}
+	source := sources.Primary()
+	proposal, err := GenerateIndex(ctx, source, prefix)
+	if err != nil {
+		return err
+	}
+	proposal.Print(o.Out)
+	if !write || len(proposal.Versions) == 0 {
+		return nil
+	}
+	if err := proposal.Write(ctx, source.Client); err != nil {
+		if errors.Is(err, est.ErrPreconditionFailed) {
+			return fmt.Errorf("index files were changed concurrently, run generate again: %w", err)
+		}
+		return err
+	}
+	fmt.Fprintf(o.Out, "Written %s and %s\n", source.Prefix+source.VersionsFileName(), source.Prefix+source.InfoFileName())
+	return nil
+}
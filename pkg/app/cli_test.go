@@ -0,0 +1,125 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kobu/c8y-devmgmt-repo-intgr/internal/c8ytest"
+	est "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/externalstorage"
+	s "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/static"
+)
+
+func TestValidateIndexFiles(t *testing.T) {
+	issues := ValidateIndexFiles(`{"key": "fw-1_1.0.0.zip", "name": "fw 1", "version": "1.0.0"}
+
+{"key": "fw-1_1.0.0.zip", "name": "fw 1", "version": "1.0.0"}
+{"key": "fw-1_1.0.1.zip", "name": "fw 1"}
+{"key": "fw-3_3.0.0.zip", "name": "fw 3", "version": "3.0.0"}
+not json`, `{"name": "fw 1", "retentionOrder": "newest"}
+{"name": "fw 2"}`)
+	expected := []string{
+		"error: c8y-firmware-info.json:1: unsupported retentionOrder 'newest', supported values are semver and index",
+		"warning: c8y-firmware-info.json:2: firmware 'fw 2' has no versions in c8y-firmware-versions.json",
+		"error: c8y-firmware-versions.json:3: duplicate version '1.0.0' of firmware 'fw 1' (first defined in line 1)",
+		"error: c8y-firmware-versions.json:4: missing mandatory fields [version]",
+		"warning: c8y-firmware-versions.json:5: no entry for firmware 'fw 3' in c8y-firmware-info.json, it is created without description and device type",
+		"error: c8y-firmware-versions.json:6: no valid JSON, entry is skipped: invalid character 'o' in literal null (expecting 'u')",
+	}
+	var got []string
+	for _, issue := range issues {
+		got = append(got, issue.String())
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected issues:\n%s\nexpected:\n%s", strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+	if issues := ValidateIndexFiles(testVersionsIndex, testInfoIndex); HasErrors(issues) {
+		t.Errorf("expected no errors, got %v", issues)
+	}
+}
+
+func TestCLIValidateIndexDir(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, s.INDEX_FILE_VERSIONS), []byte(testVersionsIndex), 0o644)
+	os.WriteFile(filepath.Join(dir, s.INDEX_FILE_INFO), []byte(testInfoIndex), 0o644)
+	os.WriteFile(filepath.Join(dir, "fw-1_1.0.0.zip"), []byte("binary"), 0o644)
+
+	var out strings.Builder
+	o := CLIOptions{IndexDir: dir, Out: &out}
+	if err := Validate(context.Background(), o, false); err != nil {
+		t.Errorf("expected index files to be valid, got %s: %s", err, out.String())
+	}
+	out.Reset()
+	if err := Validate(context.Background(), o, true); err == nil || !strings.Contains(out.String(), "object 'fw-1_1.0.1.zip' not found in storage") {
+		t.Errorf("expected missing object to be reported, got %v: %s", err, out.String())
+	}
+}
+
+func TestCLIPlanAndSyncOnce(t *testing.T) {
+	fake := c8ytest.NewServer(t, testServiceTenant, testContextPath)
+	fake.AddTenant("t1", "t1.c8y.example.com")
+	fake.AddUser("t1", c8ytest.User{Username: "ci", Password: "ci-secret", Roles: []string{"ROLE_INVENTORY_ADMIN"}})
+	storageConfig, _ := json.Marshal(est.MemoryConnectionDetails{
+		BucketName: "firmware",
+		BaseUrl:    "https://storage.example.com",
+		Objects: map[string]string{
+			s.INDEX_FILE_VERSIONS: testVersionsIndex,
+			s.INDEX_FILE_INFO:     testInfoIndex,
+		},
+	})
+	var out strings.Builder
+	o := CLIOptions{
+		Host:            fake.URL,
+		Tenant:          "t1",
+		Username:        "ci",
+		Password:        "ci-secret",
+		StorageProvider: "memory",
+		StorageConfig:   string(storageConfig),
+		ContextPath:     testContextPath,
+		Out:             &out,
+	}
+
+	if err := Plan(context.Background(), o); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.Contains(out.String(), "1 firmware(s) and 2 version(s) to create") {
+		t.Errorf("unexpected plan: %s", out.String())
+	}
+	if mos := fake.ManagedObjects("t1", "has(externalResourceOrigin)"); len(mos) != 0 {
+		t.Errorf("expected plan not to change the tenant, got %v", mos)
+	}
+
+	out.Reset()
+	if err := SyncTenant(context.Background(), o, true); err != nil {
+		t.Fatalf("unexpected error: %s: %s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "Synchronized tenant t1: 2 created") {
+		t.Errorf("unexpected output: %s", out.String())
+	}
+	if mos := fake.ManagedObjects("t1", "type eq c8y_FirmwareBinary"); len(mos) != 2 {
+		t.Errorf("expected 2 firmware versions, got %v", mos)
+	}
+
+	out.Reset()
+	Plan(context.Background(), o)
+	if !strings.Contains(out.String(), "No changes") || !strings.Contains(out.String(), "already synchronized") {
+		t.Errorf("expected no changes after synchronization, got: %s", out.String())
+	}
+
+	o.Password = "wrong"
+	if err := SyncTenant(context.Background(), o, true); err == nil {
+		t.Error("expected invalid credentials to fail")
+	}
+
+	// a cancelled context (e.g. SIGTERM) stops the commands
+	o.Password = "ci-secret"
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := Plan(ctx, o); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected plan to be cancelled, got %v", err)
+	}
+}
@@ -2,27 +2,52 @@ package app
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	est "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/externalstorage"
+	s "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/static"
 	"github.com/reubenmiller/go-c8y/pkg/c8y"
 )
 
 type FirmwareTenantController struct {
-	tenantId           string
-	tenantStore        *FirmwareTenantStore
-	ctx                context.Context
-	c8yClient          *c8y.Client
-	estClient          *est.ExternalStorageClient
-	serviceBaseUrl     string
-	lastKnownInputHash string
+	// serializes the synchronizations of the tenant
+	syncMu      sync.Mutex
+	tenantId    string
+	tenantStore *FirmwareTenantStore
+	ctx         context.Context
+	c8yClient   *c8y.Client
+	// shared sources, followed by the overlay source of the tenant (if configured)
+	sources est.Sources
+	// overlay index of the tenant, merged with the shared index for this tenant only
+	overlay *est.Source
+	// overlay entries may override shared firmwares
+	overlayOverride bool
+	serviceBaseUrl  string
+	syncSettings    SyncSettings
+	schedule        TenantSchedule
+	stateMu         sync.Mutex
+	state           TenantSyncState
+	// id of the managed object the sync state is persisted to (empty if not persisted yet)
+	stateMoId string
+	// serializes persisting the sync state, so concurrent updates do not create more than one state object
+	persistMu sync.Mutex
+	// a full resync is requested independent of the input hash, e.g. by a change below a watched prefix
+	resyncRequested atomic.Bool
 }
 
 type ExternalResourceOrigin struct {
 	Provider   string `json:"provider,omitempty"`
 	BucketName string `json:"container,omitempty"`
 	ObjectKey  string `json:"objectKey,omitempty"`
-	CreatedBy  string `json:"createdBy,omitempty"`
+	// id of the storage source the object is located in
+	Source string `json:"source,omitempty"`
+	// prefix of the source the object key is relative to
+	Prefix    string `json:"prefix,omitempty"`
+	CreatedBy string `json:"createdBy,omitempty"`
 }
 
 type C8yFirmware struct {
@@ -30,10 +55,18 @@ type C8yFirmware struct {
 	Version string `json:"version,omitempty"`
 }
 
+// Archived marks a firmware (version) which was removed from the index files while running in archive mode
+type Archived struct {
+	Time         string `json:"time"`
+	FirmwareMoId string `json:"firmwareId,omitempty"`
+	FirmwareName string `json:"firmwareName,omitempty"`
+}
+
 type FirmwareVersion struct {
 	c8y.ManagedObject
 	C8yFirmware *C8yFirmware            `json:"c8y_Firmware"`
 	Origin      *ExternalResourceOrigin `json:"externalResourceOrigin,omitempty"`
+	Archived    *Archived               `json:"c8y_RepoIntegrationArchived,omitempty"`
 }
 
 type C8yFilter struct {
@@ -47,25 +80,21 @@ type Firmware struct {
 	Origin      *ExternalResourceOrigin `json:"externalResourceOrigin,omitempty"`
 }
 
-func newFirmware(name string, fwInfo ExtFirmwareInfoEntry, provider string, bucketName string, objectKey string) *Firmware {
+func newFirmware(name string, fwInfo ExtFirmwareInfoEntry, origin ExternalResourceOrigin) *Firmware {
+	origin.CreatedBy = "repository-integration-service"
 	res := &Firmware{
 		ManagedObject: c8y.ManagedObject{
 			Name: name,
 			Type: "c8y_Firmware",
 		},
 		Description: fwInfo.Description,
-		Origin: &ExternalResourceOrigin{
-			Provider:   provider,
-			BucketName: bucketName,
-			ObjectKey:  objectKey,
-			CreatedBy:  "repository-integration-service",
-		},
-		Filter: &C8yFilter{Type: fwInfo.DeviceType},
+		Origin:      &origin,
+		Filter:      &C8yFilter{Type: fwInfo.DeviceType},
 	}
 	return res
 }
 
-func newFirmwareVersion(name string, version string, url string, provider string, bucketName string, objectKey string) FirmwareVersion {
+func newFirmwareVersion(name string, version string, url string, origin ExternalResourceOrigin) FirmwareVersion {
 	return FirmwareVersion{
 		ManagedObject: c8y.ManagedObject{
 			Name: name,
@@ -75,52 +104,207 @@ func newFirmwareVersion(name string, version string, url string, provider string
 			Url:     url,
 			Version: version,
 		},
-		Origin: &ExternalResourceOrigin{
-			Provider:   provider,
-			BucketName: bucketName,
-			ObjectKey:  objectKey,
-		},
+		Origin: &origin,
 	}
 }
 
-func (c *FirmwareTenantController) SyncWithIndexFiles(extFwVersionEntries []ExtFirmwareVersionEntry, extFwInfoEntries map[string]ExtFirmwareInfoEntry, inputHash string) {
-	slog.Info("Start synchronization for tenant", "ternantId", c.tenantId)
-	c.rebuildTenantStore()
-	syncExtFwVersionEntriesWithCumulocity(c, extFwVersionEntries, extFwInfoEntries)
-	syncCumulocityWithextFwVersionEntries(c, extFwVersionEntries)
-	c.lastKnownInputHash = inputHash
+// origin of the object of the index entry, located in the source the entry was read from
+func (c *FirmwareTenantController) origin(extFwVersionEntry ExtFirmwareVersionEntry) ExternalResourceOrigin {
+	origin := ExternalResourceOrigin{ObjectKey: extFwVersionEntry.Key, Source: extFwVersionEntry.Source}
+	if source, ok := c.sources.Get(extFwVersionEntry.Source); ok {
+		origin.Provider, origin.BucketName, origin.Prefix = source.Client.GetProviderName(), source.Client.GetBucketName(), source.Prefix
+	}
+	return origin
 }
 
-// run over the index entries (from ext. storage) and check if they are all existing. If no, create it in Cumulocity
-func syncExtFwVersionEntriesWithCumulocity(controller *FirmwareTenantController, extFwVersionEntries []ExtFirmwareVersionEntry, extFwInfoEntries map[string]ExtFirmwareInfoEntry) {
-	for _, extFwVersionEntry := range extFwVersionEntries {
-		_, vok := controller.tenantStore.GetFirmwareVersion(extFwVersionEntry.Name, extFwVersionEntry.Version)
-		if !vok {
-			slog.Info("Found version missing in tenant", "firmwareName", extFwVersionEntry.Name, "firmwareVersion", extFwVersionEntry.Version)
-			// version not in tenant store, is the firmware itself available?
-			existingFirmware, fok := controller.tenantStore.GetFirmware(extFwVersionEntry.Name)
-			if !fok {
-				slog.Info("Firmware not existing. Create Firmware and Firmware Version", "firmwareName", extFwVersionEntry.Name, "firmwareVersion", extFwVersionEntry.Version)
-				createdFirmwareMoId, fwCreateErr := createFirmware(controller, extFwVersionEntry, extFwInfoEntries[extFwVersionEntry.Name], true)
-				if fwCreateErr != nil {
-					slog.Error("Error while creating Firmware. Skipping this iteration.", "error", fwCreateErr.Error)
-					continue
-				}
-				// create firmware version & assign to Firmware
-				createAndReferenceFirmwareVersion(controller, createdFirmwareMoId, extFwVersionEntry.Name, extFwVersionEntry.Version, extFwVersionEntry.Key, true)
+// SyncWithIndexFiles applies the index files to the tenant. Once ctx is done, the synchronization stops after its current step
+// (requests towards Cumulocity use the controllers own context, so a step is never cut in half).
+func (c *FirmwareTenantController) SyncWithIndexFiles(ctx context.Context, extFwVersionEntries []ExtFirmwareVersionEntry, extFwInfoEntries map[string]ExtFirmwareInfoEntry, inputHash string) TenantSyncResult {
+	c.syncMu.Lock()
+	defer c.syncMu.Unlock()
+	result := TenantSyncResult{
+		TenantId:  c.tenantId,
+		StartTime: time.Now(),
+	}
+	state := c.SyncState()
+	if state.Paused {
+		slog.Info("Synchronization of tenant is paused, skipping tenant", "tenantId", c.tenantId)
+		result.Paused = true
+		return result
+	}
+	// nothing to do if the index files did not change since the last complete synchronization, unless a full resync is due
+	fullSyncDue := c.resyncRequested.Swap(false) || c.fullSyncDue(state)
+	if !fullSyncDue && state.LastSyncSuccessful && state.LastKnownInputHash == inputHash {
+		slog.Info("Index files unchanged since last synchronization, skipping tenant", "tenantId", c.tenantId)
+		result.Unchanged = true
+		return result
+	}
+	slog.Info("Start synchronization for tenant", "ternantId", c.tenantId, "fullSync", fullSyncDue)
+	if fullSyncDue {
+		c.tenantStore.Invalidate()
+	}
+	// the store is kept up to date during synchronization, so it only needs to be rebuilt once outdated (or after errors)
+	if c.tenantStore.IsFresh(time.Duration(c.syncSettings.TenantStoreMaxAgeMins) * time.Minute) {
+		slog.Info("Tenant Store is up to date, skipping rebuild", "tenant", c.tenantId)
+	} else if err := c.rebuildTenantStore(); err != nil {
+		result.addError(err)
+		result.Duration = time.Since(result.StartTime)
+		c.updateSyncState(func(state *TenantSyncState) {
+			state.LastSyncSuccessful = false
+			state.LastSync = result.StartTime
+			state.LastResult = &result
+		})
+		return result
+	}
+	installed := newInstalledVersionsLookup(c)
+	extFwVersionEntries = applyRetentionPolicy(c, installed, extFwVersionEntries, extFwInfoEntries)
+	applyChanges(ctx, c, planChanges(c.tenantStore, extFwVersionEntries, c.removalSettings(extFwVersionEntries, installed)), extFwInfoEntries, &result)
+	if !result.Success() {
+		c.tenantStore.Invalidate()
+	}
+	result.Duration = time.Since(result.StartTime)
+
+	c.updateSyncState(func(state *TenantSyncState) {
+		state.LastKnownInputHash = inputHash
+		// deferred and postponed removals need to be retried, so such a synchronization does not count as complete
+		state.LastSyncSuccessful = result.Success() && result.Deferred == 0 && result.Postponed == 0
+		state.LastSync = result.StartTime
+		if fullSyncDue {
+			state.LastFullSync = result.StartTime
+		}
+		state.LastResult = &result
+	})
+	return result
+}
+
+// a full resync is due if requested (e.g. by a change below a watched prefix) or once the resync interval elapsed
+func (c *FirmwareTenantController) fullSyncDue(state TenantSyncState) bool {
+	return c.resyncRequested.Load() || time.Since(state.LastFullSync) >= time.Duration(c.syncSettings.ForceResyncIntervalMins)*time.Minute
+}
+
+// applies the changes determined by planChanges to Cumulocity, keeping the tenant store up to date
+func applyChanges(ctx context.Context, controller *FirmwareTenantController, changes []PlannedChange, extFwInfoEntries map[string]ExtFirmwareInfoEntry, result *TenantSyncResult) {
+	failedFirmwares := make(map[string]bool)
+	for _, change := range changes {
+		if ctx.Err() != nil {
+			result.addError(fmt.Errorf("synchronization interrupted: %w", ctx.Err()))
+			return
+		}
+		entry, version := change.entry, change.version
+		switch change.Action {
+		case PlanRestore:
+			if err := restoreFirmwareVersion(controller, version, entry, extFwInfoEntries[entry.Name]); err == nil {
+				result.Restored++
+				continue
+			}
+			slog.Warn("Could not restore archived Firmware Version. Creating a new one instead.", "firmwareName", entry.Name, "firmwareVersion", entry.Version, "versionMoId", version.MoId)
+			fwMoId, err := ensureFirmware(controller, entry, extFwInfoEntries[entry.Name])
+			if err != nil {
+				result.addError(err)
+				continue
+			}
+			result.countCreated(createAndReferenceFirmwareVersion(controller, fwMoId, entry, true))
+		case PlanCreateFirmware:
+			slog.Info("Firmware not existing. Create Firmware", "firmwareName", entry.Name)
+			if _, err := createFirmware(controller, entry, extFwInfoEntries[entry.Name], true); err != nil {
+				slog.Error("Error while creating Firmware. Skipping its versions.", "firmwareName", entry.Name, "error", err)
+				result.addError(err)
+				failedFirmwares[entry.Name] = true
+			}
+		case PlanCreate:
+			if failedFirmwares[entry.Name] {
+				continue
+			}
+			slog.Info("Found version missing in tenant", "firmwareName", entry.Name, "firmwareVersion", entry.Version)
+			fwMoId, err := ensureFirmware(controller, entry, extFwInfoEntries[entry.Name])
+			if err != nil {
+				result.addError(err)
+				continue
+			}
+			result.countCreated(createAndReferenceFirmwareVersion(controller, fwMoId, entry, true))
+		case PlanPostpone:
+			slog.Info("Outside of maintenance window. Postponing removal of firmware version.", "versionMoId", version.MoId, "firmwareName", version.FwName, "fwVersion", version.Version, "reason", change.Reason)
+			result.Postponed++
+		case PlanDefer:
+			slog.Warn("Deferring removal of firmware version.", "versionMoId", version.MoId, "firmwareName", version.FwName, "fwVersion", version.Version, "reason", change.Reason)
+			if change.deviceCount > 0 {
+				raiseRemovalBlockedAlarm(controller, version, change.deviceCount)
+			}
+			result.Deferred++
+		case PlanArchive:
+			clearRemovalBlockedAlarm(controller, version)
+			if err := archiveFirmwareVersion(controller, version); err != nil {
+				result.addError(err)
+			} else {
+				result.Archived++
+			}
+		case PlanDelete:
+			clearRemovalBlockedAlarm(controller, version)
+			if err := deleteFirmwareVersion(controller, version); err != nil {
+				result.addError(err)
 			} else {
-				slog.Info("Firmware is already existing, adding version to it", "firmwareName", extFwVersionEntry.Name, "firmwareVersion", extFwVersionEntry.Version)
-				// firmware is already existing, add version object
-				createAndReferenceFirmwareVersion(controller, existingFirmware.MoId, extFwVersionEntry.Name, extFwVersionEntry.Version, extFwVersionEntry.Key, true)
+				result.Deleted++
 			}
 		}
 	}
 }
 
+// returns the id of the firmware of the index entry, the firmware is created if not existing yet
+func ensureFirmware(controller *FirmwareTenantController, extFwVersionEntry ExtFirmwareVersionEntry, extFwInfoEntry ExtFirmwareInfoEntry) (string, error) {
+	if existingFirmware, ok := controller.tenantStore.GetFirmware(extFwVersionEntry.Name); ok {
+		return existingFirmware.MoId, nil
+	}
+	slog.Info("Firmware not existing. Create Firmware", "firmwareName", extFwVersionEntry.Name)
+	fwMoId, err := createFirmware(controller, extFwVersionEntry, extFwInfoEntry, true)
+	if err != nil {
+		slog.Error("Error while creating Firmware. Skipping this iteration.", "error", err)
+	}
+	return fwMoId, err
+}
+
+// removes the archived marker from a firmware version and assigns it again to its (possibly recreated) firmware
+func restoreFirmwareVersion(controller *FirmwareTenantController, archivedVersion FirmwareStoreVersionEntry, extFwVersionEntry ExtFirmwareVersionEntry, extFwInfoEntry ExtFirmwareInfoEntry) error {
+	slog.Info("Restoring archived Firmware Version", "firmwareName", archivedVersion.FwName, "firmwareVersion", archivedVersion.Version, "versionMoId", archivedVersion.MoId)
+	fwMoId := ""
+	// the store keeps firmwares without versions left, the ones emptied by archiving are marked as archived themselves
+	if existingFirmware, fok := controller.tenantStore.GetFirmware(extFwVersionEntry.Name); fok {
+		fwMoId = existingFirmware.MoId
+		if _, _, err := controller.c8yClient.Inventory.Update(controller.ctx, fwMoId, map[string]any{s.FRAGMENT_ARCHIVED: nil}); err != nil {
+			slog.Warn("Error while removing archived marker from Firmware", "firmwareMoId", fwMoId, "err", err)
+		}
+	}
+	if len(fwMoId) == 0 {
+		createdFirmwareMoId, err := createFirmware(controller, extFwVersionEntry, extFwInfoEntry, true)
+		if err != nil {
+			slog.Error("Error while creating Firmware for archived Firmware Version", "firmwareName", extFwVersionEntry.Name, "err", err)
+			return err
+		}
+		fwMoId = createdFirmwareMoId
+	}
+
+	origin := controller.origin(extFwVersionEntry)
+	_, _, err := controller.c8yClient.Inventory.Update(controller.ctx, archivedVersion.MoId, map[string]any{
+		s.FRAGMENT_ARCHIVED:      nil,
+		"externalResourceOrigin": &origin,
+	})
+	if err != nil {
+		slog.Error("Error while removing archived marker from Firmware Version", "versionMoId", archivedVersion.MoId, "err", err)
+		return err
+	}
+	if _, _, err := controller.c8yClient.Inventory.AddChildAddition(controller.ctx, fwMoId, archivedVersion.MoId); err != nil {
+		slog.Error("Error while assigning restored Firmware Version to Firmware", "firmwareMoId", fwMoId, "versionMoId", archivedVersion.MoId, "err", err)
+		return err
+	}
+	slog.Info("Restored archived Firmware Version", "firmwareMoId", fwMoId, "versionMoId", archivedVersion.MoId)
+	archivedVersion.FwMoId = fwMoId
+	controller.tenantStore.RemoveArchivedFirmwareVersion(archivedVersion.FwName, archivedVersion.Version)
+	controller.tenantStore.AddFirmwareVersion(archivedVersion)
+	return nil
+}
+
 func createFirmware(controller *FirmwareTenantController, extFwVersionEntry ExtFirmwareVersionEntry, extFwInfoEntry ExtFirmwareInfoEntry, updateTenantStore bool) (string, error) {
-	estClient := *controller.estClient
 	createdFirmware, _, fwErr := controller.c8yClient.Inventory.Create(controller.ctx,
-		newFirmware(extFwVersionEntry.Name, extFwInfoEntry, estClient.GetProviderName(), estClient.GetBucketName(), extFwVersionEntry.Key))
+		newFirmware(extFwVersionEntry.Name, extFwInfoEntry, controller.origin(extFwVersionEntry)))
 	if fwErr != nil {
 		return "", fwErr
 	}
@@ -136,15 +320,15 @@ func createFirmware(controller *FirmwareTenantController, extFwVersionEntry ExtF
 	return createdFirmware.ID, nil
 }
 
-func createAndReferenceFirmwareVersion(controller *FirmwareTenantController, fwMoId string, name string, version string, objectKey string, updateTenantStore bool) {
+func createAndReferenceFirmwareVersion(controller *FirmwareTenantController, fwMoId string, extFwVersionEntry ExtFirmwareVersionEntry, updateTenantStore bool) error {
+	name, version := extFwVersionEntry.Name, extFwVersionEntry.Version
 	// Create firmware version object
-	estClient := *controller.estClient
 	createdFwVersion, _, fwCreateErr := controller.c8yClient.Inventory.Create(
 		controller.ctx,
-		newFirmwareVersion(name, version, "http://to-be-provided.org", estClient.GetProviderName(), estClient.GetBucketName(), objectKey))
+		newFirmwareVersion(name, version, "http://to-be-provided.org", controller.origin(extFwVersionEntry)))
 	if fwCreateErr != nil {
 		slog.Error("Error while creating Firmware version. Skipping this iteration.", "error", fwCreateErr.Error())
-		return
+		return fwCreateErr
 	}
 	slog.Info("Created Firmware Version", "moId", createdFwVersion.ID)
 	// Set Version URL now
@@ -156,70 +340,119 @@ func createAndReferenceFirmwareVersion(controller *FirmwareTenantController, fwM
 		},
 	})
 	if updateErr != nil {
-		slog.Error("Error while updating URL for firmware version. ", "fwVersionId", createdFwVersion.ID, "error", updateErr.Error())
+		slog.Error("Error while updating URL for firmware version. Rolling back its creation.", "fwVersionId", createdFwVersion.ID, "error", updateErr.Error())
+		rollbackFirmwareVersion(controller, createdFwVersion.ID)
+		return updateErr
 	}
 	slog.Info("Updated Firmware URL", "fwVersionId", createdFwVersion.ID, "url", versionUrl)
 	// assign firmware version to firmware
 	_, _, assignErr := controller.c8yClient.Inventory.AddChildAddition(controller.ctx, fwMoId, createdFwVersion.ID)
 	if assignErr != nil {
-		slog.Error("Error while assigning firmware version to firmware.", "firmwareMoId", fwMoId, "firmwareVersionMoId", createdFwVersion.ID, "error", assignErr.Error())
-	} else {
-		slog.Info("Assigned Firmware Version to Firmware", "firmwareMoId", fwMoId, "firmwareVersionMoId", createdFwVersion.ID)
+		slog.Error("Error while assigning firmware version to firmware. Rolling back its creation.", "firmwareMoId", fwMoId, "firmwareVersionMoId", createdFwVersion.ID, "error", assignErr.Error())
+		rollbackFirmwareVersion(controller, createdFwVersion.ID)
+		return assignErr
 	}
+	slog.Info("Assigned Firmware Version to Firmware", "firmwareMoId", fwMoId, "firmwareVersionMoId", createdFwVersion.ID)
 	// Register in tenantstore
 	if updateTenantStore {
 		controller.tenantStore.AddFirmwareVersion(FirmwareStoreVersionEntry{
-			TenantId:        controller.tenantId,
-			FwName:          createdFwVersion.Name,
-			FwMoId:          fwMoId,
-			MoId:            createdFwVersion.ID,
-			MoType:          createdFwVersion.Type,
-			IsPatch:         false,
-			PatchDependency: "",
-			Version:         version,
-			URL:             versionUrl,
+			TenantId:          controller.tenantId,
+			FwName:            createdFwVersion.Name,
+			FwMoId:            fwMoId,
+			MoId:              createdFwVersion.ID,
+			MoType:            createdFwVersion.Type,
+			IsPatch:           false,
+			PatchDependency:   "",
+			Version:           version,
+			URL:               versionUrl,
+			HasExternalOrigin: true,
 		})
 	}
+	return nil
 }
 
-// run over tenant store and check if they all exist in extFwVersionEntries. Remove from Cumulocity if not.
-func syncCumulocityWithextFwVersionEntries(controller *FirmwareTenantController, extFwVersionEntries []ExtFirmwareVersionEntry) {
-	slog.Info("Start synchronizing C8Y with external storage entries", "tenant", controller.tenantId)
-	for _, versionList := range controller.tenantStore.FirmwareVersionsByName {
-		for _, version := range versionList {
-			if !contains(extFwVersionEntries, version) {
-				mo, _, _ := controller.c8yClient.Inventory.GetManagedObject(controller.ctx, version.MoId, &c8y.ManagedObjectOptions{
-					WithParents: true,
-				})
-				createdByService := mo.Item.Get("externalResourceOrigin").Exists()
-				if !createdByService {
-					continue
-				}
-				// delete Version
-				_, err := controller.c8yClient.Inventory.Delete(controller.ctx, version.MoId)
-				if err != nil {
-					slog.Error("Error while deleting firmware version. Stopping clean-up process for this version.", "versionMoId", version.MoId, "firmwareName", version.FwName, "fwVersion", version.Version, "err", err)
-					continue
-				}
-				slog.Info("Deleted Firmware Version", "versionMoId", version.MoId, "firmwareName", version.FwName, "fwVersion", version.Version)
-
-				// check if parent has still other child-additions. Delete Parent if not.
-				childAdditions, _, err := controller.c8yClient.Inventory.GetChildAdditions(controller.ctx, version.FwMoId, &c8y.ManagedObjectOptions{
-					PaginationOptions: c8y.PaginationOptions{
-						PageSize: 1,
-					},
-				})
-				if err != nil {
-					slog.Error("Error while requesting childadditions. Parent will not be deleted", "firmwareName", version.FwName, "firmwareMoId", version.FwMoId, "err", err)
-					continue
-				}
-				if len(childAdditions.References) == 0 {
-					slog.Info("Firmware does not have any child-additions anymore, deleting it ...", "firmware", version.FwName)
-					controller.c8yClient.Inventory.Delete(controller.ctx, version.FwMoId)
-				}
-			}
+// deletes a firmware version which could not be completely created, so that no unreferenced version objects are left behind
+func rollbackFirmwareVersion(controller *FirmwareTenantController, versionMoId string) {
+	if _, err := controller.c8yClient.Inventory.Delete(controller.ctx, versionMoId); err != nil {
+		slog.Warn("Could not roll back creation of firmware version. Object is left behind.", "versionMoId", versionMoId, "err", err)
+	}
+}
+
+// deletes a firmware version, its firmware is deleted as well once it has no versions left
+func deleteFirmwareVersion(controller *FirmwareTenantController, version FirmwareStoreVersionEntry) error {
+	_, err := controller.c8yClient.Inventory.Delete(controller.ctx, version.MoId)
+	if err != nil {
+		slog.Error("Error while deleting firmware version. Stopping clean-up process for this version.", "versionMoId", version.MoId, "firmwareName", version.FwName, "fwVersion", version.Version, "err", err)
+		return err
+	}
+	slog.Info("Deleted Firmware Version", "versionMoId", version.MoId, "firmwareName", version.FwName, "fwVersion", version.Version)
+	controller.tenantStore.RemoveFirmwareVersion(version.FwName, version.Version)
+
+	// check if parent has still other child-additions. Delete Parent if not.
+	childAdditions, _, err := controller.c8yClient.Inventory.GetChildAdditions(controller.ctx, version.FwMoId, &c8y.ManagedObjectOptions{
+		PaginationOptions: c8y.PaginationOptions{
+			PageSize: 1,
+		},
+	})
+	if err != nil {
+		slog.Error("Error while requesting childadditions. Parent will not be deleted", "firmwareName", version.FwName, "firmwareMoId", version.FwMoId, "err", err)
+		return nil
+	}
+	if len(childAdditions.References) == 0 {
+		slog.Info("Firmware does not have any child-additions anymore, deleting it ...", "firmware", version.FwName)
+		if _, err := controller.c8yClient.Inventory.Delete(controller.ctx, version.FwMoId); err == nil {
+			controller.tenantStore.RemoveFirmware(version.FwName)
 		}
 	}
+	return nil
+}
+
+// marks a firmware version as archived and detaches it from its firmware, so it is hidden in the UI but kept for history
+func archiveFirmwareVersion(controller *FirmwareTenantController, version FirmwareStoreVersionEntry) error {
+	_, _, err := controller.c8yClient.Inventory.Update(controller.ctx, version.MoId, &FirmwareVersion{
+		C8yFirmware: &C8yFirmware{
+			Url:     version.URL,
+			Version: version.Version,
+		},
+		Archived: &Archived{
+			Time:         time.Now().Format(time.RFC3339),
+			FirmwareMoId: version.FwMoId,
+			FirmwareName: version.FwName,
+		},
+	})
+	if err != nil {
+		slog.Error("Error while archiving firmware version. Stopping clean-up process for this version.", "versionMoId", version.MoId, "firmwareName", version.FwName, "fwVersion", version.Version, "err", err)
+		return err
+	}
+	_, err = controller.c8yClient.SendRequest(controller.ctx, c8y.RequestOptions{
+		Method: "DELETE",
+		Path:   fmt.Sprintf("inventory/managedObjects/%s/childAdditions/%s", version.FwMoId, version.MoId),
+	})
+	if err != nil {
+		slog.Error("Error while detaching archived firmware version from firmware", "versionMoId", version.MoId, "firmwareMoId", version.FwMoId, "err", err)
+		return err
+	}
+	slog.Info("Archived Firmware Version", "versionMoId", version.MoId, "firmwareName", version.FwName, "fwVersion", version.Version)
+	controller.tenantStore.RemoveFirmwareVersion(version.FwName, version.Version)
+	controller.tenantStore.AddArchivedFirmwareVersion(version)
+
+	// firmware objects without any versions left are marked as archived as well (but not detached or deleted)
+	childAdditions, _, err := controller.c8yClient.Inventory.GetChildAdditions(controller.ctx, version.FwMoId, &c8y.ManagedObjectOptions{
+		PaginationOptions: c8y.PaginationOptions{
+			PageSize: 1,
+		},
+	})
+	if err != nil {
+		slog.Error("Error while requesting childadditions. Parent will not be archived", "firmwareName", version.FwName, "firmwareMoId", version.FwMoId, "err", err)
+		return nil
+	}
+	if len(childAdditions.References) == 0 {
+		slog.Info("Firmware does not have any child-additions anymore, archiving it ...", "firmware", version.FwName)
+		controller.c8yClient.Inventory.Update(controller.ctx, version.FwMoId, map[string]any{
+			s.FRAGMENT_ARCHIVED: &Archived{Time: time.Now().Format(time.RFC3339)},
+		})
+	}
+	return nil
 }
 
 func contains(extFwVersionEntries []ExtFirmwareVersionEntry, storeEntry FirmwareStoreVersionEntry) bool {
@@ -231,80 +464,207 @@ func contains(extFwVersionEntries []ExtFirmwareVersionEntry, storeEntry Firmware
 	return false
 }
 
-// scans tenants firmware repository and caches it to tenant store
-func (c *FirmwareTenantController) rebuildTenantStore() {
+// scans tenants firmware repository and caches it to tenant store.
+// Firmware objects are collected with one (paged) query, the firmware versions with another one (incl. their parents). Versions
+// not created by the service are cached as well, so that index entries of the same name and version don't create duplicates.
+// Firmware objects are queried on their own, as the ones without versions created by the service need to be reused as well.
+func (c *FirmwareTenantController) rebuildTenantStore() error {
 	c.tenantStore.Flush()
 	slog.Info("Rebuilding Tenant Store", "tenant", c.tenantId)
 	tenantName := c.c8yClient.GetTenantName(c.ctx)
 	// collect all firmware objects
 	cp := 1
 	for {
-		firmwares, _, _ := c.c8yClient.Inventory.GetManagedObjects(
+		firmwares, _, err := c.c8yClient.Inventory.GetManagedObjects(
 			c.ctx, &c8y.ManagedObjectOptions{
 				Type: "c8y_Firmware",
 				PaginationOptions: c8y.PaginationOptions{
-					PageSize:       100,
+					PageSize:       2000,
 					CurrentPage:    &cp,
 					WithTotalPages: true,
 				},
 			},
 		)
+		if err != nil {
+			slog.Error("Error while requesting firmware objects. Tenant Store could not be rebuilt.", "tenant", c.tenantId, "err", err)
+			return err
+		}
 		if len(firmwares.ManagedObjects) == 0 {
 			break
 		}
-
-		// iterate over firmware items, collect child-additions and register everything in the store
 		for _, fwObject := range firmwares.Items {
-			firmwareId := fwObject.Get("id").String()
-			firmwareName := fwObject.Get("name").String()
-
-			icp := 1
-			for {
-				childAdditionReferences, resp, _ := c.c8yClient.Inventory.GetChildAdditions(c.ctx, firmwareId, &c8y.ManagedObjectOptions{
-					PaginationOptions: c8y.PaginationOptions{
-						PageSize:       100,
-						CurrentPage:    &icp,
-						WithTotalPages: true,
-					},
-					Query: "type eq c8y_FirmwareBinary",
-				})
-				if len(childAdditionReferences.References) == 0 {
-					break
-				}
-				c.tenantStore.AddFirmware(FirmwareStoreFwEntry{
-					TenantId: tenantName,
-					MoId:     firmwareId,
-					MoName:   firmwareName,
-					MoType:   fwObject.Get("type").String(),
-				})
-
-				for _, ref := range resp.JSON("references").Array() {
-					isPatch := ref.Get("managedObject.c8y_Patch").Exists()
-					patchDependency := ref.Get("managedObject.c8y_Patch.dependency").String()
-					fw := FirmwareStoreVersionEntry{
-						TenantId:          tenantName,
-						MoId:              ref.Get("managedObject.id").String(),
-						MoType:            ref.Get("managedObject.type").String(),
-						FwName:            firmwareName,
-						FwMoId:            firmwareId,
-						IsPatch:           isPatch,
-						PatchDependency:   patchDependency,
-						Version:           ref.Get("managedObject.c8y_Firmware.version").String(),
-						URL:               ref.Get("managedObject.c8y_Firmware.url").String(),
-						HasExternalOrigin: ref.Get("externalResourceOrigin").Exists(),
-					}
-					c.tenantStore.AddFirmwareVersion(fw)
-				}
-				if *childAdditionReferences.Statistics.TotalPages == *childAdditionReferences.Statistics.CurrentPage {
-					break
-				}
-				icp++
+			c.tenantStore.AddFirmware(FirmwareStoreFwEntry{
+				TenantId: tenantName,
+				MoId:     fwObject.Get("id").String(),
+				MoName:   fwObject.Get("name").String(),
+				MoType:   fwObject.Get("type").String(),
+			})
+		}
+		if isLastPage(firmwares.BaseResponse, len(firmwares.ManagedObjects), 2000) {
+			break
+		}
+		cp++
+	}
+
+	// collect all firmware versions created by the service (incl. archived ones which are not referenced by any firmware anymore)
+	vcp := 1
+	for {
+		versions, _, err := c.c8yClient.Inventory.GetManagedObjects(
+			c.ctx, &c8y.ManagedObjectOptions{
+				Type:        "c8y_FirmwareBinary",
+				WithParents: true,
+				PaginationOptions: c8y.PaginationOptions{
+					PageSize:       2000,
+					CurrentPage:    &vcp,
+					WithTotalPages: true,
+				},
+			},
+		)
+		if err != nil {
+			slog.Error("Error while requesting firmware versions. Tenant Store could not be rebuilt.", "tenant", c.tenantId, "err", err)
+			return err
+		}
+		if len(versions.ManagedObjects) == 0 {
+			break
+		}
+		for _, versionObject := range versions.Items {
+			fw := FirmwareStoreVersionEntry{
+				TenantId:          tenantName,
+				MoId:              versionObject.Get("id").String(),
+				MoType:            versionObject.Get("type").String(),
+				FwName:            versionObject.Get("name").String(),
+				IsPatch:           versionObject.Get("c8y_Patch").Exists(),
+				PatchDependency:   versionObject.Get("c8y_Patch.dependency").String(),
+				Version:           versionObject.Get("c8y_Firmware.version").String(),
+				URL:               versionObject.Get("c8y_Firmware.url").String(),
+				HasExternalOrigin: versionObject.Get("externalResourceOrigin").Exists(),
+			}
+			if versionObject.Get(s.FRAGMENT_ARCHIVED).Exists() {
+				fw.FwMoId = versionObject.Get(s.FRAGMENT_ARCHIVED + ".firmwareId").String()
+				c.tenantStore.AddArchivedFirmwareVersion(fw)
+				continue
+			}
+			parent := versionObject.Get("additionParents.references.0.managedObject")
+			if !parent.Exists() {
+				slog.Debug("Firmware version is not assigned to any firmware. Ignoring it.", "tenant", c.tenantId, "versionMoId", fw.MoId)
+				continue
+			}
+			fw.FwMoId = parent.Get("id").String()
+			if parentName := parent.Get("name").String(); len(parentName) > 0 {
+				fw.FwName = parentName
+			}
+			c.tenantStore.AddFirmwareVersion(fw)
+		}
+		if isLastPage(versions.BaseResponse, len(versions.ManagedObjects), 2000) {
+			break
+		}
+		vcp++
+	}
+	c.tenantStore.MarkRebuilt()
+	return nil
+}
+
+// a page is the last one if it is not full, or if the statistics say so. The statistics are optional in the responses.
+func isLastPage(response *c8y.BaseResponse, items int, pageSize int) bool {
+	if items < pageSize {
+		return true
+	}
+	if response == nil || response.Statistics == nil || response.Statistics.CurrentPage == nil || response.Statistics.TotalPages == nil {
+		return false
+	}
+	return *response.Statistics.CurrentPage >= *response.Statistics.TotalPages
+}
+
+// removes the firmware version objects the service created in the tenant and the firmware objects it created that have no versions
+// left (e.g. firmware with manually created versions is kept). Returns the amount of removed objects.
+// Needs to run while the tenant is still subscribed, as the credentials of the service user are invalid afterwards.
+func (c *FirmwareTenantController) RemoveCreatedFirmwareObjects() (int, error) {
+	c.syncMu.Lock()
+	defer c.syncMu.Unlock()
+	slog.Info("Removing firmware objects created by the service", "tenant", c.tenantId)
+	defer c.tenantStore.Invalidate()
+	deleted := 0
+	for {
+		// objects are deleted while iterating, so always request the first page
+		versions, _, err := c.c8yClient.Inventory.GetManagedObjects(
+			c.ctx, &c8y.ManagedObjectOptions{
+				Query: "type eq c8y_FirmwareBinary and has(externalResourceOrigin)",
+				PaginationOptions: c8y.PaginationOptions{
+					PageSize: 100,
+				},
+			},
+		)
+		if err != nil {
+			slog.Warn("Error while requesting firmware versions for clean-up. Objects are left behind in tenant.", "tenant", c.tenantId, "err", err)
+			return deleted, err
+		}
+		if len(versions.ManagedObjects) == 0 {
+			break
+		}
+		deletedInPage := 0
+		for _, mo := range versions.ManagedObjects {
+			if _, err := c.c8yClient.Inventory.Delete(c.ctx, mo.ID); err != nil {
+				slog.Warn("Error while deleting firmware version during clean-up", "tenant", c.tenantId, "moId", mo.ID, "err", err)
+				continue
 			}
+			deletedInPage++
 		}
+		if deletedInPage == 0 {
+			slog.Warn("Could not delete any of the remaining firmware versions. Objects are left behind in tenant.", "tenant", c.tenantId)
+			return deleted, fmt.Errorf("%d firmware versions could not be deleted", len(versions.ManagedObjects))
+		}
+		deleted += deletedInPage
+	}
 
-		if *firmwares.Statistics.CurrentPage == *firmwares.Statistics.TotalPages {
+	// the firmware objects are collected first, as the ones with versions left stay and would shift the pages while deleting
+	var firmwareIds []string
+	for cp := 1; ; cp++ {
+		firmwares, _, err := c.c8yClient.Inventory.GetManagedObjects(
+			c.ctx, &c8y.ManagedObjectOptions{
+				Query: "type eq c8y_Firmware and has(externalResourceOrigin)",
+				PaginationOptions: c8y.PaginationOptions{
+					PageSize:    100,
+					CurrentPage: &cp,
+				},
+			},
+		)
+		if err != nil {
+			slog.Warn("Error while requesting firmwares for clean-up. Objects are left behind in tenant.", "tenant", c.tenantId, "err", err)
+			return deleted, err
+		}
+		for _, mo := range firmwares.ManagedObjects {
+			firmwareIds = append(firmwareIds, mo.ID)
+		}
+		if len(firmwares.ManagedObjects) < 100 {
 			break
 		}
-		cp++
 	}
+	var failed int
+	for _, firmwareId := range firmwareIds {
+		childAdditions, _, err := c.c8yClient.Inventory.GetChildAdditions(c.ctx, firmwareId, &c8y.ManagedObjectOptions{
+			PaginationOptions: c8y.PaginationOptions{
+				PageSize: 1,
+			},
+		})
+		if err != nil {
+			slog.Warn("Error while requesting childadditions during clean-up. Firmware is left behind in tenant.", "tenant", c.tenantId, "moId", firmwareId, "err", err)
+			failed++
+			continue
+		}
+		if len(childAdditions.References) > 0 {
+			slog.Info("Firmware still has versions that were not created by the service, keeping it", "tenant", c.tenantId, "moId", firmwareId)
+			continue
+		}
+		if _, err := c.c8yClient.Inventory.Delete(c.ctx, firmwareId); err != nil {
+			slog.Warn("Error while deleting firmware during clean-up", "tenant", c.tenantId, "moId", firmwareId, "err", err)
+			failed++
+			continue
+		}
+		deleted++
+	}
+	if failed > 0 {
+		return deleted, fmt.Errorf("%d firmwares could not be removed", failed)
+	}
+	slog.Info("Removed firmware objects created by the service", "tenant", c.tenantId, "count", deleted)
+	return deleted, nil
 }
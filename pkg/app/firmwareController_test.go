@@ -0,0 +1,224 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kobu/c8y-devmgmt-repo-intgr/internal/c8ytest"
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+)
+
+// creates a firmware repository in the tenant, firmwareCount firmwares with versionsPerFw versions each (assigned as child additions).
+// Returns the ids of the firmwares and of their versions.
+func createFirmwareRepository(fake *c8ytest.Server, tenantId string, firmwareCount int, versionsPerFw int) ([]string, [][]string) {
+	firmwareIds := make([]string, firmwareCount)
+	versionIds := make([][]string, firmwareCount)
+	for i := range firmwareCount {
+		firmwareIds[i] = fake.CreateManagedObject(tenantId, map[string]any{
+			"name": fmt.Sprintf("firmware %d", i),
+			"type": "c8y_Firmware",
+		})
+		for j := range versionsPerFw {
+			versionId := fake.CreateManagedObject(tenantId, map[string]any{
+				"name":                   fmt.Sprintf("firmware %d", i),
+				"type":                   "c8y_FirmwareBinary",
+				"c8y_Firmware":           map[string]any{"version": fmt.Sprintf("1.0.%d", j), "url": "https://example.com"},
+				"externalResourceOrigin": map[string]any{"provider": "memory", "objectKey": fmt.Sprintf("fw-%d_1.0.%d.zip", i, j)},
+			})
+			fake.AddChildAddition(tenantId, firmwareIds[i], versionId)
+			versionIds[i] = append(versionIds[i], versionId)
+		}
+	}
+	return firmwareIds, versionIds
+}
+
+func TestRebuildTenantStoreWithoutStatistics(t *testing.T) {
+	fake := c8ytest.NewServer(t, testServiceTenant, testContextPath)
+	controller := newRepositoryController(fake, "t1")
+	createFirmwareRepository(fake, "t1", 3, 2)
+	fake.CreateManagedObject("t1", map[string]any{"name": "device", "c8y_IsDevice": map[string]any{}, "c8y_Firmware": map[string]any{"name": "firmware 1", "version": "1.0.1"}})
+	// the statistics are optional in the responses, paging must not depend on them
+	fake.SetRequestHook(func(w http.ResponseWriter, r *http.Request, serve http.HandlerFunc) {
+		recorder := httptest.NewRecorder()
+		serve(recorder, r)
+		body := map[string]any{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &body); err == nil {
+			delete(body, "statistics")
+		}
+		w.Header().Set("Content-Type", recorder.Header().Get("Content-Type"))
+		w.WriteHeader(recorder.Code)
+		json.NewEncoder(w).Encode(body)
+	})
+
+	if err := controller.rebuildTenantStore(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := len(controller.tenantStore.GetFirmwareVersions()); got != 6 {
+		t.Errorf("expected 6 firmware versions in tenant store, got %d", got)
+	}
+	if installed, err := getInstalledFirmwareVersions(controller); err != nil || installed[FirmwareVersionKey{Name: "firmware 1", Version: "1.0.1"}] != 1 {
+		t.Errorf("expected installed firmware version, got %v %v", installed, err)
+	}
+}
+
+// previous implementation of rebuildTenantStore (paging all firmware objects and their child-additions), kept as benchmark baseline
+func rebuildTenantStoreByChildAdditions(c *FirmwareTenantController) {
+	c.tenantStore.Flush()
+	cp := 1
+	for {
+		firmwares, _, _ := c.c8yClient.Inventory.GetManagedObjects(c.ctx, &c8y.ManagedObjectOptions{
+			Type:              "c8y_Firmware",
+			PaginationOptions: c8y.PaginationOptions{PageSize: 100, CurrentPage: &cp, WithTotalPages: true},
+		})
+		if len(firmwares.ManagedObjects) == 0 {
+			break
+		}
+		for _, fwObject := range firmwares.Items {
+			firmwareId := fwObject.Get("id").String()
+			firmwareName := fwObject.Get("name").String()
+			icp := 1
+			for {
+				childAdditionReferences, resp, _ := c.c8yClient.Inventory.GetChildAdditions(c.ctx, firmwareId, &c8y.ManagedObjectOptions{
+					PaginationOptions: c8y.PaginationOptions{PageSize: 100, CurrentPage: &icp, WithTotalPages: true},
+					Query:             "type eq c8y_FirmwareBinary",
+				})
+				if len(childAdditionReferences.References) == 0 {
+					break
+				}
+				c.tenantStore.AddFirmware(FirmwareStoreFwEntry{MoId: firmwareId, MoName: firmwareName})
+				for _, ref := range resp.JSON("references").Array() {
+					c.tenantStore.AddFirmwareVersion(FirmwareStoreVersionEntry{
+						MoId:    ref.Get("managedObject.id").String(),
+						FwName:  firmwareName,
+						FwMoId:  firmwareId,
+						Version: ref.Get("managedObject.c8y_Firmware.version").String(),
+					})
+				}
+				if *childAdditionReferences.Statistics.TotalPages == *childAdditionReferences.Statistics.CurrentPage {
+					break
+				}
+				icp++
+			}
+		}
+		if *firmwares.Statistics.CurrentPage == *firmwares.Statistics.TotalPages {
+			break
+		}
+		cp++
+	}
+}
+
+// returns a controller of a tenant of the fake, authenticated as a user of the tenant
+func newRepositoryController(fake *c8ytest.Server, tenantId string) *FirmwareTenantController {
+	fake.AddTenant(tenantId, tenantId+".c8y.example.com")
+	fake.AddUser(tenantId, c8ytest.User{Username: "admin", Password: "secret"})
+	return &FirmwareTenantController{
+		tenantStore: NewFirmwareTenantStore(),
+		ctx:         context.Background(),
+		c8yClient:   c8y.NewClient(nil, fake.URL, tenantId, "admin", "secret", true),
+		tenantId:    tenantId,
+	}
+}
+
+func TestRebuildTenantStore(t *testing.T) {
+	fake := c8ytest.NewServer(t, testServiceTenant, testContextPath)
+	controller := newRepositoryController(fake, "t1")
+	firmwareIds, versionIds := createFirmwareRepository(fake, "t1", 30, 4)
+
+	if err := controller.rebuildTenantStore(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !controller.tenantStore.IsFresh(time.Minute) {
+		t.Errorf("expected tenant store to be fresh after rebuild")
+	}
+	if got := len(controller.tenantStore.GetFirmwareVersions()); got != 120 {
+		t.Errorf("expected 120 firmware versions in tenant store, got %d", got)
+	}
+	version, ok := controller.tenantStore.GetFirmwareVersion("firmware 7", "1.0.3")
+	if !ok {
+		t.Fatalf("expected firmware version 'firmware 7' 1.0.3 in tenant store")
+	}
+	if version.FwMoId != firmwareIds[7] || version.MoId != versionIds[7][3] || !version.HasExternalOrigin {
+		t.Errorf("unexpected firmware version entry: %+v", version)
+	}
+	if fw, ok := controller.tenantStore.GetFirmware("firmware 29"); !ok || fw.MoId != firmwareIds[29] {
+		t.Errorf("expected firmware 'firmware 29' with id %s in tenant store, got %+v", firmwareIds[29], fw)
+	}
+}
+
+// go test -run '^$' -bench RebuildTenantStore -benchtime 3x ./pkg/app/
+func BenchmarkRebuildTenantStore(b *testing.B) {
+	c8y.SilenceLogger()
+	defer c8y.UnsilenceLogger()
+	fake := c8ytest.NewServer(b, testServiceTenant, testContextPath)
+	controller := newRepositoryController(fake, "t1")
+	createFirmwareRepository(fake, "t1", 1000, 10)
+	// simulated network round trip per request
+	fake.SetRequestHook(func(w http.ResponseWriter, r *http.Request, serve http.HandlerFunc) {
+		time.Sleep(time.Millisecond)
+		serve(w, r)
+	})
+
+	b.Run("childAdditionScan", func(b *testing.B) {
+		requests := fake.Requests()
+		for range b.N {
+			rebuildTenantStoreByChildAdditions(controller)
+		}
+		b.ReportMetric(float64(fake.Requests()-requests)/float64(b.N), "requests/op")
+	})
+	b.Run("singleQuery", func(b *testing.B) {
+		requests := fake.Requests()
+		for range b.N {
+			controller.rebuildTenantStore()
+		}
+		b.ReportMetric(float64(fake.Requests()-requests)/float64(b.N), "requests/op")
+	})
+}
+
+func TestSyncWithIndexFilesSkipsUnchangedInput(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.subscribe("t1")
+	controller, _ := env.controllers.Get("t1")
+	entries, infos := ParseExtFwVersionContents(testVersionsIndex), ParseExtFwInfoContents(testInfoIndex)
+	syncWith := func(inputHash string) (TenantSyncResult, int) {
+		requests := env.c8y.Requests()
+		result := controller.SyncWithIndexFiles(context.Background(), entries, infos, inputHash)
+		return result, env.c8y.Requests() - requests
+	}
+
+	if result, _ := syncWith("hash-1"); result.Unchanged || result.Created != 2 || !result.Success() {
+		t.Fatalf("expected initial synchronization to create the versions, got %+v", result)
+	}
+	if result, requests := syncWith("hash-1"); !result.Unchanged || requests != 0 {
+		t.Errorf("expected unchanged input hash to skip the tenant without requests, got %+v (%d requests)", result, requests)
+	}
+	if result, requests := syncWith("hash-2"); result.Unchanged || requests == 0 || !result.Success() {
+		t.Errorf("expected changed input hash to synchronize the tenant, got %+v (%d requests)", result, requests)
+	}
+	if state := controller.SyncState(); state.LastKnownInputHash != "hash-2" || !state.LastSyncSuccessful {
+		t.Errorf("expected changed input hash to be persisted, got %+v", state)
+	}
+
+	// a failed synchronization is retried even though the input hash did not change
+	controller.updateSyncState(func(state *TenantSyncState) { state.LastSyncSuccessful = false })
+	if result, _ := syncWith("hash-2"); result.Unchanged {
+		t.Errorf("expected failed synchronization to be retried, got %+v", result)
+	}
+
+	// a due full resync bypasses the skip and rebuilds the tenant store
+	lastFullSync := time.Now().Add(-2 * time.Hour)
+	controller.updateSyncState(func(state *TenantSyncState) { state.LastFullSync = lastFullSync })
+	if result, _ := syncWith("hash-2"); result.Unchanged || !result.Success() {
+		t.Errorf("expected due full resync to synchronize the tenant, got %+v", result)
+	}
+	if state := controller.SyncState(); !state.LastFullSync.After(lastFullSync) {
+		t.Errorf("expected full resync to be recorded, got %+v", state)
+	}
+	if result, _ := syncWith("hash-2"); !result.Unchanged {
+		t.Errorf("expected tenant to be skipped again after the full resync, got %+v", result)
+	}
+}
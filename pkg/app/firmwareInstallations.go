@@ -0,0 +1,108 @@
+package app
+
+import (
+	"fmt"
+	"log/slog"
+
+	s "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/static"
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+)
+
+type FirmwareVersionKey struct {
+	Name    string
+	Version string
+}
+
+// collects the firmware versions reported as installed by the tenants devices. key = firmware name/version, value = number of devices
+func getInstalledFirmwareVersions(controller *FirmwareTenantController) (map[FirmwareVersionKey]int, error) {
+	res := make(map[FirmwareVersionKey]int)
+	cp := 1
+	for {
+		devices, _, err := controller.c8yClient.Inventory.GetManagedObjects(
+			controller.ctx, &c8y.ManagedObjectOptions{
+				Query: "has(c8y_IsDevice) and has(c8y_Firmware)",
+				PaginationOptions: c8y.PaginationOptions{
+					PageSize:       2000,
+					CurrentPage:    &cp,
+					WithTotalPages: true,
+				},
+			},
+		)
+		if err != nil {
+			slog.Error("Error while requesting devices with installed firmware", "tenant", controller.tenantId, "err", err)
+			return nil, err
+		}
+		if len(devices.ManagedObjects) == 0 {
+			break
+		}
+		for _, device := range devices.Items {
+			key := FirmwareVersionKey{
+				Name:    device.Get("c8y_Firmware.name").String(),
+				Version: device.Get("c8y_Firmware.version").String(),
+			}
+			if len(key.Name) == 0 {
+				continue
+			}
+			res[key]++
+		}
+		if isLastPage(devices.BaseResponse, len(devices.ManagedObjects), 2000) {
+			break
+		}
+		cp++
+	}
+	return res, nil
+}
+
+// installedVersionsLookup requests the installed firmware versions at most once per synchronization, as it scans all devices
+// of the tenant. The retention policy and the removals share it, the devices are only requested if either needs them.
+type installedVersionsLookup struct {
+	controller *FirmwareTenantController
+	done       bool
+	versions   map[FirmwareVersionKey]int
+	err        error
+}
+
+func newInstalledVersionsLookup(controller *FirmwareTenantController) *installedVersionsLookup {
+	return &installedVersionsLookup{controller: controller}
+}
+
+func (l *installedVersionsLookup) get() (map[FirmwareVersionKey]int, error) {
+	if !l.done {
+		l.versions, l.err = getInstalledFirmwareVersions(l.controller)
+		l.done = true
+	}
+	return l.versions, l.err
+}
+
+// raises a warning alarm on the firmware version, informing that it can't be removed as it is installed on devices.
+// Cumulocity de-duplicates active alarms of the same type and source, so this can be called on each synchronization.
+func raiseRemovalBlockedAlarm(controller *FirmwareTenantController, version FirmwareStoreVersionEntry, deviceCount int) {
+	_, _, err := controller.c8yClient.Alarm.Create(controller.ctx, c8y.Alarm{
+		Source:   &c8y.Source{ID: version.MoId},
+		Type:     s.ALARM_TYPE_REMOVAL_BLOCKED,
+		Time:     c8y.NewTimestamp(),
+		Severity: c8y.AlarmSeverityWarning,
+		Text:     fmt.Sprintf("Firmware '%s' version '%s' was removed from the index files but is still installed on %d device(s). Removal is deferred until it is not installed anymore.", version.FwName, version.Version, deviceCount),
+	})
+	if err != nil {
+		slog.Error("Error while raising alarm for deferred firmware version removal", "versionMoId", version.MoId, "err", err)
+	}
+}
+
+// clears the alarm raised by raiseRemovalBlockedAlarm (if any), alarms of other types on the firmware version are left untouched
+func clearRemovalBlockedAlarm(controller *FirmwareTenantController, version FirmwareStoreVersionEntry) {
+	alarms, _, err := controller.c8yClient.Alarm.GetAlarms(controller.ctx, &c8y.AlarmCollectionOptions{
+		Source: version.MoId,
+		Type:   s.ALARM_TYPE_REMOVAL_BLOCKED,
+		Status: c8y.AlarmStatusActive,
+	})
+	if err != nil {
+		slog.Warn("Error while requesting alarms of firmware version", "versionMoId", version.MoId, "err", err)
+		return
+	}
+	for _, alarm := range alarms.Alarms {
+		if _, _, err := controller.c8yClient.Alarm.Update(controller.ctx, alarm.ID, c8y.AlarmUpdateProperties{Status: c8y.AlarmStatusCleared}); err != nil {
+			slog.Warn("Error while clearing alarm of firmware version", "versionMoId", version.MoId, "alarmId", alarm.ID, "err", err)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/kobu/c8y-devmgmt-repo-intgr/internal/model"
+	est "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/externalstorage"
+)
+
+// attempts to append entries to the index files if they are changed concurrently
+const maxIndexWriteAttempts = 3
+
+var unsafeObjectKeyChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// replaces characters that are not safe in object keys, e.g. "my firmware 1" -> "my-firmware-1"
+func sanitizeObjectKeySegment(segment string) string {
+	return strings.Trim(unsafeObjectKeyChars.ReplaceAllString(segment, "-"), "-.")
+}
+
+// returns the segment if it is safe in object keys. Otherwise the sanitized segment is suffixed with a hash of the segment, so
+// that different names (e.g. "fw 1" and "fw-1") don't share the same object key.
+func objectKeySegment(segment string) string {
+	sanitized := sanitizeObjectKeySegment(segment)
+	if sanitized == segment {
+		return segment
+	}
+	hash := sha256.Sum256([]byte(segment))
+	return sanitized + "-" + hex.EncodeToString(hash[:4])
+}
+
+// objectKeyForPublishedVersion returns <uploadPrefix><name>/<version>/<file name>
+func objectKeyForPublishedVersion(uploadPrefix string, req model.PublishRequest) string {
+	name, version := objectKeySegment(req.Name), objectKeySegment(req.Version)
+	fileName := sanitizeObjectKeySegment(path.Base(strings.ReplaceAll(req.FileName, "\\", "/")))
+	if len(fileName) == 0 {
+		fileName = name + "_" + version
+	}
+	return uploadPrefix + name + "/" + version + "/" + fileName
+}
+
+func validatePublishRequest(req model.PublishRequest) error {
+	var missing []string
+	for _, field := range [][2]string{{"name", req.Name}, {"version", req.Version}} {
+		if len(strings.TrimSpace(field[1])) == 0 {
+			missing = append(missing, field[0])
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: missing mandatory fields %v", model.ErrInvalidPublishRequest, missing)
+	}
+	if len(sanitizeObjectKeySegment(req.Name)) == 0 || len(sanitizeObjectKeySegment(req.Version)) == 0 {
+		return fmt.Errorf("%w: name and version need to contain letters or digits", model.ErrInvalidPublishRequest)
+	}
+	return nil
+}
+
+// PublishFirmwareVersion uploads the binary below uploadPrefix and appends the version (and if needed the firmware) to the
+// index files. size is -1 if unknown. Existing objects are never overwritten.
+func PublishFirmwareVersion(ctx context.Context, source est.Source, uploadPrefix string, req model.PublishRequest, body io.Reader, size int64) (ExtFirmwareVersionEntry, error) {
+	if err := validatePublishRequest(req); err != nil {
+		return ExtFirmwareVersionEntry{}, err
+	}
+	entry := ExtFirmwareVersionEntry{Key: objectKeyForPublishedVersion(uploadPrefix, req), Name: req.Name, Version: req.Version}
+	// fail fast, before uploading a potentially large binary
+	if err := checkVersionNotIndexed(ctx, source, entry); err != nil {
+		return ExtFirmwareVersionEntry{}, err
+	}
+	if _, err := source.Client.Write(ctx, entry.Key, body, size, est.WriteOptions{IfNoneMatch: true, ContentType: "application/octet-stream"}); err != nil {
+		if errors.Is(err, est.ErrPreconditionFailed) {
+			return ExtFirmwareVersionEntry{}, fmt.Errorf("%w: object '%s' already exists in storage", model.ErrVersionExists, entry.Key)
+		}
+		return ExtFirmwareVersionEntry{}, fmt.Errorf("could not upload %s: %w", entry.Key, err)
+	}
+	if err := registerIndexEntry(ctx, source, entry, ExtFirmwareInfoEntry{Name: req.Name, Description: req.Description, DeviceType: req.DeviceType}); err != nil {
+		// the object was created by this request, without removing it the version could not be published again
+		if deleteErr := source.Client.Delete(context.WithoutCancel(ctx), entry.Key); deleteErr != nil {
+			slog.Error("Could not remove uploaded object of unregistered firmware version. It needs to be registered via the upload completion or removed manually.", "objectKey", entry.Key, "err", deleteErr)
+		}
+		return ExtFirmwareVersionEntry{}, err
+	}
+	slog.Info("Published firmware version", "name", entry.Name, "version", entry.Version, "objectKey", entry.Key)
+	return entry, nil
+}
+
+func checkVersionNotIndexed(ctx context.Context, source est.Source, entry ExtFirmwareVersionEntry) error {
+	contentFwVersionFile, _, err := readIndexFileForUpdate(ctx, source.Client, source.VersionsFileName())
+	if err != nil {
+		return fmt.Errorf("could not read %s: %w", source.VersionsFileName(), err)
+	}
+	if indexContainsVersion(contentFwVersionFile, entry) {
+		return fmt.Errorf("%w: version '%s' of firmware '%s' is already indexed", model.ErrVersionExists, entry.Version, entry.Name)
+	}
+	// the object of another indexed version must neither be replaced nor removed
+	if indexReferencesKey(contentFwVersionFile, entry.Key) {
+		return fmt.Errorf("%w: object '%s' is already indexed", model.ErrVersionExists, entry.Key)
+	}
+	return nil
+}
+
+func indexReferencesKey(contentFwVersionFile string, objectKey string) bool {
+	for _, indexed := range ParseExtFwVersionContents(contentFwVersionFile) {
+		if indexed.Key == objectKey {
+			return true
+		}
+	}
+	return false
+}
+
+func indexContainsVersion(contentFwVersionFile string, entry ExtFirmwareVersionEntry) bool {
+	for _, indexed := range ParseExtFwVersionContents(contentFwVersionFile) {
+		if indexed.Name == entry.Name && indexed.Version == entry.Version {
+			return true
+		}
+	}
+	return false
+}
+
+// registerIndexEntry appends the version to the index files, incl. the firmware if it is not indexed yet. The files are written
+// conditionally and re-read on concurrent changes.
+func registerIndexEntry(ctx context.Context, source est.Source, entry ExtFirmwareVersionEntry, info ExtFirmwareInfoEntry) error {
+	if len(info.Description) == 0 {
+		info.Description = info.Name
+	}
+	var err error
+	for attempt := 1; attempt <= maxIndexWriteAttempts; attempt++ {
+		var proposal *IndexProposal
+		if proposal, err = readIndexProposal(ctx, source); err != nil {
+			return err
+		}
+		proposal.Versions = []ExtFirmwareVersionEntry{entry}
+		if indexContainsVersion(proposal.contentFwVersionFile, entry) {
+			return fmt.Errorf("%w: version '%s' of firmware '%s' is already indexed", model.ErrVersionExists, entry.Version, entry.Name)
+		}
+		if _, ok := ParseExtFwInfoContents(proposal.contentFwInfoFile)[entry.Name]; !ok {
+			proposal.Infos = []ExtFirmwareInfoEntry{info}
+		}
+		if err = proposal.Write(ctx, source.Client); !errors.Is(err, est.ErrPreconditionFailed) {
+			return err
+		}
+		slog.Info("Index files were changed concurrently, retrying", "name", entry.Name, "version", entry.Version, "attempt", attempt)
+	}
+	return err
+}
+
+// FirmwareUpload is a presigned upload of a firmware binary directly to the storage, to be completed via CompleteFirmwareUpload
+type FirmwareUpload struct {
+	Key    string              `json:"key"`
+	Upload est.PresignedUpload `json:"upload"`
+}
+
+// presigned uploads are only accepted with the size of the binary, which is verified on completion
+func validateUploadRequest(req model.PublishRequest) error {
+	if err := validatePublishRequest(req); err != nil {
+		return err
+	}
+	if req.Size <= 0 {
+		return fmt.Errorf("%w: size of the binary needs to be given in bytes", model.ErrInvalidPublishRequest)
+	}
+	return nil
+}
+
+// PrepareFirmwareUpload returns a presigned upload of the binary below uploadPrefix, for binaries too large to pass the service
+func PrepareFirmwareUpload(ctx context.Context, source est.Source, uploadPrefix string, req model.PublishRequest) (*FirmwareUpload, error) {
+	if err := validateUploadRequest(req); err != nil {
+		return nil, err
+	}
+	entry := ExtFirmwareVersionEntry{Key: objectKeyForPublishedVersion(uploadPrefix, req), Name: req.Name, Version: req.Version}
+	if err := checkVersionNotIndexed(ctx, source, entry); err != nil {
+		return nil, err
+	}
+	upload, err := source.Client.PresignUpload(ctx, entry.Key, req.Size)
+	if err != nil {
+		return nil, fmt.Errorf("could not presign upload of %s: %w", entry.Key, err)
+	}
+	slog.Info("Prepared firmware upload", "name", entry.Name, "version", entry.Version, "objectKey", entry.Key)
+	return &FirmwareUpload{Key: entry.Key, Upload: upload}, nil
+}
+
+// CompleteFirmwareUpload registers a binary uploaded via PrepareFirmwareUpload (same request) in the index files, once the
+// object exists with the announced size. Objects of a different size are removed, so that the upload can be repeated.
+func CompleteFirmwareUpload(ctx context.Context, source est.Source, uploadPrefix string, req model.PublishRequest) (ExtFirmwareVersionEntry, error) {
+	if err := validateUploadRequest(req); err != nil {
+		return ExtFirmwareVersionEntry{}, err
+	}
+	entry := ExtFirmwareVersionEntry{Key: objectKeyForPublishedVersion(uploadPrefix, req), Name: req.Name, Version: req.Version}
+	// the object of a published version is never touched, e.g. removed because of a wrong size
+	if err := checkVersionNotIndexed(ctx, source, entry); err != nil {
+		return ExtFirmwareVersionEntry{}, err
+	}
+	object, err := source.Client.Stat(ctx, entry.Key)
+	if errors.Is(err, est.ErrNotFound) {
+		return ExtFirmwareVersionEntry{}, fmt.Errorf("%w: object '%s' was not uploaded", model.ErrInvalidPublishRequest, entry.Key)
+	}
+	if err != nil {
+		return ExtFirmwareVersionEntry{}, fmt.Errorf("could not check %s: %w", entry.Key, err)
+	}
+	if object.Size != req.Size {
+		if err := source.Client.Delete(ctx, entry.Key); err != nil {
+			slog.Error("Could not remove uploaded object of unexpected size", "objectKey", entry.Key, "err", err)
+		}
+		return ExtFirmwareVersionEntry{}, fmt.Errorf("%w: object '%s' has %d bytes instead of %d, it was removed and needs to be uploaded again", model.ErrInvalidPublishRequest, entry.Key, object.Size, req.Size)
+	}
+	if err := registerIndexEntry(ctx, source, entry, ExtFirmwareInfoEntry{Name: req.Name, Description: req.Description, DeviceType: req.DeviceType}); err != nil {
+		return ExtFirmwareVersionEntry{}, err
+	}
+	slog.Info("Completed firmware upload", "name", entry.Name, "version", entry.Version, "objectKey", entry.Key, "size", object.Size)
+	return entry, nil
+}
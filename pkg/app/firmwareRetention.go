@@ -0,0 +1,135 @@
+package app
+
+import (
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+
+	s "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/static"
+)
+
+// reduces the index entries to the N newest versions per firmware (N = retentionVersions of the firmware info entry or the global setting).
+// Versions that are installed on any device of the tenant are always kept. A retention of 0 keeps all versions.
+func applyRetentionPolicy(controller *FirmwareTenantController, installed *installedVersionsLookup, extFwVersionEntries []ExtFirmwareVersionEntry, extFwInfoEntries map[string]ExtFirmwareInfoEntry) []ExtFirmwareVersionEntry {
+	retentionActive := controller.syncSettings.RetentionVersions > 0
+	for _, info := range extFwInfoEntries {
+		if info.RetentionVersions != nil && *info.RetentionVersions > 0 {
+			retentionActive = true
+		}
+	}
+	if !retentionActive {
+		return extFwVersionEntries
+	}
+
+	installedVersions, err := installed.get()
+	if err != nil {
+		slog.Warn("Could not determine installed firmware versions. Retention policy is not applied in this iteration.", "tenant", controller.tenantId, "err", err)
+		return extFwVersionEntries
+	}
+
+	// group index entries by firmware name (keeping their order in the index file)
+	var names []string
+	entriesByName := make(map[string][]ExtFirmwareVersionEntry)
+	for _, e := range extFwVersionEntries {
+		if _, ok := entriesByName[e.Name]; !ok {
+			names = append(names, e.Name)
+		}
+		entriesByName[e.Name] = append(entriesByName[e.Name], e)
+	}
+
+	var res []ExtFirmwareVersionEntry
+	for _, name := range names {
+		entries := entriesByName[name]
+		retention := controller.syncSettings.RetentionVersions
+		order := controller.syncSettings.RetentionOrder
+		if info, ok := extFwInfoEntries[name]; ok {
+			if info.RetentionVersions != nil {
+				retention = *info.RetentionVersions
+			}
+			if len(info.RetentionOrder) > 0 {
+				order = info.RetentionOrder
+			}
+		}
+		if retention <= 0 || len(entries) <= retention {
+			res = append(res, entries...)
+			continue
+		}
+
+		// newest entries first
+		sorted := slices.Clone(entries)
+		if order == s.RETENTION_ORDER_INDEX {
+			slices.Reverse(sorted)
+		} else {
+			slices.SortStableFunc(sorted, func(a, b ExtFirmwareVersionEntry) int {
+				return compareVersions(b.Version, a.Version)
+			})
+		}
+		for i, e := range sorted {
+			if i < retention {
+				res = append(res, e)
+				continue
+			}
+			if installedVersions[FirmwareVersionKey{Name: e.Name, Version: e.Version}] > 0 {
+				slog.Info("Keeping firmware version outside of retention as it is installed on devices", "tenant", controller.tenantId, "firmwareName", e.Name, "firmwareVersion", e.Version)
+				res = append(res, e)
+				continue
+			}
+			slog.Debug("Firmware version is outside of retention and will not be published", "tenant", controller.tenantId, "firmwareName", e.Name, "firmwareVersion", e.Version)
+		}
+	}
+	return res
+}
+
+// compares two (semantic) versions, returns -1 if a < b, 0 if a == b and 1 if a > b.
+// A leading "v" and build metadata are ignored, a pre-release version is lower than the same version without pre-release.
+// Non-numeric parts are compared lexicographically.
+func compareVersions(a string, b string) int {
+	aCore, aPre := splitVersion(a)
+	bCore, bPre := splitVersion(b)
+	if c := compareVersionParts(strings.Split(aCore, "."), strings.Split(bCore, ".")); c != 0 {
+		return c
+	}
+	switch {
+	case aPre == bPre:
+		return 0
+	case len(aPre) == 0:
+		return 1
+	case len(bPre) == 0:
+		return -1
+	}
+	return compareVersionParts(strings.Split(aPre, "."), strings.Split(bPre, "."))
+}
+
+func splitVersion(v string) (string, string) {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	v, _, _ = strings.Cut(v, "+")
+	core, pre, _ := strings.Cut(v, "-")
+	return core, pre
+}
+
+func compareVersionParts(a []string, b []string) int {
+	for i := 0; i < max(len(a), len(b)); i++ {
+		if i >= len(a) {
+			return -1
+		}
+		if i >= len(b) {
+			return 1
+		}
+		aNum, aErr := strconv.Atoi(a[i])
+		bNum, bErr := strconv.Atoi(b[i])
+		var c int
+		if aErr == nil && bErr == nil {
+			c = aNum - bNum
+		} else {
+			c = strings.Compare(a[i], b[i])
+		}
+		if c < 0 {
+			return -1
+		}
+		if c > 0 {
+			return 1
+		}
+	}
+	return 0
+}
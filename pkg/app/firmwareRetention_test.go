@@ -0,0 +1,118 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	s "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/static"
+)
+
+func TestCompareVersions(t *testing.T) {
+	for _, test := range []struct {
+		a, b     string
+		expected int
+	}{
+		// numeric parts are compared numerically, not lexically
+		{"1.10.0", "1.9.0", 1},
+		{"1.0.2", "1.0.10", -1},
+		{"2.0.0", "10.0.0", -1},
+		{"1.0.0", "1.0.0", 0},
+		// non-numeric parts are compared lexically
+		{"1.0.b", "1.0.a", 1},
+		{"1.0.10a", "1.0.9a", -1},
+		// pre-release versions are lower than the release
+		{"1.0.0-rc1", "1.0.0", -1},
+		{"1.0.0", "1.0.0-beta", 1},
+		{"1.0.0-alpha", "1.0.0-beta", -1},
+		{"1.0.0-rc.2", "1.0.0-rc.10", -1},
+		{"1.0.0-rc.1", "1.0.0-rc.1.1", -1},
+		{"1.0.1-rc1", "1.0.0", 1},
+		// unequal segment counts, more segments are higher
+		{"1.0", "1.0.0", -1},
+		{"1.0.0.1", "1.0.0", 1},
+		{"1", "1.0.1", -1},
+		// leading v and build metadata are ignored
+		{"v1.2.0", "1.2.0", 0},
+		{"1.2.0+build.5", "1.2.0+build.7", 0},
+		{"v2.0.0", "1.9.9", 1},
+	} {
+		if c := compareVersions(test.a, test.b); c != test.expected {
+			t.Errorf("compareVersions(%q, %q) = %d, expected %d", test.a, test.b, c, test.expected)
+		}
+		if c := compareVersions(test.b, test.a); c != -test.expected {
+			t.Errorf("compareVersions(%q, %q) = %d, expected %d", test.b, test.a, c, -test.expected)
+		}
+	}
+}
+
+func TestApplyRetentionPolicy(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.subscribe("t1")
+	controller, _ := env.controllers.Get("t1")
+	// installed versions outside of the retention are kept
+	env.c8y.CreateManagedObject("t1", map[string]any{"name": "device", "c8y_IsDevice": map[string]any{}, "c8y_Firmware": map[string]any{"name": "fw 1", "version": "1.0.0"}})
+	entries := func(name string, versions ...string) []ExtFirmwareVersionEntry {
+		var res []ExtFirmwareVersionEntry
+		for _, version := range versions {
+			res = append(res, ExtFirmwareVersionEntry{Name: name, Version: version})
+		}
+		return res
+	}
+	retention := func(n int) *int { return &n }
+	index := slices.Concat(entries("fw 1", "1.0.0", "1.10.0", "1.9.0", "1.10.1-rc1", "1.2.0"), entries("fw 2", "2.0.0", "1.0.0", "3.0.0"))
+	for _, test := range []struct {
+		name      string
+		retention int
+		order     string
+		infos     map[string]ExtFirmwareInfoEntry
+		expected  []string
+	}{
+		{"disabled", 0, s.RETENTION_ORDER_SEMVER, nil, []string{"fw 1@1.0.0", "fw 1@1.10.0", "fw 1@1.9.0", "fw 1@1.10.1-rc1", "fw 1@1.2.0", "fw 2@2.0.0", "fw 2@1.0.0", "fw 2@3.0.0"}},
+		{"semver keeps newest", 2, s.RETENTION_ORDER_SEMVER, nil, []string{"fw 1@1.10.1-rc1", "fw 1@1.10.0", "fw 1@1.0.0", "fw 2@3.0.0", "fw 2@2.0.0"}},
+		{"index keeps last entries", 2, s.RETENTION_ORDER_INDEX, nil, []string{"fw 1@1.2.0", "fw 1@1.10.1-rc1", "fw 1@1.0.0", "fw 2@3.0.0", "fw 2@1.0.0"}},
+		{"retention equal to versions keeps all", 3, s.RETENTION_ORDER_SEMVER, nil, []string{"fw 1@1.10.1-rc1", "fw 1@1.10.0", "fw 1@1.9.0", "fw 1@1.0.0", "fw 2@2.0.0", "fw 2@1.0.0", "fw 2@3.0.0"}},
+		{"retention of one", 1, s.RETENTION_ORDER_SEMVER, nil, []string{"fw 1@1.10.1-rc1", "fw 1@1.0.0", "fw 2@3.0.0"}},
+		{"firmware overrides retention", 0, s.RETENTION_ORDER_SEMVER, map[string]ExtFirmwareInfoEntry{"fw 2": {Name: "fw 2", RetentionVersions: retention(1), RetentionOrder: s.RETENTION_ORDER_INDEX}},
+			[]string{"fw 1@1.0.0", "fw 1@1.10.0", "fw 1@1.9.0", "fw 1@1.10.1-rc1", "fw 1@1.2.0", "fw 2@3.0.0"}},
+	} {
+		controller.syncSettings.RetentionVersions, controller.syncSettings.RetentionOrder = test.retention, test.order
+		var got []string
+		for _, entry := range applyRetentionPolicy(controller, newInstalledVersionsLookup(controller), index, test.infos) {
+			got = append(got, entry.Name+"@"+entry.Version)
+		}
+		if !slices.Equal(got, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestInstalledVersionsRequestedOncePerSync(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.subscribe("t1")
+	controller, _ := env.controllers.Get("t1")
+	var deviceQueries atomic.Int32
+	env.c8y.SetRequestHook(func(w http.ResponseWriter, r *http.Request, serve http.HandlerFunc) {
+		if strings.Contains(r.URL.Query().Get("query"), "c8y_IsDevice") {
+			deviceQueries.Add(1)
+		}
+		serve(w, r)
+	})
+	if result := controller.SyncWithIndexFiles(context.Background(), []ExtFirmwareVersionEntry{{Name: "fw 1", Version: "1.0.0", Key: "fw-1_1.0.0.zip"}}, nil, "hash-1"); !result.Success() {
+		t.Fatalf("expected initial synchronization to succeed, got %+v", result)
+	}
+
+	// the retention policy and the removal of 1.0.0 both need the installed versions
+	controller.syncSettings.RetentionVersions = 1
+	deviceQueries.Store(0)
+	entries := []ExtFirmwareVersionEntry{{Name: "fw 1", Version: "1.0.1", Key: "fw-1_1.0.1.zip"}, {Name: "fw 1", Version: "1.0.2", Key: "fw-1_1.0.2.zip"}}
+	if result := controller.SyncWithIndexFiles(context.Background(), entries, nil, "hash-2"); result.Created != 1 || result.Deleted != 1 {
+		t.Errorf("expected newest version to be created and the removed one to be deleted, got %+v", result)
+	}
+	if got := deviceQueries.Load(); got != 1 {
+		t.Errorf("expected installed versions to be requested once per synchronization, got %d requests", got)
+	}
+}
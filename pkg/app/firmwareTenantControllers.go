@@ -1,93 +1,468 @@
 package app
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
 	"maps"
+	"reflect"
 	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	est "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/externalstorage"
 )
 
 type ExtFirmwareInfoEntry struct {
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	DeviceType  string `json:"deviceType"`
+	Name              string `json:"name"`
+	Description       string `json:"description"`
+	DeviceType        string `json:"deviceType"`
+	RetentionVersions *int   `json:"retentionVersions,omitempty"`
+	RetentionOrder    string `json:"retentionOrder,omitempty"`
+	TenantScope
 }
 
 type ExtFirmwareVersionEntry struct {
 	Key     string `json:"key"`
 	Name    string `json:"name"`
 	Version string `json:"version"`
+	TenantScope
+	// id of the storage source the entry was read from
+	Source string `json:"-"`
 }
 
+// SyncSettings are the (tenant option based) settings applied while synchronizing a tenant
+type SyncSettings struct {
+	DeletionMode      string
+	RetentionVersions int
+	RetentionOrder    string
+	// remove the firmware objects created by the service once a tenant unsubscribes
+	CleanupOnUnsubscribe bool
+	// max. age of a tenant store before it is rebuilt from the tenants inventory, 0 rebuilds it on every synchronization
+	TenantStoreMaxAgeMins int
+	// interval in which a tenant is fully synchronized (incl. store rebuild) even though the index files did not change
+	ForceResyncIntervalMins int
+}
+
+// FirmwareTenantControllers is the registry of all tenant controllers. It is safe for concurrent use.
 type FirmwareTenantControllers struct {
-	tenantControllers map[string]FirmwareTenantController
-	estClient         est.ExternalStorageClient
-	//lastKnownInputHash string
+	mu                sync.RWMutex
+	tenantControllers map[string]*FirmwareTenantController
+	sources           est.Sources
+	// settings of the storage clients, e.g. of the overlay sources of the tenants
+	storageSettings est.ClientSettings
+	// restrictions of the overlay sources of the tenants
+	overlaySettings overlaySettings
+	syncSettings    SyncSettings
+	// schedule of tenants not overriding it within their own tenant options
+	defaultSchedule TenantSchedule
+	// max. amount of tenants synchronized in parallel
+	syncConcurrency int
+	lastRunReport   *SyncRunReport
+	// latest index files read per source (incl. the overlay sources of the tenants), by source id
+	lastIndexFiles map[string]*indexFiles
+	// signals pending synchronizations of all tenants (buffered, size 1)
+	syncTrigger chan struct{}
+	// object key prefixes (relative to the prefix of each source) whose changes trigger a synchronization (next to the index files)
+	eventWatchPrefixes []string
+	// amount of consecutive empty subscription lists, tenants are only unregistered on the second one
+	emptySubscriptionLists atomic.Int32
+}
+
+// indexFiles are the parsed contents of the index files, incl. their ETags (if provided by the storage)
+type indexFiles struct {
+	versionsETag     string
+	infoETag         string
+	groupsETag       string
+	inputHash        string
+	fwVersionEntries []ExtFirmwareVersionEntry
+	fwInfoEntries    map[string]ExtFirmwareInfoEntry
+	// entries of a source shadowed by an entry of a source with higher precedence
+	conflicts []string
 }
 
-func (c *FirmwareTenantControllers) Register(fc FirmwareTenantController) {
+func (c *FirmwareTenantControllers) Register(fc *FirmwareTenantController) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.tenantControllers == nil {
-		c.tenantControllers = make(map[string]FirmwareTenantController, 1)
+		c.tenantControllers = make(map[string]*FirmwareTenantController, 1)
 	}
 	c.tenantControllers[fc.tenantId] = fc
 }
 
-func (c *FirmwareTenantControllers) Get(tenantId string) (FirmwareTenantController, bool) {
+func (c *FirmwareTenantControllers) Unregister(tenantId string) (*FirmwareTenantController, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	val, ok := c.tenantControllers[tenantId]
+	delete(c.tenantControllers, tenantId)
+	delete(c.lastIndexFiles, overlaySourceId(tenantId))
 	return val, ok
 }
 
-func (c *FirmwareTenantControllers) AutoObserve(intervalMins int) {
-	slog.Info("Auto Observing started")
+func (c *FirmwareTenantControllers) TenantIds() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return slices.Collect(maps.Keys(c.tenantControllers))
+}
+
+func (c *FirmwareTenantControllers) Get(tenantId string) (*FirmwareTenantController, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	val, ok := c.tenantControllers[tenantId]
+	return val, ok
+}
+
+// Source returns the storage source of a firmware object of the tenant, the overlay source is only known to its own tenant
+func (c *FirmwareTenantControllers) Source(tenantId string, sourceId string) (est.Source, bool) {
+	if fc, ok := c.Get(tenantId); ok {
+		return fc.sources.Get(sourceId)
+	}
+	return c.sources.Get(sourceId)
+}
+
+// TriggerSync requests a synchronization of all tenants, which is run by RunTriggeredSyncs.
+// Requests arriving while a synchronization is pending are coalesced into it.
+func (c *FirmwareTenantControllers) TriggerSync(reason string) {
+	select {
+	case c.syncTrigger <- struct{}{}:
+		slog.Info("Synchronization of all tenants triggered", "reason", reason)
+	default:
+		slog.Info("Synchronization of all tenants already pending", "reason", reason)
+	}
+}
+
+// RunTriggeredSyncs runs a synchronization of all tenants for each (coalesced) TriggerSync call until ctx is done
+func (c *FirmwareTenantControllers) RunTriggeredSyncs(ctx context.Context) {
 	for {
-		time.Sleep(time.Duration(intervalMins) * time.Minute)
-		slog.Info("Start synchronization for all tenants")
-		c.SyncAllRegisteredTenantsWithIndexFiles()
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.syncTrigger:
+			slog.Info("Start triggered synchronization for all tenants")
+			c.SyncAllRegisteredTenantsWithIndexFiles(ctx)
+		}
 	}
+}
 
+// HandleStorageEvents triggers a synchronization once an index file (or an object below one of the watched prefixes) changed.
+// Changes below the watched prefixes leave the input hash of the index files unchanged, so they force a full resync of all tenants.
+// Returns true if a synchronization was triggered.
+func (c *FirmwareTenantControllers) HandleStorageEvents(events []est.StorageEvent) bool {
+	reason, forceResync := "", false
+	for _, event := range events {
+		watched, indexFile := c.watchedObjectKey(event.ObjectKey)
+		if !watched {
+			slog.Debug("Ignoring storage event of unwatched object", "objectKey", event.ObjectKey, "event", event.EventName)
+			continue
+		}
+		if len(reason) == 0 {
+			reason = event.EventName + " " + event.ObjectKey
+		}
+		forceResync = forceResync || !indexFile
+	}
+	if len(reason) == 0 {
+		return false
+	}
+	if forceResync {
+		for _, tenantId := range c.TenantIds() {
+			if fc, ok := c.Get(tenantId); ok {
+				fc.resyncRequested.Store(true)
+			}
+		}
+	}
+	c.TriggerSync(reason)
+	return true
 }
 
-func (c *FirmwareTenantControllers) SyncAllRegisteredTenantsWithIndexFiles() {
-	c.SyncTenantsWithIndexFiles(slices.Collect(maps.Keys(c.tenantControllers)))
+// ObserveStorageEvents consumes the change notifications of the storage until ctx is done
+func (c *FirmwareTenantControllers) ObserveStorageEvents(ctx context.Context, notifier est.ChangeNotifier) {
+	notifier.ConsumeEvents(ctx, func(events []est.StorageEvent) {
+		c.HandleStorageEvents(events)
+	})
 }
 
-func (c *FirmwareTenantControllers) SyncTenantsWithIndexFiles(tenantIds []string) {
+// objectKey is the key within the bucket, it is watched if it is an index file or located below a watched prefix of any source
+func (c *FirmwareTenantControllers) watchedObjectKey(objectKey string) (watched bool, indexFile bool) {
+	for _, source := range c.sources {
+		relativeKey, ok := source.RelativeKey(objectKey)
+		if !ok {
+			continue
+		}
+		if isIndexFileKey(relativeKey, source.IndexLayout) {
+			return true, true
+		}
+		watched = watched || isBelowWatchPrefix(relativeKey, c.eventWatchPrefixes)
+	}
+	return watched, false
+}
+
+func isIndexFileKey(objectKey string, layout est.IndexLayout) bool {
+	return objectKey == layout.VersionsFileName() || objectKey == layout.InfoFileName() || objectKey == layout.TenantGroupsFileName()
+}
+
+func isBelowWatchPrefix(objectKey string, watchPrefixes []string) bool {
+	for _, prefix := range watchPrefixes {
+		if len(prefix) > 0 && strings.HasPrefix(objectKey, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *FirmwareTenantControllers) SyncAllRegisteredTenantsWithIndexFiles(ctx context.Context) {
+	c.SyncTenantsWithIndexFiles(ctx, c.TenantIds())
+}
+
+// SyncTenantsWithIndexFiles synchronizes the given tenants in parallel. Once ctx is done, no further tenants are started
+// and the running synchronizations stop after their current step.
+func (c *FirmwareTenantControllers) SyncTenantsWithIndexFiles(ctx context.Context, tenantIds []string) *SyncRunReport {
 	slog.Info("Start synchronization for tenants", "tenantList", tenantIds)
-	contentFwVersionFile := c.ReadExtFileContentsAsString("c8y-firmware-versions.json")
+	index, ok := c.readIndexFiles(ctx)
+	if !ok {
+		return nil
+	}
+	report := c.newRunReport(index)
+	c.syncTenants(ctx, index, tenantIds, report)
+	c.finishRunReport(report)
+	return report
+}
+
+// SyncTenantsStaggered synchronizes the given tenants one after another with the given delay in between, e.g. so that a
+// restart does not hit all tenants at once. The index files are read once, the tenants are reported as a single run.
+func (c *FirmwareTenantControllers) SyncTenantsStaggered(ctx context.Context, tenantIds []string, delay time.Duration) *SyncRunReport {
+	slog.Info("Start staggered synchronization for tenants", "tenantList", tenantIds, "delay", delay.String())
+	index, ok := c.readIndexFiles(ctx)
+	if !ok {
+		return nil
+	}
+	report := c.newRunReport(index)
+	for i, tenantId := range tenantIds {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				slog.Warn("Staggered synchronization interrupted, remaining tenants are not synchronized", "err", ctx.Err())
+				c.finishRunReport(report)
+				return report
+			case <-time.After(delay):
+			}
+		}
+		c.syncTenants(ctx, index, []string{tenantId}, report)
+	}
+	c.finishRunReport(report)
+	return report
+}
+
+func (c *FirmwareTenantControllers) newRunReport(index *indexFiles) *SyncRunReport {
+	return &SyncRunReport{
+		StartTime:   time.Now(),
+		InputHash:   index.inputHash,
+		Concurrency: max(1, c.syncConcurrency),
+		Conflicts:   index.conflicts,
+	}
+}
+
+// logs the report and keeps it as report of the latest run
+func (c *FirmwareTenantControllers) finishRunReport(report *SyncRunReport) {
+	report.Duration = time.Since(report.StartTime)
+	report.Log()
+	c.mu.Lock()
+	c.lastRunReport = report
+	c.mu.Unlock()
+}
+
+// synchronizes the given tenants in parallel (bound by the sync concurrency) with the index files, adding their results to the report
+func (c *FirmwareTenantControllers) syncTenants(ctx context.Context, index *indexFiles, tenantIds []string, report *SyncRunReport) {
+	slog.Info("Applying changes in each tenant...", "concurrency", report.Concurrency)
+	var reportMu sync.Mutex
+	var wg sync.WaitGroup
+	queue := make(chan string)
+	for range min(report.Concurrency, len(tenantIds)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for tenantId := range queue {
+				val, ok := c.Get(tenantId)
+				if !ok {
+					slog.Warn("No Firmware Controller found for Tenant. Skipping this tenant.", "tenantId", tenantId)
+					reportMu.Lock()
+					report.Skipped = append(report.Skipped, tenantId)
+					reportMu.Unlock()
+					continue
+				}
+				fwVersionEntries, fwInfoEntries, tenantInputHash, conflicts, err := c.tenantEntries(ctx, val, index)
+				var result TenantSyncResult
+				if err != nil {
+					slog.Error("Could not determine the entries of the tenant. Skipping this tenant.", "tenantId", tenantId, "err", err)
+					result = TenantSyncResult{TenantId: tenantId, StartTime: time.Now()}
+					result.addError(err)
+				} else {
+					result = val.SyncWithIndexFiles(ctx, fwVersionEntries, fwInfoEntries, tenantInputHash)
+					result.Conflicts = conflicts
+				}
+				reportMu.Lock()
+				report.add(result)
+				reportMu.Unlock()
+			}
+		}()
+	}
+enqueue:
+	for _, tenantId := range tenantIds {
+		select {
+		case queue <- tenantId:
+		case <-ctx.Done():
+			slog.Warn("Synchronization run interrupted, remaining tenants are not synchronized", "err", ctx.Err())
+			break enqueue
+		}
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// LastRunReport returns the report of the latest synchronization run (nil if none finished yet)
+func (c *FirmwareTenantControllers) LastRunReport() *SyncRunReport {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lastRunReport
+}
+
+// reads and parses the index files of all sources and merges them. The files are only downloaded if their ETags changed since
+// they were read the last time. Fails if the index files of any source can't be read, as its entries would be removed otherwise.
+func (c *FirmwareTenantControllers) readIndexFiles(ctx context.Context) (*indexFiles, bool) {
+	indexes := make([]*indexFiles, 0, len(c.sources))
+	for _, source := range c.sources {
+		index, ok := c.readSourceIndexFiles(ctx, source)
+		if !ok {
+			return nil, false
+		}
+		indexes = append(indexes, index)
+	}
+	if len(indexes) == 0 {
+		slog.Error("No storage source configured. Service stops syncing attempt.")
+		return nil, false
+	}
+	index := mergeIndexFiles(c.sources.Ids(), indexes)
+	for _, conflict := range index.conflicts {
+		slog.Warn("Conflicting index entry ignored", "conflict", conflict)
+	}
+	return index, true
+}
+
+func (c *FirmwareTenantControllers) readSourceIndexFiles(ctx context.Context, source est.Source) (*indexFiles, bool) {
+	versionsInfo, versionsStatErr := source.Client.Stat(ctx, source.VersionsFileName())
+	infoInfo, infoStatErr := source.Client.Stat(ctx, source.InfoFileName())
+	// the tenant groups file is optional, its ETag is empty if it doesn't exist
+	groupsInfo, groupsStatErr := source.Client.Stat(ctx, source.TenantGroupsFileName())
+	if errors.Is(groupsStatErr, est.ErrNotFound) {
+		groupsStatErr = nil
+	}
+	versionsETag, infoETag, groupsETag := versionsInfo.ETag, infoInfo.ETag, groupsInfo.ETag
+	etagsKnown := versionsStatErr == nil && infoStatErr == nil && groupsStatErr == nil && len(versionsETag) > 0 && len(infoETag) > 0
+
+	c.mu.RLock()
+	cached := c.lastIndexFiles[source.Id]
+	c.mu.RUnlock()
+	if etagsKnown && cached != nil && cached.versionsETag == versionsETag && cached.infoETag == infoETag && cached.groupsETag == groupsETag {
+		slog.Info("Index files are unchanged, using cached contents. Input Hash = "+cached.inputHash, "source", source.Id)
+		return cached, true
+	}
+
+	contentFwVersionFile := readExtFileContentsAsString(ctx, source.Client, source.VersionsFileName())
 	if len(contentFwVersionFile) == 0 {
-		slog.Error("Firmware Version Info file (c8y-firmware-versions.json) could not be read or is empty. Service stops syncing attempt.")
-		return
+		slog.Error("Firmware Version Info file ("+source.VersionsFileName()+") could not be read or is empty. Service stops syncing attempt.", "source", source.Id, "prefix", source.Prefix)
+		return nil, false
 	}
-	contentFwInfoFile := c.ReadExtFileContentsAsString("c8y-firmware-info.json")
+	contentFwInfoFile := readExtFileContentsAsString(ctx, source.Client, source.InfoFileName())
 	if len(contentFwInfoFile) == 0 {
-		slog.Error("Firmware Info file (c8y-firmware-info.json) could not be read or is empty. Service stops syncing attempt.")
-		return
+		slog.Error("Firmware Info file ("+source.InfoFileName()+") could not be read or is empty. Service stops syncing attempt.", "source", source.Id, "prefix", source.Prefix)
+		return nil, false
+	}
+	contentTenantGroupsFile, _, err := readIndexFileForUpdate(ctx, source.Client, source.TenantGroupsFileName())
+	if err != nil {
+		slog.Error("Tenant groups file ("+source.TenantGroupsFileName()+") could not be read. Service stops syncing attempt.", "source", source.Id, "prefix", source.Prefix, "err", err)
+		return nil, false
+	}
+	index := parseIndexFiles(contentFwVersionFile, contentFwInfoFile)
+	// entries restricted to tenant groups must not be published to all tenants, so an invalid file stops the synchronization
+	groups, err := ParseTenantGroups(contentTenantGroupsFile)
+	if err != nil {
+		slog.Error("Tenant groups file ("+source.TenantGroupsFileName()+") is no valid JSON object. Service stops syncing attempt.", "source", source.Id, "prefix", source.Prefix, "err", err)
+		return nil, false
+	}
+	index.setTenantGroups(groups)
+	if len(contentTenantGroupsFile) > 0 {
+		index.inputHash += GetMD5Hash(contentTenantGroupsFile)
 	}
-	inputHash := GetMD5Hash(contentFwVersionFile) + GetMD5Hash(contentFwVersionFile)
-	slog.Info("Read Index Files. Input Hash = " + inputHash)
+	for i := range index.fwVersionEntries {
+		index.fwVersionEntries[i].Source = source.Id
+	}
+	slog.Info("Read Index Files. Input Hash = "+index.inputHash, "source", source.Id)
+	if etagsKnown {
+		index.versionsETag, index.infoETag, index.groupsETag = versionsETag, infoETag, groupsETag
+	}
+	c.mu.Lock()
+	if c.lastIndexFiles == nil {
+		c.lastIndexFiles = make(map[string]*indexFiles, len(c.sources))
+	}
+	c.lastIndexFiles[source.Id] = index
+	c.mu.Unlock()
+	return index, true
+}
 
-	fwVersionEntries := ParseExtFwVersionContents(contentFwVersionFile)
-	fwInfoEntries := ParseExtFwInfoContents(contentFwInfoFile)
+func parseIndexFiles(contentFwVersionFile string, contentFwInfoFile string) *indexFiles {
+	return &indexFiles{
+		inputHash:        GetMD5Hash(contentFwVersionFile) + GetMD5Hash(contentFwInfoFile),
+		fwVersionEntries: ParseExtFwVersionContents(contentFwVersionFile),
+		fwInfoEntries:    ParseExtFwInfoContents(contentFwInfoFile),
+	}
+}
 
-	slog.Info("Applying changes in each tenant...")
-	for _, e := range tenantIds {
-		val, ok := c.tenantControllers[e]
-		if !ok {
-			slog.Warn("No Firmware Controller found for Tenant. Skipping this tenant.", "tenantId", e)
-			continue
+// mergeIndexFiles merges the index files of the sources (ordered by precedence). A version or firmware already provided by a
+// source with higher precedence shadows the one of later sources, which is reported as conflict (firmwares only if they differ).
+// The input hash of a single source is kept as is, so persisted sync states stay valid.
+func mergeIndexFiles(sourceIds []string, indexes []*indexFiles) *indexFiles {
+	if len(indexes) == 1 {
+		return indexes[0]
+	}
+	merged := &indexFiles{fwInfoEntries: make(map[string]ExtFirmwareInfoEntry)}
+	infoSources := make(map[string]string)
+	versionSources := make(map[[2]string]string)
+	var hashes strings.Builder
+	for i, index := range indexes {
+		sourceId := sourceIds[i]
+		hashes.WriteString(sourceId + ":" + index.inputHash + "\n")
+		for _, name := range slices.Sorted(maps.Keys(index.fwInfoEntries)) {
+			info := index.fwInfoEntries[name]
+			if existing, ok := merged.fwInfoEntries[name]; ok {
+				if !reflect.DeepEqual(existing, info) {
+					merged.conflicts = append(merged.conflicts, fmt.Sprintf("firmware '%s' of source '%s' is shadowed by source '%s'", name, sourceId, infoSources[name]))
+				}
+				continue
+			}
+			merged.fwInfoEntries[name] = info
+			infoSources[name] = sourceId
+		}
+		for _, entry := range index.fwVersionEntries {
+			key := [2]string{entry.Name, entry.Version}
+			if shadowingSourceId, ok := versionSources[key]; ok {
+				merged.conflicts = append(merged.conflicts, fmt.Sprintf("version '%s' of firmware '%s' of source '%s' is shadowed by source '%s'", entry.Version, entry.Name, sourceId, shadowingSourceId))
+				continue
+			}
+			merged.fwVersionEntries = append(merged.fwVersionEntries, entry)
+			versionSources[key] = sourceId
 		}
-		val.SyncWithIndexFiles(fwVersionEntries, fwInfoEntries, inputHash)
 	}
+	merged.inputHash = GetMD5Hash(hashes.String())
+	return merged
 }
 
-func (c *FirmwareTenantControllers) ReadExtFileContentsAsString(objectKey string) string {
-	res, err := c.estClient.GetFileContent(objectKey)
+func readExtFileContentsAsString(ctx context.Context, estClient est.ExternalStorageClient, objectKey string) string {
+	res, err := est.ReadObjectAsString(ctx, estClient, objectKey)
 	if err != nil {
 		slog.Error("Error while reading file from external storage", "objectKey", objectKey, "err", err)
 		return ""
@@ -0,0 +1,171 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	s "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/static"
+)
+
+// The tests in this file are meant to be run with the race detector: go test -race ./pkg/app/...
+
+func TestFirmwareTenantControllersConcurrentAccess(t *testing.T) {
+	env := newTestEnv(t, nil)
+	tenantIds := make([]string, 10)
+	for i := range tenantIds {
+		tenantIds[i] = fmt.Sprintf("t%d", i)
+	}
+	env.subscribe(tenantIds...)
+	controllers := make([]*FirmwareTenantController, len(tenantIds))
+	for i, tenantId := range tenantIds {
+		controllers[i], _ = env.controllers.Unregister(tenantId)
+		if controllers[i] == nil {
+			t.Fatalf("expected controller of tenant %s to be registered", tenantId)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i, tenantId := range tenantIds {
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			env.controllers.Register(controllers[i])
+		}()
+		go func() {
+			defer wg.Done()
+			env.controllers.SyncAllRegisteredTenantsWithIndexFiles(context.Background())
+		}()
+		go func() {
+			defer wg.Done()
+			env.controllers.Get(tenantId)
+			env.controllers.TenantIds()
+		}()
+		go func() {
+			defer wg.Done()
+			if i%3 == 0 {
+				env.controllers.Unregister(tenantId)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := range tenantIds {
+		env.controllers.Register(controllers[i])
+	}
+	for _, tenantId := range tenantIds {
+		if _, ok := env.controllers.Get(tenantId); !ok {
+			t.Errorf("expected tenant %s to be registered", tenantId)
+		}
+	}
+}
+
+func TestSyncIsSerializedPerTenant(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.subscribe("t1", "t2")
+
+	// keeps track of the requests being processed per tenant
+	var mu sync.Mutex
+	inFlight, maxInFlight := make(map[string]int), make(map[string]int)
+	env.c8y.SetRequestHook(func(w http.ResponseWriter, r *http.Request, serve http.HandlerFunc) {
+		username, _, _ := r.BasicAuth()
+		tenantId, _, _ := strings.Cut(username, "/")
+		mu.Lock()
+		inFlight[tenantId]++
+		maxInFlight[tenantId] = max(maxInFlight[tenantId], inFlight[tenantId])
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			inFlight[tenantId]--
+			mu.Unlock()
+		}()
+		// widen the window for overlapping requests
+		time.Sleep(time.Millisecond)
+		serve(w, r)
+	})
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			env.controllers.SyncTenantsWithIndexFiles(context.Background(), []string{"t1"})
+		}()
+		go func() {
+			defer wg.Done()
+			env.controllers.SyncAllRegisteredTenantsWithIndexFiles(context.Background())
+		}()
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, tenantId := range []string{"t1", "t2"} {
+		if got := maxInFlight[tenantId]; got != 1 {
+			t.Errorf("expected synchronizations of tenant %s to be serialized, but found %d concurrent requests", tenantId, got)
+		}
+	}
+}
+
+func TestConcurrentSyncStateUpdatesPersistSingleObject(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.subscribe("t1")
+	// widen the window between looking up and creating the sync state object
+	env.c8y.SetRequestHook(func(w http.ResponseWriter, r *http.Request, serve http.HandlerFunc) {
+		time.Sleep(time.Millisecond)
+		serve(w, r)
+	})
+
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			env.controllers.SetPaused("t1", i%2 == 0)
+		}()
+	}
+	wg.Wait()
+	env.controllers.SetPaused("t1", true)
+
+	states := env.c8y.ManagedObjects("t1", "type eq "+s.SYNC_STATE_TYPE)
+	if len(states) != 1 {
+		t.Fatalf("expected a single sync state object, got %d", len(states))
+	}
+	if paused := states[0][s.SYNC_STATE_TYPE].(map[string]any)["paused"]; paused != true {
+		t.Errorf("expected latest sync state to be persisted, got %v", states[0])
+	}
+}
+
+func TestFirmwareTenantStoreConcurrentAccess(t *testing.T) {
+	store := NewFirmwareTenantStore()
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			store.AddFirmware(FirmwareStoreFwEntry{MoId: fmt.Sprintf("%d", i), MoName: "fw"})
+			store.AddFirmwareVersion(FirmwareStoreVersionEntry{FwName: "fw", Version: fmt.Sprintf("1.0.%d", i)})
+			store.AddArchivedFirmwareVersion(FirmwareStoreVersionEntry{FwName: "fw", Version: fmt.Sprintf("0.0.%d", i)})
+		}()
+		go func() {
+			defer wg.Done()
+			store.GetFirmware("fw")
+			store.GetFirmwareVersion("fw", fmt.Sprintf("1.0.%d", i))
+			for range store.GetFirmwareVersions() {
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			store.RemoveArchivedFirmwareVersion("fw", fmt.Sprintf("0.0.%d", i))
+			store.GetArchivedFirmwareVersion("fw", fmt.Sprintf("0.0.%d", i))
+			if i%5 == 0 {
+				store.Flush()
+			}
+		}()
+	}
+	wg.Wait()
+}
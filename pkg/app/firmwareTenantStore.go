@@ -1,10 +1,22 @@
 package app
 
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// FirmwareTenantStore caches the firmware repository of a tenant. It is safe for concurrent use.
 type FirmwareTenantStore struct {
+	mu sync.RWMutex
 	// key = firmware name, value = all firmware versions
-	FirmwareVersionsByName map[string][]FirmwareStoreVersionEntry
+	firmwareVersionsByName map[string][]FirmwareStoreVersionEntry
 	// key=firmware name, value = firmware object
-	FirmwareByName map[string]FirmwareStoreFwEntry
+	firmwareByName map[string]FirmwareStoreFwEntry
+	// key = firmware name, value = all archived firmware versions (not attached to any firmware)
+	archivedVersionsByName map[string][]FirmwareStoreVersionEntry
+	// time of the last complete rebuild, zero if the store needs to be rebuilt
+	rebuiltAt time.Time
 }
 
 type FirmwareStoreFwEntry struct {
@@ -27,21 +39,49 @@ type FirmwareStoreVersionEntry struct {
 	HasExternalOrigin bool   `json:"hasExternalOrigin"`
 }
 
+func NewFirmwareTenantStore() *FirmwareTenantStore {
+	return &FirmwareTenantStore{
+		firmwareVersionsByName: make(map[string][]FirmwareStoreVersionEntry),
+		firmwareByName:         make(map[string]FirmwareStoreFwEntry),
+		archivedVersionsByName: make(map[string][]FirmwareStoreVersionEntry),
+	}
+}
+
 func (store *FirmwareTenantStore) AddFirmware(e FirmwareStoreFwEntry) {
-	store.FirmwareByName[e.MoName] = e
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.firmwareByName[e.MoName] = e
 }
 
 func (store *FirmwareTenantStore) AddFirmwareVersion(e FirmwareStoreVersionEntry) {
-	val, ok := store.FirmwareVersionsByName[e.FwName]
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	val, ok := store.firmwareVersionsByName[e.FwName]
 	if ok {
-		store.FirmwareVersionsByName[e.FwName] = append(val, e)
+		store.firmwareVersionsByName[e.FwName] = append(val, e)
 	} else {
-		store.FirmwareVersionsByName[e.FwName] = []FirmwareStoreVersionEntry{e}
+		store.firmwareVersionsByName[e.FwName] = []FirmwareStoreVersionEntry{e}
 	}
 }
 
+func (store *FirmwareTenantStore) RemoveFirmware(fwName string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.firmwareByName, fwName)
+}
+
+func (store *FirmwareTenantStore) RemoveFirmwareVersion(fwName string, fwVersion string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.firmwareVersionsByName[fwName] = slices.DeleteFunc(slices.Clone(store.firmwareVersionsByName[fwName]), func(e FirmwareStoreVersionEntry) bool {
+		return e.Version == fwVersion
+	})
+}
+
 func (store *FirmwareTenantStore) GetFirmware(fwName string) (FirmwareStoreFwEntry, bool) {
-	val, ok := store.FirmwareByName[fwName]
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	val, ok := store.firmwareByName[fwName]
 	if ok {
 		return val, ok
 	}
@@ -49,7 +89,9 @@ func (store *FirmwareTenantStore) GetFirmware(fwName string) (FirmwareStoreFwEnt
 }
 
 func (store *FirmwareTenantStore) GetFirmwareVersion(fwName string, fwVersion string) (FirmwareStoreVersionEntry, bool) {
-	val, ok := store.FirmwareVersionsByName[fwName]
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	val, ok := store.firmwareVersionsByName[fwName]
 	if ok {
 		for _, e := range val {
 			if e.Version != fwVersion {
@@ -61,7 +103,71 @@ func (store *FirmwareTenantStore) GetFirmwareVersion(fwName string, fwVersion st
 	return FirmwareStoreVersionEntry{}, false
 }
 
+// returns a copy of all firmware versions in the store, which can be iterated while the store is modified
+func (store *FirmwareTenantStore) GetFirmwareVersions() []FirmwareStoreVersionEntry {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	var res []FirmwareStoreVersionEntry
+	for _, versionList := range store.firmwareVersionsByName {
+		res = append(res, versionList...)
+	}
+	return res
+}
+
+func (store *FirmwareTenantStore) AddArchivedFirmwareVersion(e FirmwareStoreVersionEntry) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.archivedVersionsByName == nil {
+		store.archivedVersionsByName = make(map[string][]FirmwareStoreVersionEntry)
+	}
+	store.archivedVersionsByName[e.FwName] = append(store.archivedVersionsByName[e.FwName], e)
+}
+
+func (store *FirmwareTenantStore) GetArchivedFirmwareVersion(fwName string, fwVersion string) (FirmwareStoreVersionEntry, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	for _, e := range store.archivedVersionsByName[fwName] {
+		if e.Version == fwVersion {
+			return e, true
+		}
+	}
+	return FirmwareStoreVersionEntry{}, false
+}
+
+func (store *FirmwareTenantStore) RemoveArchivedFirmwareVersion(fwName string, fwVersion string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.archivedVersionsByName[fwName] = slices.DeleteFunc(slices.Clone(store.archivedVersionsByName[fwName]), func(e FirmwareStoreVersionEntry) bool {
+		return e.Version == fwVersion
+	})
+}
+
 func (store *FirmwareTenantStore) Flush() {
-	store.FirmwareVersionsByName = make(map[string][]FirmwareStoreVersionEntry)
-	store.FirmwareByName = make(map[string]FirmwareStoreFwEntry)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.firmwareVersionsByName = make(map[string][]FirmwareStoreVersionEntry)
+	store.firmwareByName = make(map[string]FirmwareStoreFwEntry)
+	store.archivedVersionsByName = make(map[string][]FirmwareStoreVersionEntry)
+	store.rebuiltAt = time.Time{}
+}
+
+// MarkRebuilt flags the store to reflect the tenants firmware repository as of now
+func (store *FirmwareTenantStore) MarkRebuilt() {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.rebuiltAt = time.Now()
+}
+
+// Invalidate forces a rebuild of the store before its next use, e.g. after errors that left it out of sync with the tenant
+func (store *FirmwareTenantStore) Invalidate() {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.rebuiltAt = time.Time{}
+}
+
+// IsFresh returns true if the store was rebuilt within maxAge (and not invalidated since)
+func (store *FirmwareTenantStore) IsFresh(maxAge time.Duration) bool {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return !store.rebuiltAt.IsZero() && time.Since(store.rebuiltAt) < maxAge
 }
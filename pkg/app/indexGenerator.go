@@ -0,0 +1,231 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"regexp"
+	"strings"
+
+	est "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/externalstorage"
+)
+
+// <name>[_-][v]<version>[.<ext>...], e.g. my-firmware_1.0.2.zip or tedge-image-v2.1.0-rc1.tar.gz
+var generatorFileNamePattern = regexp.MustCompile(`^(.+?)[_-][vV]?(\d+(?:\.\d+)*(?:[-+][0-9A-Za-z.+-]*?)?)((?:\.[A-Za-z][A-Za-z0-9]*)*)$`)
+
+// checksums and signatures stored next to the firmware files
+var generatorIgnoredExtensions = []string{".md5", ".sha1", ".sha256", ".sha512", ".sig", ".asc"}
+
+// SkippedObject is an object of the storage the generator did not propose an entry for
+type SkippedObject struct {
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+}
+
+// IndexProposal are the entries the generator proposes for the objects of the storage that are not yet indexed
+type IndexProposal struct {
+	Prefix   string                    `json:"prefix"`
+	Versions []ExtFirmwareVersionEntry `json:"versions"`
+	Infos    []ExtFirmwareInfoEntry    `json:"infos"`
+	Skipped  []SkippedObject           `json:"skipped"`
+	Written  bool                      `json:"written"`
+	// index files the proposal is based on, the ETags are empty if a file doesn't exist yet
+	layout               est.IndexLayout
+	contentFwVersionFile string
+	contentFwInfoFile    string
+	versionsETag         string
+	infoETag             string
+}
+
+// reads an index file incl. its ETag, a missing file is returned as empty content
+func readIndexFileForUpdate(ctx context.Context, estClient est.ExternalStorageClient, objectKey string) (string, string, error) {
+	info, err := estClient.Stat(ctx, objectKey)
+	if errors.Is(err, est.ErrNotFound) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	// if the file changes after Stat, the content is newer than the ETag and writing it back fails
+	content, err := est.ReadObjectAsString(ctx, estClient, objectKey)
+	if err != nil {
+		return "", "", err
+	}
+	return content, info.ETag, nil
+}
+
+// reads the index files of the source as base of a proposal
+func readIndexProposal(ctx context.Context, source est.Source) (*IndexProposal, error) {
+	proposal := &IndexProposal{Versions: []ExtFirmwareVersionEntry{}, Infos: []ExtFirmwareInfoEntry{}, Skipped: []SkippedObject{}, layout: source.IndexLayout}
+	var err error
+	if proposal.contentFwVersionFile, proposal.versionsETag, err = readIndexFileForUpdate(ctx, source.Client, source.VersionsFileName()); err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", source.VersionsFileName(), err)
+	}
+	if proposal.contentFwInfoFile, proposal.infoETag, err = readIndexFileForUpdate(ctx, source.Client, source.InfoFileName()); err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", source.InfoFileName(), err)
+	}
+	return proposal, nil
+}
+
+// normalizes firmware names for matching file names with existing entries, e.g. "My Firmware" and "my-firmware"
+func normalizeFirmwareName(name string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return r == ' ' || r == '-' || r == '_'
+	}), " ")
+}
+
+// GenerateIndex lists the objects of the source below prefix (relative to the prefix of the source) and proposes index entries
+// for all objects not referenced by the index files yet. Name and version are derived from the file name, names of existing
+// firmwares are reused if they only differ in case or separators.
+func GenerateIndex(ctx context.Context, source est.Source, prefix string) (*IndexProposal, error) {
+	proposal, err := readIndexProposal(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	proposal.Prefix = prefix
+	index := parseIndexFiles(proposal.contentFwVersionFile, proposal.contentFwInfoFile)
+
+	indexedKeys := make(map[string]bool)
+	indexedVersions := make(map[FirmwareVersionKey]bool)
+	names := make(map[string]string)
+	for _, entry := range index.fwVersionEntries {
+		indexedKeys[entry.Key] = true
+		indexedVersions[FirmwareVersionKey{Name: entry.Name, Version: entry.Version}] = true
+		names[normalizeFirmwareName(entry.Name)] = entry.Name
+	}
+	infoNames := make(map[string]bool)
+	for name := range index.fwInfoEntries {
+		infoNames[name] = true
+		names[normalizeFirmwareName(name)] = name
+	}
+
+	for object, err := range source.Client.List(ctx, prefix) {
+		if err != nil {
+			return nil, fmt.Errorf("could not list objects: %w", err)
+		}
+		key := object.Key
+		fileName := path.Base(key)
+		switch {
+		case strings.HasSuffix(key, "/") || key == source.VersionsFileName() || key == source.InfoFileName() || indexedKeys[key]:
+			continue
+		case hasAnySuffix(strings.ToLower(fileName), generatorIgnoredExtensions):
+			proposal.Skipped = append(proposal.Skipped, SkippedObject{Key: key, Reason: "checksum or signature file"})
+			continue
+		}
+		match := generatorFileNamePattern.FindStringSubmatch(fileName)
+		if match == nil {
+			proposal.Skipped = append(proposal.Skipped, SkippedObject{Key: key, Reason: "name and version could not be derived from the file name"})
+			continue
+		}
+		name, version := match[1], match[2]
+		if existingName, ok := names[normalizeFirmwareName(name)]; ok {
+			name = existingName
+		} else {
+			names[normalizeFirmwareName(name)] = name
+		}
+		versionKey := FirmwareVersionKey{Name: name, Version: version}
+		if indexedVersions[versionKey] {
+			proposal.Skipped = append(proposal.Skipped, SkippedObject{Key: key, Reason: fmt.Sprintf("version '%s' of firmware '%s' is already indexed", version, name)})
+			continue
+		}
+		indexedVersions[versionKey] = true
+		proposal.Versions = append(proposal.Versions, ExtFirmwareVersionEntry{Key: key, Name: name, Version: version})
+		if !infoNames[name] {
+			infoNames[name] = true
+			proposal.Infos = append(proposal.Infos, ExtFirmwareInfoEntry{Name: name, Description: "Generated from " + key})
+		}
+	}
+	slog.Info("Generated index entries", "prefix", prefix, "versions", len(proposal.Versions), "firmwares", len(proposal.Infos), "skipped", len(proposal.Skipped))
+	return proposal, nil
+}
+
+func hasAnySuffix(value string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(value, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// appends the entries as JSON lines to the content of an index file
+func appendIndexEntries[T any](content string, entries []T) (string, error) {
+	var b strings.Builder
+	if trimmed := strings.TrimRight(content, "\n"); len(trimmed) > 0 {
+		b.WriteString(trimmed + "\n")
+	}
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return "", err
+		}
+		b.Write(line)
+		b.WriteString("\n")
+	}
+	return b.String(), nil
+}
+
+// Merged returns the contents of the index files incl. the proposed entries
+func (p *IndexProposal) Merged() (string, string, error) {
+	versions, err := appendIndexEntries(p.contentFwVersionFile, p.Versions)
+	if err != nil {
+		return "", "", err
+	}
+	info, err := appendIndexEntries(p.contentFwInfoFile, p.Infos)
+	if err != nil {
+		return "", "", err
+	}
+	return versions, info, nil
+}
+
+// Write writes the merged index files back to the storage. Both files are only replaced if they were not changed since the
+// proposal was generated (ETag), otherwise est.ErrPreconditionFailed is returned and the proposal needs to be generated again.
+// The info file is written first, so the new versions never reference unknown firmwares.
+func (p *IndexProposal) Write(ctx context.Context, estClient est.ExternalStorageClient) error {
+	if len(p.Versions) == 0 {
+		return nil
+	}
+	versions, info, err := p.Merged()
+	if err != nil {
+		return err
+	}
+	if len(p.Infos) > 0 {
+		if err := writeIndexFile(ctx, estClient, p.layout.InfoFileName(), info, p.infoETag); err != nil {
+			return err
+		}
+	}
+	if err := writeIndexFile(ctx, estClient, p.layout.VersionsFileName(), versions, p.versionsETag); err != nil {
+		return err
+	}
+	p.Written = true
+	slog.Info("Written generated index entries", "versions", len(p.Versions), "firmwares", len(p.Infos))
+	return nil
+}
+
+func writeIndexFile(ctx context.Context, estClient est.ExternalStorageClient, objectKey string, content string, etag string) error {
+	opts := est.WriteOptions{IfMatch: etag, IfNoneMatch: len(etag) == 0, ContentType: "application/json"}
+	if _, err := estClient.Write(ctx, objectKey, strings.NewReader(content), int64(len(content)), opts); err != nil {
+		return fmt.Errorf("could not write %s: %w", objectKey, err)
+	}
+	return nil
+}
+
+// Print writes the proposal in a human readable form
+func (p *IndexProposal) Print(w io.Writer) {
+	for _, entry := range p.Infos {
+		line, _ := json.Marshal(entry)
+		fmt.Fprintf(w, "+ %s: %s\n", p.layout.InfoFileName(), line)
+	}
+	for _, entry := range p.Versions {
+		line, _ := json.Marshal(entry)
+		fmt.Fprintf(w, "+ %s: %s\n", p.layout.VersionsFileName(), line)
+	}
+	for _, skipped := range p.Skipped {
+		fmt.Fprintf(w, "  skipped %s: %s\n", skipped.Key, skipped.Reason)
+	}
+	fmt.Fprintf(w, "%d version(s) and %d firmware(s) proposed, %d object(s) skipped\n", len(p.Versions), len(p.Infos), len(p.Skipped))
+}
@@ -0,0 +1,87 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	est "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/externalstorage"
+	s "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/static"
+)
+
+func TestGenerateIndex(t *testing.T) {
+	ctx := context.Background()
+	storage := est.NewMemoryClient(est.MemoryConnectionDetails{BucketName: "firmware", Objects: map[string]string{
+		s.INDEX_FILE_VERSIONS:                  testVersionsIndex,
+		s.INDEX_FILE_INFO:                      testInfoIndex,
+		"fw-1_1.0.0.zip":                       "indexed",
+		"fw-1_1.0.2.zip":                       "new version of existing firmware",
+		"fw-1_1.0.2.zip.sha256":                "checksum",
+		"images/tedge-image-v2.1.0-rc1.tar.gz": "new firmware",
+		"images/README.md":                     "no version",
+		"images/":                              "",
+	}}, 1)
+
+	proposal, err := GenerateIndex(ctx, est.Source{Client: storage}, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var out strings.Builder
+	proposal.Print(&out)
+	expected := `+ c8y-firmware-info.json: {"name":"tedge-image","description":"Generated from images/tedge-image-v2.1.0-rc1.tar.gz","deviceType":""}
++ c8y-firmware-versions.json: {"key":"fw-1_1.0.2.zip","name":"fw 1","version":"1.0.2"}
++ c8y-firmware-versions.json: {"key":"images/tedge-image-v2.1.0-rc1.tar.gz","name":"tedge-image","version":"2.1.0-rc1"}
+  skipped fw-1_1.0.2.zip.sha256: checksum or signature file
+  skipped images/README.md: name and version could not be derived from the file name
+2 version(s) and 1 firmware(s) proposed, 2 object(s) skipped
+`
+	if out.String() != expected {
+		t.Errorf("unexpected proposal:\n%s\nexpected:\n%s", out.String(), expected)
+	}
+
+	if err := proposal.Write(ctx, storage); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	versions, _ := est.ReadObjectAsString(ctx, storage, s.INDEX_FILE_VERSIONS)
+	info, _ := est.ReadObjectAsString(ctx, storage, s.INDEX_FILE_INFO)
+	if issues := ValidateIndexFiles(versions, info); HasErrors(issues) || len(ParseExtFwVersionContents(versions)) != 4 {
+		t.Errorf("unexpected merged index files %v:\n%s\n%s", issues, versions, info)
+	}
+	if proposal, _ := GenerateIndex(ctx, est.Source{Client: storage}, ""); len(proposal.Versions) != 0 {
+		t.Errorf("expected all objects to be indexed, got %v", proposal.Versions)
+	}
+
+	// concurrent change between generating and writing
+	storage.Put("fw-1_1.0.3.zip", []byte("another version"))
+	proposal, _ = GenerateIndex(ctx, est.Source{Client: storage}, "fw-1")
+	storage.Put(s.INDEX_FILE_VERSIONS, []byte(versions+"\n"))
+	if err := proposal.Write(ctx, storage); !errors.Is(err, est.ErrPreconditionFailed) {
+		t.Errorf("expected concurrent change to be detected, got %v", err)
+	}
+	if content, _ := est.ReadObjectAsString(ctx, storage, s.INDEX_FILE_VERSIONS); content != versions+"\n" {
+		t.Errorf("expected index file not to be overwritten, got %s", content)
+	}
+}
+
+func TestGenerateIndexWithoutIndexFiles(t *testing.T) {
+	ctx := context.Background()
+	storage := est.NewMemoryClient(est.MemoryConnectionDetails{BucketName: "firmware", Objects: map[string]string{
+		"My_Firmware-1.0.0.bin": "v1",
+		"my-firmware_1.1.0.bin": "v2",
+	}}, 1)
+	proposal, err := GenerateIndex(ctx, est.Source{Client: storage}, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(proposal.Infos) != 1 || len(proposal.Versions) != 2 || proposal.Versions[1].Name != "My_Firmware" {
+		t.Errorf("expected both versions to be assigned to one firmware, got %v %v", proposal.Infos, proposal.Versions)
+	}
+	if err := proposal.Write(ctx, storage); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// files did not exist while generating, so the proposal must not overwrite them
+	if err := proposal.Write(ctx, storage); !errors.Is(err, est.ErrPreconditionFailed) {
+		t.Errorf("expected existing index files not to be overwritten, got %v", err)
+	}
+}
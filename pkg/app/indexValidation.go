@@ -0,0 +1,181 @@
+package app
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	est "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/externalstorage"
+	s "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/static"
+)
+
+const (
+	IssueError   = "error"
+	IssueWarning = "warning"
+)
+
+// IndexIssue is a problem found while validating the index files. Line is 0 for issues concerning a whole file.
+type IndexIssue struct {
+	File     string `json:"file"`
+	Line     int    `json:"line,omitempty"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+func (i IndexIssue) String() string {
+	if i.Line > 0 {
+		return fmt.Sprintf("%s: %s:%d: %s", i.Severity, i.File, i.Line, i.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", i.Severity, i.File, i.Message)
+}
+
+// HasErrors returns true if any of the issues is an error (and not only a warning)
+func HasErrors(issues []IndexIssue) bool {
+	for _, issue := range issues {
+		if issue.Severity == IssueError {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateIndexFiles lints the contents of the index files. Errors are problems that break the synchronization or lead to
+// entries being skipped, warnings are likely mistakes.
+func ValidateIndexFiles(contentFwVersionFile string, contentFwInfoFile string) []IndexIssue {
+	var issues []IndexIssue
+	add := func(file string, line int, severity string, format string, args ...any) {
+		issues = append(issues, IndexIssue{File: file, Line: line, Severity: severity, Message: fmt.Sprintf(format, args...)})
+	}
+
+	// firmware info file
+	infoLines := make(map[string]int)
+	if len(strings.TrimSpace(contentFwInfoFile)) == 0 {
+		add(s.INDEX_FILE_INFO, 0, IssueError, "file is empty, synchronization is not possible")
+	}
+	for i, line := range strings.Split(contentFwInfoFile, "\n") {
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		entry := ExtFirmwareInfoEntry{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			add(s.INDEX_FILE_INFO, i+1, IssueError, "no valid JSON, entry is skipped: %s", err)
+			continue
+		}
+		if len(entry.Name) == 0 {
+			add(s.INDEX_FILE_INFO, i+1, IssueError, "missing mandatory field name")
+			continue
+		}
+		if first, ok := infoLines[entry.Name]; ok {
+			add(s.INDEX_FILE_INFO, i+1, IssueWarning, "duplicate entry for firmware '%s' (first defined in line %d), the last entry wins", entry.Name, first)
+		} else {
+			infoLines[entry.Name] = i + 1
+		}
+		if entry.RetentionVersions != nil && *entry.RetentionVersions < 0 {
+			add(s.INDEX_FILE_INFO, i+1, IssueError, "retentionVersions must not be negative")
+		}
+		if len(entry.RetentionOrder) > 0 && entry.RetentionOrder != s.RETENTION_ORDER_SEMVER && entry.RetentionOrder != s.RETENTION_ORDER_INDEX {
+			add(s.INDEX_FILE_INFO, i+1, IssueError, "unsupported retentionOrder '%s', supported values are %s and %s", entry.RetentionOrder, s.RETENTION_ORDER_SEMVER, s.RETENTION_ORDER_INDEX)
+		}
+	}
+
+	// firmware versions file
+	versionLines := make(map[FirmwareVersionKey]int)
+	keyLines := make(map[string]int)
+	usedNames := make(map[string]bool)
+	if len(strings.TrimSpace(contentFwVersionFile)) == 0 {
+		add(s.INDEX_FILE_VERSIONS, 0, IssueError, "file is empty, synchronization is not possible")
+	}
+	for i, line := range strings.Split(contentFwVersionFile, "\n") {
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		entry := ExtFirmwareVersionEntry{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			add(s.INDEX_FILE_VERSIONS, i+1, IssueError, "no valid JSON, entry is skipped: %s", err)
+			continue
+		}
+		var missing []string
+		for field, value := range map[string]string{"key": entry.Key, "name": entry.Name, "version": entry.Version} {
+			if len(value) == 0 {
+				missing = append(missing, field)
+			}
+		}
+		if len(missing) > 0 {
+			slices.Sort(missing)
+			add(s.INDEX_FILE_VERSIONS, i+1, IssueError, "missing mandatory fields %v", missing)
+			continue
+		}
+		usedNames[entry.Name] = true
+		versionKey := FirmwareVersionKey{Name: entry.Name, Version: entry.Version}
+		if first, ok := versionLines[versionKey]; ok {
+			add(s.INDEX_FILE_VERSIONS, i+1, IssueError, "duplicate version '%s' of firmware '%s' (first defined in line %d)", entry.Version, entry.Name, first)
+			continue
+		}
+		versionLines[versionKey] = i + 1
+		if first, ok := keyLines[entry.Key]; ok {
+			add(s.INDEX_FILE_VERSIONS, i+1, IssueWarning, "object key '%s' is already used in line %d", entry.Key, first)
+		} else {
+			keyLines[entry.Key] = i + 1
+		}
+		if _, ok := infoLines[entry.Name]; !ok {
+			add(s.INDEX_FILE_VERSIONS, i+1, IssueWarning, "no entry for firmware '%s' in %s, it is created without description and device type", entry.Name, s.INDEX_FILE_INFO)
+		}
+	}
+	for name, line := range infoLines {
+		if !usedNames[name] {
+			add(s.INDEX_FILE_INFO, line, IssueWarning, "firmware '%s' has no versions in %s", name, s.INDEX_FILE_VERSIONS)
+		}
+	}
+	slices.SortStableFunc(issues, func(a, b IndexIssue) int {
+		return cmp.Or(strings.Compare(a.File, b.File), cmp.Compare(a.Line, b.Line))
+	})
+	return issues
+}
+
+// ValidateIndexObjects checks that the objects referenced by the firmware versions file exist. stat returns est.ErrNotFound for missing objects.
+func ValidateIndexObjects(contentFwVersionFile string, stat func(objectKey string) error) []IndexIssue {
+	var issues []IndexIssue
+	for i, line := range strings.Split(contentFwVersionFile, "\n") {
+		entry := ExtFirmwareVersionEntry{}
+		if json.Unmarshal([]byte(line), &entry) != nil || len(entry.Key) == 0 {
+			continue
+		}
+		switch err := stat(entry.Key); {
+		case errors.Is(err, est.ErrNotFound):
+			issues = append(issues, IndexIssue{File: s.INDEX_FILE_VERSIONS, Line: i + 1, Severity: IssueError, Message: fmt.Sprintf("object '%s' not found in storage", entry.Key)})
+		case err != nil:
+			issues = append(issues, IndexIssue{File: s.INDEX_FILE_VERSIONS, Line: i + 1, Severity: IssueWarning, Message: fmt.Sprintf("could not check object '%s': %s", entry.Key, err)})
+		}
+	}
+	return issues
+}
+
+// ValidateTenantGroups checks the tenant groups file (empty if it doesn't exist) and that the tenant groups the index entries are
+// restricted to are defined in it
+func ValidateTenantGroups(contentFwVersionFile string, contentFwInfoFile string, contentTenantGroupsFile string) []IndexIssue {
+	groups, err := ParseTenantGroups(contentTenantGroupsFile)
+	if err != nil {
+		return []IndexIssue{{File: s.INDEX_FILE_TENANT_GROUPS, Severity: IssueError, Message: fmt.Sprintf("no valid JSON object of group names and tenant ids, synchronization is not possible: %s", err)}}
+	}
+	var issues []IndexIssue
+	for _, file := range []struct {
+		name    string
+		content string
+	}{{s.INDEX_FILE_INFO, contentFwInfoFile}, {s.INDEX_FILE_VERSIONS, contentFwVersionFile}} {
+		for i, line := range strings.Split(file.content, "\n") {
+			scope := TenantScope{}
+			if json.Unmarshal([]byte(line), &scope) != nil {
+				continue
+			}
+			for _, group := range scope.TenantGroups {
+				if _, ok := groups[group]; !ok {
+					issues = append(issues, IndexIssue{File: file.name, Line: i + 1, Severity: IssueWarning, Message: fmt.Sprintf("tenant group '%s' is not defined in %s, no tenant is member of it", group, s.INDEX_FILE_TENANT_GROUPS)})
+				}
+			}
+		}
+	}
+	return issues
+}
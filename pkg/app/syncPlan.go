@@ -0,0 +1,182 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	s "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/static"
+)
+
+// actions of planned changes
+const (
+	PlanCreateFirmware = "create-firmware"
+	PlanCreate         = "create"
+	PlanRestore        = "restore"
+	PlanDelete         = "delete"
+	PlanArchive        = "archive"
+	PlanDefer          = "defer"
+	PlanPostpone       = "postpone"
+)
+
+// PlannedChange is a change a synchronization would apply to a tenant
+type PlannedChange struct {
+	Action    string `json:"action"`
+	Name      string `json:"name"`
+	Version   string `json:"version,omitempty"`
+	ObjectKey string `json:"objectKey,omitempty"`
+	MoId      string `json:"moId,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	// index entry to create or restore the version from
+	entry ExtFirmwareVersionEntry
+	// version of the tenant store to restore or remove
+	version FirmwareStoreVersionEntry
+	// devices the version is installed on (deferred removals only)
+	deviceCount int
+}
+
+// SyncPlan lists the changes a synchronization with the index files would apply to a tenant, without applying them
+type SyncPlan struct {
+	TenantId  string          `json:"tenantId"`
+	InputHash string          `json:"inputHash"`
+	Changes   []PlannedChange `json:"changes"`
+	// true if a scheduled synchronization would be skipped, as the tenant was already synchronized with the same index files
+	UpToDate bool `json:"upToDate"`
+	Paused   bool `json:"paused"`
+}
+
+// removalSettings decide how versions missing in the index files are handled
+type removalSettings struct {
+	// removals are only applied within the maintenance window
+	allowed      bool
+	window       string
+	deletionMode string
+	// installed firmware versions, only requested if there is anything to remove
+	installedVersions    map[FirmwareVersionKey]int
+	installedVersionsErr error
+}
+
+// returns the versions of the store created by the service which are missing in the index entries
+func removedVersions(store *FirmwareTenantStore, extFwVersionEntries []ExtFirmwareVersionEntry) []FirmwareStoreVersionEntry {
+	var res []FirmwareStoreVersionEntry
+	for _, version := range store.GetFirmwareVersions() {
+		if version.HasExternalOrigin && !contains(extFwVersionEntries, version) {
+			res = append(res, version)
+		}
+	}
+	return res
+}
+
+// planChanges determines the changes needed to bring the tenant (as cached in the store) in line with the index entries.
+// It does not access Cumulocity, the synchronization applies the changes while Plan only lists them.
+func planChanges(store *FirmwareTenantStore, extFwVersionEntries []ExtFirmwareVersionEntry, removal removalSettings) []PlannedChange {
+	var changes []PlannedChange
+	planned := make(map[FirmwareVersionKey]bool)
+	createdFirmwares := make(map[string]bool)
+	for _, entry := range extFwVersionEntries {
+		key := FirmwareVersionKey{Name: entry.Name, Version: entry.Version}
+		if _, ok := store.GetFirmwareVersion(entry.Name, entry.Version); ok || planned[key] {
+			continue
+		}
+		planned[key] = true
+		// version might have been archived earlier, it is restored instead of creating a new one
+		if archivedVersion, ok := store.GetArchivedFirmwareVersion(entry.Name, entry.Version); ok {
+			changes = append(changes, PlannedChange{Action: PlanRestore, Name: entry.Name, Version: entry.Version, ObjectKey: entry.Key, MoId: archivedVersion.MoId, entry: entry, version: archivedVersion})
+			continue
+		}
+		if _, ok := store.GetFirmware(entry.Name); !ok && !createdFirmwares[entry.Name] {
+			changes = append(changes, PlannedChange{Action: PlanCreateFirmware, Name: entry.Name, entry: entry})
+			createdFirmwares[entry.Name] = true
+		}
+		changes = append(changes, PlannedChange{Action: PlanCreate, Name: entry.Name, Version: entry.Version, ObjectKey: entry.Key, entry: entry})
+	}
+
+	for _, version := range removedVersions(store, extFwVersionEntries) {
+		change := PlannedChange{Name: version.FwName, Version: version.Version, MoId: version.MoId, version: version}
+		switch deviceCount := removal.installedVersions[FirmwareVersionKey{Name: version.FwName, Version: version.Version}]; {
+		case !removal.allowed:
+			change.Action, change.Reason = PlanPostpone, "outside of maintenance window "+removal.window
+		case removal.installedVersionsErr != nil:
+			change.Action, change.Reason = PlanDefer, "installed firmware versions could not be determined"
+		case deviceCount > 0:
+			change.Action, change.Reason, change.deviceCount = PlanDefer, fmt.Sprintf("installed on %d device(s)", deviceCount), deviceCount
+		case removal.deletionMode == s.DELETION_MODE_ARCHIVE:
+			change.Action = PlanArchive
+		default:
+			change.Action = PlanDelete
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// collects the settings for removals, the installed firmware versions are only requested if any version is to be removed
+func (c *FirmwareTenantController) removalSettings(extFwVersionEntries []ExtFirmwareVersionEntry, installed *installedVersionsLookup) removalSettings {
+	removal := removalSettings{
+		allowed:      c.schedule.MaintenanceWindow.Contains(time.Now()),
+		deletionMode: c.syncSettings.DeletionMode,
+	}
+	if c.schedule.MaintenanceWindow != nil {
+		removal.window = c.schedule.MaintenanceWindow.Spec
+	}
+	if removal.allowed && len(removedVersions(c.tenantStore, extFwVersionEntries)) > 0 {
+		removal.installedVersions, removal.installedVersionsErr = installed.get()
+	}
+	return removal
+}
+
+// Plan determines the changes SyncWithIndexFiles would apply, based on the current inventory of the tenant (read-only).
+func (c *FirmwareTenantController) Plan(extFwVersionEntries []ExtFirmwareVersionEntry, extFwInfoEntries map[string]ExtFirmwareInfoEntry, inputHash string) (*SyncPlan, error) {
+	c.syncMu.Lock()
+	defer c.syncMu.Unlock()
+	state := c.SyncState()
+	plan := &SyncPlan{
+		TenantId:  c.tenantId,
+		InputHash: inputHash,
+		UpToDate:  !c.fullSyncDue(state) && state.LastSyncSuccessful && state.LastKnownInputHash == inputHash,
+		Paused:    state.Paused,
+	}
+	if err := c.rebuildTenantStore(); err != nil {
+		return nil, err
+	}
+	installed := newInstalledVersionsLookup(c)
+	extFwVersionEntries = applyRetentionPolicy(c, installed, extFwVersionEntries, extFwInfoEntries)
+	plan.Changes = planChanges(c.tenantStore, extFwVersionEntries, c.removalSettings(extFwVersionEntries, installed))
+	slog.Info("Planned synchronization for tenant", "tenant", c.tenantId, "changes", len(plan.Changes))
+	return plan, nil
+}
+
+// Print writes the plan in a human readable form
+func (p *SyncPlan) Print(w io.Writer) {
+	fmt.Fprintf(w, "Plan for tenant %s (index files %s)\n", p.TenantId, p.InputHash)
+	if p.Paused {
+		fmt.Fprintln(w, "  Synchronization is paused for this tenant, no changes are applied until it is resumed.")
+	}
+	if p.UpToDate {
+		fmt.Fprintln(w, "  Tenant was already synchronized with these index files, scheduled synchronizations skip it until the next full sync.")
+	}
+	counts := make(map[string]int)
+	for _, change := range p.Changes {
+		counts[change.Action]++
+		line := fmt.Sprintf("  %-15s %s", change.Action, change.Name)
+		if len(change.Version) > 0 {
+			line += " " + change.Version
+		}
+		if len(change.ObjectKey) > 0 {
+			line += " (" + change.ObjectKey + ")"
+		}
+		if len(change.MoId) > 0 {
+			line += " [id " + change.MoId + "]"
+		}
+		if len(change.Reason) > 0 {
+			line += ": " + change.Reason
+		}
+		fmt.Fprintln(w, line)
+	}
+	if len(p.Changes) == 0 {
+		fmt.Fprintln(w, "  No changes, tenant is in sync with the index files.")
+	}
+	fmt.Fprintf(w, "%d firmware(s) and %d version(s) to create, %d to restore, %d to delete, %d to archive, %d deferred, %d postponed\n",
+		counts[PlanCreateFirmware], counts[PlanCreate], counts[PlanRestore], counts[PlanDelete], counts[PlanArchive], counts[PlanDefer], counts[PlanPostpone])
+}
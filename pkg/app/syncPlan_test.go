@@ -0,0 +1,66 @@
+package app
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	s "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/static"
+)
+
+func TestPlanChanges(t *testing.T) {
+	store := NewFirmwareTenantStore()
+	store.AddFirmware(FirmwareStoreFwEntry{MoId: "1", MoName: "fw 1"})
+	store.AddFirmwareVersion(FirmwareStoreVersionEntry{MoId: "11", FwMoId: "1", FwName: "fw 1", Version: "1.0.0", HasExternalOrigin: true})
+	store.AddFirmwareVersion(FirmwareStoreVersionEntry{MoId: "12", FwMoId: "1", FwName: "fw 1", Version: "0.9.0", HasExternalOrigin: true})
+	// created manually, never removed by the service
+	store.AddFirmwareVersion(FirmwareStoreVersionEntry{MoId: "13", FwMoId: "1", FwName: "fw 1", Version: "0.8.0"})
+	store.AddArchivedFirmwareVersion(FirmwareStoreVersionEntry{MoId: "21", FwMoId: "2", FwName: "fw 2", Version: "2.0.0", HasExternalOrigin: true})
+	entries := []ExtFirmwareVersionEntry{
+		{Key: "fw-1_1.0.0.zip", Name: "fw 1", Version: "1.0.0"},
+		{Key: "fw-1_1.0.1.zip", Name: "fw 1", Version: "1.0.1"},
+		{Key: "fw-2_2.0.0.zip", Name: "fw 2", Version: "2.0.0"},
+		{Key: "fw-3_3.0.0.zip", Name: "fw 3", Version: "3.0.0"},
+		{Key: "fw-3_3.0.1.zip", Name: "fw 3", Version: "3.0.1"},
+		{Key: "fw-3_3.0.1.zip", Name: "fw 3", Version: "3.0.1"},
+	}
+	creations := []string{
+		PlanCreate + " fw 1 1.0.1",
+		PlanRestore + " fw 2 2.0.0",
+		PlanCreateFirmware + " fw 3 ",
+		PlanCreate + " fw 3 3.0.0",
+		PlanCreate + " fw 3 3.0.1",
+	}
+	installed := map[FirmwareVersionKey]int{{Name: "fw 1", Version: "0.9.0"}: 3}
+
+	tests := []struct {
+		name        string
+		removal     removalSettings
+		removal09   string
+		deviceCount int
+	}{
+		{name: "outside of maintenance window", removal: removalSettings{allowed: false, window: "0 2 * * SAT;4h"}, removal09: PlanPostpone},
+		{name: "installed versions unknown", removal: removalSettings{allowed: true, installedVersionsErr: errors.New("unavailable")}, removal09: PlanDefer},
+		{name: "installed on devices", removal: removalSettings{allowed: true, installedVersions: installed}, removal09: PlanDefer, deviceCount: 3},
+		{name: "archive mode", removal: removalSettings{allowed: true, deletionMode: s.DELETION_MODE_ARCHIVE}, removal09: PlanArchive},
+		{name: "delete mode", removal: removalSettings{allowed: true, deletionMode: s.DELETION_MODE_DELETE}, removal09: PlanDelete},
+	}
+	for _, tt := range tests {
+		changes := planChanges(store, entries, tt.removal)
+		var got []string
+		for _, change := range changes {
+			got = append(got, change.Action+" "+change.Name+" "+change.Version)
+		}
+		want := append(slices.Clone(creations), tt.removal09+" fw 1 0.9.0")
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: expected changes %q, got %q", tt.name, want, got)
+			continue
+		}
+		if restore := changes[1]; restore.MoId != "21" || restore.version.MoId != "21" || restore.entry.Key != "fw-2_2.0.0.zip" {
+			t.Errorf("%s: expected restore of the archived version, got %+v", tt.name, restore)
+		}
+		if removal := changes[len(changes)-1]; removal.MoId != "12" || removal.deviceCount != tt.deviceCount {
+			t.Errorf("%s: unexpected removal %+v", tt.name, removal)
+		}
+	}
+}
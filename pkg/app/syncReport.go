@@ -0,0 +1,91 @@
+package app
+
+import (
+	"log/slog"
+	"time"
+)
+
+// TenantSyncResult is the outcome of synchronizing a single tenant with the index files
+type TenantSyncResult struct {
+	TenantId  string        `json:"tenantId"`
+	StartTime time.Time     `json:"startTime"`
+	Duration  time.Duration `json:"duration"`
+	Created   int           `json:"created"`
+	Restored  int           `json:"restored"`
+	Deleted   int           `json:"deleted"`
+	Archived  int           `json:"archived"`
+	Deferred  int           `json:"deferred"`
+	// removals postponed until the next maintenance window
+	Postponed int      `json:"postponed"`
+	Errors    []string `json:"errors,omitempty"`
+	// true if the synchronization was skipped as the index files did not change
+	Unchanged bool `json:"unchanged,omitempty"`
+	// true if the synchronization was skipped as it is paused for the tenant
+	Paused bool `json:"paused,omitempty"`
+	// entries of the overlay index ignored as they would override shared firmwares
+	Conflicts []string `json:"conflicts,omitempty"`
+}
+
+func (r *TenantSyncResult) Success() bool {
+	return len(r.Errors) == 0
+}
+
+func (r *TenantSyncResult) addError(err error) {
+	r.Errors = append(r.Errors, err.Error())
+}
+
+func (r *TenantSyncResult) countCreated(err error) {
+	if err != nil {
+		r.addError(err)
+		return
+	}
+	r.Created++
+}
+
+// SyncRunReport aggregates the results of all tenants synchronized in one run
+type SyncRunReport struct {
+	StartTime   time.Time     `json:"startTime"`
+	Duration    time.Duration `json:"duration"`
+	InputHash   string        `json:"inputHash"`
+	Concurrency int           `json:"concurrency"`
+	Succeeded   int           `json:"succeeded"`
+	Failed      int           `json:"failed"`
+	Unchanged   int           `json:"unchanged"`
+	Paused      int           `json:"paused"`
+	Skipped     []string      `json:"skipped,omitempty"`
+	// index entries of storage sources shadowed by a source with higher precedence
+	Conflicts []string           `json:"conflicts,omitempty"`
+	Tenants   []TenantSyncResult `json:"tenants"`
+}
+
+func (r *SyncRunReport) add(result TenantSyncResult) {
+	if result.Paused {
+		r.Paused++
+	} else if result.Unchanged {
+		r.Unchanged++
+	} else if result.Success() {
+		r.Succeeded++
+	} else {
+		r.Failed++
+	}
+	r.Tenants = append(r.Tenants, result)
+}
+
+func (r *SyncRunReport) Log() {
+	created, restored, deleted, archived, deferred, postponed := 0, 0, 0, 0, 0, 0
+	for _, t := range r.Tenants {
+		created += t.Created
+		restored += t.Restored
+		deleted += t.Deleted
+		archived += t.Archived
+		deferred += t.Deferred
+		postponed += t.Postponed
+		if !t.Success() {
+			slog.Warn("Synchronization of tenant finished with errors", "tenant", t.TenantId, "errors", t.Errors)
+		}
+	}
+	slog.Info("Synchronization run finished",
+		"duration", r.Duration.String(), "concurrency", r.Concurrency,
+		"succeeded", r.Succeeded, "failed", r.Failed, "unchanged", r.Unchanged, "paused", r.Paused, "skipped", len(r.Skipped),
+		"created", created, "restored", restored, "deleted", deleted, "archived", archived, "deferred", deferred, "postponed", postponed)
+}
@@ -0,0 +1,151 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+
+	s "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/static"
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+	"gopkg.in/robfig/cron.v2"
+)
+
+// interval in which the scheduler checks for due tenants
+const schedulerTickInterval = 15 * time.Second
+
+// MaintenanceWindow is a recurring time window in which destructive changes (deleting/archiving firmware versions) are applied
+type MaintenanceWindow struct {
+	// cron expression of the window start, e.g. "0 2 * * SAT"
+	Spec     string
+	Start    cron.Schedule
+	Duration time.Duration
+}
+
+// Contains returns true if t is within the window. A nil window contains any time.
+func (w *MaintenanceWindow) Contains(t time.Time) bool {
+	if w == nil {
+		return true
+	}
+	// first window start after (t - duration), t is within the window if this start is not after t
+	return !w.Start.Next(t.Add(-w.Duration)).After(t)
+}
+
+// TenantSchedule defines when a tenant is synchronized
+type TenantSchedule struct {
+	// cron expression (empty if the tenant is synchronized in a fixed interval)
+	Spec     string
+	Schedule cron.Schedule
+	// max. random delay added to each scheduled start, spreads the load of tenants sharing a schedule
+	Jitter            time.Duration
+	MaintenanceWindow *MaintenanceWindow
+}
+
+// next scheduled synchronization after t (incl. jitter)
+func (ts TenantSchedule) next(t time.Time) time.Time {
+	next := ts.Schedule.Next(t)
+	if ts.Jitter > 0 {
+		next = next.Add(rand.N(ts.Jitter))
+	}
+	return next
+}
+
+// reads the schedule related tenant options, options not set are taken from defaults.
+// Used for the tenant hosting the service (defaults for all tenants) as well as for overrides within each subscribed tenant.
+func readTenantSchedule(ctx context.Context, c *c8y.Client, defaults TenantSchedule) TenantSchedule {
+	schedule := defaults
+	opt, _, err := c.TenantOptions.GetOption(ctx, s.TOPT_CATEGORY, s.TOPT_FW_SYNC_SCHEDULE)
+	if err == nil && len(opt.Value) > 0 {
+		if parsed, e := cron.Parse(opt.Value); e == nil {
+			schedule.Spec, schedule.Schedule = opt.Value, parsed
+		} else {
+			slog.Warn("Invalid sync schedule in tenant options. Using default.", "schedule", opt.Value, "err", e)
+		}
+	}
+	opt, _, err = c.TenantOptions.GetOption(ctx, s.TOPT_CATEGORY, s.TOPT_FW_SYNC_JITTER_SECS)
+	if err == nil {
+		if o, e := strconv.Atoi(opt.Value); e == nil && o >= 0 {
+			schedule.Jitter = time.Duration(o) * time.Second
+		}
+	}
+	opt, _, err = c.TenantOptions.GetOption(ctx, s.TOPT_CATEGORY, s.TOPT_FW_MAINTENANCE_WINDOW)
+	if err == nil && len(opt.Value) > 0 {
+		if window, e := parseMaintenanceWindow(opt.Value); e == nil {
+			schedule.MaintenanceWindow = window
+		} else {
+			slog.Warn("Invalid maintenance window in tenant options. Using default.", "maintenanceWindow", opt.Value, "err", e)
+		}
+	}
+	return schedule
+}
+
+// parses maintenance windows like "0 2 * * SAT;4h" (cron expression of the start and duration, separated by ';')
+func parseMaintenanceWindow(value string) (*MaintenanceWindow, error) {
+	i := strings.LastIndex(value, ";")
+	if i < 0 {
+		return nil, fmt.Errorf("expected '<cron expression>;<duration>', got %q", value)
+	}
+	spec, durationValue := strings.TrimSpace(value[:i]), strings.TrimSpace(value[i+1:])
+	start, err := cron.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	duration, err := time.ParseDuration(durationValue)
+	if err != nil {
+		return nil, err
+	}
+	if duration <= 0 {
+		return nil, fmt.Errorf("duration of maintenance window must be positive, got %s", duration)
+	}
+	return &MaintenanceWindow{Spec: spec, Start: start, Duration: duration}, nil
+}
+
+// RunScheduler synchronizes each registered tenant according to its schedule until ctx is done.
+// Due tenants are synchronized together (see SyncTenantsWithIndexFiles), paused tenants are skipped.
+func (c *FirmwareTenantControllers) RunScheduler(ctx context.Context) {
+	slog.Info("Sync scheduler started")
+	nextRuns := make(map[string]time.Time)
+	ticker := time.NewTicker(schedulerTickInterval)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		var due []string
+		registered := make(map[string]bool)
+		for _, tenantId := range c.TenantIds() {
+			fc, ok := c.Get(tenantId)
+			if !ok {
+				continue
+			}
+			registered[tenantId] = true
+			next, scheduled := nextRuns[tenantId]
+			if !scheduled {
+				nextRuns[tenantId] = fc.schedule.next(now)
+				slog.Info("Scheduled synchronization of tenant", "tenant", tenantId, "next", nextRuns[tenantId])
+				continue
+			}
+			if now.Before(next) {
+				continue
+			}
+			nextRuns[tenantId] = fc.schedule.next(now)
+			due = append(due, tenantId)
+		}
+		for tenantId := range nextRuns {
+			if !registered[tenantId] {
+				delete(nextRuns, tenantId)
+			}
+		}
+		if len(due) > 0 {
+			slog.Info("Start scheduled synchronization", "tenants", due)
+			c.SyncTenantsWithIndexFiles(ctx, due)
+		}
+		select {
+		case <-ctx.Done():
+			slog.Info("Sync scheduler stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
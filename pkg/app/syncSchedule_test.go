@@ -0,0 +1,131 @@
+package app
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	"gopkg.in/robfig/cron.v2"
+)
+
+func mustParseMaintenanceWindow(t *testing.T, value string) *MaintenanceWindow {
+	t.Helper()
+	window, err := parseMaintenanceWindow(value)
+	if err != nil {
+		t.Fatalf("could not parse maintenance window %q: %s", value, err)
+	}
+	return window
+}
+
+func TestParseMaintenanceWindow(t *testing.T) {
+	tests := []struct {
+		value    string
+		spec     string
+		duration time.Duration
+		wantErr  bool
+	}{
+		{value: "0 2 * * SAT;4h", spec: "0 2 * * SAT", duration: 4 * time.Hour},
+		{value: " 30 22 * * * ; 3h30m ", spec: "30 22 * * *", duration: 3*time.Hour + 30*time.Minute},
+		{value: "TZ=Europe/Berlin 0 2 * * *;1h", spec: "TZ=Europe/Berlin 0 2 * * *", duration: time.Hour},
+		{value: "0 2 * * SAT", wantErr: true},
+		{value: "0 2 * * SAT;", wantErr: true},
+		{value: ";4h", wantErr: true},
+		{value: "0 2 * * SAT;4", wantErr: true},
+		{value: "0 2 * * SAT;0s", wantErr: true},
+		{value: "0 2 * * SAT;-1h", wantErr: true},
+		{value: "0 25 * * *;1h", wantErr: true},
+		{value: "every saturday;4h", wantErr: true},
+		{value: "TZ=Nowhere/Unknown 0 2 * * *;1h", wantErr: true},
+	}
+	for _, tt := range tests {
+		window, err := parseMaintenanceWindow(tt.value)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseMaintenanceWindow(%q): expected error, got %+v", tt.value, window)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseMaintenanceWindow(%q): unexpected error %s", tt.value, err)
+			continue
+		}
+		if window.Spec != tt.spec || window.Duration != tt.duration {
+			t.Errorf("parseMaintenanceWindow(%q) = %q %s, want %q %s", tt.value, window.Spec, window.Duration, tt.spec, tt.duration)
+		}
+	}
+}
+
+func TestMaintenanceWindowContains(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(value string) time.Time {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	tests := []struct {
+		name   string
+		window string
+		time   time.Time
+		want   bool
+	}{
+		{name: "before window", window: "0 2 * * SAT;4h", time: at("2026-10-17T01:59:59Z"), want: false},
+		{name: "start of window", window: "0 2 * * SAT;4h", time: at("2026-10-17T02:00:00Z"), want: true},
+		{name: "within window", window: "0 2 * * SAT;4h", time: at("2026-10-17T04:30:00Z"), want: true},
+		{name: "last second of window", window: "0 2 * * SAT;4h", time: at("2026-10-17T05:59:59Z"), want: true},
+		{name: "end of window", window: "0 2 * * SAT;4h", time: at("2026-10-17T06:00:00Z"), want: false},
+		{name: "other weekday", window: "0 2 * * SAT;4h", time: at("2026-10-18T03:00:00Z"), want: false},
+		{name: "crossing midnight, before midnight", window: "0 22 * * *;4h", time: at("2026-10-17T23:30:00Z"), want: true},
+		{name: "crossing midnight, after midnight", window: "0 22 * * *;4h", time: at("2026-10-18T01:59:59Z"), want: true},
+		{name: "crossing midnight, after window", window: "0 22 * * *;4h", time: at("2026-10-18T02:00:00Z"), want: false},
+		{name: "crossing midnight and weekday", window: "0 23 * * SAT;3h", time: at("2026-10-18T01:00:00Z"), want: true},
+		{name: "window longer than a day", window: "0 0 * * SAT;48h", time: at("2026-10-18T23:59:59Z"), want: true},
+		{name: "time in other zone", window: "0 2 * * SAT;4h", time: at("2026-10-17T02:30:00Z").In(berlin), want: true},
+		{name: "window in zone, within", window: "TZ=Europe/Berlin 0 2 * * *;1h", time: at("2026-10-17T00:30:00Z"), want: true},
+		{name: "window in zone, UTC time of start", window: "TZ=Europe/Berlin 0 2 * * *;1h", time: at("2026-10-17T02:30:00Z"), want: false},
+		{name: "window in zone, winter time", window: "TZ=Europe/Berlin 0 2 * * *;1h", time: at("2026-12-17T01:30:00Z"), want: true},
+	}
+	for _, tt := range tests {
+		if got := mustParseMaintenanceWindow(t, tt.window).Contains(tt.time); got != tt.want {
+			t.Errorf("%s: %q contains %s = %v, want %v", tt.name, tt.window, tt.time, got, tt.want)
+		}
+	}
+
+	var none *MaintenanceWindow
+	if !none.Contains(time.Now()) {
+		t.Error("expected missing maintenance window to contain any time")
+	}
+}
+
+func TestTenantScheduleNext(t *testing.T) {
+	schedule, err := cron.Parse("0 */15 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2026, 10, 17, 23, 50, 0, 0, time.UTC)
+	ts := TenantSchedule{Schedule: schedule}
+	if next := ts.next(from); !next.Equal(time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected next run at midnight, got %s", next)
+	}
+	if next := ts.next(time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)); !next.Equal(time.Date(2026, 10, 18, 0, 15, 0, 0, time.UTC)) {
+		t.Errorf("expected next run to be strictly after the given time, got %s", next)
+	}
+
+	ts.Jitter = time.Minute
+	for range 100 {
+		next := ts.next(from)
+		if base := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC); next.Before(base) || !next.Before(base.Add(ts.Jitter)) {
+			t.Fatalf("expected jitter within [0, %s), got %s", ts.Jitter, next)
+		}
+	}
+
+	every, _ := cron.Parse("@every 5m")
+	ts = TenantSchedule{Schedule: every}
+	if next := ts.next(from); !next.Equal(from.Add(5 * time.Minute)) {
+		t.Errorf("expected fixed interval from the given time, got %s", next)
+	}
+}
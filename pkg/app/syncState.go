@@ -0,0 +1,176 @@
+package app
+
+import (
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	s "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/static"
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+)
+
+// TenantSyncState describes the outcome of the latest synchronization of a tenant.
+// It is persisted to a service-owned managed object in the tenant, so that a restarted service can resume from it.
+type TenantSyncState struct {
+	// hash of the index files the tenant was synchronized with the last time
+	LastKnownInputHash string            `json:"lastKnownInputHash,omitempty"`
+	LastSyncSuccessful bool              `json:"lastSyncSuccessful"`
+	LastSync           time.Time         `json:"lastSync,omitempty"`
+	LastFullSync       time.Time         `json:"lastFullSync,omitempty"`
+	LastResult         *TenantSyncResult `json:"lastResult,omitempty"`
+	// synchronization of the tenant is paused (via the status API)
+	Paused bool `json:"paused,omitempty"`
+}
+
+// TenantSyncStatus is the sync state of a single tenant as exposed by the status API
+type TenantSyncStatus struct {
+	TenantId          string `json:"tenantId"`
+	Schedule          string `json:"schedule"`
+	MaintenanceWindow string `json:"maintenanceWindow,omitempty"`
+	TenantSyncState
+}
+
+// SyncStatus is the overall synchronization status as exposed by the status API
+type SyncStatus struct {
+	LastRun *SyncRunReport     `json:"lastRun,omitempty"`
+	Tenants []TenantSyncStatus `json:"tenants"`
+}
+
+func (c *FirmwareTenantController) SyncState() TenantSyncState {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.state
+}
+
+// applies the given changes to the sync state and persists it to the tenant. Errors while persisting are logged only.
+func (c *FirmwareTenantController) updateSyncState(update func(state *TenantSyncState)) {
+	c.stateMu.Lock()
+	update(&c.state)
+	c.stateMu.Unlock()
+	c.persistSyncState()
+}
+
+// reads the persisted sync state from the tenant (if any)
+func (c *FirmwareTenantController) loadSyncState() error {
+	objects, _, err := c.c8yClient.Inventory.GetManagedObjects(c.ctx, &c8y.ManagedObjectOptions{
+		Type:              s.SYNC_STATE_TYPE,
+		PaginationOptions: c8y.PaginationOptions{PageSize: 1},
+	})
+	if err != nil {
+		slog.Warn("Error while reading persisted sync state", "tenant", c.tenantId, "err", err)
+		return err
+	}
+	if len(objects.Items) == 0 {
+		slog.Info("No persisted sync state found for tenant", "tenant", c.tenantId)
+		return nil
+	}
+	state := TenantSyncState{}
+	mo := objects.Items[0]
+	if err := json.Unmarshal([]byte(mo.Get(s.SYNC_STATE_TYPE).Raw), &state); err != nil {
+		slog.Warn("Persisted sync state could not be parsed. Ignoring it.", "tenant", c.tenantId, "err", err)
+		state = TenantSyncState{}
+	}
+	c.stateMu.Lock()
+	c.stateMoId = mo.Get("id").String()
+	c.state = state
+	c.stateMu.Unlock()
+	slog.Info("Resuming from persisted sync state", "tenant", c.tenantId, "lastSync", state.LastSync, "lastSyncSuccessful", state.LastSyncSuccessful)
+	return nil
+}
+
+// persists the current sync state. The state is read while holding the persistence lock, so the latest update wins.
+func (c *FirmwareTenantController) persistSyncState() {
+	c.persistMu.Lock()
+	defer c.persistMu.Unlock()
+	c.stateMu.Lock()
+	moId := c.stateMoId
+	state := c.state
+	c.stateMu.Unlock()
+	if len(moId) > 0 {
+		if _, _, err := c.c8yClient.Inventory.Update(c.ctx, moId, map[string]any{s.SYNC_STATE_TYPE: state}); err != nil {
+			slog.Warn("Error while persisting sync state", "tenant", c.tenantId, "moId", moId, "err", err)
+		}
+		return
+	}
+	mo, _, err := c.c8yClient.Inventory.Create(c.ctx, map[string]any{
+		"name":            "Repository Integration Sync State",
+		"type":            s.SYNC_STATE_TYPE,
+		s.SYNC_STATE_TYPE: state,
+	})
+	if err != nil {
+		slog.Warn("Error while persisting sync state", "tenant", c.tenantId, "err", err)
+		return
+	}
+	c.stateMu.Lock()
+	c.stateMoId = mo.ID
+	c.stateMu.Unlock()
+}
+
+// deletes the persisted sync state from the tenant
+func (c *FirmwareTenantController) removeSyncState() {
+	c.persistMu.Lock()
+	defer c.persistMu.Unlock()
+	c.stateMu.Lock()
+	moId := c.stateMoId
+	c.stateMoId = ""
+	c.stateMu.Unlock()
+	if len(moId) == 0 {
+		return
+	}
+	if _, err := c.c8yClient.Inventory.Delete(c.ctx, moId); err != nil {
+		slog.Warn("Error while deleting persisted sync state", "tenant", c.tenantId, "moId", moId, "err", err)
+	}
+}
+
+// SyncStatus returns the sync state of the given tenants, or of all registered tenants if none are given
+func (c *FirmwareTenantControllers) SyncStatus(tenantIds ...string) SyncStatus {
+	all := len(tenantIds) == 0
+	if all {
+		tenantIds = c.TenantIds()
+	}
+	status := SyncStatus{Tenants: []TenantSyncStatus{}}
+	if all {
+		status.LastRun = c.LastRunReport()
+	}
+	for _, tenantId := range tenantIds {
+		if fc, ok := c.Get(tenantId); ok {
+			tenantStatus := TenantSyncStatus{TenantId: tenantId, Schedule: fc.schedule.Spec, TenantSyncState: fc.SyncState()}
+			if window := fc.schedule.MaintenanceWindow; window != nil {
+				tenantStatus.MaintenanceWindow = window.Spec + ";" + window.Duration.String()
+			}
+			status.Tenants = append(status.Tenants, tenantStatus)
+		}
+	}
+	return status
+}
+
+// SetPaused pauses (or resumes) the synchronization of the given tenant. Returns false if the tenant is not registered.
+func (c *FirmwareTenantControllers) SetPaused(tenantId string, paused bool) bool {
+	fc, ok := c.Get(tenantId)
+	if !ok {
+		return false
+	}
+	slog.Info("Changing pause state of tenant synchronization", "tenant", tenantId, "paused", paused)
+	fc.updateSyncState(func(state *TenantSyncState) {
+		state.Paused = paused
+	})
+	return true
+}
+
+// Cleanup pauses the synchronization of a tenant and removes the firmware objects the service created in it. The pause is
+// persisted, so the objects are not recreated after a restart. It needs to be called before the tenant unsubscribes, as the
+// credentials of its service user are invalid afterwards. Returns false if the tenant is unknown.
+func (c *FirmwareTenantControllers) Cleanup(tenantId string) (int, bool, error) {
+	fc, ok := c.Get(tenantId)
+	if !ok {
+		return 0, false, nil
+	}
+	slog.Info("Pausing tenant synchronization and removing created firmware objects", "tenant", tenantId)
+	// resuming the tenant synchronizes it fully, as the objects of the last known index files were removed
+	fc.updateSyncState(func(state *TenantSyncState) {
+		state.Paused = true
+		state.LastKnownInputHash = ""
+	})
+	removed, err := fc.RemoveCreatedFirmwareObjects()
+	return removed, true, err
+}
@@ -0,0 +1,189 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+
+	est "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/externalstorage"
+	s "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/static"
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+)
+
+// overlaySourceId is the id of the overlay source of a tenant, it can't clash with the ids of the shared sources
+func overlaySourceId(tenantId string) string {
+	return "overlay:" + tenantId
+}
+
+// providers an overlay source may use, the memory provider is meant for tests only
+var overlayProviders = []string{"awsS3", "azblob"}
+
+// max. size of each index file of an overlay source, larger files fail the synchronization of the tenant
+const maxOverlayIndexFileSize = 8 << 20
+
+// overlaySettings are the settings of the tenant hosting the service restricting the overlay sources of the subscribed tenants
+type overlaySettings struct {
+	// tenants allowed to configure an overlay source ("*" for all)
+	tenants []string
+	// tenants allowed to override shared firmwares with their overlay index ("*" for all)
+	overrideTenants []string
+	// hosts (incl. their subdomains) the endpoints of the overlay sources must be located at
+	endpointHosts []string
+}
+
+func readOverlaySettingsFromTenantOptions(ctx context.Context, c *c8y.Client) overlaySettings {
+	settings := overlaySettings{
+		tenants:         readTenantListFromTenantOptions(ctx, c, s.TOPT_FW_OVERLAY_TENANTS),
+		overrideTenants: readTenantListFromTenantOptions(ctx, c, s.TOPT_FW_OVERLAY_OVERRIDE_TENANTS),
+		endpointHosts:   splitList(s.TOPT_FW_OVERLAY_ENDPOINT_HOSTS_DEFAULTVALUE),
+	}
+	if opt, _, err := c.TenantOptions.GetOption(ctx, s.TOPT_CATEGORY, s.TOPT_FW_OVERLAY_ENDPOINT_HOSTS); err == nil {
+		settings.endpointHosts = splitList(opt.Value)
+	}
+	return settings
+}
+
+// reads a comma-separated list of tenants of the tenant hosting the service, "*" stands for all tenants
+func readTenantListFromTenantOptions(ctx context.Context, c *c8y.Client, key string) []string {
+	opt, _, err := c.TenantOptions.GetOption(ctx, s.TOPT_CATEGORY, key)
+	if err != nil {
+		return nil
+	}
+	return splitList(opt.Value)
+}
+
+func splitList(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func tenantListed(tenantIds []string, tenantId string) bool {
+	return slices.Contains(tenantIds, tenantId) || slices.Contains(tenantIds, "*")
+}
+
+// validateOverlayEndpoints fails if an endpoint isn't an https URL of one of the allowed hosts (or their subdomains), so the
+// overlay source of a tenant can't make the service connect to internal hosts
+func validateOverlayEndpoints(endpoints []string, allowedHosts []string) error {
+	for _, endpoint := range endpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return fmt.Errorf("invalid endpoint '%s': %w", endpoint, err)
+		}
+		if u.Scheme != "https" {
+			return fmt.Errorf("endpoint '%s' does not use https", endpoint)
+		}
+		host := strings.ToLower(u.Hostname())
+		if !slices.ContainsFunc(allowedHosts, func(allowed string) bool {
+			allowed = strings.ToLower(allowed)
+			return host == allowed || strings.HasSuffix(host, "."+allowed)
+		}) {
+			return fmt.Errorf("host of endpoint '%s' is not allowed, allowed hosts are %v", endpoint, allowedHosts)
+		}
+	}
+	return nil
+}
+
+// reads the overlay source a tenant configured within its own tenant options (nil if none). ctx carries the credentials of the tenant.
+// The source is ignored unless the tenant is allowed to use an overlay, it is rejected if it uses another than the overlay
+// providers or endpoints other than the allowed hosts.
+func readOverlaySourceFromTenantOptions(ctx context.Context, c *c8y.Client, tenantId string, storageSettings est.ClientSettings, settings overlaySettings) (*est.Source, error) {
+	opt, _, err := c.TenantOptions.GetOption(ctx, s.TOPT_CATEGORY, s.TOPT_FW_OVERLAY_SOURCE)
+	if err != nil || len(strings.TrimSpace(opt.Value)) == 0 {
+		return nil, nil
+	}
+	if !tenantListed(settings.tenants, tenantId) {
+		slog.Warn("Ignoring overlay source of tenant, the tenant is not listed in tenant option "+s.TOPT_FW_OVERLAY_TENANTS, "tenant", tenantId)
+		return nil, nil
+	}
+	config := est.SourceConfig{}
+	if err := json.Unmarshal([]byte(opt.Value), &config); err != nil {
+		return nil, fmt.Errorf("overlay source of tenant %s is no valid JSON object: %w", tenantId, err)
+	}
+	config.Id = overlaySourceId(tenantId)
+	if !slices.Contains(overlayProviders, config.Provider) {
+		return nil, fmt.Errorf("overlay source of tenant %s: unsupported storage provider '%s', supported providers are %v", tenantId, config.Provider, overlayProviders)
+	}
+	endpoints, err := config.Endpoints()
+	if err != nil {
+		return nil, fmt.Errorf("overlay source of tenant %s: %w", tenantId, err)
+	}
+	if err := validateOverlayEndpoints(endpoints, settings.endpointHosts); err != nil {
+		return nil, fmt.Errorf("overlay source of tenant %s: %w", tenantId, err)
+	}
+	source, err := est.NewSourceFromConfig(ctx, config, storageSettings)
+	if err != nil {
+		return nil, err
+	}
+	// the client of the bucket is limited, so the client scoped to the prefix can still be unwrapped (e.g. for downloads)
+	source.Client = est.WithPrefix(est.WithReadLimit(est.Unwrap(source.Client), maxOverlayIndexFileSize), source.Prefix)
+	slog.Info("Using overlay index of tenant", "tenant", tenantId, "provider", source.Client.GetProviderName(), "bucket", source.Client.GetBucketName(), "prefix", source.Prefix)
+	return &source, nil
+}
+
+// tenantEntries returns the entries of the (shared) index the tenant is entitled to, merged with the overlay index of the tenant
+// (if configured). The input hash covers the overlay index as well. Fails if the overlay index can't be read, as its entries
+// would be removed from the tenant otherwise.
+func (c *FirmwareTenantControllers) tenantEntries(ctx context.Context, fc *FirmwareTenantController, index *indexFiles) ([]ExtFirmwareVersionEntry, map[string]ExtFirmwareInfoEntry, string, []string, error) {
+	fwVersionEntries, fwInfoEntries := entitledEntries(fc.tenantId, index.fwVersionEntries, index.fwInfoEntries)
+	if fc.overlay == nil {
+		return fwVersionEntries, fwInfoEntries, index.inputHash, nil, nil
+	}
+	overlay, ok := c.readSourceIndexFiles(ctx, *fc.overlay)
+	if !ok {
+		return nil, nil, "", nil, fmt.Errorf("overlay index files of tenant %s could not be read", fc.tenantId)
+	}
+	fwVersionEntries, fwInfoEntries, conflicts := mergeOverlay(fc.tenantId, fwVersionEntries, fwInfoEntries, overlay, fc.overlayOverride)
+	for _, conflict := range conflicts {
+		slog.Warn("Conflicting overlay index entry ignored", "tenant", fc.tenantId, "conflict", conflict)
+	}
+	return fwVersionEntries, fwInfoEntries, GetMD5Hash(index.inputHash + ":" + overlay.inputHash), conflicts, nil
+}
+
+// mergeOverlay adds the entries of the overlay index of a tenant to the shared entries the tenant is entitled to. Firmwares of
+// the shared entries can only be overridden (incl. adding versions to them) if allowOverride is set, otherwise the overlay
+// entries are ignored and reported as conflicts.
+func mergeOverlay(tenantId string, extFwVersionEntries []ExtFirmwareVersionEntry, extFwInfoEntries map[string]ExtFirmwareInfoEntry, overlay *indexFiles, allowOverride bool) ([]ExtFirmwareVersionEntry, map[string]ExtFirmwareInfoEntry, []string) {
+	sharedNames := make(map[string]bool, len(extFwInfoEntries))
+	for name := range extFwInfoEntries {
+		sharedNames[name] = true
+	}
+	for _, entry := range extFwVersionEntries {
+		sharedNames[entry.Name] = true
+	}
+	var conflicts []string
+	infos := maps.Clone(extFwInfoEntries)
+	for _, name := range slices.Sorted(maps.Keys(overlay.fwInfoEntries)) {
+		if sharedNames[name] && !allowOverride {
+			conflicts = append(conflicts, fmt.Sprintf("firmware '%s' of the overlay index of tenant %s would override the shared firmware", name, tenantId))
+			continue
+		}
+		infos[name] = overlay.fwInfoEntries[name]
+	}
+	overridden := make(map[[2]string]bool)
+	var overlayVersions []ExtFirmwareVersionEntry
+	for _, entry := range overlay.fwVersionEntries {
+		if sharedNames[entry.Name] && !allowOverride {
+			conflicts = append(conflicts, fmt.Sprintf("version '%s' of firmware '%s' of the overlay index of tenant %s would override the shared firmware", entry.Version, entry.Name, tenantId))
+			continue
+		}
+		overridden[[2]string{entry.Name, entry.Version}] = true
+		overlayVersions = append(overlayVersions, entry)
+	}
+	versions := make([]ExtFirmwareVersionEntry, 0, len(extFwVersionEntries)+len(overlayVersions))
+	for _, entry := range extFwVersionEntries {
+		if !overridden[[2]string{entry.Name, entry.Version}] {
+			versions = append(versions, entry)
+		}
+	}
+	return append(versions, overlayVersions...), infos, conflicts
+}
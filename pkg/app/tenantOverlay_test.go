@@ -0,0 +1,25 @@
+package app
+
+import "testing"
+
+func TestValidateOverlayEndpoints(t *testing.T) {
+	allowedHosts := []string{"amazonaws.com", "blob.core.windows.net"}
+	for _, test := range []struct {
+		endpoint string
+		valid    bool
+	}{
+		{"https://s3.eu-central-1.amazonaws.com", true},
+		{"https://account.blob.core.windows.net", true},
+		{"https://amazonaws.com", true},
+		{"http://s3.eu-central-1.amazonaws.com", false},
+		{"https://evilamazonaws.com", false},
+		{"https://amazonaws.com.example.com", false},
+		{"https://169.254.169.254/", false},
+		{"https://localhost:9324", false},
+		{"://invalid", false},
+	} {
+		if err := validateOverlayEndpoints([]string{test.endpoint}, allowedHosts); (err == nil) != test.valid {
+			t.Errorf("%s: expected valid=%t, got %v", test.endpoint, test.valid, err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package app
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+)
+
+// TenantScope restricts an index entry to some of the subscribed tenants. Without tenants and tenant groups, the entry is
+// published to all tenants. Excluded tenants never get the entry, even if they are allowed otherwise.
+type TenantScope struct {
+	Tenants         []string `json:"tenants,omitempty"`
+	TenantGroups    []string `json:"tenantGroups,omitempty"`
+	ExcludedTenants []string `json:"excludedTenants,omitempty"`
+	// groups defined by the tenant groups file of the source the entry was read from, group names are never resolved across sources
+	groups TenantGroups
+}
+
+// TenantGroups are the members (tenant ids) of the tenant groups, by group name
+type TenantGroups map[string][]string
+
+// ParseTenantGroups parses the tenant groups file, a JSON object mapping group names to tenant ids.
+// An empty file defines no groups.
+func ParseTenantGroups(content string) (TenantGroups, error) {
+	groups := TenantGroups{}
+	if len(strings.TrimSpace(content)) == 0 {
+		return groups, nil
+	}
+	if err := json.Unmarshal([]byte(content), &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// setTenantGroups resolves the tenant groups of the entries with the groups of their source
+func (index *indexFiles) setTenantGroups(groups TenantGroups) {
+	for i := range index.fwVersionEntries {
+		index.fwVersionEntries[i].groups = groups
+	}
+	for name, info := range index.fwInfoEntries {
+		info.groups = groups
+		index.fwInfoEntries[name] = info
+	}
+}
+
+func (t TenantScope) allows(tenantId string) bool {
+	if slices.Contains(t.ExcludedTenants, tenantId) {
+		return false
+	}
+	if len(t.Tenants) == 0 && len(t.TenantGroups) == 0 {
+		return true
+	}
+	if slices.Contains(t.Tenants, tenantId) {
+		return true
+	}
+	return slices.ContainsFunc(t.TenantGroups, func(group string) bool {
+		return slices.Contains(t.groups[group], tenantId)
+	})
+}
+
+// entitledEntries returns the entries the tenant is entitled to. A version is only published if both, the version and its
+// firmware, allow the tenant. Versions the tenant is not entitled to (anymore) are removed by the synchronization.
+func entitledEntries(tenantId string, extFwVersionEntries []ExtFirmwareVersionEntry, extFwInfoEntries map[string]ExtFirmwareInfoEntry) ([]ExtFirmwareVersionEntry, map[string]ExtFirmwareInfoEntry) {
+	infos := make(map[string]ExtFirmwareInfoEntry, len(extFwInfoEntries))
+	for name, info := range extFwInfoEntries {
+		if info.allows(tenantId) {
+			infos[name] = info
+		}
+	}
+	versions := make([]ExtFirmwareVersionEntry, 0, len(extFwVersionEntries))
+	for _, entry := range extFwVersionEntries {
+		info, hasInfo := extFwInfoEntries[entry.Name]
+		if hasInfo && !info.allows(tenantId) || !entry.allows(tenantId) {
+			continue
+		}
+		versions = append(versions, entry)
+	}
+	return versions, infos
+}
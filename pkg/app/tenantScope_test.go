@@ -0,0 +1,95 @@
+package app
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	s "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/static"
+)
+
+func TestEntitledEntries(t *testing.T) {
+	groups, err := ParseTenantGroups(`{"beta": ["t1", "t2"], "eu": ["t3"]}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	infos := map[string]ExtFirmwareInfoEntry{
+		"fw 1": {Name: "fw 1"},
+		"fw 2": {Name: "fw 2", TenantScope: TenantScope{TenantGroups: []string{"eu"}}},
+	}
+	versions := []ExtFirmwareVersionEntry{
+		{Name: "fw 1", Version: "1.0.0"},
+		{Name: "fw 1", Version: "1.1.0-beta", TenantScope: TenantScope{TenantGroups: []string{"beta"}, ExcludedTenants: []string{"t2"}}},
+		{Name: "fw 1", Version: "1.0.1", TenantScope: TenantScope{Tenants: []string{"t3"}}},
+		{Name: "fw 2", Version: "2.0.0"},
+		{Name: "fw 2", Version: "2.0.1", TenantScope: TenantScope{Tenants: []string{"t1"}}},
+		{Name: "fw 3", Version: "3.0.0", TenantScope: TenantScope{ExcludedTenants: []string{"t1"}}},
+	}
+	index := &indexFiles{fwVersionEntries: versions, fwInfoEntries: infos}
+	index.setTenantGroups(groups)
+	for tenantId, expected := range map[string][]string{
+		"t1": {"fw 1@1.0.0", "fw 1@1.1.0-beta"},
+		"t2": {"fw 1@1.0.0", "fw 3@3.0.0"},
+		"t3": {"fw 1@1.0.0", "fw 1@1.0.1", "fw 2@2.0.0", "fw 3@3.0.0"},
+	} {
+		entitledVersions, entitledInfos := entitledEntries(tenantId, index.fwVersionEntries, index.fwInfoEntries)
+		var got []string
+		for _, entry := range entitledVersions {
+			got = append(got, entry.Name+"@"+entry.Version)
+		}
+		if !slices.Equal(got, expected) {
+			t.Errorf("%s: expected versions %v, got %v", tenantId, expected, got)
+		}
+		if _, ok := entitledInfos["fw 2"]; ok != (tenantId == "t3") {
+			t.Errorf("%s: unexpected firmware entries %v", tenantId, entitledInfos)
+		}
+	}
+
+	if groups, err := ParseTenantGroups(" \n"); err != nil || len(groups) != 0 {
+		t.Errorf("expected empty file to define no groups, got %v (%v)", groups, err)
+	}
+	if _, err := ParseTenantGroups(`["t1"]`); err == nil {
+		t.Error("expected list to be rejected")
+	}
+}
+
+func TestEntitledEntriesResolveGroupsPerSource(t *testing.T) {
+	// both sources define the group beta, with different members
+	shared := parseIndexFiles(`{"key": "fw-1_1.0.0.zip", "name": "fw 1", "version": "1.0.0", "tenantGroups": ["beta"]}`,
+		`{"name": "fw 1", "description": "fw 1 description"}`)
+	sharedGroups, _ := ParseTenantGroups(`{"beta": ["t1"]}`)
+	shared.setTenantGroups(sharedGroups)
+	vendor := parseIndexFiles(`{"key": "fw-1_2.0.0.zip", "name": "fw 1", "version": "2.0.0", "tenantGroups": ["beta"]}
+{"key": "fw-2_1.0.0.zip", "name": "fw 2", "version": "1.0.0"}`,
+		`{"name": "fw 2", "description": "fw 2 description", "tenantGroups": ["beta"]}`)
+	vendorGroups, _ := ParseTenantGroups(`{"beta": ["t2"]}`)
+	vendor.setTenantGroups(vendorGroups)
+	merged := mergeIndexFiles([]string{"shared", "vendor"}, []*indexFiles{shared, vendor})
+
+	for tenantId, expected := range map[string][]string{
+		"t1": {"fw 1@1.0.0"},
+		"t2": {"fw 1@2.0.0", "fw 2@1.0.0"},
+		"t3": nil,
+	} {
+		entitledVersions, _ := entitledEntries(tenantId, merged.fwVersionEntries, merged.fwInfoEntries)
+		var got []string
+		for _, entry := range entitledVersions {
+			got = append(got, entry.Name+"@"+entry.Version)
+		}
+		if !slices.Equal(got, expected) {
+			t.Errorf("%s: expected versions %v, got %v", tenantId, expected, got)
+		}
+	}
+}
+
+func TestValidateTenantGroups(t *testing.T) {
+	issues := ValidateTenantGroups(`{"key": "fw-1_1.0.0.zip", "name": "fw 1", "version": "1.0.0", "tenantGroups": ["beta", "eu"]}`,
+		`{"name": "fw 1", "tenantGroups": ["beta"]}`, `{"beta": ["t1"]}`)
+	if len(issues) != 1 || issues[0].String() != "warning: c8y-firmware-versions.json:1: tenant group 'eu' is not defined in c8y-tenant-groups.json, no tenant is member of it" {
+		t.Errorf("unexpected issues %v", issues)
+	}
+	issues = ValidateTenantGroups(testVersionsIndex, testInfoIndex, `{"beta": "t1"}`)
+	if !HasErrors(issues) || issues[0].File != s.INDEX_FILE_TENANT_GROUPS || !strings.Contains(issues[0].Message, "no valid JSON object") {
+		t.Errorf("expected invalid tenant groups file to be an error, got %v", issues)
+	}
+}
@@ -28,7 +28,16 @@ func (e *ErrInvalidAuthType) Error() string {
 type Role string
 
 const (
-	RoleDevice Role = "ROLE_DEVICE"
+	RoleDevice         Role = "ROLE_DEVICE"
+	RoleInventoryAdmin Role = "ROLE_INVENTORY_ADMIN"
+	// custom role of the service (see roles of the manifest), allows publishing firmware
+	RoleFirmwarePublish Role = "ROLE_FIRMWARE_REPO_PUBLISH"
+)
+
+// Webhook endpoints called by external systems. They don't use Cumulocity credentials but verify a shared secret themselves.
+const (
+	PathEventGridWebhook = "/webhooks/eventgrid"
+	PathGenericWebhook   = "/webhooks/storage"
 )
 
 func SkipCheck(c echo.Context) bool {
@@ -38,6 +47,14 @@ func SkipCheck(c echo.Context) bool {
 		"/health",
 		"/prometheus",
 	}
+	// only POST is routed for the webhooks, any other method still requires authentication
+	webhookPaths := []string{
+		PathEventGridWebhook,
+		PathGenericWebhook,
+	}
+	if c.Request().Method == http.MethodPost && slices.Contains(webhookPaths, path) {
+		return true
+	}
 	return slices.Contains(noAuthPaths, path)
 }
 
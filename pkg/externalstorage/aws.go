@@ -1,25 +1,30 @@
 package externalstorage
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"iter"
 	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
-	"github.com/reubenmiller/go-c8y/pkg/c8y"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
 )
 
 type AWSClient struct {
 	s3Client          *s3.Client
+	sqsClient         *sqs.Client
 	s3PresignClient   *s3.PresignClient
 	connectionDetails AwsConnectionDetails
 	urlExpirationMins int
@@ -30,35 +35,62 @@ type AwsConnectionDetails struct {
 	SecretAccessKey string `json:"secretAccessKey"`
 	BucketName      string `json:"bucketName"`
 	Region          string `json:"region"`
+	// URL of an SQS queue receiving the S3 event notifications of the bucket. Optional.
+	SqsQueueUrl string `json:"sqsQueueUrl,omitempty"`
+	// custom SQS endpoint, e.g. a local ElasticMQ. Optional.
+	SqsEndpoint string `json:"sqsEndpoint,omitempty"`
 }
 
-func (awsClient *AWSClient) Init(ctx context.Context, client *c8y.Client, tenantOptionCategory string, tenantOptionKey string, urlExpirationMins int) error {
-	tenantOptionConnectionDetails, _, e := client.TenantOptions.GetOption(ctx, tenantOptionCategory, tenantOptionKey)
-	if e != nil {
-		slog.Error("AWS Credentials were not found in tenant options. Make sure a tenant option for category="+tenantOptionCategory+" and key="+tenantOptionKey+" exists and your service has READ access to tenant option. ", "err", e)
-		return e
-	}
+func init() {
+	RegisterProvider(Provider{
+		Name:      "awsS3",
+		ConfigKey: "credentials.fwAwsS3ConnectionDetails",
+		NewConfig: func() ProviderConfig { return &AwsConnectionDetails{} },
+		New: func(ctx context.Context, config ProviderConfig, settings ClientSettings) (ExternalStorageClient, error) {
+			return NewAWSClient(ctx, *config.(*AwsConnectionDetails), settings.UrlExpirationMins)
+		},
+	})
+}
 
-	var connectionDetails AwsConnectionDetails
-	err := json.Unmarshal([]byte(tenantOptionConnectionDetails.Value), &connectionDetails)
-	if err != nil {
-		slog.Error("Error while unmarshalling tenantOption for awsConnectionDetails. Make sure the tenantoptions value aligns with documentation.", "err", e)
-		return err
+func (d *AwsConnectionDetails) Validate() error {
+	return requireFields("region", d.Region, "accessKeyID", d.AccessKeyId, "secretAccessKey", d.SecretAccessKey, "bucketName", d.BucketName)
+}
+
+// Endpoints returns the S3 endpoint of the region and the SQS endpoints (if configured)
+func (d *AwsConnectionDetails) Endpoints() ([]string, error) {
+	endpoints := []string{"https://s3." + d.Region + ".amazonaws.com"}
+	for _, endpoint := range []string{d.SqsQueueUrl, d.SqsEndpoint} {
+		if len(endpoint) > 0 {
+			endpoints = append(endpoints, endpoint)
+		}
 	}
+	return endpoints, nil
+}
 
-	cfg, err := config.LoadDefaultConfig(context.TODO(),
+func NewAWSClient(ctx context.Context, connectionDetails AwsConnectionDetails, urlExpirationMins int) (*AWSClient, error) {
+	cfg, err := config.LoadDefaultConfig(ctx,
 		config.WithRegion(connectionDetails.Region),
 		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(connectionDetails.AccessKeyId, connectionDetails.SecretAccessKey, "")))
 	if err != nil {
 		slog.Error("Error while loading default config for AWS connection.", "err", err)
-		return err
+		return nil, err
 	}
 	c := s3.NewFromConfig(cfg)
-	awsClient.s3Client = c
-	awsClient.s3PresignClient = s3.NewPresignClient(c)
-	awsClient.urlExpirationMins = urlExpirationMins
-	awsClient.connectionDetails = connectionDetails
-	return nil
+	awsClient := &AWSClient{
+		s3Client:          c,
+		s3PresignClient:   s3.NewPresignClient(c),
+		urlExpirationMins: urlExpirationMins,
+		connectionDetails: connectionDetails,
+	}
+	if len(connectionDetails.SqsQueueUrl) > 0 {
+		awsClient.sqsClient = sqs.NewFromConfig(cfg, func(o *sqs.Options) {
+			if len(connectionDetails.SqsEndpoint) > 0 {
+				o.BaseEndpoint = aws.String(connectionDetails.SqsEndpoint)
+			}
+		})
+		slog.Info("S3 event notifications are consumed from SQS queue", "queueUrl", connectionDetails.SqsQueueUrl)
+	}
+	return awsClient, nil
 }
 
 func (awsClient *AWSClient) GetBucketName() string {
@@ -69,21 +101,35 @@ func (awsClient *AWSClient) GetProviderName() string {
 	return "aws"
 }
 
-func (awsClient *AWSClient) ListBucketContent() {
-	output, err := awsClient.s3Client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
-		Bucket: aws.String(awsClient.connectionDetails.BucketName),
-	})
-	if err != nil {
-		log.Fatal(err)
-	}
-	slog.Info("Bucket content:")
-	for _, object := range output.Contents {
-		slog.Info(fmt.Sprintf("key=%s size=%d", aws.ToString(object.Key), *object.Size))
+func (awsClient *AWSClient) List(ctx context.Context, prefix string) iter.Seq2[ObjectInfo, error] {
+	return func(yield func(ObjectInfo, error) bool) {
+		paginator := s3.NewListObjectsV2Paginator(awsClient.s3Client, &s3.ListObjectsV2Input{
+			Bucket: aws.String(awsClient.connectionDetails.BucketName),
+			Prefix: aws.String(prefix),
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				yield(ObjectInfo{}, awsClient.wrapError(err))
+				return
+			}
+			for _, object := range page.Contents {
+				info := ObjectInfo{
+					Key:          aws.ToString(object.Key),
+					Size:         aws.ToInt64(object.Size),
+					ETag:         aws.ToString(object.ETag),
+					LastModified: aws.ToTime(object.LastModified),
+				}
+				if !yield(info, nil) {
+					return
+				}
+			}
+		}
 	}
 }
 
-func (awsClient *AWSClient) GetPresignedURL(awsObjectKey string) (string, error) {
-	presignedUrl, err := awsClient.s3PresignClient.PresignGetObject(context.Background(),
+func (awsClient *AWSClient) GetPresignedURL(ctx context.Context, awsObjectKey string) (string, error) {
+	presignedUrl, err := awsClient.s3PresignClient.PresignGetObject(ctx,
 		&s3.GetObjectInput{
 			Bucket: aws.String(awsClient.connectionDetails.BucketName),
 			Key:    aws.String(awsObjectKey),
@@ -95,27 +141,196 @@ func (awsClient *AWSClient) GetPresignedURL(awsObjectKey string) (string, error)
 	return presignedUrl.URL, err
 }
 
-func (awsClient *AWSClient) GetFileContent(awsObjectKey string) (string, error) {
-	result, err := awsClient.s3Client.GetObject(context.Background(), &s3.GetObjectInput{
+// the size is signed, S3 rejects uploads of a different size
+func (awsClient *AWSClient) PresignUpload(ctx context.Context, awsObjectKey string, size int64) (PresignedUpload, error) {
+	expiration := time.Minute * time.Duration(awsClient.urlExpirationMins)
+	presigned, err := awsClient.s3PresignClient.PresignPutObject(ctx,
+		&s3.PutObjectInput{
+			Bucket:        aws.String(awsClient.connectionDetails.BucketName),
+			Key:           aws.String(awsObjectKey),
+			IfNoneMatch:   aws.String("*"),
+			ContentLength: aws.Int64(size),
+		},
+		s3.WithPresignExpires(expiration))
+	if err != nil {
+		return PresignedUpload{}, err
+	}
+	upload := PresignedUpload{URL: presigned.URL, Method: presigned.Method, Headers: make(map[string]string), ExpiresAt: time.Now().Add(expiration)}
+	for name, values := range presigned.SignedHeader {
+		// set by the HTTP client itself
+		if !strings.EqualFold(name, "Host") && len(values) > 0 {
+			upload.Headers[name] = values[0]
+		}
+	}
+	return upload, nil
+}
+
+func (awsClient *AWSClient) Open(ctx context.Context, awsObjectKey string) (io.ReadCloser, error) {
+	result, err := awsClient.s3Client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(awsClient.connectionDetails.BucketName),
 		Key:    aws.String(awsObjectKey),
 	})
+	if err != nil {
+		slog.Warn("Couldn't get object from external storage", "awsObjectKey", awsObjectKey, "bucketName", awsClient.connectionDetails.BucketName, "err", err)
+		return nil, awsClient.wrapError(err)
+	}
+	return result.Body, nil
+}
 
+func (awsClient *AWSClient) Stat(ctx context.Context, awsObjectKey string) (ObjectInfo, error) {
+	result, err := awsClient.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(awsClient.connectionDetails.BucketName),
+		Key:    aws.String(awsObjectKey),
+	})
 	if err != nil {
-		var noKey *types.NoSuchKey
-		if errors.As(err, &noKey) {
-			slog.Warn("Can't get object from bucket. No such key existing", "awsObjectKey", awsObjectKey, "bucketName", awsClient.connectionDetails.BucketName)
-		} else {
-			slog.Warn("Couldn't get object from external storage", "awsObjectKey", awsObjectKey, "bucketName", awsClient.connectionDetails.BucketName, "err", err)
+		slog.Warn("Couldn't get object metadata from external storage", "awsObjectKey", awsObjectKey, "bucketName", awsClient.connectionDetails.BucketName, "err", err)
+		return ObjectInfo{}, awsClient.wrapError(err)
+	}
+	return ObjectInfo{
+		Key:          awsObjectKey,
+		Size:         aws.ToInt64(result.ContentLength),
+		ETag:         aws.ToString(result.ETag),
+		LastModified: aws.ToTime(result.LastModified),
+	}, nil
+}
+
+// objects larger than this (or of unknown size) are uploaded in parts of this size, each part is buffered in memory
+const awsMultipartPartSize = 16 * 1024 * 1024
+
+// part buffers are reused across uploads, at most maxConcurrentPartUploads of them are in use at the same time
+var awsPartBuffers = sync.Pool{New: func() any { return make([]byte, awsMultipartPartSize) }}
+
+func (awsClient *AWSClient) Write(ctx context.Context, awsObjectKey string, body io.Reader, size int64, opts WriteOptions) (ObjectInfo, error) {
+	if size < 0 || size > awsMultipartPartSize {
+		return awsClient.writeMultipart(ctx, awsObjectKey, body, opts)
+	}
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(awsClient.connectionDetails.BucketName),
+		Key:           aws.String(awsObjectKey),
+		Body:          body,
+		ContentLength: aws.Int64(size),
+	}
+	if len(opts.IfMatch) > 0 {
+		input.IfMatch = aws.String(opts.IfMatch)
+	}
+	if opts.IfNoneMatch {
+		input.IfNoneMatch = aws.String("*")
+	}
+	if len(opts.ContentType) > 0 {
+		input.ContentType = aws.String(opts.ContentType)
+	}
+	result, err := awsClient.s3Client.PutObject(ctx, input)
+	if err != nil {
+		slog.Warn("Couldn't write object to external storage", "awsObjectKey", awsObjectKey, "bucketName", awsClient.connectionDetails.BucketName, "err", err)
+		return ObjectInfo{}, awsClient.wrapError(err)
+	}
+	return ObjectInfo{Key: awsObjectKey, Size: size, ETag: aws.ToString(result.ETag), LastModified: time.Now()}, nil
+}
+
+func (awsClient *AWSClient) writeMultipart(ctx context.Context, awsObjectKey string, body io.Reader, opts WriteOptions) (ObjectInfo, error) {
+	release, err := acquirePartUploadSlot(ctx)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer release()
+	bucket := aws.String(awsClient.connectionDetails.BucketName)
+	createInput := &s3.CreateMultipartUploadInput{Bucket: bucket, Key: aws.String(awsObjectKey)}
+	if len(opts.ContentType) > 0 {
+		createInput.ContentType = aws.String(opts.ContentType)
+	}
+	upload, err := awsClient.s3Client.CreateMultipartUpload(ctx, createInput)
+	if err != nil {
+		slog.Warn("Couldn't start multipart upload to external storage", "awsObjectKey", awsObjectKey, "bucketName", awsClient.connectionDetails.BucketName, "err", err)
+		return ObjectInfo{}, awsClient.wrapError(err)
+	}
+	// otherwise the uploaded parts are kept (and billed) until a lifecycle rule removes them
+	abort := func(err error) (ObjectInfo, error) {
+		slog.Warn("Aborting multipart upload to external storage", "awsObjectKey", awsObjectKey, "bucketName", awsClient.connectionDetails.BucketName, "err", err)
+		if _, abortErr := awsClient.s3Client.AbortMultipartUpload(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+			Bucket:   bucket,
+			Key:      aws.String(awsObjectKey),
+			UploadId: upload.UploadId,
+		}); abortErr != nil {
+			slog.Error("Couldn't abort multipart upload", "awsObjectKey", awsObjectKey, "uploadId", aws.ToString(upload.UploadId), "err", abortErr)
+		}
+		return ObjectInfo{}, awsClient.wrapError(err)
+	}
+
+	var parts []types.CompletedPart
+	var size int64
+	buffer := awsPartBuffers.Get().([]byte)
+	defer awsPartBuffers.Put(buffer)
+	for partNumber := int32(1); ; partNumber++ {
+		n, readErr := io.ReadFull(body, buffer)
+		if readErr == io.EOF && partNumber > 1 {
+			break
+		}
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return abort(readErr)
+		}
+		part, err := awsClient.s3Client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:        bucket,
+			Key:           aws.String(awsObjectKey),
+			UploadId:      upload.UploadId,
+			PartNumber:    aws.Int32(partNumber),
+			Body:          bytes.NewReader(buffer[:n]),
+			ContentLength: aws.Int64(int64(n)),
+		})
+		if err != nil {
+			return abort(err)
+		}
+		parts = append(parts, types.CompletedPart{ETag: part.ETag, PartNumber: aws.Int32(partNumber)})
+		size += int64(n)
+		if readErr != nil {
+			// last (incomplete) part
+			break
 		}
-		return "", err
 	}
-	defer result.Body.Close()
 
-	body, err := io.ReadAll(result.Body)
+	completeInput := &s3.CompleteMultipartUploadInput{
+		Bucket:          bucket,
+		Key:             aws.String(awsObjectKey),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	}
+	if len(opts.IfMatch) > 0 {
+		completeInput.IfMatch = aws.String(opts.IfMatch)
+	}
+	if opts.IfNoneMatch {
+		completeInput.IfNoneMatch = aws.String("*")
+	}
+	result, err := awsClient.s3Client.CompleteMultipartUpload(ctx, completeInput)
 	if err != nil {
-		slog.Warn("Couldn't read object from body", "awsObjectKey", awsObjectKey, "bucketName", awsClient.connectionDetails.BucketName, "err", err)
-		return "", err
+		return abort(err)
+	}
+	slog.Info("Uploaded object in parts", "awsObjectKey", awsObjectKey, "parts", len(parts), "size", size)
+	return ObjectInfo{Key: awsObjectKey, Size: size, ETag: aws.ToString(result.ETag), LastModified: time.Now()}, nil
+}
+
+func (awsClient *AWSClient) Delete(ctx context.Context, awsObjectKey string) error {
+	_, err := awsClient.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(awsClient.connectionDetails.BucketName),
+		Key:    aws.String(awsObjectKey),
+	})
+	if err != nil {
+		slog.Warn("Couldn't delete object from external storage", "awsObjectKey", awsObjectKey, "bucketName", awsClient.connectionDetails.BucketName, "err", err)
+		return awsClient.wrapError(err)
+	}
+	return nil
+}
+
+// maps the S3 specific "not found" and "precondition failed" errors to ErrNotFound and ErrPreconditionFailed
+func (awsClient *AWSClient) wrapError(err error) error {
+	var noKey *types.NoSuchKey
+	var notFound *types.NotFound
+	var responseError *awshttp.ResponseError
+	isResponseError := errors.As(err, &responseError)
+	if errors.As(err, &noKey) || errors.As(err, &notFound) || (isResponseError && responseError.HTTPStatusCode() == http.StatusNotFound) {
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+	// a concurrent conditional write is reported as 409 ConditionalRequestConflict
+	if isResponseError && (responseError.HTTPStatusCode() == http.StatusPreconditionFailed || responseError.HTTPStatusCode() == http.StatusConflict) {
+		return fmt.Errorf("%w: %w", ErrPreconditionFailed, err)
 	}
-	return string(body), nil
+	return err
 }
@@ -0,0 +1,119 @@
+package externalstorage
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// s3EventNotification is the message body of an S3 event notification (https://docs.aws.amazon.com/AmazonS3/latest/userguide/notification-content-structure.html)
+type s3EventNotification struct {
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+	// set for the test event S3 sends once the notification is configured
+	Event string `json:"Event"`
+}
+
+// snsNotification wraps the S3 event notification in case it is fanned out via SNS
+type snsNotification struct {
+	Type    string `json:"Type"`
+	Message string `json:"Message"`
+}
+
+func (awsClient *AWSClient) EventsEnabled() bool {
+	return awsClient.sqsClient != nil
+}
+
+// ConsumeEvents long-polls the configured SQS queue for S3 event notifications until ctx is done.
+// Messages are deleted from the queue once they were passed to onEvents.
+func (awsClient *AWSClient) ConsumeEvents(ctx context.Context, onEvents func(events []StorageEvent)) error {
+	queueUrl := aws.String(awsClient.connectionDetails.SqsQueueUrl)
+	slog.Info("Start consuming S3 event notifications", "queueUrl", awsClient.connectionDetails.SqsQueueUrl)
+	for ctx.Err() == nil {
+		output, err := awsClient.sqsClient.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            queueUrl,
+			MaxNumberOfMessages: 10,
+			WaitTimeSeconds:     20,
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			slog.Warn("Error while receiving S3 event notifications. Retrying in 10 seconds.", "queueUrl", awsClient.connectionDetails.SqsQueueUrl, "err", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(10 * time.Second):
+			}
+			continue
+		}
+		if len(output.Messages) == 0 {
+			continue
+		}
+		var events []StorageEvent
+		var receipts []sqstypes.DeleteMessageBatchRequestEntry
+		for _, message := range output.Messages {
+			events = append(events, awsClient.parseS3EventNotification(aws.ToString(message.Body))...)
+			receipts = append(receipts, sqstypes.DeleteMessageBatchRequestEntry{
+				Id:            message.MessageId,
+				ReceiptHandle: message.ReceiptHandle,
+			})
+		}
+		if len(events) > 0 {
+			onEvents(events)
+		}
+		if _, err := awsClient.sqsClient.DeleteMessageBatch(ctx, &sqs.DeleteMessageBatchInput{
+			QueueUrl: queueUrl,
+			Entries:  receipts,
+		}); err != nil {
+			slog.Warn("Error while deleting consumed S3 event notifications from queue", "queueUrl", awsClient.connectionDetails.SqsQueueUrl, "err", err)
+		}
+	}
+	slog.Info("Stopped consuming S3 event notifications")
+	return ctx.Err()
+}
+
+// parses the message body into storage events, ignoring test events and events of other buckets
+func (awsClient *AWSClient) parseS3EventNotification(body string) []StorageEvent {
+	var sns snsNotification
+	if err := json.Unmarshal([]byte(body), &sns); err == nil && sns.Type == "Notification" {
+		body = sns.Message
+	}
+	var notification s3EventNotification
+	if err := json.Unmarshal([]byte(body), &notification); err != nil {
+		slog.Warn("Could not parse S3 event notification. Ignoring it.", "body", body, "err", err)
+		return nil
+	}
+	if notification.Event == "s3:TestEvent" {
+		slog.Info("Received S3 test event notification")
+		return nil
+	}
+	var events []StorageEvent
+	for _, record := range notification.Records {
+		if record.S3.Bucket.Name != awsClient.connectionDetails.BucketName {
+			slog.Debug("Ignoring S3 event notification of other bucket", "bucketName", record.S3.Bucket.Name)
+			continue
+		}
+		// object keys are URL encoded (spaces as '+')
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			key = record.S3.Object.Key
+		}
+		events = append(events, StorageEvent{EventName: record.EventName, ObjectKey: key})
+	}
+	return events
+}
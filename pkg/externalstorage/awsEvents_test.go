@@ -0,0 +1,102 @@
+package externalstorage
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const objectCreatedNotification = `{"Records":[{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"firmware"},"object":{"key":"c8y-firmware-versions.json"}}},
+{"eventName":"ObjectRemoved:Delete","s3":{"bucket":{"name":"firmware"},"object":{"key":"my+folder/fw%201.zip"}}},
+{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"other"},"object":{"key":"c8y-firmware-info.json"}}}]}`
+
+func TestParseS3EventNotification(t *testing.T) {
+	awsClient := &AWSClient{connectionDetails: AwsConnectionDetails{BucketName: "firmware"}}
+
+	events := awsClient.parseS3EventNotification(objectCreatedNotification)
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events of bucket 'firmware', got %+v", events)
+	}
+	if events[0].ObjectKey != "c8y-firmware-versions.json" || events[0].EventName != "ObjectCreated:Put" {
+		t.Errorf("unexpected event: %+v", events[0])
+	}
+	if events[1].ObjectKey != "my folder/fw 1.zip" {
+		t.Errorf("expected object key to be URL decoded, got %q", events[1].ObjectKey)
+	}
+
+	sns := `{"Type":"Notification","Message":"{\"Records\":[{\"eventName\":\"ObjectCreated:Put\",\"s3\":{\"bucket\":{\"name\":\"firmware\"},\"object\":{\"key\":\"c8y-firmware-info.json\"}}}]}"}`
+	if events := awsClient.parseS3EventNotification(sns); len(events) != 1 || events[0].ObjectKey != "c8y-firmware-info.json" {
+		t.Errorf("expected event wrapped in SNS notification, got %+v", events)
+	}
+	if events := awsClient.parseS3EventNotification(`{"Event":"s3:TestEvent","Bucket":"firmware"}`); len(events) != 0 {
+		t.Errorf("expected test event to be ignored, got %+v", events)
+	}
+	if events := awsClient.parseS3EventNotification("not json"); len(events) != 0 {
+		t.Errorf("expected invalid message to be ignored, got %+v", events)
+	}
+}
+
+// Runs against a local SQS stand-in, e.g.:
+// docker run --rm -p 9324:9324 softwaremill/elasticmq-native
+// ELASTICMQ_ENDPOINT=http://localhost:9324 go test -run ConsumeEvents ./pkg/externalstorage/
+func TestConsumeEventsFromElasticMQ(t *testing.T) {
+	endpoint := os.Getenv("ELASTICMQ_ENDPOINT")
+	if len(endpoint) == 0 {
+		t.Skip("ELASTICMQ_ENDPOINT not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	sqsClient := sqs.New(sqs.Options{
+		Region:       "elasticmq",
+		BaseEndpoint: aws.String(endpoint),
+		Credentials:  credentials.NewStaticCredentialsProvider("x", "x", ""),
+	})
+	queue, err := sqsClient.CreateQueue(ctx, &sqs.CreateQueueInput{QueueName: aws.String("fw-events-" + time.Now().Format("150405"))})
+	if err != nil {
+		t.Fatalf("could not create queue: %s", err)
+	}
+	awsClient := &AWSClient{
+		sqsClient:         sqsClient,
+		connectionDetails: AwsConnectionDetails{BucketName: "firmware", SqsQueueUrl: aws.ToString(queue.QueueUrl)},
+	}
+	if _, err := sqsClient.SendMessage(ctx, &sqs.SendMessageInput{QueueUrl: queue.QueueUrl, MessageBody: aws.String(objectCreatedNotification)}); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+
+	received := make(chan []StorageEvent, 1)
+	consumeCtx, stop := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() {
+		done <- awsClient.ConsumeEvents(consumeCtx, func(events []StorageEvent) {
+			received <- events
+		})
+	}()
+	select {
+	case events := <-received:
+		if len(events) != 2 {
+			t.Errorf("expected 2 events, got %+v", events)
+		}
+	case <-ctx.Done():
+		t.Fatalf("no events received")
+	}
+	stop()
+	<-done
+
+	// consumed messages are deleted from the queue
+	attributes, err := sqsClient.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{QueueUrl: queue.QueueUrl, AttributeNames: []sqstypes.QueueAttributeName{"ApproximateNumberOfMessages", "ApproximateNumberOfMessagesNotVisible"}})
+	if err != nil {
+		t.Fatalf("could not read queue attributes: %s", err)
+	}
+	for name, value := range attributes.Attributes {
+		if value != "0" {
+			t.Errorf("expected queue to be empty, %s = %s", name, value)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package externalstorage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// minimal S3 stand-in for multipart uploads, records the size of the uploaded parts
+type fakeMultipartS3 struct {
+	mu        sync.Mutex
+	partSizes []int64
+	completed bool
+	aborted   bool
+	exists    bool
+}
+
+func (f *fakeMultipartS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		fmt.Fprint(w, `<InitiateMultipartUploadResult><Bucket>firmware</Bucket><Key>fw.bin</Key><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>`)
+	case r.Method == http.MethodPut && query.Has("partNumber"):
+		size := r.ContentLength
+		if decoded := r.Header.Get("X-Amz-Decoded-Content-Length"); len(decoded) > 0 {
+			size, _ = strconv.ParseInt(decoded, 10, 64)
+		}
+		io.Copy(io.Discard, r.Body)
+		f.partSizes = append(f.partSizes, size)
+		w.Header().Set("ETag", `"part-`+query.Get("partNumber")+`"`)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		if f.exists && r.Header.Get("If-None-Match") == "*" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			fmt.Fprint(w, `<Error><Code>PreconditionFailed</Code><Message>At least one of the pre-conditions you specified did not hold</Message></Error>`)
+			return
+		}
+		f.completed = true
+		fmt.Fprint(w, `<CompleteMultipartUploadResult><Bucket>firmware</Bucket><Key>fw.bin</Key><ETag>"multipart-2"</ETag></CompleteMultipartUploadResult>`)
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		f.aborted = true
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func TestAWSWriteMultipart(t *testing.T) {
+	fake := &fakeMultipartS3{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	awsClient := &AWSClient{
+		s3Client: s3.New(s3.Options{
+			Region:       "eu-central-1",
+			BaseEndpoint: aws.String(server.URL),
+			UsePathStyle: true,
+			Credentials:  credentials.NewStaticCredentialsProvider("x", "x", ""),
+		}),
+		connectionDetails: AwsConnectionDetails{BucketName: "firmware"},
+	}
+
+	// unknown size, uploaded in two parts
+	body := bytes.Repeat([]byte("x"), awsMultipartPartSize+10)
+	info, err := awsClient.Write(context.Background(), "fw.bin", bytes.NewReader(body), -1, WriteOptions{IfNoneMatch: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if info.Size != int64(len(body)) || info.ETag != `"multipart-2"` || !fake.completed {
+		t.Errorf("unexpected object %+v", info)
+	}
+	if len(fake.partSizes) != 2 || fake.partSizes[0] != awsMultipartPartSize || fake.partSizes[1] != 10 {
+		t.Errorf("unexpected parts %v", fake.partSizes)
+	}
+
+	// existing objects are not overwritten, the upload is aborted
+	fake.exists = true
+	if _, err := awsClient.Write(context.Background(), "fw.bin", bytes.NewReader([]byte("small")), -1, WriteOptions{IfNoneMatch: true}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("expected precondition to fail, got %v", err)
+	}
+	if !fake.aborted {
+		t.Error("expected multipart upload to be aborted")
+	}
+}
+
+func TestAWSWriteMultipartWaitsForUploadSlot(t *testing.T) {
+	fake := &fakeMultipartS3{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	awsClient := &AWSClient{
+		s3Client: s3.New(s3.Options{
+			Region:       "eu-central-1",
+			BaseEndpoint: aws.String(server.URL),
+			UsePathStyle: true,
+			Credentials:  credentials.NewStaticCredentialsProvider("x", "x", ""),
+		}),
+		connectionDetails: AwsConnectionDetails{BucketName: "firmware"},
+	}
+
+	// all slots taken by other uploads, the upload does not start before its context is done
+	var releases []func()
+	for range maxConcurrentPartUploads {
+		release, err := acquirePartUploadSlot(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		releases = append(releases, release)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := awsClient.Write(ctx, "fw.bin", bytes.NewReader([]byte("small")), -1, WriteOptions{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected upload to wait for a free slot, got %v", err)
+	}
+	if len(fake.partSizes) != 0 {
+		t.Errorf("expected no parts to be uploaded, got %v", fake.partSizes)
+	}
+
+	releases[0]()
+	if _, err := awsClient.Write(context.Background(), "fw.bin", bytes.NewReader([]byte("small")), -1, WriteOptions{}); err != nil {
+		t.Errorf("expected upload to start once a slot is released, got %v", err)
+	}
+	for _, release := range releases[1:] {
+		release()
+	}
+}
+
+func TestAWSPresignUpload(t *testing.T) {
+	s3Client := s3.New(s3.Options{
+		Region:      "eu-central-1",
+		Credentials: credentials.NewStaticCredentialsProvider("x", "x", ""),
+	})
+	awsClient := &AWSClient{
+		s3Client:          s3Client,
+		s3PresignClient:   s3.NewPresignClient(s3Client),
+		connectionDetails: AwsConnectionDetails{BucketName: "firmware"},
+		urlExpirationMins: 30,
+	}
+	upload, err := awsClient.PresignUpload(context.Background(), "uploads/fw 1/1.0.0/fw.bin", 1024)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if upload.Method != http.MethodPut || !strings.HasPrefix(upload.URL, "https://firmware.s3.eu-central-1.amazonaws.com/uploads/fw%201/1.0.0/fw.bin?") {
+		t.Errorf("unexpected upload %+v", upload)
+	}
+	// the condition and the size are signed, so the upload needs to send them
+	if upload.Headers["If-None-Match"] != "*" || upload.Headers["Content-Length"] != "1024" || len(upload.Headers["Host"]) > 0 {
+		t.Errorf("unexpected headers %v", upload.Headers)
+	}
+}
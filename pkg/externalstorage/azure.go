@@ -1,20 +1,23 @@
 package externalstorage
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"iter"
 	"log/slog"
+	"net/http"
+	"strings"
 	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	azblob "github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/sas"
-
-	"github.com/reubenmiller/go-c8y/pkg/c8y"
 )
 
 type AzClient struct {
@@ -29,35 +32,59 @@ type AzConnectionDetails struct {
 	ContainerName    string `json:"containerName"`
 }
 
-func (azureClient *AzClient) Init(ctx context.Context, client *c8y.Client, tenantOptionCategory string, tenantOptionKey string, urlExpirationMins int) error {
-	tenantOptionConnectionDetails, _, e := client.TenantOptions.GetOption(ctx, tenantOptionCategory, tenantOptionKey)
-	if e != nil {
-		slog.Error("Azure Credentials were not found in tenant options. Make sure a tenant option for category="+tenantOptionCategory+" and key="+tenantOptionKey+" exists and your service has READ access to tenant option. ", "err", e)
-		return e
-	}
+func init() {
+	RegisterProvider(Provider{
+		Name:      "azblob",
+		ConfigKey: "credentials.fwAzblobConnectionDetails",
+		NewConfig: func() ProviderConfig { return &AzConnectionDetails{} },
+		New: func(ctx context.Context, config ProviderConfig, settings ClientSettings) (ExternalStorageClient, error) {
+			return NewAzClient(*config.(*AzConnectionDetails), settings.UrlExpirationMins)
+		},
+	})
+}
 
-	var connectionDetails AzConnectionDetails
-	err := json.Unmarshal([]byte(tenantOptionConnectionDetails.Value), &connectionDetails)
-	if err != nil {
-		slog.Error("Error while unmarshalling tenantOption for azureConnectionDetails. Make sure the tenantoptions value aligns with documentation.", "err", e)
-		return err
-	}
-	if len(connectionDetails.ConnectionString) == 0 {
-		return errors.New("connection String could not be found in tenant option")
+func (d *AzConnectionDetails) Validate() error {
+	return requireFields("connectionString", d.ConnectionString, "containerName", d.ContainerName)
+}
+
+// Endpoints returns the blob endpoint of the connection string, either its BlobEndpoint or the one of the account
+func (d *AzConnectionDetails) Endpoints() ([]string, error) {
+	fields := make(map[string]string)
+	for _, field := range strings.Split(d.ConnectionString, ";") {
+		if key, value, ok := strings.Cut(strings.TrimSpace(field), "="); ok {
+			fields[strings.ToLower(key)] = value
+		}
 	}
-	if len(connectionDetails.ContainerName) == 0 {
-		return errors.New("container name could not be found in tenant option")
+	switch {
+	case len(fields["blobendpoint"]) > 0:
+		return []string{fields["blobendpoint"]}, nil
+	case strings.EqualFold(fields["usedevelopmentstorage"], "true"):
+		return []string{"http://127.0.0.1:10000/devstoreaccount1"}, nil
+	case len(fields["accountname"]) > 0:
+		protocol, suffix := fields["defaultendpointsprotocol"], fields["endpointsuffix"]
+		if len(protocol) == 0 {
+			protocol = "https"
+		}
+		if len(suffix) == 0 {
+			suffix = "core.windows.net"
+		}
+		return []string{protocol + "://" + fields["accountname"] + ".blob." + suffix}, nil
 	}
+	return nil, errors.New("connection string contains neither BlobEndpoint nor AccountName")
+}
 
-	azureClient.ConnectionDetails = connectionDetails
-	azureClient.urlExpirationMins = urlExpirationMins
-	azureClient.azBlobClient, err = azblob.NewClientFromConnectionString(connectionDetails.ConnectionString, nil)
+func NewAzClient(connectionDetails AzConnectionDetails, urlExpirationMins int) (*AzClient, error) {
+	azBlobClient, err := azblob.NewClientFromConnectionString(connectionDetails.ConnectionString, nil)
 	if err != nil {
-		slog.Error("Error while creating Azure Client from connection string. Make sure the connection string is set properly", "err", e)
-		return err
+		slog.Error("Error while creating Azure Client from connection string. Make sure the connection string is set properly", "err", err)
+		return nil, err
 	}
-	azureClient.azContainerClient = azureClient.azBlobClient.ServiceClient().NewContainerClient(connectionDetails.ContainerName)
-	return nil
+	return &AzClient{
+		azBlobClient:      azBlobClient,
+		azContainerClient: azBlobClient.ServiceClient().NewContainerClient(connectionDetails.ContainerName),
+		ConnectionDetails: connectionDetails,
+		urlExpirationMins: urlExpirationMins,
+	}, nil
 }
 
 func (azClient *AzClient) GetBucketName() string {
@@ -68,24 +95,39 @@ func (azClient *AzClient) GetProviderName() string {
 	return "azblob"
 }
 
-func (azClient *AzClient) ListBucketContent() {
-	containerName := azClient.ConnectionDetails.ContainerName
-	pager := azClient.azBlobClient.NewListBlobsFlatPager(containerName, &azblob.ListBlobsFlatOptions{
-		Include: azblob.ListBlobsInclude{Snapshots: true, Versions: true},
-	})
-	slog.Info("Bucket content:")
-	for pager.More() {
-		resp, err := pager.NextPage(context.TODO())
-		if err != nil {
-			slog.Error("Error when paging trough container list", "err", err)
-		}
-		for _, blob := range resp.Segment.BlobItems {
-			slog.Info(fmt.Sprintf("name=%s", *blob.Name))
+func (azClient *AzClient) List(ctx context.Context, prefix string) iter.Seq2[ObjectInfo, error] {
+	return func(yield func(ObjectInfo, error) bool) {
+		pager := azClient.azContainerClient.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{
+			Prefix: &prefix,
+		})
+		for pager.More() {
+			resp, err := pager.NextPage(ctx)
+			if err != nil {
+				yield(ObjectInfo{}, wrapAzError(err))
+				return
+			}
+			for _, item := range resp.Segment.BlobItems {
+				info := ObjectInfo{Key: *item.Name}
+				if props := item.Properties; props != nil {
+					if props.ContentLength != nil {
+						info.Size = *props.ContentLength
+					}
+					if props.ETag != nil {
+						info.ETag = string(*props.ETag)
+					}
+					if props.LastModified != nil {
+						info.LastModified = *props.LastModified
+					}
+				}
+				if !yield(info, nil) {
+					return
+				}
+			}
 		}
 	}
 }
 
-func (azClient *AzClient) GetPresignedURL(azObjectFileName string) (string, error) {
+func (azClient *AzClient) GetPresignedURL(ctx context.Context, azObjectFileName string) (string, error) {
 	cc := azClient.azContainerClient
 	start := time.Now()
 	sasurl, err := cc.NewBlobClient(azObjectFileName).GetSASURL(
@@ -101,21 +143,113 @@ func (azClient *AzClient) GetPresignedURL(azObjectFileName string) (string, erro
 	return sasurl, nil
 }
 
-func (azClient *AzClient) GetFileContent(azObjectFileName string) (string, error) {
-	get, err := azClient.azBlobClient.DownloadStream(context.TODO(), azClient.ConnectionDetails.ContainerName, azObjectFileName, nil)
+// the SAS only permits creating the blob (not overwriting it). The size can't be enforced by the SAS, it needs to be checked
+// once the upload is completed.
+func (azClient *AzClient) PresignUpload(ctx context.Context, azObjectFileName string, size int64) (PresignedUpload, error) {
+	start := time.Now()
+	expiresAt := start.Add(time.Minute * time.Duration(azClient.urlExpirationMins))
+	sasurl, err := azClient.azContainerClient.NewBlobClient(azObjectFileName).GetSASURL(
+		sas.BlobPermissions{Create: true},
+		expiresAt,
+		&blob.GetSASURLOptions{
+			StartTime: &start,
+		},
+	)
 	if err != nil {
-		return "", err
+		return PresignedUpload{}, err
 	}
+	// a single Put Blob request, If-None-Match prevents overwriting existing blobs
+	return PresignedUpload{
+		URL:       sasurl,
+		Method:    http.MethodPut,
+		Headers:   map[string]string{"x-ms-blob-type": "BlockBlob", "If-None-Match": "*"},
+		ExpiresAt: expiresAt,
+	}, nil
+}
 
-	downloadedData := bytes.Buffer{}
-	retryReader := get.NewRetryReader(context.TODO(), &azblob.RetryReaderOptions{})
-	if _, err = downloadedData.ReadFrom(retryReader); err != nil {
-		return "", err
+func (azClient *AzClient) Open(ctx context.Context, azObjectFileName string) (io.ReadCloser, error) {
+	get, err := azClient.azBlobClient.DownloadStream(ctx, azClient.ConnectionDetails.ContainerName, azObjectFileName, nil)
+	if err != nil {
+		slog.Warn("Couldn't get blob from external storage", "blobName", azObjectFileName, "containerName", azClient.ConnectionDetails.ContainerName, "err", err)
+		return nil, wrapAzError(err)
 	}
+	return get.NewRetryReader(ctx, &azblob.RetryReaderOptions{}), nil
+}
 
-	if err = retryReader.Close(); err != nil {
-		return "", err
+func (azClient *AzClient) Stat(ctx context.Context, azObjectFileName string) (ObjectInfo, error) {
+	props, err := azClient.azContainerClient.NewBlobClient(azObjectFileName).GetProperties(ctx, nil)
+	if err != nil {
+		slog.Warn("Couldn't get blob properties from external storage", "blobName", azObjectFileName, "containerName", azClient.ConnectionDetails.ContainerName, "err", err)
+		return ObjectInfo{}, wrapAzError(err)
+	}
+	info := ObjectInfo{Key: azObjectFileName}
+	if props.ContentLength != nil {
+		info.Size = *props.ContentLength
+	}
+	if props.ETag != nil {
+		info.ETag = string(*props.ETag)
 	}
+	if props.LastModified != nil {
+		info.LastModified = *props.LastModified
+	}
+	return info, nil
+}
+
+// each block is buffered in memory while uploading
+const azBlockSize = 8 * 1024 * 1024
 
-	return downloadedData.String(), nil
+func (azClient *AzClient) Write(ctx context.Context, azObjectFileName string, body io.Reader, size int64, opts WriteOptions) (ObjectInfo, error) {
+	uploadOptions := &azblob.UploadStreamOptions{
+		// max. 50000 blocks per blob, so this allows blobs up to ~390GiB
+		BlockSize:        azBlockSize,
+		AccessConditions: &blob.AccessConditions{ModifiedAccessConditions: &blob.ModifiedAccessConditions{}},
+	}
+	if len(opts.IfMatch) > 0 {
+		uploadOptions.AccessConditions.ModifiedAccessConditions.IfMatch = to.Ptr(azcore.ETag(opts.IfMatch))
+	}
+	if opts.IfNoneMatch {
+		uploadOptions.AccessConditions.ModifiedAccessConditions.IfNoneMatch = to.Ptr(azcore.ETagAny)
+	}
+	if len(opts.ContentType) > 0 {
+		uploadOptions.HTTPHeaders = &blob.HTTPHeaders{BlobContentType: to.Ptr(opts.ContentType)}
+	}
+	release, err := acquirePartUploadSlot(ctx)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer release()
+	result, err := azClient.azBlobClient.UploadStream(ctx, azClient.ConnectionDetails.ContainerName, azObjectFileName, body, uploadOptions)
+	if err != nil {
+		slog.Warn("Couldn't write blob to external storage", "blobName", azObjectFileName, "containerName", azClient.ConnectionDetails.ContainerName, "err", err)
+		return ObjectInfo{}, wrapAzError(err)
+	}
+	info := ObjectInfo{Key: azObjectFileName, Size: size, LastModified: time.Now()}
+	if result.ETag != nil {
+		info.ETag = string(*result.ETag)
+	}
+	if result.LastModified != nil {
+		info.LastModified = *result.LastModified
+	}
+	return info, nil
+}
+
+func (azClient *AzClient) Delete(ctx context.Context, azObjectFileName string) error {
+	_, err := azClient.azBlobClient.DeleteBlob(ctx, azClient.ConnectionDetails.ContainerName, azObjectFileName, nil)
+	if err != nil && !bloberror.HasCode(err, bloberror.BlobNotFound) {
+		slog.Warn("Couldn't delete blob from external storage", "blobName", azObjectFileName, "containerName", azClient.ConnectionDetails.ContainerName, "err", err)
+		return wrapAzError(err)
+	}
+	return nil
+}
+
+// maps the Azure specific "not found" and "condition not met" errors to ErrNotFound and ErrPreconditionFailed
+func wrapAzError(err error) error {
+	var responseError *azcore.ResponseError
+	if bloberror.HasCode(err, bloberror.BlobNotFound, bloberror.ContainerNotFound) || (errors.As(err, &responseError) && responseError.StatusCode == http.StatusNotFound) {
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+	if bloberror.HasCode(err, bloberror.ConditionNotMet, bloberror.BlobAlreadyExists) || (responseError != nil && responseError.StatusCode == http.StatusPreconditionFailed) {
+		return fmt.Errorf("%w: %w", ErrPreconditionFailed, err)
+	}
+	return err
 }
@@ -0,0 +1,33 @@
+package externalstorage
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestAzPresignUpload(t *testing.T) {
+	azClient, err := NewAzClient(AzConnectionDetails{
+		ConnectionString: "DefaultEndpointsProtocol=https;AccountName=firmware;AccountKey=c2VjcmV0;EndpointSuffix=core.windows.net",
+		ContainerName:    "images",
+	}, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload, err := azClient.PresignUpload(context.Background(), "uploads/fw-1/1.0.0/fw.bin", 1024)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	sasUrl, err := url.Parse(upload.URL)
+	if err != nil || upload.Method != http.MethodPut || sasUrl.Path != "/images/uploads/fw-1/1.0.0/fw.bin" {
+		t.Fatalf("unexpected upload %+v", upload)
+	}
+	// create only, existing blobs can't be overwritten with the SAS
+	if permissions := sasUrl.Query().Get("sp"); permissions != "c" {
+		t.Errorf("expected SAS to only permit creating the blob, got permissions %q", permissions)
+	}
+	if upload.Headers["If-None-Match"] != "*" || upload.Headers["x-ms-blob-type"] != "BlockBlob" {
+		t.Errorf("unexpected headers %v", upload.Headers)
+	}
+}
@@ -2,19 +2,150 @@ package externalstorage
 
 import (
 	"context"
-
-	"github.com/reubenmiller/go-c8y/pkg/c8y"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"time"
 )
 
+// ErrNotFound is returned (wrapped) if the requested object does not exist in the external storage
+var ErrNotFound = errors.New("object not found")
+
+// ErrPreconditionFailed is returned (wrapped) by Write if the condition of the WriteOptions is not met, e.g. the object was
+// changed concurrently
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// ObjectInfo describes an object of the external storage
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+}
+
+// WriteOptions are the conditions of a write, used for optimistic concurrency
+type WriteOptions struct {
+	// only replace the object if its ETag matches (as returned by Stat or List)
+	IfMatch string
+	// only create the object if it doesn't exist yet
+	IfNoneMatch bool
+	ContentType string
+}
+
+// PresignedUpload is a presigned request that uploads an object directly to the storage, without passing the service
+type PresignedUpload struct {
+	URL    string `json:"url"`
+	Method string `json:"method"`
+	// headers the upload request needs to contain
+	Headers   map[string]string `json:"headers,omitempty"`
+	ExpiresAt time.Time         `json:"expiresAt"`
+}
+
+// max. number of uploads buffering parts in memory at the same time (per process), further uploads wait for a free slot
+const maxConcurrentPartUploads = 4
+
+var partUploadSlots = make(chan struct{}, maxConcurrentPartUploads)
+
+// acquirePartUploadSlot blocks until an upload buffering parts in memory may start (or ctx is done), the returned function
+// releases the slot again
+func acquirePartUploadSlot(ctx context.Context) (func(), error) {
+	select {
+	case partUploadSlots <- struct{}{}:
+		return func() { <-partUploadSlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// ExternalStorageClient is the client of a storage provider, clients are created via the provider registry (see RegisterProvider)
 type ExternalStorageClient interface {
-	Init(ctx context.Context, client *c8y.Client, tenantOptionCategory string, tenantOptionKey string, urlExpirationMins int) error
-	GetFileContent(awsObjectKey string) (string, error)
-	GetPresignedURL(awsObjectKey string) (string, error)
-	ListBucketContent()
+	// Open returns a stream of the object contents, the caller needs to close it
+	Open(ctx context.Context, objectKey string) (io.ReadCloser, error)
+	// Stat returns the metadata of the object without downloading it
+	Stat(ctx context.Context, objectKey string) (ObjectInfo, error)
+	// List iterates over all objects whose key starts with prefix, pages are requested while iterating.
+	// Iteration stops after the first error.
+	List(ctx context.Context, prefix string) iter.Seq2[ObjectInfo, error]
+	// Write creates or replaces the object with the size bytes of body, size is -1 if unknown. Large bodies (and bodies of
+	// unknown size) are uploaded in parts, without buffering the whole body. Returns ErrPreconditionFailed if the conditions
+	// of opts are not met.
+	Write(ctx context.Context, objectKey string, body io.Reader, size int64, opts WriteOptions) (ObjectInfo, error)
+	// Delete removes the object, deleting a missing object is no error
+	Delete(ctx context.Context, objectKey string) error
+	GetPresignedURL(ctx context.Context, objectKey string) (string, error)
+	// PresignUpload returns a presigned request creating the object of the given size, it fails if the object already exists
+	PresignUpload(ctx context.Context, objectKey string, size int64) (PresignedUpload, error)
 	GetBucketName() string
 	GetProviderName() string
 }
 
-func ListBucketContent(esc ExternalStorageClient) {
-	esc.ListBucketContent()
+// ErrObjectTooLarge is returned (wrapped) when reading an object exceeding the read limit of the client, see WithReadLimit
+var ErrObjectTooLarge = errors.New("object too large")
+
+// readLimitedClient fails reading objects exceeding maxSize bytes, all other methods are passed on unchanged
+type readLimitedClient struct {
+	ExternalStorageClient
+	maxSize int64
+}
+
+// WithReadLimit returns the client failing to read objects larger than maxSize bytes, e.g. to read the index files of
+// untrusted sources without loading arbitrarily large objects into memory
+func WithReadLimit(client ExternalStorageClient, maxSize int64) ExternalStorageClient {
+	return &readLimitedClient{ExternalStorageClient: client, maxSize: maxSize}
+}
+
+func (l *readLimitedClient) Open(ctx context.Context, objectKey string) (io.ReadCloser, error) {
+	reader, err := l.ExternalStorageClient.Open(ctx, objectKey)
+	if err != nil {
+		return nil, err
+	}
+	return &limitedReadCloser{ReadCloser: reader, remaining: l.maxSize, objectKey: objectKey}, nil
+}
+
+type limitedReadCloser struct {
+	io.ReadCloser
+	remaining int64
+	objectKey string
+}
+
+func (r *limitedReadCloser) Read(p []byte) (int, error) {
+	// reads one byte beyond the limit to tell an object of exactly the max. size from a larger one
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if r.remaining -= int64(n); r.remaining < 0 {
+		return 0, fmt.Errorf("%s: %w", r.objectKey, ErrObjectTooLarge)
+	}
+	return n, err
+}
+
+// ReadObjectAsString reads the whole object, meant for small objects like the index files
+func ReadObjectAsString(ctx context.Context, esc ExternalStorageClient, objectKey string) (string, error) {
+	reader, err := esc.Open(ctx, objectKey)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// StorageEvent describes a change of an object in the external storage
+type StorageEvent struct {
+	// e.g. ObjectCreated:Put or ObjectRemoved:Delete
+	EventName string
+	ObjectKey string
+}
+
+// ChangeNotifier is implemented by storage clients that are able to notify about changed objects (instead of being polled)
+type ChangeNotifier interface {
+	// EventsEnabled returns true if change notifications are configured for the client
+	EventsEnabled() bool
+	// ConsumeEvents blocks and passes the received events to onEvents until ctx is done
+	ConsumeEvents(ctx context.Context, onEvents func(events []StorageEvent)) error
 }
@@ -0,0 +1,207 @@
+package externalstorage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"iter"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryClient is a storage client keeping all objects in memory. It is meant as test double for unit and integration tests.
+type MemoryClient struct {
+	mu                sync.RWMutex
+	objects           map[string]memoryObject
+	connectionDetails MemoryConnectionDetails
+	urlExpirationMins int
+}
+
+type memoryObject struct {
+	content      []byte
+	etag         string
+	lastModified time.Time
+}
+
+type MemoryConnectionDetails struct {
+	BucketName string `json:"bucketName"`
+	// base URL of the presigned URLs, e.g. of a test server serving the objects. Optional.
+	BaseUrl string `json:"baseUrl,omitempty"`
+	// objects the storage is initialized with (object key -> content). Optional.
+	Objects map[string]string `json:"objects,omitempty"`
+}
+
+var registerMemoryProviderOnce sync.Once
+
+// RegisterMemoryProvider registers the memory provider (name "memory"). The service does not register it, so it is only available
+// to tests calling this function. Calling it more than once has no effect.
+func RegisterMemoryProvider() {
+	registerMemoryProviderOnce.Do(func() {
+		RegisterProvider(Provider{
+			Name:           "memory",
+			ConfigKey:      "fwMemoryConnectionDetails",
+			ConfigOptional: true,
+			NewConfig: func() ProviderConfig {
+				return &MemoryConnectionDetails{BucketName: "memory", BaseUrl: "memory://memory"}
+			},
+			New: func(ctx context.Context, config ProviderConfig, settings ClientSettings) (ExternalStorageClient, error) {
+				return NewMemoryClient(*config.(*MemoryConnectionDetails), settings.UrlExpirationMins), nil
+			},
+		})
+	})
+}
+
+func (d *MemoryConnectionDetails) Validate() error {
+	if err := requireFields("bucketName", d.BucketName); err != nil {
+		return err
+	}
+	if len(d.BaseUrl) > 0 {
+		if _, err := url.Parse(d.BaseUrl); err != nil {
+			return fmt.Errorf("invalid baseUrl: %w", err)
+		}
+	}
+	return nil
+}
+
+func NewMemoryClient(connectionDetails MemoryConnectionDetails, urlExpirationMins int) *MemoryClient {
+	client := &MemoryClient{
+		objects:           make(map[string]memoryObject),
+		connectionDetails: connectionDetails,
+		urlExpirationMins: urlExpirationMins,
+	}
+	for key, content := range connectionDetails.Objects {
+		client.Put(key, []byte(content))
+	}
+	return client
+}
+
+// Put creates or replaces an object
+func (m *MemoryClient) Put(objectKey string, content []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.put(objectKey, content)
+}
+
+func (m *MemoryClient) put(objectKey string, content []byte) memoryObject {
+	hash := md5.Sum(content)
+	object := memoryObject{
+		content:      slices.Clone(content),
+		etag:         `"` + hex.EncodeToString(hash[:]) + `"`,
+		lastModified: time.Now(),
+	}
+	m.objects[objectKey] = object
+	return object
+}
+
+func (m *MemoryClient) Write(ctx context.Context, objectKey string, body io.Reader, size int64, opts WriteOptions) (ObjectInfo, error) {
+	if size >= 0 {
+		body = io.LimitReader(body, size)
+	}
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing, exists := m.objects[objectKey]
+	if opts.IfNoneMatch && exists {
+		return ObjectInfo{}, fmt.Errorf("%w: %s already exists", ErrPreconditionFailed, objectKey)
+	}
+	if len(opts.IfMatch) > 0 && (!exists || existing.etag != opts.IfMatch) {
+		return ObjectInfo{}, fmt.Errorf("%w: ETag of %s does not match %s", ErrPreconditionFailed, objectKey, opts.IfMatch)
+	}
+	object := m.put(objectKey, content)
+	return ObjectInfo{Key: objectKey, Size: int64(len(content)), ETag: object.etag, LastModified: object.lastModified}, nil
+}
+
+func (m *MemoryClient) Delete(ctx context.Context, objectKey string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, objectKey)
+	return nil
+}
+
+func (m *MemoryClient) get(objectKey string) (memoryObject, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	object, ok := m.objects[objectKey]
+	if !ok {
+		return memoryObject{}, fmt.Errorf("%w: %s", ErrNotFound, objectKey)
+	}
+	return object, nil
+}
+
+func (m *MemoryClient) Open(ctx context.Context, objectKey string) (io.ReadCloser, error) {
+	object, err := m.get(objectKey)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(strings.NewReader(string(object.content))), nil
+}
+
+func (m *MemoryClient) Stat(ctx context.Context, objectKey string) (ObjectInfo, error) {
+	object, err := m.get(objectKey)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Key: objectKey, Size: int64(len(object.content)), ETag: object.etag, LastModified: object.lastModified}, nil
+}
+
+func (m *MemoryClient) List(ctx context.Context, prefix string) iter.Seq2[ObjectInfo, error] {
+	return func(yield func(ObjectInfo, error) bool) {
+		m.mu.RLock()
+		var keys []string
+		for key := range m.objects {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		m.mu.RUnlock()
+		slices.Sort(keys)
+		for _, key := range keys {
+			if err := ctx.Err(); err != nil {
+				yield(ObjectInfo{}, err)
+				return
+			}
+			info, err := m.Stat(ctx, key)
+			if err != nil {
+				// deleted while iterating
+				continue
+			}
+			if !yield(info, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (m *MemoryClient) GetPresignedURL(ctx context.Context, objectKey string) (string, error) {
+	expires := time.Now().Add(time.Duration(m.urlExpirationMins) * time.Minute).Unix()
+	return fmt.Sprintf("%s/%s?expires=%d", strings.TrimSuffix(m.connectionDetails.BaseUrl, "/"), (&url.URL{Path: objectKey}).EscapedPath(), expires), nil
+}
+
+// PresignUpload returns a URL below the base URL, uploads need to be simulated via Put
+func (m *MemoryClient) PresignUpload(ctx context.Context, objectKey string, size int64) (PresignedUpload, error) {
+	expiresAt := time.Now().Add(time.Duration(m.urlExpirationMins) * time.Minute)
+	return PresignedUpload{
+		URL:       fmt.Sprintf("%s/%s?upload=true&expires=%d", strings.TrimSuffix(m.connectionDetails.BaseUrl, "/"), (&url.URL{Path: objectKey}).EscapedPath(), expiresAt.Unix()),
+		Method:    http.MethodPut,
+		Headers:   map[string]string{"If-None-Match": "*", "Content-Length": strconv.FormatInt(size, 10)},
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+func (m *MemoryClient) GetBucketName() string {
+	return m.connectionDetails.BucketName
+}
+
+func (m *MemoryClient) GetProviderName() string {
+	return "memory"
+}
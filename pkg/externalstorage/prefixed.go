@@ -0,0 +1,93 @@
+package externalstorage
+
+import (
+	"context"
+	"io"
+	"iter"
+	"strings"
+)
+
+// PrefixedClient scopes a client to the objects below a prefix (e.g. "prod/"). Object keys are resolved relative to the
+// prefix, the keys of returned objects are relative as well. Change notifications are passed on unchanged (absolute keys).
+type PrefixedClient struct {
+	client ExternalStorageClient
+	prefix string
+}
+
+// WithPrefix returns the client scoped to prefix, the client itself if prefix is empty
+func WithPrefix(client ExternalStorageClient, prefix string) ExternalStorageClient {
+	if len(prefix) == 0 {
+		return client
+	}
+	return &PrefixedClient{client: client, prefix: prefix}
+}
+
+// Unwrap returns the client addressing the whole bucket, the client itself if it is not scoped to a prefix
+func Unwrap(client ExternalStorageClient) ExternalStorageClient {
+	if prefixed, ok := client.(*PrefixedClient); ok {
+		return prefixed.client
+	}
+	return client
+}
+
+func (p *PrefixedClient) relative(info ObjectInfo) ObjectInfo {
+	info.Key = strings.TrimPrefix(info.Key, p.prefix)
+	return info
+}
+
+func (p *PrefixedClient) Open(ctx context.Context, objectKey string) (io.ReadCloser, error) {
+	return p.client.Open(ctx, p.prefix+objectKey)
+}
+
+func (p *PrefixedClient) Stat(ctx context.Context, objectKey string) (ObjectInfo, error) {
+	info, err := p.client.Stat(ctx, p.prefix+objectKey)
+	return p.relative(info), err
+}
+
+func (p *PrefixedClient) List(ctx context.Context, prefix string) iter.Seq2[ObjectInfo, error] {
+	return func(yield func(ObjectInfo, error) bool) {
+		for info, err := range p.client.List(ctx, p.prefix+prefix) {
+			if !yield(p.relative(info), err) {
+				return
+			}
+		}
+	}
+}
+
+func (p *PrefixedClient) Write(ctx context.Context, objectKey string, body io.Reader, size int64, opts WriteOptions) (ObjectInfo, error) {
+	info, err := p.client.Write(ctx, p.prefix+objectKey, body, size, opts)
+	return p.relative(info), err
+}
+
+func (p *PrefixedClient) Delete(ctx context.Context, objectKey string) error {
+	return p.client.Delete(ctx, p.prefix+objectKey)
+}
+
+func (p *PrefixedClient) GetPresignedURL(ctx context.Context, objectKey string) (string, error) {
+	return p.client.GetPresignedURL(ctx, p.prefix+objectKey)
+}
+
+func (p *PrefixedClient) PresignUpload(ctx context.Context, objectKey string, size int64) (PresignedUpload, error) {
+	return p.client.PresignUpload(ctx, p.prefix+objectKey, size)
+}
+
+func (p *PrefixedClient) GetBucketName() string {
+	return p.client.GetBucketName()
+}
+
+func (p *PrefixedClient) GetProviderName() string {
+	return p.client.GetProviderName()
+}
+
+func (p *PrefixedClient) EventsEnabled() bool {
+	notifier, ok := p.client.(ChangeNotifier)
+	return ok && notifier.EventsEnabled()
+}
+
+func (p *PrefixedClient) ConsumeEvents(ctx context.Context, onEvents func(events []StorageEvent)) error {
+	if notifier, ok := p.client.(ChangeNotifier); ok {
+		return notifier.ConsumeEvents(ctx, onEvents)
+	}
+	<-ctx.Done()
+	return nil
+}
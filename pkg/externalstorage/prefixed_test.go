@@ -0,0 +1,51 @@
+package externalstorage
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestPrefixedClient(t *testing.T) {
+	ctx := context.Background()
+	memory := NewMemoryClient(MemoryConnectionDetails{BucketName: "shared", BaseUrl: "https://storage.example.com", Objects: map[string]string{
+		"prod/fw/1.0.0.zip":    "prod",
+		"staging/fw/1.0.0.zip": "staging",
+	}}, 5)
+	source := NewSource("prod", memory, IndexLayout{Prefix: "/prod"})
+	if source.Prefix != "prod/" || source.VersionsFileName() != "c8y-firmware-versions.json" {
+		t.Errorf("unexpected layout %+v", source.IndexLayout)
+	}
+
+	if content, err := ReadObjectAsString(ctx, source.Client, "fw/1.0.0.zip"); err != nil || content != "prod" {
+		t.Errorf("expected content of prod object, got %q (%v)", content, err)
+	}
+	var keys []string
+	for info, err := range source.Client.List(ctx, "") {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		keys = append(keys, info.Key)
+	}
+	if strings.Join(keys, ",") != "fw/1.0.0.zip" {
+		t.Errorf("expected relative keys of the prefix only, got %v", keys)
+	}
+	if info, err := source.Client.Write(ctx, "fw/1.0.1.zip", strings.NewReader("v2"), 2, WriteOptions{IfNoneMatch: true}); err != nil || info.Key != "fw/1.0.1.zip" {
+		t.Errorf("unexpected write result %+v (%v)", info, err)
+	}
+	if _, err := memory.Stat(ctx, "prod/fw/1.0.1.zip"); err != nil {
+		t.Errorf("expected object to be written below the prefix, got %v", err)
+	}
+	if url, _ := source.Client.GetPresignedURL(ctx, "fw/1.0.0.zip"); !strings.HasPrefix(url, "https://storage.example.com/prod/fw/1.0.0.zip?") {
+		t.Errorf("unexpected presigned URL %s", url)
+	}
+	if Unwrap(source.Client) != memory || Unwrap(memory) != memory {
+		t.Error("expected unwrapped client to address the whole bucket")
+	}
+	if relativeKey, ok := source.RelativeKey("prod/c8y-firmware-info.json"); !ok || relativeKey != "c8y-firmware-info.json" {
+		t.Errorf("unexpected relative key %s", relativeKey)
+	}
+	if _, ok := source.RelativeKey("staging/c8y-firmware-info.json"); ok {
+		t.Error("expected key of other prefix not to be relative to the source")
+	}
+}
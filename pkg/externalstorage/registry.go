@@ -0,0 +1,128 @@
+package externalstorage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+)
+
+// ProviderConfig is the (JSON) connection details of a storage provider
+type ProviderConfig interface {
+	// Validate returns a descriptive error if mandatory fields are missing or invalid
+	Validate() error
+}
+
+// EndpointConfig is implemented by the connection details of providers connecting to endpoints derived from them (e.g. custom
+// endpoints), so the connection details of untrusted sources can be validated before a client is created
+type EndpointConfig interface {
+	// Endpoints returns the URLs the client connects to
+	Endpoints() ([]string, error)
+}
+
+// ClientSettings are the provider independent settings of a storage client
+type ClientSettings struct {
+	UrlExpirationMins int
+}
+
+// Provider describes a storage provider and how its clients are created
+type Provider struct {
+	// value of the fwStorageProvider tenant option selecting this provider
+	Name string
+	// tenant option key (within the service category) holding the JSON connection details
+	ConfigKey string
+	// if true, the provider is created with the defaults of NewConfig if the tenant option is missing
+	ConfigOptional bool
+	// returns a pointer to a new config struct (incl. defaults) the tenant option is unmarshalled into
+	NewConfig func() ProviderConfig
+	// creates a client from the validated config
+	New func(ctx context.Context, config ProviderConfig, settings ClientSettings) (ExternalStorageClient, error)
+}
+
+var (
+	providersMu sync.RWMutex
+	providers   = make(map[string]Provider)
+)
+
+// RegisterProvider makes a provider available by its name. It panics if a provider with the same name is registered twice.
+func RegisterProvider(provider Provider) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	if _, exists := providers[provider.Name]; exists {
+		panic("storage provider registered twice: " + provider.Name)
+	}
+	providers[provider.Name] = provider
+}
+
+func GetProvider(name string) (Provider, bool) {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	provider, ok := providers[name]
+	return provider, ok
+}
+
+// ProviderNames returns the names of all registered providers (sorted)
+func ProviderNames() []string {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	return slices.Sorted(maps.Keys(providers))
+}
+
+// ParseConfig unmarshals and validates the connection details of the provider
+func (p Provider) ParseConfig(value string) (ProviderConfig, error) {
+	config := p.NewConfig()
+	if err := json.Unmarshal([]byte(value), config); err != nil {
+		return nil, fmt.Errorf("connection details of storage provider '%s' (tenant option %s) are no valid JSON: %w", p.Name, p.ConfigKey, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid connection details of storage provider '%s' (tenant option %s): %w", p.Name, p.ConfigKey, err)
+	}
+	return config, nil
+}
+
+// NewClientFromTenantOptions creates the client of the named provider. Its connection details are read from the tenant options
+// (category tenantOptionCategory) and validated before the client is created.
+func NewClientFromTenantOptions(ctx context.Context, client *c8y.Client, tenantOptionCategory string, providerName string, settings ClientSettings) (ExternalStorageClient, error) {
+	provider, ok := GetProvider(providerName)
+	if !ok {
+		return nil, fmt.Errorf("unsupported storage provider '%s', supported providers are %v", providerName, ProviderNames())
+	}
+	var config ProviderConfig
+	option, resp, err := client.TenantOptions.GetOption(ctx, tenantOptionCategory, provider.ConfigKey)
+	switch {
+	case err == nil:
+		if config, err = provider.ParseConfig(option.Value); err != nil {
+			return nil, err
+		}
+	// only a missing option falls back to the defaults, other errors (e.g. missing permissions) would hide the configured provider
+	case provider.ConfigOptional && resp != nil && resp.StatusCode() == http.StatusNotFound:
+		slog.Info("No connection details found for storage provider, using defaults", "provider", provider.Name, "tenantOptionKey", provider.ConfigKey)
+		config = provider.NewConfig()
+	default:
+		return nil, fmt.Errorf("connection details of storage provider '%s' could not be read. Make sure a tenant option for category=%s and key=%s exists and the service has READ access to tenant options: %w",
+			provider.Name, tenantOptionCategory, provider.ConfigKey, err)
+	}
+	slog.Info("Initializing storage client", "provider", provider.Name)
+	return provider.New(ctx, config, settings)
+}
+
+// returns an error naming all missing mandatory fields (given as json field name/value pairs)
+func requireFields(fields ...string) error {
+	var missing []string
+	for i := 0; i+1 < len(fields); i += 2 {
+		if len(fields[i+1]) == 0 {
+			missing = append(missing, fields[i])
+		}
+	}
+	if len(missing) > 0 {
+		return errors.New("missing mandatory fields " + fmt.Sprint(missing))
+	}
+	return nil
+}
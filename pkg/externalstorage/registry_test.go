@@ -0,0 +1,102 @@
+package externalstorage
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/kobu/c8y-devmgmt-repo-intgr/internal/c8ytest"
+)
+
+func init() {
+	RegisterMemoryProvider()
+}
+
+func TestParseProviderConfig(t *testing.T) {
+	for _, name := range []string{"awsS3", "azblob", "memory"} {
+		if _, ok := GetProvider(name); !ok {
+			t.Errorf("expected provider %s to be registered", name)
+		}
+	}
+
+	aws, _ := GetProvider("awsS3")
+	if _, err := aws.ParseConfig(`{"region": "eu-central-1", "bucketName": "firmware"}`); err == nil ||
+		!strings.Contains(err.Error(), "accessKeyID") || !strings.Contains(err.Error(), "secretAccessKey") {
+		t.Errorf("expected error naming the missing fields, got %v", err)
+	}
+	if _, err := aws.ParseConfig(`{"region": `); err == nil || !strings.Contains(err.Error(), "no valid JSON") {
+		t.Errorf("expected JSON error, got %v", err)
+	}
+	config, err := aws.ParseConfig(`{"region": "eu-central-1", "bucketName": "firmware", "accessKeyID": "id", "secretAccessKey": "secret"}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if details := config.(*AwsConnectionDetails); details.BucketName != "firmware" {
+		t.Errorf("unexpected config: %+v", details)
+	}
+}
+
+func TestNewClientFromTenantOptions(t *testing.T) {
+	ctx := context.Background()
+	fake := c8ytest.NewServer(t, "t100", "c8y-devmgmt-repo-intgr")
+	client := fake.NewClient()
+
+	// optional connection details fall back to the defaults if the tenant option does not exist
+	storage, err := NewClientFromTenantOptions(ctx, client, "c8y-devmgmt-repo-intgr", "memory", ClientSettings{})
+	if err != nil || storage.GetBucketName() != "memory" {
+		t.Fatalf("expected memory client with default config, got %v (%v)", storage, err)
+	}
+	fake.SetOption("t100", "c8y-devmgmt-repo-intgr", "fwMemoryConnectionDetails", `{"bucketName": "firmware"}`)
+	if storage, err := NewClientFromTenantOptions(ctx, client, "c8y-devmgmt-repo-intgr", "memory", ClientSettings{}); err != nil || storage.GetBucketName() != "firmware" {
+		t.Errorf("expected memory client with configured bucket, got %v (%v)", storage, err)
+	}
+
+	// other errors than a missing tenant option are returned instead of falling back to the defaults
+	fake.SetRequestHook(func(w http.ResponseWriter, r *http.Request, serve http.HandlerFunc) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+	if _, err := NewClientFromTenantOptions(ctx, client, "c8y-devmgmt-repo-intgr", "memory", ClientSettings{}); err == nil || !strings.Contains(err.Error(), "could not be read") {
+		t.Errorf("expected error while reading the connection details, got %v", err)
+	}
+	if _, err := NewClientFromTenantOptions(ctx, client, "c8y-devmgmt-repo-intgr", "unknown", ClientSettings{}); err == nil || !strings.Contains(err.Error(), "unsupported storage provider") {
+		t.Errorf("expected unsupported provider error, got %v", err)
+	}
+}
+
+func TestMemoryClient(t *testing.T) {
+	ctx := context.Background()
+	memory, _ := GetProvider("memory")
+	config, err := memory.ParseConfig(`{"bucketName": "firmware", "baseUrl": "https://storage.example.com", "objects": {"fw/1.0.0.zip": "v1"}}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	client, err := memory.New(ctx, config, ClientSettings{UrlExpirationMins: 5})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	client.(*MemoryClient).Put("fw/1.0.1.zip", []byte("v2"))
+	client.(*MemoryClient).Put("index.json", []byte("{}"))
+
+	content, err := ReadObjectAsString(ctx, client, "fw/1.0.0.zip")
+	if err != nil || content != "v1" {
+		t.Errorf("expected content v1, got %q (%v)", content, err)
+	}
+	if _, err := client.Stat(ctx, "missing.zip"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	var keys []string
+	for info, err := range client.List(ctx, "fw/") {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		keys = append(keys, info.Key)
+	}
+	if strings.Join(keys, ",") != "fw/1.0.0.zip,fw/1.0.1.zip" {
+		t.Errorf("unexpected keys listed: %v", keys)
+	}
+	if url, _ := client.GetPresignedURL(ctx, "fw/1.0.0.zip"); !strings.HasPrefix(url, "https://storage.example.com/fw/1.0.0.zip?expires=") {
+		t.Errorf("unexpected presigned URL: %s", url)
+	}
+}
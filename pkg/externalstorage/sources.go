@@ -0,0 +1,192 @@
+package externalstorage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	s "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/static"
+)
+
+// DefaultSourceId is the id of the single source configured via the storage provider (instead of a list of sources)
+const DefaultSourceId = "default"
+
+// IndexLayout locates the index files and objects of a source within its bucket, e.g. to share a bucket between environments
+type IndexLayout struct {
+	// prefix the index files and the object keys listed in them are relative to, e.g. "prod/"
+	Prefix string `json:"prefix,omitempty"`
+	// names of the index files (relative to the prefix), defaults are c8y-firmware-versions.json and c8y-firmware-info.json
+	VersionsFile string `json:"versionsFile,omitempty"`
+	InfoFile     string `json:"infoFile,omitempty"`
+	// name of the (optional) tenant groups file, default is c8y-tenant-groups.json
+	TenantGroupsFile string `json:"tenantGroupsFile,omitempty"`
+}
+
+func (l IndexLayout) VersionsFileName() string {
+	if len(l.VersionsFile) == 0 {
+		return s.INDEX_FILE_VERSIONS
+	}
+	return l.VersionsFile
+}
+
+func (l IndexLayout) InfoFileName() string {
+	if len(l.InfoFile) == 0 {
+		return s.INDEX_FILE_INFO
+	}
+	return l.InfoFile
+}
+
+func (l IndexLayout) TenantGroupsFileName() string {
+	if len(l.TenantGroupsFile) == 0 {
+		return s.INDEX_FILE_TENANT_GROUPS
+	}
+	return l.TenantGroupsFile
+}
+
+// RelativeKey returns the key relative to the prefix, false if the (bucket) object key is not located below the prefix
+func (l IndexLayout) RelativeKey(objectKey string) (string, bool) {
+	return strings.CutPrefix(objectKey, l.Prefix)
+}
+
+// normalizes the prefix to a folder, e.g. "/prod" -> "prod/"
+func normalizePrefix(prefix string) string {
+	prefix = strings.TrimLeft(strings.TrimSpace(prefix), "/")
+	if len(prefix) > 0 && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix
+}
+
+// Source is a named storage. The index files of multiple sources are merged into one repository.
+type Source struct {
+	Id string
+	// client scoped to the prefix of the layout, see Unwrap for the client of the whole bucket
+	Client ExternalStorageClient
+	IndexLayout
+}
+
+// NewSource scopes the client to the prefix of layout
+func NewSource(id string, client ExternalStorageClient, layout IndexLayout) Source {
+	layout.Prefix = normalizePrefix(layout.Prefix)
+	return Source{Id: id, Client: WithPrefix(client, layout.Prefix), IndexLayout: layout}
+}
+
+// Sources are ordered by precedence, the first one is the primary source (e.g. used for publishing firmware)
+type Sources []Source
+
+// SingleSource wraps a client as the only (default) source
+func SingleSource(client ExternalStorageClient, layout IndexLayout) Sources {
+	return Sources{NewSource(DefaultSourceId, client, layout)}
+}
+
+func (s Sources) Primary() Source {
+	if len(s) == 0 {
+		return Source{}
+	}
+	return s[0]
+}
+
+// Get returns the source. An empty id refers to the primary source, e.g. for objects created before sources were recorded.
+func (s Sources) Get(id string) (Source, bool) {
+	if len(id) == 0 && len(s) > 0 {
+		return s[0], true
+	}
+	for _, source := range s {
+		if source.Id == id {
+			return source, true
+		}
+	}
+	return Source{}, false
+}
+
+func (s Sources) Ids() []string {
+	ids := make([]string, len(s))
+	for i, source := range s {
+		ids[i] = source.Id
+	}
+	return ids
+}
+
+// SourceConfig is an entry of the JSON list of sources
+type SourceConfig struct {
+	Id       string `json:"id"`
+	Provider string `json:"provider"`
+	// connection details of the provider, same format as the tenant option of the provider
+	Config json.RawMessage `json:"config,omitempty"`
+	IndexLayout
+}
+
+// NewSources creates the clients of the sources configured as JSON list (see SourceConfig). The order of the list defines the precedence.
+func NewSources(ctx context.Context, value string, settings ClientSettings) (Sources, error) {
+	var configs []SourceConfig
+	if err := json.Unmarshal([]byte(value), &configs); err != nil {
+		return nil, fmt.Errorf("storage sources are no valid JSON list: %w", err)
+	}
+	if len(configs) == 0 {
+		return nil, errors.New("no storage sources configured")
+	}
+	var sources Sources
+	for i, sourceConfig := range configs {
+		if len(sourceConfig.Id) == 0 {
+			return nil, fmt.Errorf("storage source %d: missing mandatory field id", i+1)
+		}
+		if _, exists := sources.Get(sourceConfig.Id); exists {
+			return nil, fmt.Errorf("storage source '%s' is configured twice", sourceConfig.Id)
+		}
+		source, err := NewSourceFromConfig(ctx, sourceConfig, settings)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// Endpoints returns the URLs a client of the source would connect to, without creating it. Providers whose connection details
+// don't implement EndpointConfig (e.g. the memory provider) have none.
+func (sourceConfig SourceConfig) Endpoints() ([]string, error) {
+	provider, ok := GetProvider(sourceConfig.Provider)
+	if !ok {
+		return nil, fmt.Errorf("storage source '%s': unsupported storage provider '%s', supported providers are %v", sourceConfig.Id, sourceConfig.Provider, ProviderNames())
+	}
+	if len(sourceConfig.Config) == 0 {
+		return nil, nil
+	}
+	config, err := provider.ParseConfig(string(sourceConfig.Config))
+	if err != nil {
+		return nil, fmt.Errorf("storage source '%s': %w", sourceConfig.Id, err)
+	}
+	if endpointConfig, ok := config.(EndpointConfig); ok {
+		return endpointConfig.Endpoints()
+	}
+	return nil, nil
+}
+
+// NewSourceFromConfig creates the client of a single source
+func NewSourceFromConfig(ctx context.Context, sourceConfig SourceConfig, settings ClientSettings) (Source, error) {
+	provider, ok := GetProvider(sourceConfig.Provider)
+	if !ok {
+		return Source{}, fmt.Errorf("storage source '%s': unsupported storage provider '%s', supported providers are %v", sourceConfig.Id, sourceConfig.Provider, ProviderNames())
+	}
+	var config ProviderConfig
+	switch {
+	case len(sourceConfig.Config) > 0:
+		var err error
+		if config, err = provider.ParseConfig(string(sourceConfig.Config)); err != nil {
+			return Source{}, fmt.Errorf("storage source '%s': %w", sourceConfig.Id, err)
+		}
+	case provider.ConfigOptional:
+		config = provider.NewConfig()
+	default:
+		return Source{}, fmt.Errorf("storage source '%s': missing connection details (field config) of storage provider '%s'", sourceConfig.Id, provider.Name)
+	}
+	slog.Info("Initializing storage client", "source", sourceConfig.Id, "provider", provider.Name)
+	client, err := provider.New(ctx, config, settings)
+	if err != nil {
+		return Source{}, fmt.Errorf("storage source '%s': %w", sourceConfig.Id, err)
+	}
+	return NewSource(sourceConfig.Id, client, sourceConfig.IndexLayout), nil
+}
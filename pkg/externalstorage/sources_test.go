@@ -0,0 +1,87 @@
+package externalstorage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNewSources(t *testing.T) {
+	ctx := context.Background()
+	sources, err := NewSources(ctx, `[
+		{"id": "shared", "provider": "memory", "config": {"bucketName": "shared", "baseUrl": "https://shared.example.com"}},
+		{"id": "vendor", "provider": "memory"}
+	]`, ClientSettings{UrlExpirationMins: 5})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ids := strings.Join(sources.Ids(), ","); ids != "shared,vendor" {
+		t.Errorf("expected sources in configured order, got %s", ids)
+	}
+	if primary := sources.Primary(); primary.Id != "shared" || primary.Client.GetBucketName() != "shared" {
+		t.Errorf("expected first source to be primary, got %+v", primary)
+	}
+	if source, ok := sources.Get("vendor"); !ok || source.Client.GetBucketName() != "memory" {
+		t.Errorf("expected vendor source with default config, got %+v", source)
+	}
+	if source, ok := sources.Get(""); !ok || source.Id != "shared" {
+		t.Error("expected empty id to refer to the primary source")
+	}
+	if _, ok := sources.Get("unknown"); ok {
+		t.Error("expected unknown source not to be found")
+	}
+
+	for value, expected := range map[string]string{
+		`{"id": "shared"}`:         "no valid JSON list",
+		`[]`:                       "no storage sources configured",
+		`[{"provider": "memory"}]`: "storage source 1: missing mandatory field id",
+		`[{"id": "a", "provider": "memory"}, {"id": "a", "provider": "memory"}]`:   "configured twice",
+		`[{"id": "a", "provider": "ftp"}]`:                                         "unsupported storage provider 'ftp'",
+		`[{"id": "a", "provider": "awsS3"}]`:                                       "missing connection details",
+		`[{"id": "a", "provider": "awsS3", "config": {"region": "eu-central-1"}}]`: "storage source 'a': invalid connection details",
+	} {
+		if _, err := NewSources(ctx, value, ClientSettings{}); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: expected error containing %q, got %v", value, expected, err)
+		}
+	}
+}
+
+func TestSourceConfigEndpoints(t *testing.T) {
+	for _, test := range []struct {
+		config   string
+		expected []string
+	}{
+		{`{"provider": "awsS3", "config": {"region": "eu-central-1", "accessKeyID": "id", "secretAccessKey": "secret", "bucketName": "b"}}`,
+			[]string{"https://s3.eu-central-1.amazonaws.com"}},
+		{`{"provider": "awsS3", "config": {"region": "eu-central-1", "accessKeyID": "id", "secretAccessKey": "secret", "bucketName": "b", "sqsEndpoint": "http://localhost:9324"}}`,
+			[]string{"https://s3.eu-central-1.amazonaws.com", "http://localhost:9324"}},
+		{`{"provider": "azblob", "config": {"connectionString": "DefaultEndpointsProtocol=https;AccountName=acc;AccountKey=a2V5", "containerName": "c"}}`,
+			[]string{"https://acc.blob.core.windows.net"}},
+		{`{"provider": "azblob", "config": {"connectionString": "BlobEndpoint=http://169.254.169.254/;SharedAccessSignature=sv=1", "containerName": "c"}}`,
+			[]string{"http://169.254.169.254/"}},
+		{`{"provider": "memory", "config": {"bucketName": "b", "baseUrl": "https://memory.example.com"}}`, nil},
+	} {
+		var config SourceConfig
+		if err := json.Unmarshal([]byte(test.config), &config); err != nil {
+			t.Fatal(err)
+		}
+		endpoints, err := config.Endpoints()
+		if err != nil || !slices.Equal(endpoints, test.expected) {
+			t.Errorf("%s: expected endpoints %v, got %v (%v)", config.Provider, test.expected, endpoints, err)
+		}
+	}
+}
+
+func TestWithReadLimit(t *testing.T) {
+	ctx := context.Background()
+	client := WithReadLimit(NewMemoryClient(MemoryConnectionDetails{BucketName: "b", Objects: map[string]string{"small": "1234", "large": "12345"}}, 5), 4)
+	if content, err := ReadObjectAsString(ctx, client, "small"); err != nil || content != "1234" {
+		t.Errorf("expected object of max. size to be read, got %q (%v)", content, err)
+	}
+	if _, err := ReadObjectAsString(ctx, client, "large"); !errors.Is(err, ErrObjectTooLarge) {
+		t.Errorf("expected ErrObjectTooLarge, got %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kobu/c8y-devmgmt-repo-intgr/pkg/c8yauth"
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+)
+
+// DeviceTypeCheck configures the check that device users only download firmware matching their device type
+type DeviceTypeCheck struct {
+	Enabled bool
+	// how long looked up devices and device type filters of firmware versions are cached
+	CacheTTL time.Duration
+}
+
+// type and hardware model of the device managed object of a device user, found is false if the user owns no device
+type deviceInfo struct {
+	found         bool
+	deviceType    string
+	hardwareModel string
+}
+
+var deviceTypeCheck DeviceTypeCheck
+
+// devices by device user and device type filters (c8y_Filter.type) by firmware, keyed per tenant
+var deviceCache *lookupCache[deviceInfo]
+var filterCache *lookupCache[string]
+
+// lookupCache caches lookups towards Cumulocity for a limited time. It is safe for concurrent use.
+type lookupCache[V any] struct {
+	mu      sync.Mutex
+	entries map[string]lookupCacheEntry[V]
+	// expired entries are dropped at most once per ttl, so devices that stopped downloading don't accumulate
+	nextSweep time.Time
+}
+
+type lookupCacheEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+func newLookupCache[V any]() *lookupCache[V] {
+	return &lookupCache[V]{entries: make(map[string]lookupCacheEntry[V])}
+}
+
+// get returns the cached value, or looks it up and caches it for ttl. Failed lookups are not cached.
+func (c *lookupCache[V]) get(key string, ttl time.Duration, lookup func() (V, error)) (V, error) {
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.value, nil
+	}
+	value, err := lookup()
+	if err != nil || ttl <= 0 {
+		return value, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.After(c.nextSweep) {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.nextSweep = now.Add(ttl)
+	}
+	c.entries[key] = lookupCacheEntry[V]{value: value, expires: now.Add(ttl)}
+	return value, nil
+}
+
+// device users (as created by the device registration) have the device role, but can't manage the inventory in contrast to
+// e.g. service users that are granted the device role as well
+func isDeviceUser(auth c8yauth.AuthContext) bool {
+	return auth.CheckPrivilege(c8yauth.RoleDevice) && !auth.CheckPrivilege(c8yauth.RoleInventoryAdmin)
+}
+
+// checkDeviceType rejects downloads of device users whose device does not match the device type filter of the firmware.
+// Returns http.StatusOK if the download is allowed.
+// The version needs to be queried with its parents, the firmware is its addition parent.
+func checkDeviceType(ctx context.Context, c8yClient *c8y.Client, auth c8yauth.AuthContext, version *c8y.ManagedObject) (int, map[string]any) {
+	if !deviceTypeCheck.Enabled || !isDeviceUser(auth) {
+		return http.StatusOK, nil
+	}
+	moid := version.ID
+	// versions not assigned to a firmware have no device type filter
+	firmwareId := version.Item.Get("additionParents.references.0.managedObject.id").String()
+	if len(firmwareId) == 0 {
+		return http.StatusOK, nil
+	}
+	filterType, err := filterCache.get(auth.Tenant+"/"+firmwareId, deviceTypeCheck.CacheTTL, func() (string, error) {
+		return lookupDeviceTypeFilter(ctx, c8yClient, firmwareId)
+	})
+	if err != nil {
+		return internalError("Error while looking up the device type of firmware version '"+moid+"'", err)
+	}
+	// firmware without device type filter is applicable to all devices
+	if len(filterType) == 0 {
+		return http.StatusOK, nil
+	}
+	device, err := deviceCache.get(auth.Tenant+"/"+auth.UserID, deviceTypeCheck.CacheTTL, func() (deviceInfo, error) {
+		return lookupDevice(ctx, c8yClient, auth.UserID)
+	})
+	if err != nil {
+		return internalError("Error while looking up the device of user '"+auth.UserID+"'", err)
+	}
+	if !device.found {
+		slog.Warn("Download rejected, no device managed object found for device user", "user", auth.UserID, "tenant", auth.Tenant, "managedObjectId", moid)
+		return http.StatusForbidden, map[string]any{
+			"status":  http.StatusForbidden,
+			"message": "No device found for user '" + auth.UserID + "', firmware version '" + moid + "' is restricted to device type '" + filterType + "'",
+		}
+	}
+	if device.deviceType != filterType && device.hardwareModel != filterType {
+		slog.Warn("Download rejected, device type does not match the firmware", "user", auth.UserID, "tenant", auth.Tenant, "managedObjectId", moid,
+			"deviceType", device.deviceType, "hardwareModel", device.hardwareModel, "firmwareDeviceType", filterType)
+		return http.StatusForbidden, map[string]any{
+			"status":  http.StatusForbidden,
+			"message": "Firmware version '" + moid + "' is restricted to device type '" + filterType + "'",
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// returns c8y_Filter.type of the firmware, empty if it has no filter
+func lookupDeviceTypeFilter(ctx context.Context, c8yClient *c8y.Client, firmwareId string) (string, error) {
+	firmware, _, err := c8yClient.Inventory.GetManagedObject(ctx, firmwareId, nil)
+	if err != nil {
+		return "", err
+	}
+	return firmware.Item.Get("c8y_Filter.type").String(), nil
+}
+
+// looks up the device managed object owned by the device user
+func lookupDevice(ctx context.Context, c8yClient *c8y.Client, userId string) (deviceInfo, error) {
+	devices, _, err := c8yClient.Inventory.GetManagedObjects(ctx, &c8y.ManagedObjectOptions{
+		// quotes within string literals of the query language are escaped by doubling them
+		Query: fmt.Sprintf("$filter=(owner eq '%s') and has(c8y_IsDevice)", strings.ReplaceAll(userId, "'", "''")),
+		PaginationOptions: c8y.PaginationOptions{
+			PageSize: 1,
+		},
+	})
+	if err != nil {
+		return deviceInfo{}, err
+	}
+	if len(devices.Items) == 0 {
+		return deviceInfo{}, nil
+	}
+	return deviceInfo{
+		found:         true,
+		deviceType:    devices.Items[0].Get("type").String(),
+		hardwareModel: devices.Items[0].Get("c8y_Hardware.model").String(),
+	}, nil
+}
+
+func internalError(message string, err error) (int, map[string]any) {
+	slog.Error(message, "err", err)
+	return http.StatusInternalServerError, map[string]any{
+		"status":  http.StatusInternalServerError,
+		"message": message,
+		"error":   err.Error(),
+	}
+}
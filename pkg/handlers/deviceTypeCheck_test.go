@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kobu/c8y-devmgmt-repo-intgr/pkg/c8yauth"
+)
+
+func TestLookupCache(t *testing.T) {
+	cache := newLookupCache[string]()
+	lookups := 0
+	lookup := func(value string) func() (string, error) {
+		return func() (string, error) {
+			lookups++
+			return value, nil
+		}
+	}
+	if value, _ := cache.get("a", time.Hour, lookup("a1")); value != "a1" {
+		t.Errorf("expected looked up value, got %s", value)
+	}
+	if value, _ := cache.get("a", time.Hour, lookup("a2")); value != "a1" || lookups != 1 {
+		t.Errorf("expected cached value without lookup, got %s after %d lookups", value, lookups)
+	}
+	if _, err := cache.get("b", time.Hour, func() (string, error) { return "", errors.New("unavailable") }); err == nil || len(cache.entries) != 1 {
+		t.Errorf("expected failed lookup not to be cached, got %v %v", err, cache.entries)
+	}
+
+	// expired entries are dropped once the sweep is due, not with every insert
+	cache.entries["a"] = lookupCacheEntry[string]{value: "a1", expires: time.Now().Add(-time.Second)}
+	cache.get("c", time.Hour, lookup("c1"))
+	if _, ok := cache.entries["a"]; !ok {
+		t.Error("expected expired entry to be kept until the next sweep")
+	}
+	cache.nextSweep = time.Now().Add(-time.Second)
+	cache.get("d", time.Hour, lookup("d1"))
+	if _, ok := cache.entries["a"]; ok || len(cache.entries) != 2 {
+		t.Errorf("expected expired entry to be dropped by the sweep, got %v", cache.entries)
+	}
+}
+
+func TestIsDeviceUser(t *testing.T) {
+	for _, test := range []struct {
+		roles    []string
+		expected bool
+	}{
+		{[]string{string(c8yauth.RoleDevice)}, true},
+		{[]string{string(c8yauth.RoleDevice), string(c8yauth.RoleInventoryAdmin)}, false},
+		{[]string{string(c8yauth.RoleInventoryAdmin)}, false},
+	} {
+		auth := c8yauth.AuthContext{UserID: "device_1", Roles: make(map[string]struct{})}
+		for _, role := range test.roles {
+			auth.Roles[role] = struct{}{}
+		}
+		if isDeviceUser(auth) != test.expected {
+			t.Errorf("%v: expected device user %t", test.roles, test.expected)
+		}
+	}
+}
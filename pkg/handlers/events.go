@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kobu/c8y-devmgmt-repo-intgr/pkg/c8yauth"
+	est "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/externalstorage"
+	"github.com/labstack/echo/v4"
+)
+
+// max. accepted size of webhook request bodies
+const maxWebhookBodyBytes = 1 << 20
+
+// header carrying the HMAC-SHA256 signature (hex, prefixed with "sha256=") of "<timestamp>.<body>" of the generic webhook
+const signatureHeader = "X-Signature-256"
+
+// header carrying the time the generic webhook request was signed at (unix seconds)
+const signatureTimestampHeader = "X-Signature-Timestamp"
+
+// header carrying the secret of Event Grid requests, configured as delivery property of the event subscription
+const secretHeader = "X-Webhook-Secret"
+
+// max. age (and clock skew) of signed generic webhook requests, older requests are rejected as replays
+const signatureMaxAge = 5 * time.Minute
+
+// ids of delivered Event Grid events are remembered for the retry period of Event Grid, so replayed events are ignored
+const eventIdRetention = 24 * time.Hour
+
+var webhookSecret string
+
+// signatures of accepted generic webhook requests and ids of accepted Event Grid events
+var seenSignatures *replayGuard
+var seenEventIds *replayGuard
+
+// sources whose containers are watched by the Event Grid webhook
+var watchedSources est.Sources
+var onStorageEvents func(events []est.StorageEvent) bool
+var onSyncRequested func(reason string)
+
+// RegisterEventHandlers registers the webhook endpoints. Both bypass the Cumulocity authentication (see c8yauth.SkipCheck)
+// and verify the shared secret instead, so they must only be registered if a secret is configured.
+func RegisterEventHandlers(e *echo.Echo, secret string, sources est.Sources, storageEventsFunc func(events []est.StorageEvent) bool, syncFunc func(reason string)) {
+	webhookSecret = secret
+	seenSignatures = newReplayGuard(2 * signatureMaxAge)
+	seenEventIds = newReplayGuard(eventIdRetention)
+	watchedSources = sources
+	onStorageEvents = storageEventsFunc
+	onSyncRequested = syncFunc
+	e.Add("POST", c8yauth.PathEventGridWebhook, HandleEventGridEvents)
+	e.Add("POST", c8yauth.PathGenericWebhook, HandleGenericWebhook)
+}
+
+// eventGridEvent is an event in the Event Grid event schema (https://learn.microsoft.com/en-us/azure/event-grid/event-schema)
+type eventGridEvent struct {
+	Id        string `json:"id"`
+	EventType string `json:"eventType"`
+	Topic     string `json:"topic"`
+	Subject   string `json:"subject"`
+	Data      struct {
+		ValidationCode string `json:"validationCode"`
+	} `json:"data"`
+}
+
+// HandleEventGridEvents accepts Azure Event Grid BlobCreated/BlobDeleted events (incl. the subscription validation handshake).
+// The secret is expected in the header X-Webhook-Secret, configured as (secret) delivery property of the event subscription.
+// Events already delivered before (same topic and id) are ignored, so replayed requests don't trigger synchronizations.
+func HandleEventGridEvents(c echo.Context) error {
+	if !secretEquals(c.Request().Header.Get(secretHeader)) {
+		slog.Warn("Rejected Event Grid request with invalid secret", "remoteIp", c.RealIP())
+		return c.JSON(http.StatusUnauthorized, ErrorMessage{Err: "invalid secret"})
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, maxWebhookBodyBytes))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorMessage{Err: "could not read body", Reason: err.Error()})
+	}
+	var events []eventGridEvent
+	if err := json.Unmarshal(body, &events); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorMessage{Err: "invalid Event Grid payload", Reason: err.Error()})
+	}
+	for _, event := range events {
+		if event.EventType == "Microsoft.EventGrid.SubscriptionValidationEvent" {
+			slog.Info("Answering Event Grid subscription validation", "eventId", event.Id)
+			return c.JSON(http.StatusOK, map[string]string{"validationResponse": event.Data.ValidationCode})
+		}
+	}
+	storageEvents := storageEventsOf(events)
+	triggered := len(storageEvents) > 0 && onStorageEvents(storageEvents)
+	return c.JSON(http.StatusOK, map[string]any{"syncTriggered": triggered})
+}
+
+// returns the storage events of blobs of the watched containers, skipping events delivered before
+func storageEventsOf(events []eventGridEvent) []est.StorageEvent {
+	var storageEvents []est.StorageEvent
+	now := time.Now()
+	for _, event := range events {
+		switch event.EventType {
+		case "Microsoft.Storage.BlobCreated", "Microsoft.Storage.BlobDeleted":
+			objectKey, ok := blobNameFromSubject(event.Subject)
+			if !ok {
+				continue
+			}
+			if len(event.Id) > 0 && !seenEventIds.firstSeen(event.Topic+"/"+event.Id, now) {
+				slog.Info("Ignoring Event Grid event delivered before", "eventId", event.Id, "subject", event.Subject)
+				continue
+			}
+			storageEvents = append(storageEvents, est.StorageEvent{EventName: event.EventType, ObjectKey: objectKey})
+		default:
+			slog.Debug("Ignoring Event Grid event", "eventType", event.EventType, "subject", event.Subject)
+		}
+	}
+	return storageEvents
+}
+
+// extracts the blob name from subjects like /blobServices/default/containers/<container>/blobs/<blob name>.
+// Events of other containers than the configured ones are ignored.
+func blobNameFromSubject(subject string) (string, bool) {
+	container, blobName, found := strings.Cut(strings.TrimPrefix(subject, "/blobServices/default/containers/"), "/blobs/")
+	if !found {
+		return "", false
+	}
+	if len(watchedSources) > 0 && !slices.ContainsFunc(watchedSources, func(source est.Source) bool { return source.Client.GetBucketName() == container }) {
+		slog.Debug("Ignoring Event Grid event of other container", "container", container)
+		return "", false
+	}
+	return blobName, true
+}
+
+// HandleGenericWebhook accepts a signed request (e.g. from a CI pipeline) and triggers a synchronization. Requests signed more than
+// signatureMaxAge ago and requests already accepted before (same signature) are rejected, so they can't be replayed.
+// The body is optional and may name the changed objects: {"objectKeys": ["c8y-firmware-versions.json"]}. Without object keys, a sync is triggered unconditionally.
+func HandleGenericWebhook(c echo.Context) error {
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, maxWebhookBodyBytes))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorMessage{Err: "could not read body", Reason: err.Error()})
+	}
+	now := time.Now()
+	signature, timestamp := c.Request().Header.Get(signatureHeader), c.Request().Header.Get(signatureTimestampHeader)
+	if !signatureValid(body, timestamp, signature) {
+		slog.Warn("Rejected webhook request with invalid signature", "remoteIp", c.RealIP())
+		return c.JSON(http.StatusUnauthorized, ErrorMessage{Err: "invalid signature"})
+	}
+	if !timestampValid(timestamp, now) {
+		slog.Warn("Rejected webhook request with outdated timestamp", "remoteIp", c.RealIP(), "timestamp", timestamp)
+		return c.JSON(http.StatusUnauthorized, ErrorMessage{Err: "outdated signature timestamp"})
+	}
+	if !seenSignatures.firstSeen(signature, now) {
+		slog.Warn("Rejected replayed webhook request", "remoteIp", c.RealIP())
+		return c.JSON(http.StatusUnauthorized, ErrorMessage{Err: "request already accepted before"})
+	}
+	var payload struct {
+		ObjectKeys []string `json:"objectKeys"`
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorMessage{Err: "invalid payload", Reason: err.Error()})
+		}
+	}
+	if len(payload.ObjectKeys) == 0 {
+		onSyncRequested("webhook")
+		return c.JSON(http.StatusOK, map[string]any{"syncTriggered": true})
+	}
+	var storageEvents []est.StorageEvent
+	for _, objectKey := range payload.ObjectKeys {
+		storageEvents = append(storageEvents, est.StorageEvent{EventName: "webhook", ObjectKey: objectKey})
+	}
+	return c.JSON(http.StatusOK, map[string]any{"syncTriggered": onStorageEvents(storageEvents)})
+}
+
+func secretEquals(secret string) bool {
+	return len(webhookSecret) > 0 && subtle.ConstantTimeCompare([]byte(secret), []byte(webhookSecret)) == 1
+}
+
+// verifies the signature header "sha256=<hex encoded HMAC-SHA256 of <timestamp>.<body>>"
+func signatureValid(body []byte, timestamp string, signature string) bool {
+	if len(webhookSecret) == 0 || len(timestamp) == 0 {
+		return false
+	}
+	received, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(webhookSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hmac.Equal(received, mac.Sum(nil))
+}
+
+// the timestamp (unix seconds) needs to be within signatureMaxAge of now, in both directions to allow for clock skew
+func timestampValid(timestamp string, now time.Time) bool {
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := now.Sub(time.Unix(secs, 0))
+	return age <= signatureMaxAge && age >= -signatureMaxAge
+}
+
+// replayGuard remembers ids for a limited time. It is safe for concurrent use.
+type replayGuard struct {
+	mu        sync.Mutex
+	retention time.Duration
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+func newReplayGuard(retention time.Duration) *replayGuard {
+	return &replayGuard{retention: retention, seen: make(map[string]time.Time), lastPrune: time.Now()}
+}
+
+// firstSeen remembers the id and returns false if it was seen within the retention before.
+// Expired ids are dropped at most once per retention period, so remembering an id stays cheap.
+func (g *replayGuard) firstSeen(id string, now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if now.Sub(g.lastPrune) >= g.retention {
+		for seenId, seenAt := range g.seen {
+			if now.Sub(seenAt) >= g.retention {
+				delete(g.seen, seenId)
+			}
+		}
+		g.lastPrune = now
+	}
+	if seenAt, ok := g.seen[id]; ok && now.Sub(seenAt) < g.retention {
+		return false
+	}
+	g.seen[id] = now
+	return true
+}
@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kobu/c8y-devmgmt-repo-intgr/pkg/c8yauth"
+	est "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/externalstorage"
+	"github.com/labstack/echo/v4"
+)
+
+const testSecret = "webhook-secret"
+
+// records the storage events and sync requests of the webhooks
+type webhookRecorder struct {
+	storageEvents []est.StorageEvent
+	syncRequests  int
+}
+
+func newWebhookServer(t *testing.T) (*echo.Echo, *webhookRecorder) {
+	t.Helper()
+	recorder := &webhookRecorder{}
+	e := echo.New()
+	sources := est.Sources{est.NewSource("default", est.NewMemoryClient(est.MemoryConnectionDetails{BucketName: "firmware"}, 0), est.IndexLayout{})}
+	RegisterEventHandlers(e, testSecret, sources, func(events []est.StorageEvent) bool {
+		recorder.storageEvents = append(recorder.storageEvents, events...)
+		return true
+	}, func(reason string) {
+		recorder.syncRequests++
+	})
+	return e, recorder
+}
+
+func sign(secret string, timestamp string, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func serve(e *echo.Echo, path string, headers map[string]string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestSecretEquals(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured string
+		secret     string
+		want       bool
+	}{
+		{name: "matching secret", configured: testSecret, secret: testSecret, want: true},
+		{name: "other secret", configured: testSecret, secret: "other", want: false},
+		{name: "prefix of secret", configured: testSecret, secret: testSecret[:4], want: false},
+		{name: "missing secret", configured: testSecret, secret: "", want: false},
+		{name: "no secret configured", configured: "", secret: "", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			webhookSecret = tt.configured
+			if got := secretEquals(tt.secret); got != tt.want {
+				t.Errorf("secretEquals(%q) = %v, want %v", tt.secret, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignatureValid(t *testing.T) {
+	body, timestamp := `{"objectKeys": ["c8y-firmware-versions.json"]}`, "1700000000"
+	tests := []struct {
+		name       string
+		configured string
+		body       string
+		timestamp  string
+		signature  string
+		want       bool
+	}{
+		{name: "valid signature", configured: testSecret, body: body, timestamp: timestamp, signature: sign(testSecret, timestamp, body), want: true},
+		{name: "without sha256 prefix", configured: testSecret, body: body, timestamp: timestamp, signature: strings.TrimPrefix(sign(testSecret, timestamp, body), "sha256="), want: true},
+		{name: "signed with other secret", configured: testSecret, body: body, timestamp: timestamp, signature: sign("other", timestamp, body), want: false},
+		{name: "changed body", configured: testSecret, body: body + " ", timestamp: timestamp, signature: sign(testSecret, timestamp, body), want: false},
+		{name: "changed timestamp", configured: testSecret, body: body, timestamp: "1700000001", signature: sign(testSecret, timestamp, body), want: false},
+		{name: "missing timestamp", configured: testSecret, body: body, timestamp: "", signature: sign(testSecret, "", body), want: false},
+		{name: "missing signature", configured: testSecret, body: body, timestamp: timestamp, signature: "", want: false},
+		{name: "signature not hex encoded", configured: testSecret, body: body, timestamp: timestamp, signature: "sha256=xyz", want: false},
+		{name: "no secret configured", configured: "", body: body, timestamp: timestamp, signature: sign("", timestamp, body), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			webhookSecret = tt.configured
+			if got := signatureValid([]byte(tt.body), tt.timestamp, tt.signature); got != tt.want {
+				t.Errorf("signatureValid() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimestampValid(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		timestamp string
+		want      bool
+	}{
+		{timestamp: "1700000000", want: true},
+		{timestamp: strconv.FormatInt(now.Add(-4*time.Minute).Unix(), 10), want: true},
+		{timestamp: strconv.FormatInt(now.Add(4*time.Minute).Unix(), 10), want: true},
+		{timestamp: strconv.FormatInt(now.Add(-6*time.Minute).Unix(), 10), want: false},
+		{timestamp: strconv.FormatInt(now.Add(6*time.Minute).Unix(), 10), want: false},
+		{timestamp: "", want: false},
+		{timestamp: "2023-11-14T22:13:20Z", want: false},
+	}
+	for _, tt := range tests {
+		if got := timestampValid(tt.timestamp, now); got != tt.want {
+			t.Errorf("timestampValid(%q) = %v, want %v", tt.timestamp, got, tt.want)
+		}
+	}
+}
+
+func TestReplayGuard(t *testing.T) {
+	now := time.Now()
+	guard := newReplayGuard(time.Minute)
+	if !guard.firstSeen("a", now) || !guard.firstSeen("b", now) {
+		t.Fatal("expected unknown ids to be seen the first time")
+	}
+	if guard.firstSeen("a", now.Add(30*time.Second)) {
+		t.Error("expected id to be rejected within the retention")
+	}
+	if !guard.firstSeen("a", now.Add(2*time.Minute)) {
+		t.Error("expected id to be accepted again after the retention")
+	}
+	if _, ok := guard.seen["b"]; ok {
+		t.Error("expected expired ids to be dropped")
+	}
+}
+
+func TestSkipCheckWebhooks(t *testing.T) {
+	e := echo.New()
+	tests := []struct {
+		method string
+		path   string
+		want   bool
+	}{
+		{method: http.MethodPost, path: c8yauth.PathEventGridWebhook, want: true},
+		{method: http.MethodPost, path: c8yauth.PathGenericWebhook, want: true},
+		{method: http.MethodGet, path: c8yauth.PathGenericWebhook, want: false},
+		{method: http.MethodPost, path: c8yauth.PathGenericWebhook + "/other", want: false},
+		{method: http.MethodPost, path: "/sync/tenants/t1/pause", want: false},
+		{method: http.MethodGet, path: "/health", want: true},
+	}
+	for _, tt := range tests {
+		c := e.NewContext(httptest.NewRequest(tt.method, tt.path, nil), httptest.NewRecorder())
+		if got := c8yauth.SkipCheck(c); got != tt.want {
+			t.Errorf("SkipCheck(%s %s) = %v, want %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestHandleGenericWebhook(t *testing.T) {
+	e, recorder := newWebhookServer(t)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	outdated := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	request := func(timestamp string, signature string, body string) *httptest.ResponseRecorder {
+		return serve(e, c8yauth.PathGenericWebhook, map[string]string{signatureHeader: signature, signatureTimestampHeader: timestamp}, body)
+	}
+
+	if rec := request(now, sign(testSecret, now, ""), ""); rec.Code != http.StatusOK || recorder.syncRequests != 1 {
+		t.Errorf("expected signed request without body to trigger a sync, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := request(now, sign(testSecret, now, ""), ""); rec.Code != http.StatusUnauthorized || recorder.syncRequests != 1 {
+		t.Errorf("expected replayed request to be rejected, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := request(outdated, sign(testSecret, outdated, ""), ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected outdated request to be rejected, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := request(now, "", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected request without signature to be rejected, got %d", rec.Code)
+	}
+	if rec := request("", sign(testSecret, "", ""), ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected request without timestamp to be rejected, got %d", rec.Code)
+	}
+
+	body := `{"objectKeys": ["c8y-firmware-versions.json", "firmware/fw.zip"]}`
+	if rec := request(now, sign(testSecret, now, body), body); rec.Code != http.StatusOK {
+		t.Errorf("expected signed request with object keys to be accepted, got %d: %s", rec.Code, rec.Body.String())
+	}
+	keys := []string{}
+	for _, event := range recorder.storageEvents {
+		keys = append(keys, event.ObjectKey)
+	}
+	if !slices.Equal(keys, []string{"c8y-firmware-versions.json", "firmware/fw.zip"}) {
+		t.Errorf("expected storage events of the object keys, got %v", recorder.storageEvents)
+	}
+	if rec := request(now, sign(testSecret, now, "{"), "{"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected invalid payload to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestHandleEventGridEvents(t *testing.T) {
+	e, recorder := newWebhookServer(t)
+	withSecret := map[string]string{secretHeader: testSecret}
+	blobEvents := `[
+		{"id": "1", "topic": "storage", "eventType": "Microsoft.Storage.BlobCreated", "subject": "/blobServices/default/containers/firmware/blobs/c8y-firmware-versions.json"},
+		{"id": "2", "topic": "storage", "eventType": "Microsoft.Storage.BlobDeleted", "subject": "/blobServices/default/containers/other/blobs/c8y-firmware-info.json"},
+		{"id": "3", "topic": "storage", "eventType": "Microsoft.Storage.BlobTierChanged", "subject": "/blobServices/default/containers/firmware/blobs/fw.zip"},
+		{"id": "4", "topic": "storage", "eventType": "Microsoft.Storage.BlobDeleted", "subject": "/blobServices/default/containers/firmware/blobs/nightly/fw.zip"}
+	]`
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		path    string
+		body    string
+		code    int
+		want    string
+	}{
+		{name: "missing secret", body: blobEvents, code: http.StatusUnauthorized},
+		{name: "secret as query parameter", path: "?secret=" + testSecret, body: blobEvents, code: http.StatusUnauthorized},
+		{name: "wrong secret", headers: map[string]string{secretHeader: "other"}, body: blobEvents, code: http.StatusUnauthorized},
+		{name: "invalid payload", headers: withSecret, body: `{"eventType": "Microsoft.Storage.BlobCreated"}`, code: http.StatusBadRequest},
+		{name: "subscription validation", headers: withSecret, body: `[{"id": "v", "eventType": "Microsoft.EventGrid.SubscriptionValidationEvent", "data": {"validationCode": "code-1"}}]`,
+			code: http.StatusOK, want: `"validationResponse":"code-1"`},
+		{name: "blob events", headers: withSecret, body: blobEvents, code: http.StatusOK, want: `"syncTriggered":true`},
+		{name: "replayed blob events", headers: withSecret, body: blobEvents, code: http.StatusOK, want: `"syncTriggered":false`},
+	}
+	for _, tt := range tests {
+		rec := serve(e, c8yauth.PathEventGridWebhook+tt.path, tt.headers, tt.body)
+		if rec.Code != tt.code || !strings.Contains(rec.Body.String(), tt.want) {
+			t.Errorf("%s: expected %d with %s, got %d: %s", tt.name, tt.code, tt.want, rec.Code, rec.Body.String())
+		}
+	}
+	want := []est.StorageEvent{
+		{EventName: "Microsoft.Storage.BlobCreated", ObjectKey: "c8y-firmware-versions.json"},
+		{EventName: "Microsoft.Storage.BlobDeleted", ObjectKey: "nightly/fw.zip"},
+	}
+	if !slices.Equal(recorder.storageEvents, want) {
+		t.Errorf("expected storage events of the watched container only (once), got %v", recorder.storageEvents)
+	}
+}
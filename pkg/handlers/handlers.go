@@ -8,14 +8,18 @@ import (
 	"github.com/kobu/c8y-devmgmt-repo-intgr/internal/model"
 	"github.com/kobu/c8y-devmgmt-repo-intgr/pkg/c8yauth"
 	est "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/externalstorage"
+	s "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/static"
 	"github.com/labstack/echo/v4"
 	"github.com/reubenmiller/go-c8y/pkg/c8y"
 )
 
-var estClient *est.ExternalStorageClient
+// resolves the storage source of a firmware object of a tenant (shared sources or the overlay source of the tenant)
+var resolveSource func(tenantId string, sourceId string) (est.Source, bool)
 
-func RegisterFirmwareHandler(e *echo.Echo, eClient *est.ExternalStorageClient) {
-	estClient = eClient
+func RegisterFirmwareHandler(e *echo.Echo, sourceResolver func(tenantId string, sourceId string) (est.Source, bool), check DeviceTypeCheck) {
+	resolveSource = sourceResolver
+	deviceTypeCheck = check
+	deviceCache, filterCache = newLookupCache[deviceInfo](), newLookupCache[string]()
 	e.Add("GET", "firmware/download", DownloadFileViaRedirect, c8yauth.Authorization(c8yauth.RoleDevice))
 }
 
@@ -46,29 +50,50 @@ func DownloadFileViaRedirect(c echo.Context) error {
 			"message": "Missing 'id' parameter in request",
 		})
 	}
-	presignedUrl, statusCode, content := GeneratePresignedUrl(cc.Microservice.WithServiceUser(auth.Tenant), cc.Microservice.Client, id)
+	ctx := cc.Microservice.WithServiceUser(auth.Tenant)
+	mo, statusCode, content := getFirmwareVersion(ctx, cc.Microservice.Client, id)
+	if statusCode != http.StatusOK {
+		return c.JSON(statusCode, content)
+	}
+	// device users may only download firmware matching their device type, checked before a URL is presigned
+	if statusCode, content := checkDeviceType(ctx, cc.Microservice.Client, auth, mo); statusCode != http.StatusOK {
+		return c.JSON(statusCode, content)
+	}
+	presignedUrl, statusCode, content := GeneratePresignedUrl(ctx, auth.Tenant, mo)
 	if statusCode != http.StatusOK {
 		return c.JSON(statusCode, content)
 	}
 	return c.Redirect(http.StatusTemporaryRedirect, presignedUrl)
 }
 
-func GeneratePresignedUrl(ctx context.Context, c8yClient *c8y.Client, moid string) (string, int, map[string]any) {
-	// query Managed Object
-	mo, resp, err := c8yClient.Inventory.GetManagedObject(ctx, moid, nil)
+// queries the firmware version managed object incl. its parents (the firmware, see checkDeviceType)
+func getFirmwareVersion(ctx context.Context, c8yClient *c8y.Client, moid string) (*c8y.ManagedObject, int, map[string]any) {
+	mo, resp, err := c8yClient.Inventory.GetManagedObject(ctx, moid, &c8y.ManagedObjectOptions{WithParents: true})
 	if err != nil {
 		slog.Error("Error while getting the Managed Object", "err", err.Error())
-		if resp.StatusCode() == 404 {
-			return "", http.StatusNotFound, map[string]any{
+		if resp != nil && resp.StatusCode() == 404 {
+			return nil, http.StatusNotFound, map[string]any{
 				"status":  http.StatusNotFound,
 				"message": "No Managed Object found for id=" + moid,
 			}
-		} else {
-			return "", http.StatusInternalServerError, map[string]any{
-				"status":  http.StatusInternalServerError,
-				"message": "Error while getting Managed Object wit id=" + moid,
-				"error":   err.Error(),
-			}
+		}
+		return nil, http.StatusInternalServerError, map[string]any{
+			"status":  http.StatusInternalServerError,
+			"message": "Error while getting Managed Object wit id=" + moid,
+			"error":   err.Error(),
+		}
+	}
+	return mo, http.StatusOK, nil
+}
+
+func GeneratePresignedUrl(ctx context.Context, tenantId string, mo *c8y.ManagedObject) (string, int, map[string]any) {
+	moid := mo.ID
+	// archived versions are kept for history only, they can't be downloaded anymore
+	if mo.Item.Get(s.FRAGMENT_ARCHIVED).Exists() {
+		slog.Info("Firmware Managed Object is archived", "managedObjectId", mo.ID)
+		return "", http.StatusGone, map[string]any{
+			"status":  http.StatusGone,
+			"message": "Firmware version with id '" + moid + "' was archived and is not available anymore",
 		}
 	}
 	// extract reference to external storage
@@ -80,8 +105,19 @@ func GeneratePresignedUrl(ctx context.Context, c8yClient *c8y.Client, moid strin
 			"message": "Missing 'externalResourceOrigin.objectKey' on Managed Object id '" + moid + "'",
 		}
 	}
-	// generate presigned URL
-	presignedUrl, err := (*estClient).GetPresignedURL(objectKey)
+	// objects created before sources were recorded are located in the primary source
+	sourceId := mo.Item.Get("externalResourceOrigin.source").String()
+	source, ok := resolveSource(tenantId, sourceId)
+	if !ok {
+		slog.Error("Firmware Managed Object refers to an unknown storage source", "managedObjectId", mo.ID, "source", sourceId)
+		return "", http.StatusUnprocessableEntity, map[string]any{
+			"status":  http.StatusUnprocessableEntity,
+			"message": "Unknown storage source '" + sourceId + "' on Managed Object id '" + moid + "'",
+		}
+	}
+	// generate presigned URL. The object key is relative to the prefix recorded at creation, the prefix of the source may have changed since
+	objectKey = mo.Item.Get("externalResourceOrigin.prefix").String() + objectKey
+	presignedUrl, err := est.Unwrap(source.Client).GetPresignedURL(ctx, objectKey)
 	if err != nil {
 		slog.Error("Error while generating presigned URL for objectKey", "objectKey", objectKey, "err", err.Error())
 		return "", http.StatusInternalServerError, map[string]any{
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/kobu/c8y-devmgmt-repo-intgr/internal/model"
+	"github.com/kobu/c8y-devmgmt-repo-intgr/pkg/c8yauth"
+	est "github.com/kobu/c8y-devmgmt-repo-intgr/pkg/externalstorage"
+	"github.com/labstack/echo/v4"
+)
+
+// IndexGenerateFunc proposes index entries for the not yet indexed objects below prefix, with write the merged index files are written back
+type IndexGenerateFunc func(ctx context.Context, prefix string, write bool) (any, error)
+
+var generateIndex IndexGenerateFunc
+
+func RegisterIndexHandler(e *echo.Echo, generateFunc IndexGenerateFunc) {
+	generateIndex = generateFunc
+	e.Add("POST", "index/generate", GenerateIndex, c8yauth.Authorization(c8yauth.RoleInventoryAdmin))
+}
+
+// GenerateIndex proposes (and with write=true writes) index entries. As the storage is shared by all tenants, only users of the
+// tenant hosting the service are allowed to use it.
+func GenerateIndex(c echo.Context) error {
+	cc := c.(*model.RequestContext)
+	auth, err := c8yauth.GetUserSecurityContext(c)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, ErrorMessage{
+			Err:    "invalid user context",
+			Reason: err.Error(),
+		})
+	}
+	if auth.Tenant != cc.Microservice.Client.TenantName {
+		return c.JSON(http.StatusForbidden, ErrorMessage{
+			Err: "only users of the tenant hosting the service are allowed to change the index files",
+		})
+	}
+	write := false
+	if value := c.QueryParam("write"); len(value) > 0 {
+		if write, err = strconv.ParseBool(value); err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorMessage{Err: "invalid query parameter write", Reason: err.Error()})
+		}
+	}
+	proposal, err := generateIndex(c.Request().Context(), c.QueryParam("prefix"), write)
+	if errors.Is(err, est.ErrPreconditionFailed) {
+		return c.JSON(http.StatusConflict, ErrorMessage{
+			Err:    "index files were changed concurrently, generate the entries again",
+			Reason: err.Error(),
+		})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, ErrorMessage{Err: "could not generate index entries", Reason: err.Error()})
+	}
+	return c.JSON(http.StatusOK, proposal)
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/kobu/c8y-devmgmt-repo-intgr/internal/model"
+	"github.com/kobu/c8y-devmgmt-repo-intgr/pkg/c8yauth"
+	"github.com/labstack/echo/v4"
+)
+
+// max. size of the form fields next to the binary
+const maxPublishFieldBytes = 4096
+
+// PublishFunc stores the binary and registers it in the index files, size is -1 if unknown
+type PublishFunc func(ctx context.Context, req model.PublishRequest, body io.Reader, size int64) (any, error)
+
+// UploadFunc prepares or completes a presigned upload of a firmware binary
+type UploadFunc func(ctx context.Context, req model.PublishRequest) (any, error)
+
+var publish PublishFunc
+var prepareUpload, completeUpload UploadFunc
+
+func RegisterPublishHandler(e *echo.Echo, publishFunc PublishFunc, prepareUploadFunc UploadFunc, completeUploadFunc UploadFunc) {
+	publish = publishFunc
+	prepareUpload, completeUpload = prepareUploadFunc, completeUploadFunc
+	e.Add("POST", "firmware/publish", PublishFirmware, c8yauth.Authorization(c8yauth.RoleInventoryAdmin, c8yauth.RoleFirmwarePublish))
+	e.Add("POST", "firmware/uploads", PrepareFirmwareUpload, c8yauth.Authorization(c8yauth.RoleFirmwarePublish))
+	e.Add("POST", "firmware/uploads/complete", CompleteFirmwareUpload, c8yauth.Authorization(c8yauth.RoleFirmwarePublish))
+}
+
+// as the storage is shared by all tenants, only users of the tenant hosting the service are allowed to publish. Returns nil if allowed.
+func checkPublishingTenant(c echo.Context) *ErrorMessage {
+	cc := c.(*model.RequestContext)
+	auth, err := c8yauth.GetUserSecurityContext(c)
+	if err != nil {
+		return &ErrorMessage{Err: "invalid user context", Reason: err.Error()}
+	}
+	if auth.Tenant != cc.Microservice.Client.TenantName {
+		return &ErrorMessage{Err: "only users of the tenant hosting the service are allowed to publish firmware"}
+	}
+	return nil
+}
+
+// PublishFirmware accepts a multipart form with the fields name, version, deviceType and description followed by the binary
+// (field file). The binary is streamed to the storage, so it needs to be the last part of the form.
+func PublishFirmware(c echo.Context) error {
+	if errMessage := checkPublishingTenant(c); errMessage != nil {
+		return c.JSON(http.StatusForbidden, errMessage)
+	}
+	reader, err := c.Request().MultipartReader()
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorMessage{Err: "expected multipart/form-data", Reason: err.Error()})
+	}
+	req := model.PublishRequest{}
+	fields := map[string]*string{"name": &req.Name, "version": &req.Version, "deviceType": &req.DeviceType, "description": &req.Description}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return c.JSON(http.StatusBadRequest, ErrorMessage{Err: "missing field file"})
+		}
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorMessage{Err: "invalid multipart form", Reason: err.Error()})
+		}
+		if part.FormName() == "file" {
+			req.FileName = part.FileName()
+			return publishPart(c, req, part)
+		}
+		field, ok := fields[part.FormName()]
+		if !ok {
+			continue
+		}
+		value, err := io.ReadAll(io.LimitReader(part, maxPublishFieldBytes))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorMessage{Err: "could not read field " + part.FormName(), Reason: err.Error()})
+		}
+		*field = strings.TrimSpace(string(value))
+	}
+}
+
+func publishPart(c echo.Context, req model.PublishRequest, body io.Reader) error {
+	result, err := publish(c.Request().Context(), req, body, -1)
+	return publishResponse(c, http.StatusCreated, result, err)
+}
+
+// PrepareFirmwareUpload returns a presigned upload URL for the binary of the firmware version (JSON body with name, version and fileName)
+func PrepareFirmwareUpload(c echo.Context) error {
+	return handleUpload(c, prepareUpload, http.StatusOK)
+}
+
+// CompleteFirmwareUpload registers the uploaded binary in the index files (same JSON body as the upload request, incl. deviceType and description)
+func CompleteFirmwareUpload(c echo.Context) error {
+	return handleUpload(c, completeUpload, http.StatusCreated)
+}
+
+func handleUpload(c echo.Context, uploadFunc UploadFunc, successStatus int) error {
+	if errMessage := checkPublishingTenant(c); errMessage != nil {
+		return c.JSON(http.StatusForbidden, errMessage)
+	}
+	req := model.PublishRequest{}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorMessage{Err: "invalid request body", Reason: err.Error()})
+	}
+	result, err := uploadFunc(c.Request().Context(), req)
+	return publishResponse(c, successStatus, result, err)
+}
+
+func publishResponse(c echo.Context, successStatus int, result any, err error) error {
+	switch {
+	case err == nil:
+		return c.JSON(successStatus, result)
+	case errors.Is(err, model.ErrInvalidPublishRequest):
+		return c.JSON(http.StatusBadRequest, ErrorMessage{Err: "invalid firmware version", Reason: err.Error()})
+	case errors.Is(err, model.ErrVersionExists):
+		return c.JSON(http.StatusConflict, ErrorMessage{Err: "firmware version already exists", Reason: err.Error()})
+	default:
+		return c.JSON(http.StatusInternalServerError, ErrorMessage{Err: "could not publish firmware version", Reason: err.Error()})
+	}
+}
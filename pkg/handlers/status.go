@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/kobu/c8y-devmgmt-repo-intgr/internal/model"
+	"github.com/kobu/c8y-devmgmt-repo-intgr/pkg/c8yauth"
+	"github.com/labstack/echo/v4"
+)
+
+// SyncStatusFunc returns the sync status of the given tenants, or of all tenants if none are given
+type SyncStatusFunc func(tenantIds ...string) any
+
+// PauseFunc pauses (or resumes) the synchronization of a tenant, returns false if the tenant is unknown
+type PauseFunc func(tenantId string, paused bool) bool
+
+// CleanupFunc pauses the synchronization of a tenant and removes the firmware objects created in it, returns false if the tenant is unknown
+type CleanupFunc func(tenantId string) (int, bool, error)
+
+var syncStatus SyncStatusFunc
+var setPaused PauseFunc
+var cleanup CleanupFunc
+
+func RegisterStatusHandler(e *echo.Echo, statusFunc SyncStatusFunc, pauseFunc PauseFunc, cleanupFunc CleanupFunc) {
+	syncStatus = statusFunc
+	setPaused = pauseFunc
+	cleanup = cleanupFunc
+	e.Add("GET", "sync/status", GetSyncStatus, c8yauth.Authorization(c8yauth.RoleInventoryAdmin))
+	e.Add("POST", "sync/tenants/:tenantId/pause", PauseTenantSync, c8yauth.Authorization(c8yauth.RoleInventoryAdmin))
+	e.Add("POST", "sync/tenants/:tenantId/resume", ResumeTenantSync, c8yauth.Authorization(c8yauth.RoleInventoryAdmin))
+	e.Add("POST", "sync/tenants/:tenantId/cleanup", CleanupTenant, c8yauth.Authorization(c8yauth.RoleInventoryAdmin))
+}
+
+// GetSyncStatus returns the sync status. Users of the tenant hosting the service see all tenants, others only their own tenant.
+func GetSyncStatus(c echo.Context) error {
+	cc := c.(*model.RequestContext)
+	auth, err := c8yauth.GetUserSecurityContext(c)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, ErrorMessage{
+			Err:    "invalid user context",
+			Reason: err.Error(),
+		})
+	}
+	if auth.Tenant == cc.Microservice.Client.TenantName {
+		return c.JSON(http.StatusOK, syncStatus())
+	}
+	return c.JSON(http.StatusOK, syncStatus(auth.Tenant))
+}
+
+func PauseTenantSync(c echo.Context) error {
+	return changeTenantPause(c, true)
+}
+
+func ResumeTenantSync(c echo.Context) error {
+	return changeTenantPause(c, false)
+}
+
+// users of the tenant hosting the service may pause any tenant, others only their own tenant
+func changeTenantPause(c echo.Context, paused bool) error {
+	tenantId, err := authorizedTenantId(c)
+	if err != nil || len(tenantId) == 0 {
+		return err
+	}
+	if !setPaused(tenantId, paused) {
+		return c.JSON(http.StatusNotFound, ErrorMessage{
+			Err: "no synchronization registered for tenant " + tenantId,
+		})
+	}
+	return c.JSON(http.StatusOK, syncStatus(tenantId))
+}
+
+// CleanupTenant pauses the synchronization of a tenant and removes the firmware objects the service created in it. It is meant to
+// be called before the tenant unsubscribes from the service, while the credentials of its service user are still valid.
+func CleanupTenant(c echo.Context) error {
+	tenantId, err := authorizedTenantId(c)
+	if err != nil || len(tenantId) == 0 {
+		return err
+	}
+	removed, ok, err := cleanup(tenantId)
+	if !ok {
+		return c.JSON(http.StatusNotFound, ErrorMessage{
+			Err: "no synchronization registered for tenant " + tenantId,
+		})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, ErrorMessage{
+			Err:    "firmware objects of tenant " + tenantId + " could not be removed completely",
+			Reason: err.Error(),
+		})
+	}
+	return c.JSON(http.StatusOK, map[string]any{"tenantId": tenantId, "removed": removed})
+}
+
+// returns the tenant of the request path if the user may change its synchronization: users of the tenant hosting the service
+// may change any tenant, others only their own tenant. Otherwise the error response is written and an empty tenant id returned.
+func authorizedTenantId(c echo.Context) (string, error) {
+	cc := c.(*model.RequestContext)
+	auth, err := c8yauth.GetUserSecurityContext(c)
+	if err != nil {
+		return "", c.JSON(http.StatusForbidden, ErrorMessage{
+			Err:    "invalid user context",
+			Reason: err.Error(),
+		})
+	}
+	tenantId := c.Param("tenantId")
+	if auth.Tenant != cc.Microservice.Client.TenantName && auth.Tenant != tenantId {
+		return "", c.JSON(http.StatusForbidden, ErrorMessage{
+			Err: "not allowed to change synchronization of tenant " + tenantId,
+		})
+	}
+	return tenantId, nil
+}
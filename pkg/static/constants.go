@@ -3,9 +3,68 @@ package static
 // Tenant Options (incl. default values)
 var TOPT_CATEGORY string = "c8y-devmgmt-repo-intgr"
 var TOPT_FW_STORAGE_PROVIDER_KEY string = "fwStorageProvider"
-var TOPT_FW_AZ_CONNECTION_KEY string = "credentials.fwAzblobConnectionDetails"
-var TOPT_FW_AWS_CONNECTION_KEY string = "credentials.fwAwsS3ConnectionDetails"
+var TOPT_FW_STORAGE_SOURCES string = "credentials.fwStorageSources"
+var TOPT_FW_INDEX_PREFIX string = "fwIndexPrefix"
+var TOPT_FW_INDEX_VERSIONS_FILE string = "fwIndexVersionsFile"
+var TOPT_FW_INDEX_INFO_FILE string = "fwIndexInfoFile"
+var TOPT_FW_INDEX_TENANT_GROUPS_FILE string = "fwIndexTenantGroupsFile"
+var TOPT_FW_OVERLAY_SOURCE string = "credentials.fwOverlaySource"
+var TOPT_FW_OVERLAY_TENANTS string = "fwOverlayTenants"
+var TOPT_FW_OVERLAY_OVERRIDE_TENANTS string = "fwOverlayOverrideTenants"
+var TOPT_FW_OVERLAY_ENDPOINT_HOSTS string = "fwOverlayEndpointHosts"
+var TOPT_FW_OVERLAY_ENDPOINT_HOSTS_DEFAULTVALUE string = "amazonaws.com,blob.core.windows.net"
 var TOPT_FW_STORAGE_OBSERVE_INTERVAL_MINS string = "fwStorageObserveIntervalMins"
 var TOPT_FW_STORAGE_OBSERVE_INTERVAL_MINS_DEFAULTVALUE int = 5
+var TOPT_FW_SYNC_SCHEDULE string = "fwSyncSchedule"
+var TOPT_FW_SYNC_JITTER_SECS string = "fwSyncJitterSecs"
+var TOPT_FW_MAINTENANCE_WINDOW string = "fwMaintenanceWindow"
 var TOPT_FW_URL_EXPIRATION_MINS string = "fwUrlExpirationMins"
 var TOPT_FW_URL_EXPIRATION_MINS_DEFAULTVALUE int = 180
+var TOPT_FW_DOWNLOAD_DEVICE_TYPE_CHECK string = "fwDownloadDeviceTypeCheck"
+var TOPT_FW_DOWNLOAD_DEVICE_TYPE_CHECK_DEFAULTVALUE bool = true
+var TOPT_FW_DOWNLOAD_CACHE_TTL_SECS string = "fwDownloadCacheTtlSecs"
+var TOPT_FW_DOWNLOAD_CACHE_TTL_SECS_DEFAULTVALUE int = 300
+var TOPT_FW_DELETION_MODE string = "fwDeletionMode"
+var TOPT_FW_DELETION_MODE_DEFAULTVALUE string = DELETION_MODE_DELETE
+var TOPT_FW_RETENTION_VERSIONS string = "fwRetentionVersions"
+var TOPT_FW_RETENTION_VERSIONS_DEFAULTVALUE int = 0
+var TOPT_FW_RETENTION_ORDER string = "fwRetentionOrder"
+var TOPT_FW_RETENTION_ORDER_DEFAULTVALUE string = RETENTION_ORDER_SEMVER
+var TOPT_FW_CLEANUP_ON_UNSUBSCRIBE string = "fwCleanupOnUnsubscribe"
+var TOPT_FW_CLEANUP_ON_UNSUBSCRIBE_DEFAULTVALUE bool = false
+var TOPT_FW_SYNC_CONCURRENCY string = "fwSyncConcurrency"
+var TOPT_FW_SYNC_CONCURRENCY_DEFAULTVALUE int = 4
+var TOPT_FW_TENANT_STORE_MAX_AGE_MINS string = "fwTenantStoreMaxAgeMins"
+var TOPT_FW_TENANT_STORE_MAX_AGE_MINS_DEFAULTVALUE int = 60
+var TOPT_FW_FORCE_RESYNC_INTERVAL_MINS string = "fwForceResyncIntervalMins"
+var TOPT_FW_FORCE_RESYNC_INTERVAL_MINS_DEFAULTVALUE int = 60
+var TOPT_FW_STARTUP_STAGGER_SECS string = "fwStartupStaggerSecs"
+var TOPT_FW_STARTUP_STAGGER_SECS_DEFAULTVALUE int = 5
+var TOPT_FW_EVENT_WATCH_PREFIXES string = "fwEventWatchPrefixes"
+var TOPT_FW_WEBHOOK_SECRET string = "credentials.fwWebhookSecret"
+var TOPT_FW_UPLOAD_PREFIX string = "fwUploadPrefix"
+var TOPT_FW_UPLOAD_PREFIX_DEFAULTVALUE string = "uploads/"
+
+// Default names of the index files, expected in the root of the external storage (or below the prefix of a source)
+const INDEX_FILE_VERSIONS string = "c8y-firmware-versions.json"
+const INDEX_FILE_INFO string = "c8y-firmware-info.json"
+
+// Optional file defining the members of the tenant groups index entries can be restricted to, next to the index files
+const INDEX_FILE_TENANT_GROUPS string = "c8y-tenant-groups.json"
+
+// Deletion modes for firmware versions that were removed from the index files
+const DELETION_MODE_DELETE string = "delete"
+const DELETION_MODE_ARCHIVE string = "archive"
+
+// Orders used to determine the newest versions of a firmware for the retention policy
+const RETENTION_ORDER_SEMVER string = "semver"
+const RETENTION_ORDER_INDEX string = "index"
+
+// Fragment put on firmware (version) objects that were archived instead of deleted
+const FRAGMENT_ARCHIVED string = "c8y_RepoIntegrationArchived"
+
+// Alarm raised on firmware versions which can't be removed as they are still installed on devices
+const ALARM_TYPE_REMOVAL_BLOCKED string = "c8y_RepoIntegrationRemovalBlocked"
+
+// Type (and fragment) of the service-owned managed object holding the sync state of a tenant
+const SYNC_STATE_TYPE string = "c8y_RepoIntegrationSyncState"